@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// auditEntry is one line of the audit log, recording a destructive operation
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Remote    string    `json:"remote"`
+	Path      string    `json:"path"`
+	ItemID    string    `json:"item_id,omitempty"`
+	Folder    bool      `json:"folder,omitempty"`
+	Size      int64     `json:"size"`
+	Mode      string    `json:"mode,omitempty"`
+}
+
+// appendAuditLog appends entry as a JSON line to the audit log at path
+func appendAuditLog(path string, entry auditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// Values of -remote-config that let the tool pick the remote for an upload
+const (
+	autoRemote           = "auto"             // The remote with the most free space
+	autoRemoteRoundRobin = "auto:round-robin" // Each remote in turn, one per run
+)
+
+// roundRobinFileName is the file in the state directory that records the remote the last
+// round-robin upload went to
+const roundRobinFileName = "round-robin"
+
+// isAutoRemote reports whether a -remote-config value asks for automatic remote selection
+func isAutoRemote(remoteConfig string) bool {
+	return remoteConfig == autoRemote || remoteConfig == autoRemoteRoundRobin
+}
+
+// pickRemote resolves an automatic -remote-config value to one of the configured remotes that
+// allow uploads: the one with the most free space, or for round-robin the one after the remote
+// the previous round-robin run used
+func pickRemote(configData []byte, mode, stateDir string, quotaCache *azure.QuotaCache, timeout time.Duration) (string, error) {
+	candidates, err := uploadRemotes(configData)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", errors.New("no configured remote allows uploads")
+	}
+
+	if mode == autoRemoteRoundRobin {
+		return nextRoundRobinRemote(candidates, stateDir)
+	}
+
+	best := ""
+	var bestFree int64
+	results := fetchQuotas(configData, candidates, stateDir, quotaCache, timeout)
+	for range candidates {
+		report := <-results
+		if report.err != nil {
+			fmt.Printf("%sWarning: skipping remote '%s': %v%s\n", ColorYellow, report.Remote, report.err, ColorReset)
+			continue
+		}
+		// Ties go to the first remote by name, so the choice doesn't depend on which answered first
+		if best == "" || report.Remaining > bestFree || (report.Remaining == bestFree && report.Remote < best) {
+			best, bestFree = report.Remote, report.Remaining
+		}
+	}
+	if best == "" {
+		return "", errors.New("failed to fetch the quota of every remote")
+	}
+	fmt.Printf("Selected remote '%s' with %s free.\n", best, formatBytes(bestFree))
+	return best, nil
+}
+
+// uploadRemotes returns the configured remotes whose access policy allows uploads, sorted by name
+func uploadRemotes(configData []byte) ([]string, error) {
+	var remotes []string
+	for _, remote := range configRemotes(configData) {
+		policy, err := remoteAccessPolicy(configData, remote)
+		if err != nil {
+			return nil, err
+		}
+		if policy == nil || slices.Contains(policy.Operations, azure.OpUpload) {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes, nil
+}
+
+// nextRoundRobinRemote returns the remote after the one recorded in the state directory and
+// records it for the next run
+func nextRoundRobinRemote(remotes []string, stateDir string) (string, error) {
+	statePath := filepath.Join(stateDir, roundRobinFileName)
+	next := remotes[0]
+	if data, err := os.ReadFile(statePath); err == nil {
+		last := strings.TrimSpace(string(data))
+		// Remotes are sorted by name, so a removed remote is still followed by the next one in order
+		for _, remote := range remotes {
+			if remote > last {
+				next = remote
+				break
+			}
+		}
+	}
+
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to save round-robin state: %v", err)
+	}
+	if err := os.WriteFile(statePath, []byte(next+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to save round-robin state: %v", err)
+	}
+	fmt.Printf("Selected remote '%s' (round-robin).\n", next)
+	return next, nil
+}
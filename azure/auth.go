@@ -0,0 +1,173 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuth endpoints and the scopes requested on login; the same scopes rclone asks for
+const (
+	authorizeURL  = "https://login.microsoftonline.com/common/oauth2/v2.0/authorize"
+	deviceCodeURL = "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode"
+	tokenURL      = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+	LoginScopes   = "Files.Read Files.ReadWrite Files.Read.All Files.ReadWrite.All Sites.Read.All offline_access"
+)
+
+// Token is an OAuth token in the format of rclone's token config key
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// AuthCodeURL returns the URL the user opens to authorize the app; the browser is then
+// redirected to redirectURI with the code and the given state
+func AuthCodeURL(clientID, redirectURI, state string) string {
+	params := url.Values{}
+	params.Set("client_id", clientID)
+	params.Set("response_type", "code")
+	params.Set("redirect_uri", redirectURI)
+	params.Set("scope", LoginScopes)
+	params.Set("state", state)
+	return authorizeURL + "?" + params.Encode()
+}
+
+// ExchangeAuthCode redeems an authorization code for a token
+func ExchangeAuthCode(httpClient *http.Client, clientID, clientSecret, code, redirectURI string) (*Token, error) {
+	data := url.Values{}
+	data.Set("client_id", clientID)
+	data.Set("client_secret", clientSecret)
+	data.Set("code", code)
+	data.Set("redirect_uri", redirectURI)
+	data.Set("grant_type", "authorization_code")
+	data.Set("scope", LoginScopes)
+
+	token, err := requestToken(httpClient, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	return token, nil
+}
+
+// DeviceCode is a pending device code authorization: the user enters UserCode at VerificationURI
+// on any device while the app polls for the token
+type DeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+// RequestDeviceCode starts a device code authorization. The app registration must allow public client flows.
+func RequestDeviceCode(httpClient *http.Client, clientID string) (*DeviceCode, error) {
+	data := url.Values{}
+	data.Set("client_id", clientID)
+	data.Set("scope", LoginScopes)
+
+	req, err := http.NewRequest("POST", deviceCodeURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create device code request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request device code: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to request device code: %w", parseGraphError(res))
+	}
+
+	var code DeviceCode
+	if err := json.NewDecoder(res.Body).Decode(&code); err != nil {
+		return nil, fmt.Errorf("failed to parse device code response: %v", err)
+	}
+	return &code, nil
+}
+
+// PollDeviceToken polls the token endpoint at the interval the server asked for until the user
+// completes the device code authorization, declines it or the code expires
+func PollDeviceToken(httpClient *http.Client, clientID string, code *DeviceCode) (*Token, error) {
+	data := url.Values{}
+	data.Set("client_id", clientID)
+	data.Set("device_code", code.DeviceCode)
+	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+
+	interval := time.Duration(max(code.Interval, 1)) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		token, err := requestToken(httpClient, data)
+		if err == nil {
+			return token, nil
+		}
+
+		graphErr, ok := AsGraphError(err)
+		switch {
+		case ok && graphErr.Code == "authorization_pending":
+		case ok && graphErr.Code == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("device code authorization failed: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("device code expired before the authorization was completed")
+}
+
+// requestToken posts a grant to the token endpoint and returns the issued token
+func requestToken(httpClient *http.Client, data url.Values) (*Token, error) {
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, parseGraphError(res)
+	}
+
+	var responseData struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&responseData); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %v", err)
+	}
+
+	return &Token{
+		AccessToken:  responseData.AccessToken,
+		TokenType:    responseData.TokenType,
+		RefreshToken: responseData.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(responseData.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// NewAzureClientFromToken initializes an AzureClient from app credentials and a freshly issued token
+func NewAzureClientFromToken(clientID, clientSecret string, token *Token) *AzureClient {
+	return &AzureClient{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiration:   token.Expiry,
+	}
+}
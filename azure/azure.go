@@ -2,28 +2,41 @@ package azure
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // AzureClient represents the Azure connection with credentials
 type AzureClient struct {
-	ClientID     string
-	ClientSecret string
-	AccessToken  string
-	RefreshToken string
-	Expiration   time.Time
-	DriveID      string
-	DriveType    string
-	mu           sync.Mutex
+	ClientID      string
+	ClientSecret  string
+	AccessToken   string
+	RefreshToken  string
+	Expiration    time.Time
+	DriveID       string
+	DriveType     string
+	mu            sync.Mutex
+	persisters    []TokenPersister
+	itemCache     *ItemCache
+	metadataRetry *RetryRule
+	accessPolicy  *AccessPolicy
+	timeouts      Timeouts
+	throttling    throttleControl // Bounds the transfers in progress by UseConnectionLimit and while Graph throttles the client
+	bandwidth     *rateLimiter    // Shared bandwidth limit set by UseBandwidthLimit (nil for no limit)
+	requests      *requestLimiter // Shared request limit set by UseRequestLimit (nil for no limit)
+	userAgent     string          // User-Agent of all requests, set by UseUserAgent ("" for DefaultUserAgent)
+	middleware    []Middleware    // Wrappers around the transport of all requests, added by UseMiddleware
+	stats         clientStats     // Counters reported by Stats
 }
 
 // NewAzureClientFromRcloneConfigData initializes the AzureClient from embedded rclone config data
@@ -101,6 +114,18 @@ func ParseRcloneConfigData(configData []byte, remoteConfig string) (map[string]s
 	return configMap, nil
 }
 
+// RcloneRemotes returns the names of all remote sections in the rclone configuration data, in file order
+func RcloneRemotes(configData []byte) []string {
+	var remotes []string
+	for _, line := range strings.Split(string(configData), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			remotes = append(remotes, strings.Trim(line, "[]"))
+		}
+	}
+	return remotes
+}
+
 // EnsureTokenValid checks and refreshes the access token if expired
 func (client *AzureClient) EnsureTokenValid(httpClient *http.Client) error {
 	client.mu.Lock()
@@ -110,7 +135,26 @@ func (client *AzureClient) EnsureTokenValid(httpClient *http.Client) error {
 		return nil
 	}
 
-	tokenURL := "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+	return client.refreshLocked(httpClient)
+}
+
+// currentToken returns the access token, which another goroutine may be refreshing
+func (client *AzureClient) currentToken() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.AccessToken
+}
+
+// RefreshAccessToken refreshes the access token even if it has not expired yet
+func (client *AzureClient) RefreshAccessToken(httpClient *http.Client) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.refreshLocked(httpClient)
+}
+
+// refreshLocked exchanges the refresh token for a new access token; callers must hold client.mu
+func (client *AzureClient) refreshLocked(httpClient *http.Client) error {
 	data := url.Values{}
 	data.Set("client_id", client.ClientID)
 	data.Set("client_secret", client.ClientSecret)
@@ -123,14 +167,14 @@ func (client *AzureClient) EnsureTokenValid(httpClient *http.Client) error {
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	res, err := httpClient.Do(req)
+	res, err := client.do(httpClient, req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		return fmt.Errorf("failed to refresh token, status code: %v", res.StatusCode)
+		return fmt.Errorf("failed to refresh token: %w", parseGraphError(res))
 	}
 
 	var responseData struct {
@@ -146,12 +190,29 @@ func (client *AzureClient) EnsureTokenValid(httpClient *http.Client) error {
 	client.AccessToken = responseData.AccessToken
 	client.RefreshToken = responseData.RefreshToken
 	client.Expiration = time.Now().Add(time.Duration(responseData.ExpiresIn) * time.Second)
+	client.stats.tokenRefreshes.Add(1)
+
+	token := &Token{AccessToken: client.AccessToken, TokenType: "Bearer", RefreshToken: client.RefreshToken, Expiry: client.Expiration}
+	for _, persister := range client.persisters {
+		if err := persister.SaveToken(token); err != nil {
+			fmt.Printf("Warning: failed to persist refreshed token: %v\n", err)
+		}
+	}
 
 	return nil
 }
 
 // Upload uploads a file to OneDrive using parallel chunk uploads
 func (client *AzureClient) Upload(httpClient *http.Client, params UploadParams) (string, error) {
+	if err := client.checkAccess(OpUpload, params.RemoteFilePath); err != nil {
+		return "", err
+	}
+	if params.ConflictBehavior != "" {
+		if _, err := ParseConflictBehavior(string(params.ConflictBehavior)); err != nil {
+			return "", err
+		}
+	}
+
 	fmt.Println("Starting file upload with upload session...")
 
 	// Ensure the access token is valid
@@ -159,114 +220,435 @@ func (client *AzureClient) Upload(httpClient *http.Client, params UploadParams)
 		return "", err
 	}
 
-	// Create an upload session
-	uploadURL, err := client.createUploadSession(httpClient, params.RemoteFilePath, client.AccessToken)
+	// The upload replaces whatever metadata is cached for the target
+	client.itemCache.invalidate("", params.RemoteFilePath)
+
+	var file *os.File
+	var fileInfo os.FileInfo
+	var fileSize int64
+	var err error
+	if params.Reader != nil {
+		// A stream can't be read again, so its session can't be resumed later
+		fileSize = params.Size
+		params.StateDir = ""
+	} else {
+		// Open the file to upload
+		file, err = os.Open(params.FilePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to open file: %v", err)
+		}
+		defer file.Close()
+
+		// Get file information
+		fileInfo, err = file.Stat()
+		if err != nil {
+			return "", fmt.Errorf("failed to get file info: %v", err)
+		}
+		fileSize = fileInfo.Size()
+	}
+	fmt.Printf("File size: %d bytes\n", fileSize)
+
+	// An upload session can't be sent 0 bytes, so it would never complete; empty files are created
+	// with a simple upload instead
+	if fileSize == 0 {
+		return client.uploadEmpty(httpClient, params)
+	}
+
+	// Pick up a previously persisted session if asked to resume
+	var state *uploadState
+	var pending []byteRange
+	if params.StateDir != "" && params.Resume {
+		state, pending = client.resumeUploadSession(httpClient, params, fileInfo)
+	}
+
+	// Otherwise use the session created ahead of time or create a new one
+	if state == nil {
+		uploadURL := params.UploadURL
+		if uploadURL != "" {
+			fmt.Println("Using upload session created ahead of time.")
+		} else {
+			uploadURL, err = client.createUploadSession(httpClient, params.RemoteFilePath, params.ConflictBehavior, params.FileSystemInfo)
+			if err != nil {
+				return "", err
+			}
+			fmt.Println("Upload session created successfully.")
+		}
+
+		state = &uploadState{
+			UploadURL:      uploadURL,
+			FilePath:       params.FilePath,
+			RemoteFilePath: params.RemoteFilePath,
+			FileSize:       fileSize,
+		}
+		pending = []byteRange{{start: 0, end: fileSize - 1}}
+
+		if params.StateDir != "" {
+			state.ModTime = fileInfo.ModTime()
+			state.path = uploadStatePath(params.StateDir, params.FilePath, params.RemoteFilePath)
+			if err := state.save(); err != nil {
+				fmt.Printf("Warning: failed to persist upload session state: %v\n", err)
+			}
+		}
+	}
+
+	// Split the pending ranges into chunks
+	chunkSize := params.ChunkSize
+	chunks := splitRanges(pending, chunkSize)
+
+	ctx := params.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	session := &uploadSession{
+		ctx:            ctx,
+		file:           file,
+		uploadURL:      state.UploadURL,
+		totalSize:      fileSize,
+		tracker:        &uploadTracker{total: fileSize, progress: params.Progress},
+		minSpeed:       params.MinSpeed,
+		minSpeedWindow: params.MinSpeedWindow,
+		timeout:        client.timeouts.Data,
+	}
+	if params.Bandwidth != nil {
+		session.bandwidth = &rateLimiter{limit: params.Bandwidth}
+	}
+
+	// Bytes the session already has count as transferred
+	remaining := int64(0)
+	for _, chunk := range chunks {
+		remaining += chunk.end - chunk.start + 1
+	}
+	session.tracker.add(fileSize - remaining)
+
+	// The hash can only be computed while reading if every byte is sent by this run
+	if params.Hashed != nil && remaining == fileSize {
+		session.hash = &quickXorState{}
+	}
+
+	// Sessions expire after a while, which long uploads on slow links can outlive; a file is then
+	// sent again from the start on a new session
+	err = client.uploadChunks(httpClient, params, session, state, chunks, chunkSize)
+	for renewals := 0; err != nil && isSessionExpired(err) && ctx.Err() == nil; renewals++ {
+		if params.Reader != nil {
+			return "", fmt.Errorf("failed to upload file: upload session expired and a stream can't be sent again: %w", err)
+		}
+		if renewals == maxSessionRenewals {
+			return "", fmt.Errorf("failed to upload file: upload session expired %d times: %w", renewals+1, err)
+		}
+
+		fmt.Println("Upload session expired, creating a new one and uploading the file again...")
+		uploadURL, createErr := client.createUploadSession(httpClient, params.RemoteFilePath, params.ConflictBehavior, params.FileSystemInfo)
+		if createErr != nil {
+			return "", fmt.Errorf("failed to renew upload session: %v", createErr)
+		}
+
+		session.uploadURL = uploadURL
+		session.tracker.add(-session.tracker.transferred.Load())
+		if params.Hashed != nil {
+			session.hash = &quickXorState{}
+			session.hashFailed = false
+		}
+		state.UploadURL = uploadURL
+		state.CompletedRanges = nil
+		if params.StateDir != "" {
+			if err := state.save(); err != nil {
+				fmt.Printf("Warning: failed to persist upload session state: %v\n", err)
+			}
+		}
+
+		chunks = splitRanges([]byteRange{{start: 0, end: fileSize - 1}}, chunkSize)
+		err = client.uploadChunks(httpClient, params, session, state, chunks, chunkSize)
+	}
+
+	// Don't leave a half-uploaded session behind: keep it for resuming if state is persisted, otherwise cancel it
+	if ctx.Err() != nil {
+		if params.StateDir != "" {
+			fmt.Println("Upload interrupted; session state kept, rerun with resume enabled to continue.")
+		} else if err := client.DeleteUploadSession(httpClient, session.uploadURL); err != nil {
+			fmt.Printf("Warning: failed to cancel upload session: %v\n", err)
+		} else {
+			fmt.Println("Upload interrupted; upload session cancelled.")
+		}
+		return "", fmt.Errorf("upload interrupted: %w", ctx.Err())
+	}
+
 	if err != nil {
-		return "", fmt.Errorf("failed to create upload session: %v", err)
+		if params.StateDir != "" {
+			fmt.Println("Upload session state kept; rerun with resume enabled to continue.")
+		} else if err := client.DeleteUploadSession(httpClient, session.uploadURL); err != nil {
+			fmt.Printf("Warning: failed to cancel upload session: %v\n", err)
+		}
+		return "", fmt.Errorf("failed to upload file: %w", err)
 	}
-	fmt.Println("Upload session created successfully.")
 
-	// Open the file to upload
-	file, err := os.Open(params.FilePath)
+	if params.StateDir != "" {
+		state.remove()
+	}
+
+	if hash, ok := session.quickXorHash(); ok {
+		params.Hashed(hash)
+	}
+
+	// With ConflictRename, the path may hold another file and the upload a new name
+	if item := session.item.Load(); item != nil {
+		return item.ID, nil
+	}
+	fileID, err := client.getFileID(httpClient, params.RemoteFilePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file: %v", err)
+		return "", fmt.Errorf("failed to fetch file ID: %v", err)
 	}
-	defer file.Close()
 
-	// Get file information
-	fileInfo, err := file.Stat()
+	return fileID, nil
+}
+
+// uploadEmpty creates an empty file with a single PUT of its content, cancelling the session created
+// ahead of time for it, if any
+func (client *AzureClient) uploadEmpty(httpClient *http.Client, params UploadParams) (string, error) {
+	if params.UploadURL != "" {
+		if err := client.DeleteUploadSession(httpClient, params.UploadURL); err != nil {
+			fmt.Printf("Warning: failed to cancel upload session: %v\n", err)
+		}
+	}
+
+	conflict := params.ConflictBehavior
+	if conflict == "" {
+		conflict = ConflictRename
+	}
+	ctx := params.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	url := itemURL("", params.RemoteFilePath, "/content") + "?@microsoft.graph.conflictBehavior=" + string(conflict)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, http.NoBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to get file info: %v", err)
+		return "", fmt.Errorf("failed to create upload request: %v", err)
 	}
-	fileSize := fileInfo.Size()
-	fmt.Printf("File size: %d bytes\n", fileSize)
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	req.Header.Set("Content-Type", "application/octet-stream")
 
-	// Define chunk size and calculate the number of chunks
-	chunkSize := params.ChunkSize
-	numChunks := (fileSize + chunkSize - 1) / chunkSize
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload file: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to upload file: %w", parseGraphError(resp))
+	}
+	var item DriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return "", fmt.Errorf("failed to parse file metadata: %v", err)
+	}
+
+	// A simple upload can't carry the timestamps, so they are set afterwards
+	if times := params.FileSystemInfo.requestBody(); len(times) > 0 {
+		if err := client.patchFileSystemInfo(httpClient, item.ID, times); err != nil {
+			fmt.Printf("Warning: failed to set file timestamps: %v\n", err)
+		}
+	}
+	if params.Hashed != nil {
+		params.Hashed((&quickXorState{}).sum(0))
+	}
+	fmt.Println("Empty file uploaded.")
+	return item.ID, nil
+}
+
+// patchFileSystemInfo sets the client-side timestamps of the item with the given ID
+func (client *AzureClient) patchFileSystemInfo(httpClient *http.Client, itemID string, times map[string]string) error {
+	body, _ := json.Marshal(map[string]interface{}{"fileSystemInfo": times})
+	req, err := http.NewRequest("PATCH", "https://graph.microsoft.com/v1.0/me/drive/items/"+url.PathEscape(itemID), bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("failed to create update request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return parseGraphError(resp)
+	}
+	return nil
+}
+
+// uploadChunks uploads chunks of the file to the session with a pool of parallel workers. It returns
+// the error of the first chunk that failed for good, or the context's error if the upload was cancelled.
+func (client *AzureClient) uploadChunks(httpClient *http.Client, params UploadParams, session *uploadSession, state *uploadState, chunks []byteRange, chunkSize int64) error {
+	ctx := session.ctx
 
-	// Create a worker pool for parallel uploads
+	// Create a worker pool for parallel uploads; buffered stream chunks are handed over as they are
+	// read so no more of them are held in memory than there are workers
 	var wg sync.WaitGroup
-	chunkChan := make(chan int64, numChunks)
-	errChan := make(chan error, numChunks)
+	chunkChan := make(chan chunk, len(chunks))
+	if params.Reader != nil {
+		chunkChan = make(chan chunk, params.ParallelChunks)
+	}
+	errChan := make(chan error, len(chunks)+1)
+
+	// A chunk that can't be uploaded fails the whole file, so the other workers are stopped right away
+	// instead of sending the rest of a file that can't be completed
+	uploadCtx, abort := context.WithCancel(ctx)
+	defer abort()
+	session.ctx = uploadCtx
+	defer func() { session.ctx = ctx }()
+	fail := func(err error) {
+		errChan <- err
+		abort()
+	}
 
 	// Start workers
 	for i := 0; i < params.ParallelChunks; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for start := range chunkChan {
-				end := start + chunkSize - 1
-				if end >= fileSize {
-					end = fileSize - 1
-				}
-
-				// Read the current chunk from the file
-				chunk := make([]byte, end-start+1)
-				_, err := file.ReadAt(chunk, start)
-				if err != nil && err != io.EOF {
-					errChan <- fmt.Errorf("failed to read chunk %d-%d: %v", start, end, err)
+			for c := range chunkChan {
+				// Drain the remaining chunks without sending them once the upload is cancelled or failed
+				if uploadCtx.Err() != nil {
+					putChunkBuffer(c.data)
 					continue
 				}
+				start, end := c.start, c.end
 
-				// Retry logic for chunk upload
-				for retry := 0; retry < params.MaxRetries; retry++ {
-					success, err := client.uploadChunk(httpClient, uploadURL, chunk, start, end, fileSize)
+				// Retry logic for chunk upload; each class of error has its own retry budget
+				retries := newRetryTracker(params.Retry)
+				for retry := false; ; retry = true {
+					success, err := client.uploadChunkRealigned(httpClient, session, c, retry)
 					if success {
+						if params.StateDir != "" {
+							if err := state.markCompleted(start, end); err != nil {
+								fmt.Printf("Warning: failed to persist upload progress: %v\n", err)
+							}
+						}
+						break
+					}
+
+					if uploadCtx.Err() != nil {
+						break
+					}
+
+					// Retrying on an expired session can't succeed; the caller starts over on a new one
+					if isSessionExpired(err) {
+						fail(err)
 						break
 					}
 
 					fmt.Printf("Error uploading chunk %d-%d: %v\n", start, end, err)
-					fmt.Printf("Retrying chunk upload (attempt %d/%d)...\n", retry+1, params.MaxRetries)
-					time.Sleep(params.RetryDelay)
+					class, attempt, delay, ok := retries.next(err)
+					if !ok {
+						fail(fmt.Errorf("chunk %d-%d failed after %d retries (%s error): %w", start, end, attempt-1, class, err))
+						break
+					}
+					client.stats.chunkRetries.Add(1)
+					fmt.Printf("Retrying chunk upload in %s (%s error, attempt %d/%d)...\n", delay, class, attempt, params.Retry.Rule(class).MaxRetries)
+					select {
+					case <-time.After(delay):
+					case <-uploadCtx.Done():
+					}
 				}
+				putChunkBuffer(c.data)
 			}
 		}()
 	}
 
-	// Send chunk start positions to the workers
-	for start := int64(0); start < fileSize; start += chunkSize {
-		chunkChan <- start
+	// Send the chunks to the workers, reading stream chunks into pooled buffers first
+	for _, r := range chunks {
+		if params.Reader == nil {
+			chunkChan <- chunk{byteRange: r}
+			continue
+		}
+		if uploadCtx.Err() != nil {
+			break
+		}
+
+		data := getChunkBuffer(chunkSize)[:r.end-r.start+1]
+		if _, err := io.ReadFull(params.Reader, data); err != nil {
+			putChunkBuffer(data)
+			fail(fmt.Errorf("failed to read chunk %d-%d: %v", r.start, r.end, err))
+			break
+		}
+		chunkChan <- chunk{byteRange: r, data: data}
 	}
 	close(chunkChan)
 
 	// Wait for all workers to finish
 	wg.Wait()
 
-	// Check for errors
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	select {
 	case err := <-errChan:
-		return "", fmt.Errorf("failed to upload file: %v", err)
+		return err
 	default:
-		fileID, err := client.getFileID(httpClient, params.RemoteFilePath)
-		if err != nil {
-			return "", fmt.Errorf("failed to fetch file ID: %v", err)
+		return nil
+	}
+}
+
+// resumeUploadSession loads the persisted session for this upload and asks it which ranges are
+// still missing; it returns nil if there is no usable session to resume
+func (client *AzureClient) resumeUploadSession(httpClient *http.Client, params UploadParams, fileInfo os.FileInfo) (*uploadState, []byteRange) {
+	state, err := loadUploadState(uploadStatePath(params.StateDir, params.FilePath, params.RemoteFilePath))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: ignoring unreadable upload state: %v\n", err)
+		} else {
+			fmt.Println("No saved upload session found, starting a new one.")
 		}
+		return nil, nil
+	}
+
+	if !state.matches(fileInfo) {
+		fmt.Println("Local file changed since the saved upload session, starting a new one.")
+		return nil, nil
+	}
 
-		return fileID, nil
+	ranges, err := client.getNextExpectedRanges(httpClient, state.UploadURL)
+	if err != nil {
+		fmt.Printf("Saved upload session is no longer usable (%v), starting a new one.\n", err)
+		return nil, nil
+	}
+
+	pending, err := parseExpectedRanges(ranges, fileInfo.Size())
+	if err != nil {
+		fmt.Printf("Saved upload session is no longer usable (%v), starting a new one.\n", err)
+		return nil, nil
 	}
 
+	var remaining int64
+	for _, r := range pending {
+		remaining += r.end - r.start + 1
+	}
+	fmt.Printf("Resuming upload session: %d of %d bytes remaining.\n", remaining, fileInfo.Size())
+
+	return state, pending
 }
 
 // getFileID retrieves the file ID for a given remote path
 func (client *AzureClient) getFileID(httpClient *http.Client, remotePath string) (string, error) {
-	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/root:/%s", remotePath)
+	// The token may have expired while the file was uploading
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return "", err
+	}
+
+	url := itemURL("", remotePath, "")
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %v", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
 
-	resp, err := httpClient.Do(req)
+	resp, err := client.do(httpClient, req)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch file metadata: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		responseBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to fetch file metadata, status: %d, response: %s", resp.StatusCode, responseBody)
+		return "", fmt.Errorf("failed to fetch file metadata: %w", parseGraphError(resp))
 	}
 
 	var metadata struct {
@@ -284,13 +666,44 @@ func (client *AzureClient) getFileID(httpClient *http.Client, remotePath string)
 	return metadata.ID, nil
 }
 
-// createUploadSession creates an upload session for the file
-func (client *AzureClient) createUploadSession(httpClient *http.Client, remotePath string, accessToken string) (string, error) {
-	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/root:/%s:/createUploadSession", remotePath)
+// CreateUploadSession creates an upload session for remotePath ahead of time, to be passed to Upload
+// as UploadParams.UploadURL
+func (client *AzureClient) CreateUploadSession(httpClient *http.Client, remotePath string) (string, error) {
+	if err := client.checkAccess(OpUpload, remotePath); err != nil {
+		return "", err
+	}
+	return client.createUploadSession(httpClient, remotePath, ConflictRename, nil)
+}
+
+// CreateUploadSessionWithInfo is like CreateUploadSession but also gives the uploaded file the
+// client-side timestamps in info
+func (client *AzureClient) CreateUploadSessionWithInfo(httpClient *http.Client, remotePath string, info *FileSystemInfo) (string, error) {
+	if err := client.checkAccess(OpUpload, remotePath); err != nil {
+		return "", err
+	}
+	return client.createUploadSession(httpClient, remotePath, ConflictRename, info)
+}
+
+// createUploadSession creates an upload session for the file; conflict decides what happens if it
+// already exists, renaming the upload if empty
+func (client *AzureClient) createUploadSession(httpClient *http.Client, remotePath string, conflict ConflictBehavior, info *FileSystemInfo) (string, error) {
+	// Long uploads outlive the token, e.g. when an expired session is renewed hours in
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return "", err
+	}
+
+	url := itemURL("", remotePath, "/createUploadSession")
+	if conflict == "" {
+		conflict = ConflictRename
+	}
+	item := map[string]interface{}{
+		"@microsoft.graph.conflictBehavior": conflict,
+	}
+	if times := info.requestBody(); len(times) > 0 {
+		item["fileSystemInfo"] = times
+	}
 	requestBody := map[string]interface{}{
-		"item": map[string]string{
-			"@microsoft.graph.conflictBehavior": "rename",
-		},
+		"item": item,
 	}
 	body, _ := json.Marshal(requestBody)
 
@@ -299,18 +712,17 @@ func (client *AzureClient) createUploadSession(httpClient *http.Client, remotePa
 		return "", fmt.Errorf("failed to create upload session request: %v", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := httpClient.Do(req)
+	resp, err := client.do(httpClient, req)
 	if err != nil {
 		return "", fmt.Errorf("failed to create upload session: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		responseBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to create upload session, status: %d, response: %s", resp.StatusCode, responseBody)
+		return "", fmt.Errorf("failed to create upload session: %w", parseGraphError(resp))
 	}
 
 	var response struct {
@@ -323,34 +735,115 @@ func (client *AzureClient) createUploadSession(httpClient *http.Client, remotePa
 	return response.UploadUrl, nil
 }
 
-// uploadChunk uploads a single chunk of the file
-func (client *AzureClient) uploadChunk(httpClient *http.Client, uploadURL string, chunk []byte, start, end, totalSize int64) (bool, error) {
-	req, err := http.NewRequest("PUT", uploadURL, bytes.NewReader(chunk))
+// uploadChunk uploads a chunk of the file; chunks of a file are streamed straight from it instead
+// of being buffered in memory
+func (client *AzureClient) uploadChunk(httpClient *http.Client, session *uploadSession, c chunk) (bool, error) {
+	start, end := c.start, c.end
+
+	// Wait for the shared connection budget and request limit before the chunk's own deadline starts running
+	release, err := client.acquireConnection(session.ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	endRequest, err := client.startRequest(session.ctx)
+	if err != nil {
+		return false, err
+	}
+	defer endRequest()
+
+	ctx, cancel := context.WithCancel(session.ctx)
+	if session.timeout > 0 {
+		ctx, cancel = context.WithTimeout(session.ctx, session.timeout)
+	}
+	defer cancel()
+
+	size := end - start + 1
+	// Hash the bytes as they are sent; they only count once the chunk has been accepted
+	var hash *quickXorState
+	source := c.reader(session)
+	if session.hash != nil && !c.hashed {
+		hash = &quickXorState{}
+		source = &hashingReader{r: source, state: hash, offset: start}
+	}
+
+	source = client.throttle(ctx, source)
+	if session.bandwidth != nil {
+		source = &throttledReader{r: source, ctx: ctx, limiter: session.bandwidth}
+	}
+	body := &progressReader{r: source, tracker: session.tracker}
+	req, err := http.NewRequestWithContext(ctx, "PUT", session.uploadURL, body)
 	if err != nil {
 		return false, fmt.Errorf("failed to create chunk upload request: %v", err)
 	}
+	req.ContentLength = size
+
+	success := false
+	defer func() {
+		// Bytes of a failed attempt will be sent again, so take them back out of the progress
+		if !success {
+			session.tracker.add(-body.read.Load())
+		}
+	}()
 
-	rangeHeader := fmt.Sprintf("bytes %d-%d/%d", start, end, totalSize)
+	rangeHeader := fmt.Sprintf("bytes %d-%d/%d", start, end, session.totalSize)
 	req.Header.Set("Content-Range", rangeHeader)
 
-	resp, err := httpClient.Do(req)
+	// Abort the transfer if it stalls below the speed floor; a cancelled request's connection
+	// is discarded, so the retry goes out on a fresh one
+	var stalled atomic.Bool
+	if session.minSpeed > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go session.watchSpeed(body, size, cancel, done, &stalled)
+	}
+
+	resp, err := client.httpDo(httpClient, req)
 	if err != nil {
+		if stalled.Load() {
+			return false, fmt.Errorf("chunk transfer stalled below %s/s for %s, reconnecting", formatBytes(session.minSpeed), session.minSpeedWindow)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return false, fmt.Errorf("chunk upload timed out after %s", session.timeout)
+		}
 		return false, fmt.Errorf("failed to upload chunk: %v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusAccepted {
+	// The last chunk is answered with 201 for a new file and 200 when it replaced an existing one,
+	// with the uploaded item, which may have been renamed
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusAccepted {
+		success = true
+		if resp.StatusCode != http.StatusAccepted {
+			var item DriveItem
+			if json.NewDecoder(resp.Body).Decode(&item) == nil && item.ID != "" {
+				session.item.Store(&item)
+			}
+		}
+		client.stats.uploadedBytes.Add(size)
+		if hash != nil {
+			session.addHash(hash)
+		}
 		return true, nil
 	}
 
-	responseBody, _ := io.ReadAll(resp.Body)
-	return false, fmt.Errorf("failed to upload chunk, status: %d, response: %s", resp.StatusCode, responseBody)
+	graphErr := parseGraphError(resp)
+	if isThrottledStatus(resp.StatusCode) {
+		client.throttled()
+	}
+
+	// 416 and 409 mean the session expected a different range than the one we sent
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || resp.StatusCode == http.StatusConflict {
+		return false, &rangeMismatchError{GraphError: graphErr}
+	}
+
+	return false, fmt.Errorf("failed to upload chunk: %w", graphErr)
 }
 
 // itemByPath retrieves the metadata of a folder by its path
 func itemByPath(httpClient *http.Client, accessToken, path string) (*DriveItem, error) {
 	fmt.Println("Retrieving item by path:", path)
-	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/root:/%s", path)
+	url := itemURL("", path, "")
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 
@@ -363,8 +856,7 @@ func itemByPath(httpClient *http.Client, accessToken, path string) (*DriveItem,
 	fmt.Println("Item by path response status code:", res.StatusCode)
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		responseBody, _ := ioutil.ReadAll(res.Body)
-		return nil, fmt.Errorf("failed to retrieve item, status code: %v, response: %s", res.StatusCode, string(responseBody))
+		return nil, fmt.Errorf("failed to retrieve item: %w", parseGraphError(res))
 	}
 
 	var item DriveItem
@@ -378,19 +870,96 @@ func itemByPath(httpClient *http.Client, accessToken, path string) (*DriveItem,
 
 // DriveItem represents a file or folder item in the drive
 type DriveItem struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID                   string          `json:"id"`
+	Name                 string          `json:"name"`
+	Size                 int64           `json:"size"`
+	LastModifiedDateTime time.Time       `json:"lastModifiedDateTime"`
+	Folder               *FolderFacet    `json:"folder,omitempty"`
+	File                 *FileFacet      `json:"file,omitempty"`
+	FileSystemInfo       *FileSystemInfo `json:"fileSystemInfo,omitempty"`
+	DownloadURL          string          `json:"@microsoft.graph.downloadUrl,omitempty"` // Pre-authenticated, short-lived URL of a file's content
+}
+
+// FileFacet is present on drive items that are files
+type FileFacet struct {
+	MimeType string `json:"mimeType"`
+	Hashes   struct {
+		QuickXorHash string `json:"quickXorHash"`
+	} `json:"hashes"`
+}
+
+// FileSystemInfo holds the client-side timestamps of a drive item
+type FileSystemInfo struct {
+	CreatedDateTime      time.Time `json:"createdDateTime,omitempty"`
+	LastModifiedDateTime time.Time `json:"lastModifiedDateTime,omitempty"`
+}
+
+// requestBody returns the timestamps that are set, formatted for a request; zero times are left
+// for OneDrive to fill in
+func (info *FileSystemInfo) requestBody() map[string]string {
+	body := make(map[string]string)
+	if info == nil {
+		return body
+	}
+	if !info.CreatedDateTime.IsZero() {
+		body["createdDateTime"] = info.CreatedDateTime.UTC().Format(time.RFC3339)
+	}
+	if !info.LastModifiedDateTime.IsZero() {
+		body["lastModifiedDateTime"] = info.LastModifiedDateTime.UTC().Format(time.RFC3339)
+	}
+	return body
+}
+
+// FolderFacet is present on drive items that are folders
+type FolderFacet struct {
+	ChildCount int `json:"childCount"`
+}
+
+// IsFolder reports whether the item is a folder
+func (item *DriveItem) IsFolder() bool {
+	return item.Folder != nil
 }
 
 // UploadParams represents the parameters for the upload operation
 type UploadParams struct {
-	FilePath       string
-	RemoteFilePath string
-	ChunkSize      int64
-	ParallelChunks int
-	MaxRetries     int
-	RetryDelay     time.Duration
-	AccessToken    string
+	FilePath         string
+	RemoteFilePath   string
+	ChunkSize        int64
+	ParallelChunks   int
+	Retry            RetryPolicy // Retry rules per class of chunk upload error
+	AccessToken      string      // Deprecated: ignored; requests use the client's token, which is refreshed as needed during the upload
+	StateDir         string      // Directory to persist the upload session in so it can be resumed (empty disables)
+	Resume           bool        // Continue the session persisted in StateDir instead of starting over
+	Progress         ProgressFunc
+	MinSpeed         int64                     // Abort and retry a chunk whose transfer rate stays below this many bytes/s (0 disables)
+	MinSpeedWindow   time.Duration             // How long the rate must stay below MinSpeed before the chunk is aborted
+	Reader           io.Reader                 // Upload from this reader instead of FilePath, e.g. a pipe; its chunks are buffered in memory and it can't be resumed
+	Size             int64                     // Size of Reader's content, which the upload session needs up front
+	Hashed           func(quickXorHash string) // Receives the QuickXorHash of the content, computed while it is sent, unless the upload resumed a session
+	UploadURL        string                    // Upload session created with CreateUploadSession (empty creates one)
+	Context          context.Context           // Stops the upload when cancelled, keeping or cancelling the session (nil never cancels)
+	ConflictBehavior ConflictBehavior          // What to do if RemoteFilePath already exists: ConflictRename (default), ConflictReplace or ConflictFail; ignored with UploadURL
+	FileSystemInfo   *FileSystemInfo           // Client-side timestamps to give the uploaded file, e.g. the local file's; ignored with UploadURL (nil leaves them to OneDrive)
+	Bandwidth        BandwidthFunc             // Limits this upload alone, within the client's shared limit (nil for no limit of its own)
+}
+
+// ConflictBehavior is what an upload does when a file already exists at its path
+type ConflictBehavior string
+
+// Conflict behaviors for UploadParams.ConflictBehavior
+const (
+	ConflictRename  ConflictBehavior = "rename"  // Keep the existing file and upload under a new name, e.g. "file 1.txt"
+	ConflictReplace ConflictBehavior = "replace" // Replace the existing file
+	ConflictFail    ConflictBehavior = "fail"    // Fail the upload with a nameAlreadyExists error
+)
+
+// ParseConflictBehavior parses a conflict behavior given by name, e.g. in a -conflict flag
+func ParseConflictBehavior(name string) (ConflictBehavior, error) {
+	switch behavior := ConflictBehavior(name); behavior {
+	case ConflictRename, ConflictReplace, ConflictFail:
+		return behavior, nil
+	}
+	return "", fmt.Errorf("unknown conflict behavior '%s': must be %s, %s or %s", name, ConflictRename, ConflictReplace, ConflictFail)
 }
 
 // DriveQuota represents the quota information for a drive
@@ -403,30 +972,35 @@ type DriveQuota struct {
 
 // GetDriveQuota fetches the quota information for the drive
 func (client *AzureClient) GetDriveQuota(httpClient *http.Client) (*DriveQuota, error) {
+	return client.GetDriveQuotaForDrive(httpClient, "")
+}
+
+// GetDriveQuotaForDrive fetches the quota information for the drive with the given ID,
+// or for the signed-in user's drive if driveID is empty
+func (client *AzureClient) GetDriveQuotaForDrive(httpClient *http.Client, driveID string) (*DriveQuota, error) {
 	// Ensure the access token is valid
 	if err := client.EnsureTokenValid(httpClient); err != nil {
 		return nil, err
 	}
 
 	// Construct the URL to get the drive's quota information
-	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/quota")
+	url := driveURL(driveID) + "/quota"
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create quota request: %v", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
 
-	resp, err := httpClient.Do(req)
+	resp, err := client.do(httpClient, req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch quota information: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		responseBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to fetch quota information, status: %d, response: %s", resp.StatusCode, responseBody)
+		return nil, fmt.Errorf("failed to fetch quota information: %w", parseGraphError(resp))
 	}
 
 	var quotaResponse struct {
@@ -487,17 +1061,16 @@ func (client *AzureClient) GetQuickXorHash(httpClient *http.Client, fileID strin
 		return "", fmt.Errorf("failed to create request: %v", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+client.AccessToken)
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
 
-	resp, err := httpClient.Do(req)
+	resp, err := client.do(httpClient, req)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch file metadata: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		responseBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to fetch file metadata, status: %d, response: %s", resp.StatusCode, responseBody)
+		return "", fmt.Errorf("failed to fetch file metadata: %w", parseGraphError(resp))
 	}
 
 	// Parse the response to extract the quickXorHash
@@ -0,0 +1,377 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGraph serves the Graph requests of an upload: creating upload sessions with a conflict
+// behavior, receiving their chunks and looking up the uploaded item. Like Graph, it answers the last
+// chunk with 201 for a new file and 200 for a replaced one, and forgets a session once it completes.
+type fakeGraph struct {
+	t        *testing.T
+	server   *httptest.Server
+	mu       sync.Mutex
+	files    map[string][]byte // Path below the drive root -> content
+	sessions map[string]*fakeSession
+	created  int // Upload sessions created
+}
+
+// fakeSession is an upload session of fakeGraph
+type fakeSession struct {
+	path     string
+	conflict ConflictBehavior
+	data     []byte
+	received int64
+}
+
+func newFakeGraph(t *testing.T) *fakeGraph {
+	g := &fakeGraph{t: t, files: make(map[string][]byte), sessions: make(map[string]*fakeSession)}
+	g.server = httptest.NewServer(g)
+	t.Cleanup(g.server.Close)
+	return g
+}
+
+// client returns a client with a valid token and an HTTP client that sends Graph requests to g
+func (g *fakeGraph) client() (*AzureClient, *http.Client) {
+	target, _ := url.Parse(g.server.URL)
+	httpClient := &http.Client{Transport: rewriteHost{target: target}}
+	return &AzureClient{AccessToken: "token", Expiration: time.Now().Add(time.Hour)}, httpClient
+}
+
+// rewriteHost sends every request to the fake server, whatever host it was for
+type rewriteHost struct {
+	target *url.URL
+}
+
+func (r rewriteHost) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme, req.URL.Host = r.target.Scheme, r.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (g *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if id, ok := strings.CutPrefix(r.URL.Path, "/upload/"); ok {
+		g.serveChunk(w, r, id)
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v1.0/me/drive/root:/")
+	if !ok {
+		g.fail(w, http.StatusBadRequest, "invalidRequest", "unexpected "+r.URL.Path)
+		return
+	}
+	if itemPath, ok := strings.CutSuffix(rest, ":/createUploadSession"); ok && r.Method == http.MethodPost {
+		var body struct {
+			Item map[string]any `json:"item"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		name, _ := body.Item["@microsoft.graph.conflictBehavior"].(string)
+		conflict := ConflictBehavior(name)
+		if _, exists := g.files[itemPath]; exists && conflict == ConflictFail {
+			g.fail(w, http.StatusConflict, "nameAlreadyExists", "The specified item name already exists.")
+			return
+		}
+		g.created++
+		id := strconv.Itoa(g.created)
+		g.sessions[id] = &fakeSession{path: itemPath, conflict: conflict}
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": "https://upload.example.com/upload/" + id})
+		return
+	}
+	if itemPath, ok := strings.CutSuffix(rest, ":/content"); ok && r.Method == http.MethodPut {
+		conflict := ConflictBehavior(r.URL.Query().Get("@microsoft.graph.conflictBehavior"))
+		if _, exists := g.files[itemPath]; exists && conflict == ConflictFail {
+			g.fail(w, http.StatusConflict, "nameAlreadyExists", "The specified item name already exists.")
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		g.store(w, itemPath, conflict, data)
+		return
+	}
+	if r.Method == http.MethodGet {
+		if _, exists := g.files[rest]; !exists {
+			g.fail(w, http.StatusNotFound, "itemNotFound", "The resource could not be found.")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": "id-" + rest, "name": filepath.Base(rest)})
+		return
+	}
+	g.fail(w, http.StatusBadRequest, "invalidRequest", "unexpected "+r.Method+" "+r.URL.Path)
+}
+
+// serveChunk receives a chunk of an upload session, or reports its status on GET
+func (g *fakeGraph) serveChunk(w http.ResponseWriter, r *http.Request, id string) {
+	session, ok := g.sessions[id]
+	if !ok {
+		g.fail(w, http.StatusNotFound, "itemNotFound", "The upload session was not found.")
+		return
+	}
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(map[string][]string{"nextExpectedRanges": {fmt.Sprintf("%d-", session.received)}})
+		return
+	}
+
+	var start, end, total int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || start != session.received {
+		g.fail(w, http.StatusRequestedRangeNotSatisfiable, "invalidRange", "unexpected range")
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	session.data = append(session.data, data...)
+	session.received = end + 1
+	if session.received < total {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	delete(g.sessions, id)
+	g.store(w, session.path, session.conflict, session.data)
+}
+
+// store saves a completed upload, renaming it unless it replaces an existing file, and answers
+// with the item
+func (g *fakeGraph) store(w http.ResponseWriter, path string, conflict ConflictBehavior, data []byte) {
+	itemPath := path
+	status := http.StatusCreated
+	if _, exists := g.files[itemPath]; exists {
+		if conflict == ConflictReplace {
+			status = http.StatusOK
+		} else {
+			ext := filepath.Ext(itemPath)
+			for n := 1; ; n++ {
+				itemPath = fmt.Sprintf("%s %d%s", strings.TrimSuffix(path, ext), n, ext)
+				if _, exists := g.files[itemPath]; !exists {
+					break
+				}
+			}
+		}
+	}
+	g.files[itemPath] = data
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"id": "id-" + itemPath, "name": filepath.Base(itemPath), "size": len(data)})
+}
+
+func (g *fakeGraph) fail(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": code, "message": message}})
+}
+
+// writeTempFile writes content to a file in a test's temporary directory
+func writeTempFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUploadReplaceAcceptsFinalChunkOK(t *testing.T) {
+	g := newFakeGraph(t)
+	g.files["folder/file.txt"] = []byte("old content")
+	client, httpClient := g.client()
+
+	fileID, err := client.Upload(httpClient, UploadParams{
+		FilePath:         writeTempFile(t, "new content, sent in several chunks"),
+		RemoteFilePath:   "folder/file.txt",
+		ChunkSize:        8,
+		ParallelChunks:   1,
+		Retry:            DefaultRetryPolicy(),
+		ConflictBehavior: ConflictReplace,
+	})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if fileID != "id-folder/file.txt" {
+		t.Errorf("file ID = %q, want %q", fileID, "id-folder/file.txt")
+	}
+	if got := string(g.files["folder/file.txt"]); got != "new content, sent in several chunks" {
+		t.Errorf("remote content = %q", got)
+	}
+	if g.created != 1 {
+		t.Errorf("created %d upload sessions, want 1; the file was uploaded again", g.created)
+	}
+}
+
+func TestUploadConflictBehavior(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict ConflictBehavior
+		exists   bool
+		wantErr  string            // Graph error code of a failed upload
+		wantID   string            // ID of the uploaded item
+		want     map[string]string // Remote files after the upload
+	}{
+		{name: "rename new file", conflict: ConflictRename, wantID: "id-f/a.txt", want: map[string]string{"f/a.txt": "new"}},
+		{name: "replace new file", conflict: ConflictReplace, wantID: "id-f/a.txt", want: map[string]string{"f/a.txt": "new"}},
+		{name: "fail new file", conflict: ConflictFail, wantID: "id-f/a.txt", want: map[string]string{"f/a.txt": "new"}},
+		{name: "default renames", conflict: "", exists: true, wantID: "id-f/a 1.txt", want: map[string]string{"f/a.txt": "old", "f/a 1.txt": "new"}},
+		{name: "rename existing file", conflict: ConflictRename, exists: true, wantID: "id-f/a 1.txt", want: map[string]string{"f/a.txt": "old", "f/a 1.txt": "new"}},
+		{name: "replace existing file", conflict: ConflictReplace, exists: true, wantID: "id-f/a.txt", want: map[string]string{"f/a.txt": "new"}},
+		{name: "fail on existing file", conflict: ConflictFail, exists: true, wantErr: "nameAlreadyExists", want: map[string]string{"f/a.txt": "old"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newFakeGraph(t)
+			if tt.exists {
+				g.files["f/a.txt"] = []byte("old")
+			}
+			client, httpClient := g.client()
+
+			fileID, err := client.Upload(httpClient, UploadParams{
+				FilePath:         writeTempFile(t, "new"),
+				RemoteFilePath:   "f/a.txt",
+				ChunkSize:        2,
+				ParallelChunks:   1,
+				Retry:            DefaultRetryPolicy(),
+				ConflictBehavior: tt.conflict,
+			})
+			if tt.wantErr != "" {
+				graphErr, ok := AsGraphError(err)
+				if !ok || graphErr.Code != tt.wantErr {
+					t.Fatalf("Upload error = %v, want Graph error %s", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			} else if fileID != tt.wantID {
+				t.Errorf("file ID = %q, want %q", fileID, tt.wantID)
+			}
+
+			if len(g.files) != len(tt.want) {
+				t.Errorf("remote has %d files, want %d", len(g.files), len(tt.want))
+			}
+			for path, content := range tt.want {
+				if got := string(g.files[path]); got != content {
+					t.Errorf("%s = %q, want %q", path, got, content)
+				}
+			}
+			if g.created > 1 {
+				t.Errorf("created %d upload sessions, want at most 1", g.created)
+			}
+		})
+	}
+}
+
+func TestUploadEmptyFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict ConflictBehavior
+		exists   bool
+		wantID   string
+	}{
+		{name: "new file", wantID: "id-f/empty.txt"},
+		{name: "replace existing file", conflict: ConflictReplace, exists: true, wantID: "id-f/empty.txt"},
+		{name: "rename existing file", conflict: ConflictRename, exists: true, wantID: "id-f/empty 1.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newFakeGraph(t)
+			if tt.exists {
+				g.files["f/empty.txt"] = []byte("old")
+			}
+			client, httpClient := g.client()
+
+			var hash string
+			fileID, err := client.Upload(httpClient, UploadParams{
+				FilePath:         writeTempFile(t, ""),
+				RemoteFilePath:   "f/empty.txt",
+				ChunkSize:        8,
+				ParallelChunks:   1,
+				ConflictBehavior: tt.conflict,
+				Hashed:           func(h string) { hash = h },
+			})
+			if err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			if fileID != tt.wantID {
+				t.Errorf("file ID = %q, want %q", fileID, tt.wantID)
+			}
+			if data, ok := g.files[strings.TrimPrefix(tt.wantID, "id-")]; !ok || len(data) != 0 {
+				t.Errorf("remote file = %q, %v, want an empty file", data, ok)
+			}
+			if g.created != 0 {
+				t.Errorf("created %d upload sessions, want none", g.created)
+			}
+			if hash != "AAAAAAAAAAAAAAAAAAAAAAAAAAA=" {
+				t.Errorf("hash = %q, want the QuickXorHash of no content", hash)
+			}
+		})
+	}
+}
+
+func TestUploadBandwidth(t *testing.T) {
+	g := newFakeGraph(t)
+	client, httpClient := g.client()
+	content := strings.Repeat("x", 48*1024)
+
+	// 48 KiB at 32 KiB/s can't take much less than 1.5s, whatever the client's own limit
+	start := time.Now()
+	_, err := client.Upload(httpClient, UploadParams{
+		FilePath:       writeTempFile(t, content),
+		RemoteFilePath: "f/limited.bin",
+		ChunkSize:      16 * 1024,
+		ParallelChunks: 3,
+		Bandwidth:      func(time.Time) int64 { return 32 * 1024 },
+	})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("upload took %v, faster than its bandwidth limit allows", elapsed)
+	}
+	if got := string(g.files["f/limited.bin"]); got != content {
+		t.Errorf("remote content has %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestUploadInvalidConflictBehavior(t *testing.T) {
+	g := newFakeGraph(t)
+	client, httpClient := g.client()
+	_, err := client.Upload(httpClient, UploadParams{FilePath: writeTempFile(t, "x"), RemoteFilePath: "f/a.txt", ChunkSize: 2, ParallelChunks: 1, ConflictBehavior: "overwrite"})
+	if err == nil || g.created != 0 {
+		t.Fatalf("Upload with an invalid conflict behavior: err = %v, %d sessions created", err, g.created)
+	}
+}
+
+func TestParseConflictBehavior(t *testing.T) {
+	for _, name := range []string{"rename", "replace", "fail"} {
+		if got, err := ParseConflictBehavior(name); err != nil || string(got) != name {
+			t.Errorf("ParseConflictBehavior(%q) = %q, %v", name, got, err)
+		}
+	}
+	for _, name := range []string{"", "overwrite", "Replace"} {
+		if _, err := ParseConflictBehavior(name); err == nil {
+			t.Errorf("ParseConflictBehavior(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestClientThrottled(t *testing.T) {
+	client := &AzureClient{}
+	if client.Throttled() {
+		t.Fatal("new client reports being throttled")
+	}
+	client.throttled()
+	if !client.Throttled() {
+		t.Fatal("client doesn't report being throttled right after a throttled response")
+	}
+	client.throttling.lastHit = time.Now().Add(-throttleCooldown)
+	if client.Throttled() {
+		t.Fatal("client still reports being throttled after the cooldown without a reduced limit")
+	}
+}
@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthFunc returns the bandwidth limit in bytes/s that applies at a given time, or 0 for no limit
+type BandwidthFunc func(now time.Time) int64
+
+// maxThrottledRead bounds each read of a throttled transfer, so bandwidth is handed out in small steps
+const maxThrottledRead = 64 * 1024
+
+// rateLimiter is a token bucket shared by all transfers of a client, refilled at the rate its
+// BandwidthFunc gives for the current time
+type rateLimiter struct {
+	limit  BandwidthFunc
+	mu     sync.Mutex
+	tokens float64 // Bytes that may be sent right away; negative while transfers wait for their share
+	last   time.Time
+}
+
+// UseBandwidthLimit throttles the data of all uploads and downloads of the client to the rate limit
+// returns, shared between them; nil removes the limit
+func (client *AzureClient) UseBandwidthLimit(limit BandwidthFunc) {
+	client.bandwidth = nil
+	if limit != nil {
+		client.bandwidth = &rateLimiter{limit: limit}
+	}
+}
+
+// wait takes n bytes out of the bucket and waits until the rate allows them to be sent
+func (limiter *rateLimiter) wait(ctx context.Context, n int) error {
+	limiter.mu.Lock()
+	now := time.Now()
+	rate := float64(limiter.limit(now))
+	if rate <= 0 {
+		limiter.tokens = 0
+		limiter.last = now
+		limiter.mu.Unlock()
+		return nil
+	}
+
+	// Refill for the time since the last transfer, keeping at most a second's worth as a burst
+	if !limiter.last.IsZero() {
+		limiter.tokens = min(limiter.tokens+now.Sub(limiter.last).Seconds()*rate, rate)
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	delay := time.Duration(-limiter.tokens / rate * float64(time.Second))
+	limiter.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader passes data through once its bandwidth limit allows it
+type throttledReader struct {
+	r       io.Reader
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > maxThrottledRead {
+		p = p[:maxThrottledRead]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if waitErr := tr.limiter.wait(tr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// throttle wraps r in the client's bandwidth limit, if it has one
+func (client *AzureClient) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if client.bandwidth == nil {
+		return r
+	}
+	return &throttledReader{r: r, ctx: ctx, limiter: client.bandwidth}
+}
@@ -0,0 +1,32 @@
+package azure
+
+import "sync"
+
+// chunkBuffers holds a pool of buffers per chunk size, so buffered uploads reuse chunk buffers
+// instead of allocating a new one for every chunk
+var chunkBuffers sync.Map // int64 -> *sync.Pool
+
+// getChunkBuffer returns a buffer of size bytes from the pool
+func getChunkBuffer(size int64) []byte {
+	pool, ok := chunkBuffers.Load(size)
+	if !ok {
+		pool, _ = chunkBuffers.LoadOrStore(size, &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}})
+	}
+	return *pool.(*sync.Pool).Get().(*[]byte)
+}
+
+// putChunkBuffer returns a buffer from getChunkBuffer to the pool; nil buffers are ignored
+func putChunkBuffer(buf []byte) {
+	if buf == nil {
+		return
+	}
+	pool, ok := chunkBuffers.Load(int64(cap(buf)))
+	if !ok {
+		return
+	}
+	buf = buf[:cap(buf)]
+	pool.(*sync.Pool).Put(&buf)
+}
@@ -0,0 +1,17 @@
+package azure
+
+import "context"
+
+// UseConnectionLimit bounds how many chunk uploads the client runs at the same time, shared by all
+// uploads in progress, e.g. when several files are uploaded in parallel; 0 removes the limit
+func (client *AzureClient) UseConnectionLimit(n int) {
+	client.throttling.mu.Lock()
+	defer client.throttling.mu.Unlock()
+	client.throttling.chunks.max = max(n, 0)
+}
+
+// acquireConnection waits until the connection limit and throttling allow another chunk upload or
+// download part and returns the function that gives the connection back
+func (client *AzureClient) acquireConnection(ctx context.Context) (func(), error) {
+	return client.throttling.acquire(ctx, &client.throttling.chunks)
+}
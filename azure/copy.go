@@ -0,0 +1,137 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CopyStatus reports the progress of an asynchronous server-side copy
+type CopyStatus struct {
+	Status             string  `json:"status"`
+	PercentageComplete float64 `json:"percentageComplete"`
+	ResourceID         string  `json:"resourceId"`
+}
+
+// Done reports whether the copy has finished, successfully or not
+func (status *CopyStatus) Done() bool {
+	return status.Status == "completed" || status.Status == "failed"
+}
+
+// Copy starts a server-side copy of the item at srcPath into destFolder under name
+// and returns the monitor URL to poll for its progress
+func (client *AzureClient) Copy(httpClient *http.Client, srcPath, destFolder, name string) (string, error) {
+	if err := client.checkAccess(OpCopy, srcPath); err != nil {
+		return "", err
+	}
+	if err := client.checkAccess(OpCopy, destFolder); err != nil {
+		return "", err
+	}
+
+	dest, err := client.GetItem(httpClient, destFolder)
+	if err != nil {
+		return "", fmt.Errorf("failed to find destination folder: %w", err)
+	}
+	if !dest.IsFolder() {
+		return "", fmt.Errorf("destination '%s' is not a folder", destFolder)
+	}
+
+	parentReference := map[string]string{"id": dest.ID}
+	if client.DriveID != "" {
+		parentReference["driveId"] = client.DriveID
+	}
+	requestBody := map[string]interface{}{
+		"parentReference": parentReference,
+		"name":            name,
+	}
+	body, _ := json.Marshal(requestBody)
+
+	url := itemURL("", srcPath, "/copy")
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create copy request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to start copy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("failed to start copy: %w", parseGraphError(resp))
+	}
+
+	client.itemCache.invalidate("", JoinRemotePath(destFolder, name).String())
+
+	monitorURL := resp.Header.Get("Location")
+	if monitorURL == "" {
+		return "", fmt.Errorf("copy accepted but no monitor URL was returned")
+	}
+
+	return monitorURL, nil
+}
+
+// GetCopyStatus queries the monitor URL of a copy operation
+func (client *AzureClient) GetCopyStatus(httpClient *http.Client, monitorURL string) (*CopyStatus, error) {
+	req, err := http.NewRequest("GET", monitorURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create copy status request: %v", err)
+	}
+
+	// The monitor redirects to the new item once done; that item needs authentication
+	// to fetch and we only want the status, so stop at the redirect
+	monitorClient := *httpClient
+	monitorClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.send(req.Context(), &monitorClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query copy status: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusSeeOther:
+		return &CopyStatus{Status: "completed", PercentageComplete: 100}, nil
+	case http.StatusOK, http.StatusAccepted:
+	default:
+		return nil, fmt.Errorf("failed to query copy status: %w", parseGraphError(resp))
+	}
+
+	var status CopyStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse copy status: %v", err)
+	}
+
+	return &status, nil
+}
+
+// WaitForCopy polls the monitor URL every interval until the copy finishes, reporting each status to progress
+func (client *AzureClient) WaitForCopy(httpClient *http.Client, monitorURL string, interval time.Duration, progress func(*CopyStatus)) (*CopyStatus, error) {
+	for {
+		status, err := client.GetCopyStatus(httpClient, monitorURL)
+		if err != nil {
+			return nil, err
+		}
+
+		if progress != nil {
+			progress(status)
+		}
+
+		if status.Status == "failed" {
+			return status, fmt.Errorf("server-side copy failed")
+		}
+		if status.Done() {
+			return status, nil
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,80 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// DeltaItem is an item reported by Delta as added, changed or deleted
+type DeltaItem struct {
+	DriveItem
+	ParentID string // ID of the folder the item is in
+	Deleted  bool   // The item was deleted; only its ID is meaningful then
+}
+
+// Delta returns the items below the folder at remotePath that changed since deltaLink was issued,
+// following paging links, and the deltaLink to pass next time. Without a deltaLink every item is
+// returned. Graph answers 410 Gone when a deltaLink has expired; the caller has to start over then.
+func (client *AzureClient) Delta(httpClient *http.Client, remotePath, deltaLink string) ([]DeltaItem, string, error) {
+	if err := client.checkAccess(OpList, remotePath); err != nil {
+		return nil, "", err
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return nil, "", err
+	}
+
+	url := deltaLink
+	if url == "" {
+		url = itemURL("", remotePath, "/delta")
+	}
+
+	var items []DeltaItem
+	for {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create delta request: %v", err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+client.currentToken())
+
+		resp, err := client.do(httpClient, req)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to fetch changes: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := parseGraphError(resp)
+			resp.Body.Close()
+			return nil, "", fmt.Errorf("failed to fetch changes: %w", err)
+		}
+
+		var page struct {
+			Value []struct {
+				DriveItem
+				ParentReference struct {
+					ID string `json:"id"`
+				} `json:"parentReference"`
+				Deleted *struct{} `json:"deleted"`
+			} `json:"value"`
+			NextLink  string `json:"@odata.nextLink"`
+			DeltaLink string `json:"@odata.deltaLink"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse changes: %v", err)
+		}
+
+		for _, item := range page.Value {
+			items = append(items, DeltaItem{DriveItem: item.DriveItem, ParentID: item.ParentReference.ID, Deleted: item.Deleted != nil})
+		}
+
+		if page.NextLink == "" {
+			return items, page.DeltaLink, nil
+		}
+		url = page.NextLink
+	}
+}
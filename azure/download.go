@@ -0,0 +1,79 @@
+package azure
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Download streams the content of the file at remotePath into w and returns the number of bytes written
+func (client *AzureClient) Download(httpClient *http.Client, remotePath string, w io.Writer) (int64, error) {
+	return client.DownloadRange(httpClient, remotePath, 0, -1, w)
+}
+
+// DownloadRange streams part of the file at remotePath into w: count bytes starting at offset, or
+// everything from offset on if count is negative. A negative offset counts from the end of the file.
+func (client *AzureClient) DownloadRange(httpClient *http.Client, remotePath string, offset, count int64, w io.Writer) (int64, error) {
+	if err := client.checkAccess(OpDownload, remotePath); err != nil {
+		return 0, err
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return 0, err
+	}
+
+	url := itemURL("", remotePath, "/content")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create download request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	switch {
+	case offset < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d", offset))
+	case count == 0:
+		return 0, nil
+	case count > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+count-1))
+	case offset > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// Graph answers with a redirect to a pre-authenticated download URL, which the http.Client follows
+	// along with the Range header
+	resp, err := client.send(req.Context(), httpClient, req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Asking for data past the end of the file yields nothing rather than an error
+		return 0, nil
+	case http.StatusOK:
+		// The whole file came back, so skip to the requested part ourselves
+		if offset < 0 {
+			return 0, fmt.Errorf("failed to download file: the server ignored the requested range")
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("failed to download file: %v", err)
+		}
+	default:
+		return 0, fmt.Errorf("failed to download file: %w", parseGraphError(resp))
+	}
+	if count >= 0 {
+		body = io.LimitReader(body, count)
+	}
+
+	written, err := io.Copy(w, client.throttle(req.Context(), body))
+	if err != nil {
+		return written, fmt.Errorf("failed to write downloaded data: %v", err)
+	}
+
+	return written, nil
+}
@@ -0,0 +1,133 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Drive represents a drive (OneDrive or document library) the client can access
+type Drive struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	DriveType string      `json:"driveType"`
+	WebURL    string      `json:"webUrl"`
+	Quota     *DriveQuota `json:"quota,omitempty"`
+}
+
+// driveURL returns the Graph URL of the drive with the given ID, or of the user's own drive if driveID is empty
+func driveURL(driveID string) string {
+	if driveID == "" {
+		return "https://graph.microsoft.com/v1.0/me/drive"
+	}
+	return "https://graph.microsoft.com/v1.0/drives/" + url.PathEscape(driveID)
+}
+
+// ListDrives lists the drives available to the signed-in user
+func (client *AzureClient) ListDrives(httpClient *http.Client) ([]Drive, error) {
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/me/drives", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create drives request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list drives: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list drives: %w", parseGraphError(resp))
+	}
+
+	var response struct {
+		Value []Drive `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to parse drives response: %v", err)
+	}
+
+	return response.Value, nil
+}
+
+// GetDrive retrieves the drive with the given ID, or the user's own drive if driveID is empty
+func (client *AzureClient) GetDrive(httpClient *http.Client, driveID string) (*Drive, error) {
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", driveURL(driveID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create drive request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get drive: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get drive: %w", parseGraphError(resp))
+	}
+
+	var drive Drive
+	if err := json.NewDecoder(resp.Body).Decode(&drive); err != nil {
+		return nil, fmt.Errorf("failed to parse drive response: %v", err)
+	}
+
+	return &drive, nil
+}
+
+// GetItemForDrive retrieves the metadata of the item at remotePath on the drive with the given ID,
+// or on the user's own drive if driveID is empty
+func (client *AzureClient) GetItemForDrive(httpClient *http.Client, driveID, remotePath string) (*DriveItem, error) {
+	if err := client.checkLookup(remotePath); err != nil {
+		return nil, err
+	}
+
+	if item, ok := client.itemCache.get(driveID, remotePath); ok {
+		return item, nil
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", itemURL(driveID, remotePath, ""), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch item metadata: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch item metadata: %w", parseGraphError(resp))
+	}
+
+	var item DriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, fmt.Errorf("failed to parse item metadata: %v", err)
+	}
+
+	client.itemCache.put(driveID, remotePath, &item)
+	return &item, nil
+}
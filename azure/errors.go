@@ -0,0 +1,93 @@
+package azure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GraphError represents an error response returned by the Microsoft Graph API
+type GraphError struct {
+	StatusCode int              `json:"status"`
+	Code       string           `json:"code"`
+	Message    string           `json:"message"`
+	InnerError *GraphInnerError `json:"innerError,omitempty"`
+	RetryAfter time.Duration    `json:"-"` // From the Retry-After header of throttled responses
+}
+
+// GraphInnerError holds the diagnostic details Graph attaches to an error
+type GraphInnerError struct {
+	Code            string `json:"code,omitempty"`
+	RequestID       string `json:"request-id,omitempty"`
+	ClientRequestID string `json:"client-request-id,omitempty"`
+	Date            string `json:"date,omitempty"`
+}
+
+func (e *GraphError) Error() string {
+	msg := fmt.Sprintf("status: %d", e.StatusCode)
+	if e.Code != "" {
+		msg += fmt.Sprintf(", code: %s", e.Code)
+	}
+	if e.Message != "" {
+		msg += fmt.Sprintf(", message: %s", e.Message)
+	}
+	if e.InnerError != nil && e.InnerError.RequestID != "" {
+		msg += fmt.Sprintf(", request-id: %s", e.InnerError.RequestID)
+	}
+	return msg
+}
+
+// parseGraphError reads an unsuccessful response and converts it into a *GraphError.
+// Both the Graph error format and the OAuth token endpoint format are understood;
+// bodies that are not JSON are kept verbatim as the message.
+func parseGraphError(resp *http.Response) *GraphError {
+	graphErr := &GraphError{StatusCode: resp.StatusCode}
+	graphErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+
+	responseBody, _ := io.ReadAll(resp.Body)
+
+	var payload struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	if err := json.Unmarshal(responseBody, &payload); err != nil || len(payload.Error) == 0 {
+		graphErr.Message = strings.TrimSpace(string(responseBody))
+		return graphErr
+	}
+
+	// OAuth errors use a plain string code with a separate description
+	var oauthCode string
+	if err := json.Unmarshal(payload.Error, &oauthCode); err == nil {
+		graphErr.Code = oauthCode
+		graphErr.Message = payload.ErrorDescription
+		return graphErr
+	}
+
+	var body struct {
+		Code       string           `json:"code"`
+		Message    string           `json:"message"`
+		InnerError *GraphInnerError `json:"innerError"`
+	}
+	if err := json.Unmarshal(payload.Error, &body); err != nil {
+		graphErr.Message = strings.TrimSpace(string(responseBody))
+		return graphErr
+	}
+
+	graphErr.Code = body.Code
+	graphErr.Message = body.Message
+	graphErr.InnerError = body.InnerError
+	return graphErr
+}
+
+// AsGraphError returns the *GraphError wrapped in err, if any
+func AsGraphError(err error) (*GraphError, bool) {
+	var graphErr *GraphError
+	if errors.As(err, &graphErr) {
+		return graphErr, true
+	}
+	return nil, false
+}
@@ -0,0 +1,146 @@
+package azure
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ItemCache caches drive item metadata by path for a fixed TTL, so repeated lookups of the same
+// folders during a run don't each cost a request. Items learned from folder listings are cached
+// too, and the client invalidates paths it changes. If Path is set, Save persists the cache to disk
+// so successive runs can share it.
+type ItemCache struct {
+	TTL     time.Duration
+	Path    string
+	mu      sync.Mutex
+	entries map[string]itemCacheEntry
+	loaded  bool
+}
+
+// itemCacheEntry is a single cached item
+type itemCacheEntry struct {
+	Item      DriveItem `json:"item"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// NewItemCache creates an item cache with the given TTL, optionally backed by a file
+func NewItemCache(ttl time.Duration, path string) *ItemCache {
+	return &ItemCache{
+		TTL:     ttl,
+		Path:    path,
+		entries: make(map[string]itemCacheEntry),
+	}
+}
+
+// UseItemCache makes the client consult cache for item lookups
+func (client *AzureClient) UseItemCache(cache *ItemCache) {
+	client.itemCache = cache
+}
+
+// itemCacheKey identifies an item by drive and path; OneDrive paths are case-insensitive
+func itemCacheKey(driveID, remotePath string) string {
+	return driveID + ":" + strings.ToLower(NewRemotePath(remotePath).String())
+}
+
+// get returns the cached item at remotePath if it is younger than the TTL
+func (c *ItemCache) get(driveID, remotePath string) (*DriveItem, bool) {
+	if c == nil || c.TTL <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+
+	entry, ok := c.entries[itemCacheKey(driveID, remotePath)]
+	if !ok || time.Since(entry.FetchedAt) >= c.TTL {
+		return nil, false
+	}
+	item := entry.Item
+	return &item, true
+}
+
+// put caches the item at remotePath
+func (c *ItemCache) put(driveID, remotePath string, item *DriveItem) {
+	if c == nil || c.TTL <= 0 || item == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	c.entries[itemCacheKey(driveID, remotePath)] = itemCacheEntry{Item: *item, FetchedAt: time.Now()}
+}
+
+// invalidate drops the cached item at remotePath and everything below it
+func (c *ItemCache) invalidate(driveID, remotePath string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+
+	key := itemCacheKey(driveID, remotePath)
+	for cached := range c.entries {
+		if cached == key || strings.HasPrefix(cached, key+"/") {
+			delete(c.entries, cached)
+		}
+	}
+}
+
+// Save writes the unexpired entries to disk if the cache has a Path
+func (c *ItemCache) Save() error {
+	if c == nil || c.Path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+
+	for key, entry := range c.entries {
+		if time.Since(entry.FetchedAt) >= c.TTL {
+			delete(c.entries, key)
+		}
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(c.Path, data, 0o600)
+}
+
+// load reads the on-disk cache once; callers must hold c.mu
+func (c *ItemCache) load() {
+	if c.entries == nil {
+		c.entries = make(map[string]itemCacheEntry)
+	}
+	if c.loaded || c.Path == "" {
+		c.loaded = true
+		return
+	}
+	c.loaded = true
+
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return
+	}
+
+	var entries map[string]itemCacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return
+	}
+	for key, entry := range entries {
+		c.entries[key] = entry
+	}
+}
@@ -0,0 +1,368 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// GetItem retrieves the metadata of the file or folder at remotePath
+func (client *AzureClient) GetItem(httpClient *http.Client, remotePath string) (*DriveItem, error) {
+	return client.GetItemForDrive(httpClient, "", remotePath)
+}
+
+// ListChildren lists the files and folders directly inside the folder at remotePath, following paging links
+func (client *AzureClient) ListChildren(httpClient *http.Client, remotePath string) ([]DriveItem, error) {
+	if err := client.checkAccess(OpList, remotePath); err != nil {
+		return nil, err
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return nil, err
+	}
+
+	url := itemURL("", remotePath, "/children?$top=200")
+
+	var items []DriveItem
+	for url != "" {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create list request: %v", err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+client.currentToken())
+
+		resp, err := client.do(httpClient, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list folder: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := parseGraphError(resp)
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to list folder: %w", err)
+		}
+
+		var page struct {
+			Value    []DriveItem `json:"value"`
+			NextLink string      `json:"@odata.nextLink"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse folder listing: %v", err)
+		}
+
+		items = append(items, page.Value...)
+		url = page.NextLink
+	}
+
+	// The listing answers later lookups of the children too
+	for i := range items {
+		client.itemCache.put("", JoinRemotePath(remotePath, items[i].Name).String(), &items[i])
+	}
+
+	return items, nil
+}
+
+// Delete moves the file or folder at remotePath to the recycle bin, from where it can be restored;
+// folders are deleted with all their contents
+func (client *AzureClient) Delete(httpClient *http.Client, remotePath string) error {
+	if err := client.checkAccess(OpDelete, remotePath); err != nil {
+		return err
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return err
+	}
+
+	url := itemURL("", remotePath, "")
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create delete request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("failed to delete item: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to delete item: %w", parseGraphError(resp))
+	}
+
+	client.itemCache.invalidate("", remotePath)
+	return nil
+}
+
+// PermanentDelete deletes the file or folder at remotePath without moving it to the recycle bin, so it
+// can't be restored. Graph only supports this on OneDrive for Business and SharePoint drives.
+func (client *AzureClient) PermanentDelete(httpClient *http.Client, remotePath string) error {
+	if err := client.checkAccess(OpDelete, remotePath); err != nil {
+		return err
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return err
+	}
+
+	url := itemURL("", remotePath, "/permanentDelete")
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create permanent delete request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("failed to permanently delete item: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to permanently delete item: %w", parseGraphError(resp))
+	}
+
+	client.itemCache.invalidate("", remotePath)
+	return nil
+}
+
+// Move moves the file or folder at srcPath into destFolder under name, failing if an item of that
+// name is already there. Graph moves items within a drive without transferring their content.
+func (client *AzureClient) Move(httpClient *http.Client, srcPath, destFolder, name string) (*DriveItem, error) {
+	if err := client.checkAccess(OpDelete, srcPath); err != nil {
+		return nil, err
+	}
+	if err := client.checkAccess(OpUpload, JoinRemotePath(destFolder, name).String()); err != nil {
+		return nil, err
+	}
+
+	dest, err := client.GetItem(httpClient, destFolder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find destination folder: %w", err)
+	}
+	if !dest.IsFolder() {
+		return nil, fmt.Errorf("destination '%s' is not a folder", destFolder)
+	}
+
+	requestBody := map[string]interface{}{
+		"parentReference":                   map[string]string{"id": dest.ID},
+		"name":                              name,
+		"@microsoft.graph.conflictBehavior": "fail",
+	}
+	body, _ := json.Marshal(requestBody)
+
+	url := itemURL("", srcPath, "")
+	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create move request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move item: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to move item: %w", parseGraphError(resp))
+	}
+
+	var item DriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, fmt.Errorf("failed to parse item metadata: %v", err)
+	}
+
+	client.itemCache.invalidate("", srcPath)
+	client.itemCache.put("", JoinRemotePath(destFolder, name).String(), &item)
+	return &item, nil
+}
+
+// PutSmallFile uploads data as the file at remotePath in a single request, replacing any existing file.
+// Graph only accepts up to 4 MB this way; larger files need Upload.
+func (client *AzureClient) PutSmallFile(httpClient *http.Client, remotePath string, data []byte) (*DriveItem, error) {
+	if err := client.checkAccess(OpUpload, remotePath); err != nil {
+		return nil, err
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return nil, err
+	}
+
+	url := itemURL("", remotePath, "/content")
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to upload file: %w", parseGraphError(resp))
+	}
+
+	var item DriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, fmt.Errorf("failed to parse file metadata: %v", err)
+	}
+
+	client.itemCache.put("", remotePath, &item)
+	return &item, nil
+}
+
+// CreateFolder creates the folder at remotePath. With parents set, missing parent folders are
+// created too and an existing folder is not an error, like mkdir -p.
+func (client *AzureClient) CreateFolder(httpClient *http.Client, remotePath string, parents bool) (*DriveItem, error) {
+	if parents {
+		return client.EnsureFolder(httpClient, remotePath)
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return nil, err
+	}
+
+	target := NewRemotePath(remotePath)
+	if target.IsRoot() {
+		return nil, fmt.Errorf("cannot create the drive root")
+	}
+
+	return client.createFolder(httpClient, target.Dir().String(), target.Base())
+}
+
+// EnsureFolder makes sure the folder at remotePath exists, creating it and any missing parents
+func (client *AzureClient) EnsureFolder(httpClient *http.Client, remotePath string) (*DriveItem, error) {
+	target := NewRemotePath(remotePath)
+	if target.IsRoot() {
+		return nil, nil
+	}
+	remotePath = target.String()
+
+	item, err := client.GetItem(httpClient, remotePath)
+	if err == nil {
+		if !item.IsFolder() {
+			return nil, fmt.Errorf("remote path '%s' exists and is not a folder", remotePath)
+		}
+		return item, nil
+	}
+	if graphErr, ok := AsGraphError(err); !ok || graphErr.StatusCode != http.StatusNotFound {
+		return nil, err
+	}
+
+	parent := target.Dir()
+	if !parent.IsRoot() {
+		if _, err := client.EnsureFolder(httpClient, parent.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	item, err = client.createFolder(httpClient, parent.String(), target.Base())
+	if graphErr, ok := AsGraphError(err); ok && graphErr.StatusCode == http.StatusConflict {
+		// Someone else created it in the meantime
+		return client.GetItem(httpClient, remotePath)
+	}
+	return item, err
+}
+
+// createFolder creates a folder named name inside parentPath, failing if it already exists
+func (client *AzureClient) createFolder(httpClient *http.Client, parentPath, name string) (*DriveItem, error) {
+	if err := client.checkAccess(OpMkdir, JoinRemotePath(parentPath, name).String()); err != nil {
+		return nil, err
+	}
+
+	url := itemURL("", parentPath, "/children")
+
+	requestBody := map[string]interface{}{
+		"name":                              name,
+		"folder":                            map[string]interface{}{},
+		"@microsoft.graph.conflictBehavior": "fail",
+	}
+	body, _ := json.Marshal(requestBody)
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create folder request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create folder: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to create folder: %w", parseGraphError(resp))
+	}
+
+	var item DriveItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, fmt.Errorf("failed to parse folder metadata: %v", err)
+	}
+
+	client.itemCache.put("", JoinRemotePath(parentPath, name).String(), &item)
+	return &item, nil
+}
+
+// SetModTime sets the client-side last modified time of the item at remotePath
+func (client *AzureClient) SetModTime(httpClient *http.Client, remotePath string, modTime time.Time) error {
+	if err := client.checkAccess(OpUpload, remotePath); err != nil {
+		return err
+	}
+
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return err
+	}
+
+	url := itemURL("", remotePath, "")
+	requestBody := map[string]interface{}{
+		"fileSystemInfo": map[string]string{
+			"lastModifiedDateTime": modTime.UTC().Format(time.RFC3339),
+		},
+	}
+	body, _ := json.Marshal(requestBody)
+
+	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("failed to create update request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("failed to update modification time: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to update modification time: %w", parseGraphError(resp))
+	}
+
+	client.itemCache.invalidate("", remotePath)
+	return nil
+}
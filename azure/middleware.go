@@ -0,0 +1,66 @@
+package azure
+
+import "net/http"
+
+// DefaultUserAgent identifies requests of clients that don't set their own User-Agent, in the
+// ISV|Company|App form Microsoft asks for so it can tell apps apart when diagnosing throttling
+const DefaultUserAgent = "ISV|ksauraj|ksau-oned-api"
+
+// Middleware wraps the transport of a client's requests, e.g. to add headers or log them; next
+// is the transport the request would use otherwise
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// UseUserAgent sets the User-Agent header of all requests of the client; "" restores DefaultUserAgent
+func (client *AzureClient) UseUserAgent(userAgent string) {
+	client.userAgent = userAgent
+}
+
+// UseMiddleware adds middleware around the transport of all requests of the client, including
+// token refreshes and downloads. Middleware added first sees each request first.
+func (client *AzureClient) UseMiddleware(middleware ...Middleware) {
+	client.middleware = append(client.middleware, middleware...)
+}
+
+// HeaderMiddleware returns middleware that sets the given headers on every request
+func HeaderMiddleware(header http.Header) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// A RoundTripper must not modify the request it was given
+			req = req.Clone(req.Context())
+			for name, values := range header {
+				req.Header[http.CanonicalHeaderKey(name)] = values
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// roundTripperFunc adapts a function to the http.RoundTripper interface
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// httpDo sends req with httpClient, with the client's User-Agent and through its middleware
+func (client *AzureClient) httpDo(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	userAgent := client.userAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	if len(client.middleware) == 0 {
+		return httpClient.Do(req)
+	}
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	for i := len(client.middleware) - 1; i >= 0; i-- {
+		transport = client.middleware[i](transport)
+	}
+	decorated := *httpClient
+	decorated.Transport = transport
+	return decorated.Do(req)
+}
@@ -0,0 +1,278 @@
+package azure
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultDownloadPartSize is the size of each ranged request of a parallel download
+const defaultDownloadPartSize = 16 * 1024 * 1024
+
+// maxPartAttempts is how often a part of a parallel download is requested before the download fails
+const maxPartAttempts = 4
+
+// DownloadParams describes a parallel download
+type DownloadParams struct {
+	RemotePath string
+	Streams    int   // Ranged requests to run at the same time; 1 or less downloads the file in a single stream
+	PartSize   int64 // Size of each ranged request (0 selects 16 MiB)
+	Progress   ProgressFunc
+	Context    context.Context        // Stops the download when cancelled (nil never cancels)
+	Completed  [][2]int64             // Inclusive byte ranges already in w from an earlier attempt, which aren't downloaded again
+	PartDone   func(start, end int64) // Called, possibly from several goroutines, with each inclusive range once it is written to w
+}
+
+// DownloadParallel downloads the file at params.RemotePath into w with several concurrent ranged
+// requests against its pre-authenticated download URL, each part written at its own offset, and
+// returns the file's size. Parts that fail are retried, fetching a fresh download URL if the old
+// one has expired.
+func (client *AzureClient) DownloadParallel(httpClient *http.Client, params DownloadParams, w io.WriterAt) (int64, error) {
+	if err := client.checkAccess(OpDownload, params.RemotePath); err != nil {
+		return 0, err
+	}
+
+	ctx := params.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	partSize := params.PartSize
+	if partSize <= 0 {
+		partSize = defaultDownloadPartSize
+	}
+
+	item, err := client.GetItem(httpClient, params.RemotePath)
+	if err != nil {
+		return 0, err
+	}
+	if item.IsFolder() {
+		return 0, fmt.Errorf("'%s' is a folder", params.RemotePath)
+	}
+	tracker := &uploadTracker{total: item.Size, progress: params.Progress}
+	pending := uncoveredRanges(params.Completed, item.Size)
+	tracker.add(item.Size - rangesSize(pending))
+	if len(pending) == 0 {
+		return item.Size, nil
+	}
+
+	// Small files and single streams don't gain anything from splitting
+	if params.Streams <= 1 || item.Size <= partSize || item.DownloadURL == "" {
+		for _, r := range pending {
+			written, err := client.DownloadRange(httpClient, params.RemotePath, r.start, r.end-r.start+1, &progressWriter{w: io.NewOffsetWriter(w, r.start), tracker: tracker})
+			// What did arrive is kept, so an interrupted stream resumes where it stopped
+			if written > 0 && params.PartDone != nil {
+				params.PartDone(r.start, r.start+written-1)
+			}
+			if err == nil && written != r.end-r.start+1 {
+				err = fmt.Errorf("failed to download file: got %d of %d bytes", written, r.end-r.start+1)
+			}
+			if err != nil {
+				return tracker.transferred.Load(), err
+			}
+		}
+		return item.Size, nil
+	}
+
+	download := &parallelDownload{client: client, httpClient: httpClient, remotePath: params.RemotePath, downloadURL: item.DownloadURL}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make(chan byteRange)
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for range params.Streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				if err := download.part(ctx, part, w, tracker); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				} else if params.PartDone != nil {
+					params.PartDone(part.start, part.end)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, part := range splitRanges(pending, partSize) {
+		select {
+		case parts <- part:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if firstErr != nil {
+		return tracker.transferred.Load(), firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return tracker.transferred.Load(), err
+	}
+	return item.Size, nil
+}
+
+// parallelDownload is the state shared by the workers of a parallel download
+type parallelDownload struct {
+	client      *AzureClient
+	httpClient  *http.Client
+	remotePath  string
+	mu          sync.Mutex
+	downloadURL string
+}
+
+// url returns the current download URL
+func (download *parallelDownload) url() string {
+	download.mu.Lock()
+	defer download.mu.Unlock()
+	return download.downloadURL
+}
+
+// refreshURL replaces an expired download URL unless another worker already did
+func (download *parallelDownload) refreshURL(expired string) error {
+	download.mu.Lock()
+	defer download.mu.Unlock()
+	if download.downloadURL != expired {
+		return nil
+	}
+
+	download.client.itemCache.invalidate("", download.remotePath)
+	item, err := download.client.GetItem(download.httpClient, download.remotePath)
+	if err != nil {
+		return err
+	}
+	if item.DownloadURL == "" {
+		return errors.New("no download URL in the item metadata")
+	}
+	download.downloadURL = item.DownloadURL
+	return nil
+}
+
+// part downloads one range of the file into w at its offset, retrying failed attempts
+func (download *parallelDownload) part(ctx context.Context, part byteRange, w io.WriterAt, tracker *uploadTracker) error {
+	var err error
+	for attempt := 1; attempt <= maxPartAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(time.Duration(attempt-1) * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var expired bool
+		expired, err = download.fetchPart(ctx, part, w, tracker)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if expired {
+			if refreshErr := download.refreshURL(download.url()); refreshErr != nil {
+				return fmt.Errorf("failed to refresh download URL: %v", refreshErr)
+			}
+		}
+	}
+	return fmt.Errorf("failed to download bytes %d-%d after %d attempts: %w", part.start, part.end, maxPartAttempts, err)
+}
+
+// fetchPart makes one attempt at downloading a range; it reports whether the download URL expired
+func (download *parallelDownload) fetchPart(ctx context.Context, part byteRange, w io.WriterAt, tracker *uploadTracker) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", download.url(), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create download request: %v", err)
+	}
+	// The download URL is pre-authenticated, so no Authorization header is sent
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", part.start, part.end))
+
+	release, err := download.client.acquireConnection(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	resp, err := download.client.send(ctx, download.httpClient, req)
+	if err != nil {
+		return false, fmt.Errorf("failed to download part: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusGone:
+		return true, fmt.Errorf("download URL expired: %w", parseGraphError(resp))
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		download.client.throttled()
+		return false, fmt.Errorf("failed to download part: %w", parseGraphError(resp))
+	default:
+		return false, fmt.Errorf("failed to download part: %w", parseGraphError(resp))
+	}
+
+	// Bytes of a failed attempt are downloaded again, so take them back out of the progress
+	size := part.end - part.start + 1
+	body := &progressReader{r: download.client.throttle(ctx, io.LimitReader(resp.Body, size)), tracker: tracker}
+	written, err := io.Copy(io.NewOffsetWriter(w, part.start), body)
+	if err == nil && written != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		tracker.add(-body.read.Load())
+		return false, fmt.Errorf("failed to download part: %v", err)
+	}
+	return false, nil
+}
+
+// uncoveredRanges returns the parts of a file of the given size that none of the completed
+// inclusive ranges cover, in order
+func uncoveredRanges(completed [][2]int64, size int64) []byteRange {
+	sorted := slices.Clone(completed)
+	slices.SortFunc(sorted, func(a, b [2]int64) int { return cmp.Compare(a[0], b[0]) })
+
+	var uncovered []byteRange
+	next := int64(0)
+	for _, r := range sorted {
+		if r[0] > next {
+			uncovered = append(uncovered, byteRange{start: next, end: min(r[0], size) - 1})
+		}
+		next = max(next, r[1]+1)
+		if next >= size {
+			return uncovered
+		}
+	}
+	if next < size {
+		uncovered = append(uncovered, byteRange{start: next, end: size - 1})
+	}
+	return uncovered
+}
+
+// rangesSize returns the number of bytes in a list of byte ranges
+func rangesSize(ranges []byteRange) int64 {
+	var size int64
+	for _, r := range ranges {
+		size += r.end - r.start + 1
+	}
+	return size
+}
+
+// progressWriter counts the bytes written to w into a tracker
+type progressWriter struct {
+	w       io.Writer
+	tracker *uploadTracker
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.tracker.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,108 @@
+package azure
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrNotAllowed is returned for operations the client's access policy forbids
+var ErrNotAllowed = errors.New("not allowed by the access policy")
+
+// Operations an AccessPolicy can allow
+const (
+	OpUpload   = "upload"   // Uploading files and setting their modification time
+	OpDownload = "download" // Downloading file contents
+	OpList     = "list"     // Listing folder contents
+	OpMkdir    = "mkdir"    // Creating folders
+	OpDelete   = "delete"   // Deleting items, to the recycle bin or permanently
+	OpCopy     = "copy"     // Server-side copies
+	OpShare    = "share"    // Creating sharing links
+)
+
+// AccessPolicy restricts what a client may do, so credentials shipped inside a distributed binary
+// can't be used for more than the binary needs. Looking up item metadata is always allowed, but
+// only inside Roots or on the way down to them.
+type AccessPolicy struct {
+	Operations []string // Allowed operations; anything not listed is refused
+	Roots      []string // Folders that path-based operations are confined to; empty allows the whole drive
+}
+
+// ParseAccessPolicy parses a comma-separated list of allowed operations and of root folders
+func ParseAccessPolicy(operations, roots string) (*AccessPolicy, error) {
+	policy := &AccessPolicy{}
+	for _, op := range strings.Split(operations, ",") {
+		op = strings.TrimSpace(op)
+		switch op {
+		case "":
+		case OpUpload, OpDownload, OpList, OpMkdir, OpDelete, OpCopy, OpShare:
+			policy.Operations = append(policy.Operations, op)
+		default:
+			return nil, fmt.Errorf("unknown operation '%s'", op)
+		}
+	}
+	for _, root := range strings.Split(roots, ",") {
+		if root = normalizePolicyPath(root); root != "" {
+			policy.Roots = append(policy.Roots, root)
+		}
+	}
+	return policy, nil
+}
+
+// UseAccessPolicy makes the client refuse operations the policy doesn't allow; nil allows everything
+func (client *AzureClient) UseAccessPolicy(policy *AccessPolicy) {
+	client.accessPolicy = policy
+}
+
+// checkAccess returns an error wrapping ErrNotAllowed unless the policy allows op on remotePath
+func (client *AzureClient) checkAccess(op, remotePath string) error {
+	policy := client.accessPolicy
+	if policy == nil {
+		return nil
+	}
+	if !slices.Contains(policy.Operations, op) {
+		return fmt.Errorf("%s: %w", op, ErrNotAllowed)
+	}
+	if !policy.inRoots(remotePath) {
+		return fmt.Errorf("%s of '%s' outside the allowed roots: %w", op, remotePath, ErrNotAllowed)
+	}
+	return nil
+}
+
+// checkLookup returns an error wrapping ErrNotAllowed unless remotePath is inside the policy's roots
+// or one of their parent folders
+func (client *AzureClient) checkLookup(remotePath string) error {
+	policy := client.accessPolicy
+	if policy == nil || policy.inRoots(remotePath) {
+		return nil
+	}
+
+	target := normalizePolicyPath(remotePath)
+	for _, root := range policy.Roots {
+		if target == "" || strings.HasPrefix(root, target+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("lookup of '%s' outside the allowed roots: %w", remotePath, ErrNotAllowed)
+}
+
+// inRoots reports whether remotePath is one of the policy's roots or inside one
+func (policy *AccessPolicy) inRoots(remotePath string) bool {
+	if len(policy.Roots) == 0 {
+		return true
+	}
+
+	target := normalizePolicyPath(remotePath)
+	for _, root := range policy.Roots {
+		if target == root || strings.HasPrefix(target, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePolicyPath cleans a drive path for comparison; OneDrive paths are case-insensitive
+func normalizePolicyPath(remotePath string) string {
+	return strings.ToLower(NewRemotePath(strings.TrimSpace(remotePath)).String())
+}
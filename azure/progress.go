@@ -0,0 +1,42 @@
+package azure
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// ProgressFunc receives the number of bytes transferred so far and the total size.
+// It is called concurrently from the upload workers.
+type ProgressFunc func(transferred, total int64)
+
+// uploadTracker counts the bytes sent for an upload and reports them to a ProgressFunc
+type uploadTracker struct {
+	transferred atomic.Int64
+	total       int64
+	progress    ProgressFunc
+}
+
+// add adjusts the transferred byte count; a negative n rolls back bytes of a failed attempt
+func (t *uploadTracker) add(n int64) {
+	if t == nil {
+		return
+	}
+	transferred := t.transferred.Add(n)
+	if t.progress != nil {
+		t.progress(transferred, t.total)
+	}
+}
+
+// progressReader counts the bytes read from r into a tracker
+type progressReader struct {
+	r       io.Reader
+	tracker *uploadTracker
+	read    atomic.Int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.read.Add(int64(n))
+	pr.tracker.add(int64(n))
+	return n, err
+}
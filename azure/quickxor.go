@@ -0,0 +1,64 @@
+package azure
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+)
+
+// quickXorDataSize is the period after which QuickXorHash maps bytes to the same bit offset again:
+// each byte is shifted 11 bits further into a 160-bit value than the one before it
+const quickXorDataSize = 11 * 160
+
+// quickXorState accumulates a QuickXorHash from parts of the content in any order. Every byte only
+// depends on its position and is combined with XOR, so chunks hashed separately, in parallel and out
+// of order can be merged into the hash of the whole content.
+type quickXorState struct {
+	data [quickXorDataSize]byte
+}
+
+// writeAt adds p, which starts at offset in the content
+func (state *quickXorState) writeAt(p []byte, offset int64) {
+	pos := int(offset % quickXorDataSize)
+	for len(p) > 0 {
+		n := subtle.XORBytes(state.data[pos:], state.data[pos:], p)
+		p = p[n:]
+		pos = 0
+	}
+}
+
+// merge adds the bytes hashed into other
+func (state *quickXorState) merge(other *quickXorState) {
+	subtle.XORBytes(state.data[:], state.data[:], other.data[:])
+}
+
+// sum returns the base64-encoded QuickXorHash of content of the given size, in the format Graph reports
+func (state *quickXorState) sum(size int64) string {
+	var h [21]byte
+	for i := 0; i < quickXorDataSize; i++ {
+		shift := (i * 11) % 160
+		shifted := int(state.data[i]) << (shift % 8)
+		h[shift/8] ^= byte(shifted)
+		h[shift/8+1] ^= byte(shifted >> 8)
+	}
+	h[0] ^= h[20]
+
+	for i := 0; i < 8; i++ {
+		h[12+i] ^= byte(uint64(size) >> (8 * i))
+	}
+	return base64.StdEncoding.EncodeToString(h[:20])
+}
+
+// hashingReader hashes the bytes read from r into state at their position in the content
+type hashingReader struct {
+	r      io.Reader
+	state  *quickXorState
+	offset int64
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.state.writeAt(p[:n], hr.offset)
+	hr.offset += int64(n)
+	return n, err
+}
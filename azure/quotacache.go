@@ -0,0 +1,122 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// QuotaCache caches drive quota results per remote for a fixed TTL.
+// If Path is set the cache is also persisted to disk so successive runs can share it.
+type QuotaCache struct {
+	TTL     time.Duration
+	Path    string
+	mu      sync.Mutex
+	entries map[string]quotaCacheEntry
+	loaded  bool
+}
+
+// quotaCacheEntry is a single cached quota result
+type quotaCacheEntry struct {
+	Quota     DriveQuota `json:"quota"`
+	FetchedAt time.Time  `json:"fetched_at"`
+}
+
+// NewQuotaCache creates a quota cache with the given TTL, optionally backed by a file
+func NewQuotaCache(ttl time.Duration, path string) *QuotaCache {
+	return &QuotaCache{
+		TTL:     ttl,
+		Path:    path,
+		entries: make(map[string]quotaCacheEntry),
+	}
+}
+
+// Get returns the cached quota for remote if it is younger than the TTL, otherwise it calls fetch and caches the result
+func (c *QuotaCache) Get(remote string, fetch func() (*DriveQuota, error)) (*DriveQuota, error) {
+	if c == nil || c.TTL <= 0 {
+		return fetch()
+	}
+
+	c.mu.Lock()
+	c.load()
+	entry, ok := c.entries[remote]
+	c.mu.Unlock()
+
+	if ok && time.Since(entry.FetchedAt) < c.TTL {
+		quota := entry.Quota
+		return &quota, nil
+	}
+
+	quota, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[remote] = quotaCacheEntry{Quota: *quota, FetchedAt: time.Now()}
+	if err := c.save(); err != nil {
+		fmt.Printf("Warning: failed to save quota cache: %v\n", err)
+	}
+	c.mu.Unlock()
+
+	return quota, nil
+}
+
+// Invalidate drops the cached quota for remote, e.g. after an upload changed it
+func (c *QuotaCache) Invalidate(remote string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	delete(c.entries, remote)
+	if err := c.save(); err != nil {
+		fmt.Printf("Warning: failed to save quota cache: %v\n", err)
+	}
+}
+
+// load reads the on-disk cache once; callers must hold c.mu
+func (c *QuotaCache) load() {
+	if c.entries == nil {
+		c.entries = make(map[string]quotaCacheEntry)
+	}
+	if c.loaded || c.Path == "" {
+		c.loaded = true
+		return
+	}
+	c.loaded = true
+
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return
+	}
+
+	var entries map[string]quotaCacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return
+	}
+	for remote, entry := range entries {
+		c.entries[remote] = entry
+	}
+}
+
+// save writes the cache to disk; callers must hold c.mu
+func (c *QuotaCache) save() error {
+	if c.Path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(c.Path, data, 0o600)
+}
@@ -0,0 +1,89 @@
+package azure
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// RemotePath is a path on a drive relative to its root, always with forward slashes and without
+// leading, trailing or repeated slashes, whatever the local OS uses. The root itself is "".
+type RemotePath string
+
+// NewRemotePath normalizes a path given in any form, e.g. built with filepath on Windows:
+// backslashes become slashes, surrounding slashes are dropped and . and .. elements are resolved
+func NewRemotePath(p string) RemotePath {
+	cleaned := path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	return RemotePath(strings.TrimPrefix(cleaned, "/"))
+}
+
+// JoinRemotePath joins path elements into a remote path, normalizing each of them
+func JoinRemotePath(elem ...string) RemotePath {
+	return NewRemotePath(strings.Join(elem, "/"))
+}
+
+// Join returns the path of elem below p
+func (p RemotePath) Join(elem ...string) RemotePath {
+	return JoinRemotePath(append([]string{string(p)}, elem...)...)
+}
+
+// Base returns the last element of the path, or "" for the root
+func (p RemotePath) Base() string {
+	return string(p[strings.LastIndex(string(p), "/")+1:])
+}
+
+// Dir returns the path of the folder containing p; the root's parent is the root
+func (p RemotePath) Dir() RemotePath {
+	if i := strings.LastIndex(string(p), "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// IsRoot reports whether p is the root of the drive
+func (p RemotePath) IsRoot() bool {
+	return p == ""
+}
+
+// Rel returns p relative to base, and false if p is not base or inside it. Like OneDrive, the
+// comparison ignores case.
+func (p RemotePath) Rel(base RemotePath) (RemotePath, bool) {
+	if base.IsRoot() {
+		return p, true
+	}
+	if strings.EqualFold(string(p), string(base)) {
+		return "", true
+	}
+	if len(p) > len(base) && p[len(base)] == '/' && strings.EqualFold(string(p[:len(base)]), string(base)) {
+		return p[len(base)+1:], true
+	}
+	return "", false
+}
+
+// String returns the path with forward slashes
+func (p RemotePath) String() string {
+	return string(p)
+}
+
+// escaped returns the path with each element escaped for use in a URL
+func (p RemotePath) escaped() string {
+	elements := strings.Split(string(p), "/")
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return strings.Join(elements, "/")
+}
+
+// itemURL returns the Graph URL of the item at remotePath on the drive with the given ID (the
+// user's own drive if empty), followed by suffix such as "/children"; the root has no path form
+// in Graph URLs, so it is addressed as root
+func itemURL(driveID, remotePath, suffix string) string {
+	p := NewRemotePath(remotePath)
+	if p.IsRoot() {
+		return driveURL(driveID) + "/root" + suffix
+	}
+	if suffix == "" {
+		return driveURL(driveID) + "/root:/" + p.escaped()
+	}
+	return driveURL(driveID) + "/root:/" + p.escaped() + ":" + suffix
+}
@@ -0,0 +1,129 @@
+package azure
+
+import "testing"
+
+func TestNewRemotePath(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want RemotePath
+	}{
+		{"slashes", "Public/builds/a.zip", "Public/builds/a.zip"},
+		{"backslashes", `Public\builds\a.zip`, "Public/builds/a.zip"},
+		{"mixed separators", `Public\builds/nightly\a.zip`, "Public/builds/nightly/a.zip"},
+		{"filepath.Join on Windows", `Public\builds\` + `sub\a.zip`, "Public/builds/sub/a.zip"},
+		{"drive-relative backslash", `\Public\a.zip`, "Public/a.zip"},
+		{"drive-relative slash", "/Public/a.zip", "Public/a.zip"},
+		{"trailing separators", `Public\builds\\`, "Public/builds"},
+		{"repeated separators", `Public\\builds//a.zip`, "Public/builds/a.zip"},
+		{"dot elements", `.\Public\.\a.zip`, "Public/a.zip"},
+		{"dot-dot elements", `Public\builds\..\ROMs\a.zip`, "Public/ROMs/a.zip"},
+		{"dot-dot above the root", `..\..\Public\a.zip`, "Public/a.zip"},
+		{"dot-dot to the root", `Public\..`, ""},
+		{"empty root", "", ""},
+		{"slash root", "/", ""},
+		{"backslash root", `\`, ""},
+		{"dot root", ".", ""},
+		{"spaces and symbols kept", `My Files\#1 100%.txt`, "My Files/#1 100%.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewRemotePath(tt.in); got != tt.want {
+				t.Errorf("NewRemotePath(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemotePathJoinDirBase(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     RemotePath
+		want     RemotePath
+		wantDir  RemotePath
+		wantBase string
+		wantRoot bool
+	}{
+		{"nested", JoinRemotePath("Public", `builds\nightly`, "a.zip"), "Public/builds/nightly/a.zip", "Public/builds/nightly", "a.zip", false},
+		{"join on root", RemotePath("").Join(`\Public\`, "a.zip"), "Public/a.zip", "Public", "a.zip", false},
+		{"top level", JoinRemotePath("", "a.zip"), "a.zip", "", "a.zip", false},
+		{"root", JoinRemotePath("", "/"), "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.path != tt.want {
+				t.Errorf("path = %q, want %q", tt.path, tt.want)
+			}
+			if got := tt.path.Dir(); got != tt.wantDir {
+				t.Errorf("Dir() = %q, want %q", got, tt.wantDir)
+			}
+			if got := tt.path.Base(); got != tt.wantBase {
+				t.Errorf("Base() = %q, want %q", got, tt.wantBase)
+			}
+			if got := tt.path.IsRoot(); got != tt.wantRoot {
+				t.Errorf("IsRoot() = %v, want %v", got, tt.wantRoot)
+			}
+		})
+	}
+}
+
+func TestRemotePathRel(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		base   string
+		want   RemotePath
+		wantOK bool
+	}{
+		{"inside", "Public/builds/a.zip", "Public", "builds/a.zip", true},
+		{"same", "Public/builds", "Public/builds", "", true},
+		{"different case", "public/BUILDS/a.zip", "Public/builds", "a.zip", true},
+		{"same but case", "PUBLIC", "public", "", true},
+		{"windows input", `Public\builds\a.zip`, `\Public\`, "builds/a.zip", true},
+		{"empty root base", "Public/a.zip", "", "Public/a.zip", true},
+		{"slash root base", "Public/a.zip", "/", "Public/a.zip", true},
+		{"sibling with common prefix", "Public2/a.zip", "Public", "", false},
+		{"outside", "Private/a.zip", "Public", "", false},
+		{"parent of base", "Public", "Public/builds", "", false},
+		{"dot-dot escapes base", "Public/../Private/a.zip", "Public", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := NewRemotePath(tt.path).Rel(NewRemotePath(tt.base))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Rel(%q, %q) = %q, %v, want %q, %v", tt.path, tt.base, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestItemURL(t *testing.T) {
+	const me = "https://graph.microsoft.com/v1.0/me/drive"
+	tests := []struct {
+		name    string
+		driveID string
+		path    string
+		suffix  string
+		want    string
+	}{
+		{"empty root", "", "", "", me + "/root"},
+		{"slash root", "", "/", "/children", me + "/root/children"},
+		{"backslash root", "", `\`, "", me + "/root"},
+		{"plain path", "", "Public/a.zip", "", me + "/root:/Public/a.zip"},
+		{"suffix", "", "Public/builds", "/children", me + "/root:/Public/builds:/children"},
+		{"windows path", "", `Public\builds\a.zip`, "", me + "/root:/Public/builds/a.zip"},
+		{"spaces", "", "My Files/a b.zip", "", me + "/root:/My%20Files/a%20b.zip"},
+		{"hash", "", "Public/#1.zip", "", me + "/root:/Public/%231.zip"},
+		{"percent", "", "Public/100%.zip", "", me + "/root:/Public/100%25.zip"},
+		{"question mark", "", "Public/a?.zip", "", me + "/root:/Public/a%3F.zip"},
+		{"all together", "", `My Files\#1 at 100%\a b.zip`, "/content", me + "/root:/My%20Files/%231%20at%20100%25/a%20b.zip:/content"},
+		{"drive ID", "b!abc/def", "Public/a.zip", "", "https://graph.microsoft.com/v1.0/drives/b%21abc%2Fdef/root:/Public/a.zip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := itemURL(tt.driveID, tt.path, tt.suffix); got != tt.want {
+				t.Errorf("itemURL(%q, %q, %q) = %q, want %q", tt.driveID, tt.path, tt.suffix, got, tt.want)
+			}
+		})
+	}
+}
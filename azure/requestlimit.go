@@ -0,0 +1,117 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestLimit caps the Graph requests of a client: how many start per second and how many are in
+// progress at once, counting a request until its response body is closed; 0 leaves either unlimited
+type RequestLimit struct {
+	PerSecond  float64
+	Concurrent int
+}
+
+// requestLimiter spaces out the requests of a client and bounds how many are in progress, shared by
+// all its workers
+type requestLimiter struct {
+	limit RequestLimit
+	slots chan struct{} // Requests in progress (nil for no limit)
+	mu    sync.Mutex
+	next  time.Time // When the next request may start
+}
+
+// UseRequestLimit applies limit to all Graph requests of the client, shared by all uploads, downloads
+// and metadata requests in progress, so batch jobs stay below Graph's throttling thresholds; a
+// zero limit removes it
+func (client *AzureClient) UseRequestLimit(limit RequestLimit) {
+	client.requests = nil
+	if limit.PerSecond <= 0 && limit.Concurrent <= 0 {
+		return
+	}
+	client.requests = &requestLimiter{limit: limit}
+	if limit.Concurrent > 0 {
+		client.requests.slots = make(chan struct{}, limit.Concurrent)
+	}
+}
+
+// start waits until the limit allows another request and returns the function that ends it
+func (limiter *requestLimiter) start(ctx context.Context) (func(), error) {
+	if limiter.slots != nil {
+		select {
+		case limiter.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if limiter.slots != nil {
+			<-limiter.slots
+		}
+	}
+
+	if limiter.limit.PerSecond > 0 {
+		// Each request reserves the next start time, so waiting requests go out evenly spaced
+		limiter.mu.Lock()
+		now := time.Now()
+		start := limiter.next
+		if start.Before(now) {
+			start = now
+		}
+		limiter.next = start.Add(time.Duration(float64(time.Second) / limiter.limit.PerSecond))
+		limiter.mu.Unlock()
+
+		if delay := time.Until(start); delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return release, nil
+}
+
+// startRequest waits within ctx until the client's request limit allows another request and returns
+// the function that ends it
+func (client *AzureClient) startRequest(ctx context.Context) (func(), error) {
+	if client.requests == nil {
+		return func() {}, nil
+	}
+	return client.requests.start(ctx)
+}
+
+// send sends a Graph request once the client's request limit allows it, waiting within ctx rather
+// than the request's own deadline; the request counts as in progress until its response body is closed
+func (client *AzureClient) send(ctx context.Context, httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	release, err := client.startRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.httpDo(httpClient, req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseOnClose ends a request's slot once its response body has been closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (body *releaseOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
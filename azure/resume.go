@@ -0,0 +1,141 @@
+package azure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// uploadState is the persisted state of an upload session, used to resume it after the process dies
+type uploadState struct {
+	UploadURL       string     `json:"upload_url"`
+	FilePath        string     `json:"file_path"`
+	RemoteFilePath  string     `json:"remote_file_path"`
+	FileSize        int64      `json:"file_size"`
+	ModTime         time.Time  `json:"mod_time"`
+	CompletedRanges [][2]int64 `json:"completed_ranges"`
+	path            string
+	mu              sync.Mutex
+}
+
+// uploadStatePath returns the state file used for uploading filePath to remotePath
+func uploadStatePath(stateDir, filePath, remotePath string) string {
+	if absPath, err := filepath.Abs(filePath); err == nil {
+		filePath = absPath
+	}
+	sum := sha256.Sum256([]byte(filePath + "\n" + remotePath))
+	return filepath.Join(stateDir, "upload-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadUploadState reads a previously persisted upload state
+func loadUploadState(path string) (*uploadState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse upload state: %v", err)
+	}
+	state.path = path
+	return &state, nil
+}
+
+// matches reports whether the state was recorded for the same version of the local file
+func (state *uploadState) matches(fileInfo os.FileInfo) bool {
+	return state.FileSize == fileInfo.Size() && state.ModTime.Equal(fileInfo.ModTime())
+}
+
+// markCompleted records a successfully uploaded range and persists the state
+func (state *uploadState) markCompleted(start, end int64) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.CompletedRanges = append(state.CompletedRanges, [2]int64{start, end})
+	return state.saveLocked()
+}
+
+// save persists the state to disk
+func (state *uploadState) save() error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	return state.saveLocked()
+}
+
+// saveLocked writes the state atomically; callers must hold state.mu
+func (state *uploadState) saveLocked() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(state.path), 0o700); err != nil {
+		return err
+	}
+
+	tmpPath := state.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, state.path)
+}
+
+// remove deletes the state file, and the state directory if nothing else is left in it
+func (state *uploadState) remove() {
+	os.Remove(state.path)
+	os.Remove(filepath.Dir(state.path))
+}
+
+// SavedUpload is an upload session persisted in a state directory, so -resume can continue it
+type SavedUpload struct {
+	FilePath       string
+	RemoteFilePath string
+	FileSize       int64
+	Saved          time.Time // When the upload last made progress
+	state          *uploadState
+}
+
+// SavedUploads lists the upload sessions persisted in stateDir; state files that can't be read are skipped
+func SavedUploads(stateDir string) ([]SavedUpload, error) {
+	paths, err := filepath.Glob(filepath.Join(stateDir, "upload-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []SavedUpload
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		state, err := loadUploadState(path)
+		if err != nil {
+			continue
+		}
+		uploads = append(uploads, SavedUpload{
+			FilePath:       state.FilePath,
+			RemoteFilePath: state.RemoteFilePath,
+			FileSize:       state.FileSize,
+			Saved:          info.ModTime(),
+			state:          state,
+		})
+	}
+	return uploads, nil
+}
+
+// AbortSavedUpload cancels a persisted upload session so OneDrive discards the bytes it received, and
+// removes its state. A session that already expired only has its state removed.
+func (client *AzureClient) AbortSavedUpload(httpClient *http.Client, upload SavedUpload) error {
+	if err := client.DeleteUploadSession(httpClient, upload.state.UploadURL); err != nil {
+		return err
+	}
+	upload.state.remove()
+	return nil
+}
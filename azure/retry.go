@@ -0,0 +1,235 @@
+package azure
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryRule is how often and how long to wait before retrying one class of errors. The delay
+// doubles with every attempt up to MaxDelay; without a MaxDelay it stays constant. Every delay is
+// randomized by up to 20% either way so parallel workers don't retry in lockstep.
+type RetryRule struct {
+	MaxRetries int
+	Delay      time.Duration
+	MaxDelay   time.Duration
+}
+
+// RetryPolicy holds a retry rule per class of error
+type RetryPolicy struct {
+	Throttled RetryRule // 429 and 503 responses: Graph asks us to slow down
+	Network   RetryRule // Connection failures, timeouts and stalled transfers
+	Server    RetryRule // Other 5xx responses
+	Other     RetryRule // Everything else, e.g. unexpected 4xx responses
+}
+
+// Error classes a RetryPolicy distinguishes
+const (
+	ErrorClassThrottled = "throttled"
+	ErrorClassNetwork   = "network"
+	ErrorClassServer    = "server"
+	ErrorClassOther     = "other"
+)
+
+// DefaultRetryPolicy returns the built-in policy: many long retries when throttled, fast retries for
+// network errors and a few for server errors
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Throttled: RetryRule{MaxRetries: 10, Delay: 30 * time.Second, MaxDelay: 5 * time.Minute},
+		Network:   RetryRule{MaxRetries: 5, Delay: time.Second, MaxDelay: 30 * time.Second},
+		Server:    RetryRule{MaxRetries: 3, Delay: 5 * time.Second, MaxDelay: time.Minute},
+		Other:     RetryRule{MaxRetries: 3, Delay: 5 * time.Second},
+	}
+}
+
+// UniformRetryPolicy returns a policy that treats every class of error the same
+func UniformRetryPolicy(maxRetries int, delay time.Duration) RetryPolicy {
+	rule := RetryRule{MaxRetries: maxRetries, Delay: delay}
+	return RetryPolicy{Throttled: rule, Network: rule, Server: rule, Other: rule}
+}
+
+// ParseRetryRule parses a rule written as "retries:delay[:max-delay]", e.g. "10:30s:5m"
+func ParseRetryRule(value string) (RetryRule, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return RetryRule{}, fmt.Errorf("invalid retry rule '%s': expected retries:delay[:max-delay]", value)
+	}
+
+	var rule RetryRule
+	var err error
+	if rule.MaxRetries, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil || rule.MaxRetries < 0 {
+		return RetryRule{}, fmt.Errorf("invalid retry count in '%s'", value)
+	}
+	if rule.Delay, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil {
+		return RetryRule{}, fmt.Errorf("invalid retry delay in '%s': %v", value, err)
+	}
+	if len(parts) == 3 {
+		if rule.MaxDelay, err = time.ParseDuration(strings.TrimSpace(parts[2])); err != nil {
+			return RetryRule{}, fmt.Errorf("invalid maximum retry delay in '%s': %v", value, err)
+		}
+	}
+	return rule, nil
+}
+
+// Rule returns the rule for an error class
+func (policy RetryPolicy) Rule(class string) RetryRule {
+	switch class {
+	case ErrorClassThrottled:
+		return policy.Throttled
+	case ErrorClassNetwork:
+		return policy.Network
+	case ErrorClassServer:
+		return policy.Server
+	default:
+		return policy.Other
+	}
+}
+
+// backoff returns the jittered delay before the given retry attempt (1-based)
+func (rule RetryRule) backoff(attempt int) time.Duration {
+	delay := rule.Delay
+	if rule.MaxDelay > 0 {
+		for i := 1; i < attempt && delay < rule.MaxDelay; i++ {
+			delay *= 2
+		}
+		return min(jitter(min(delay, rule.MaxDelay)), rule.MaxDelay)
+	}
+	return jitter(delay)
+}
+
+// jitter randomizes delay by up to 20% either way
+func jitter(delay time.Duration) time.Duration {
+	spread := delay / 5
+	if spread <= 0 {
+		return delay
+	}
+	return delay - spread + rand.N(2*spread+1)
+}
+
+// ClassifyError returns the retry class of an error returned by a Graph request
+func ClassifyError(err error) string {
+	graphErr, ok := AsGraphError(err)
+	if !ok {
+		return ErrorClassNetwork
+	}
+	switch {
+	case graphErr.StatusCode == http.StatusTooManyRequests || graphErr.StatusCode == http.StatusServiceUnavailable:
+		return ErrorClassThrottled
+	case graphErr.StatusCode >= 500:
+		return ErrorClassServer
+	default:
+		return ErrorClassOther
+	}
+}
+
+// retryTracker counts the attempts made per error class against a policy
+type retryTracker struct {
+	policy   RetryPolicy
+	attempts map[string]int
+}
+
+// newRetryTracker starts counting retries against policy
+func newRetryTracker(policy RetryPolicy) *retryTracker {
+	return &retryTracker{policy: policy, attempts: make(map[string]int)}
+}
+
+// next records a failure and returns how long to wait before retrying, or false once the
+// rule for the error's class has no retries left. Throttled requests wait at least as long as
+// the Retry-After header asked for.
+func (tracker *retryTracker) next(err error) (string, int, time.Duration, bool) {
+	class := ClassifyError(err)
+	rule := tracker.policy.Rule(class)
+
+	tracker.attempts[class]++
+	attempt := tracker.attempts[class]
+	if attempt > rule.MaxRetries {
+		return class, attempt, 0, false
+	}
+
+	delay := rule.backoff(attempt)
+	if graphErr, ok := AsGraphError(err); ok && graphErr.RetryAfter > delay {
+		delay = graphErr.RetryAfter
+	}
+	return class, attempt, delay, true
+}
+
+// defaultMetadataRetry is how throttled metadata requests are retried unless UseMetadataRetry says otherwise
+var defaultMetadataRetry = RetryRule{MaxRetries: 5, Delay: 2 * time.Second, MaxDelay: time.Minute}
+
+// UseMetadataRetry sets how metadata requests (lookups, listings, folder creation and the like) are
+// retried when Graph throttles them; a rule without retries disables it
+func (client *AzureClient) UseMetadataRetry(rule RetryRule) {
+	client.metadataRetry = &rule
+}
+
+// do sends a metadata request within the metadata timeout, retrying it when Graph throttles it with a 429 or 503 response after
+// the Retry-After delay or the backoff of the metadata retry rule, whichever is longer. Throttled
+// requests were not processed, so retrying is safe for any method; a request body is only replayed if
+// the request can recreate it.
+func (client *AzureClient) do(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	rule := defaultMetadataRetry
+	if client.metadataRetry != nil {
+		rule = *client.metadataRetry
+	}
+
+	for attempt := 1; ; attempt++ {
+		// Wait for the request limit before the request's own deadline starts running
+		release, err := client.startRequest(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		attemptReq, cancel := withTimeout(req, client.timeouts.Metadata)
+		resp, err := client.httpDo(httpClient, attemptReq)
+		if err != nil {
+			cancel()
+			release()
+			return nil, err
+		}
+		resp.Body = &releaseOnClose{ReadCloser: &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}, release: release}
+		if !isThrottledStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		client.throttled()
+		if attempt > rule.MaxRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+
+		delay := rule.backoff(attempt)
+		if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > delay {
+			delay = retryAfter
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		fmt.Printf("Request throttled (%s), retrying in %s (attempt %d/%d)...\n", resp.Status, delay.Round(time.Millisecond), attempt, rule.MaxRetries)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
@@ -0,0 +1,328 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// chunk is a byte range of an upload. Chunks of a stream carry their bytes in data since the stream
+// can't be read again; chunks of a file are read from the session's file as they are sent.
+type chunk struct {
+	byteRange
+	data   []byte
+	hashed bool // Already added to the upload's hash, so uploading it doesn't hash it again
+}
+
+// reader returns the bytes of the chunk
+func (c chunk) reader(session *uploadSession) io.Reader {
+	if c.data != nil {
+		return bytes.NewReader(c.data)
+	}
+	return io.NewSectionReader(session.file, c.start, c.end-c.start+1)
+}
+
+// slice returns the part of the chunk covering r, which must lie within it
+func (c chunk) slice(r byteRange) chunk {
+	part := chunk{byteRange: r}
+	if c.data != nil {
+		part.data = c.data[r.start-c.start : r.end-c.start+1]
+	}
+	return part
+}
+
+// uploadSession holds the state shared by all chunk uploads of a file
+type uploadSession struct {
+	ctx            context.Context
+	file           io.ReaderAt // Chunks are read from here as they are sent
+	uploadURL      string
+	totalSize      int64
+	tracker        *uploadTracker
+	minSpeed       int64
+	minSpeedWindow time.Duration
+	timeout        time.Duration             // Deadline of each chunk request (0 for none)
+	bandwidth      *rateLimiter              // Limit of this upload alone, from UploadParams.Bandwidth (nil for none)
+	item           atomic.Pointer[DriveItem] // The uploaded item, from the response to the last chunk
+
+	// QuickXorHash of the bytes sent, built from the chunks as they are uploaded (nil if not needed)
+	hash       *quickXorState
+	hashMu     sync.Mutex
+	hashFailed bool
+}
+
+// addHash merges the hash of a successfully uploaded chunk into the hash of the upload
+func (session *uploadSession) addHash(state *quickXorState) {
+	session.hashMu.Lock()
+	defer session.hashMu.Unlock()
+	session.hash.merge(state)
+}
+
+// quickXorHash returns the hash of the uploaded content, or false if it couldn't be computed
+func (session *uploadSession) quickXorHash() (string, bool) {
+	session.hashMu.Lock()
+	defer session.hashMu.Unlock()
+	if session.hash == nil || session.hashFailed {
+		return "", false
+	}
+	return session.hash.sum(session.totalSize), true
+}
+
+// watchSpeed cancels a chunk request whose transfer rate stays below the session's speed floor
+// for a full window; it returns once the body has been sent or done is closed
+func (session *uploadSession) watchSpeed(body *progressReader, size int64, cancel context.CancelFunc, done <-chan struct{}, stalled *atomic.Bool) {
+	windowTicks := int(session.minSpeedWindow / time.Second)
+	if windowTicks < 1 {
+		windowTicks = 1
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Bytes read at each tick, covering the last window
+	var samples []int64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		read := body.read.Load()
+		if read >= size {
+			// Everything is sent; the server may legitimately take a while to respond
+			return
+		}
+
+		samples = append(samples, read)
+		if len(samples) <= windowTicks {
+			continue
+		}
+		samples = samples[len(samples)-windowTicks-1:]
+
+		rate := float64(samples[len(samples)-1]-samples[0]) / float64(windowTicks)
+		if rate < float64(session.minSpeed) {
+			stalled.Store(true)
+			cancel()
+			return
+		}
+	}
+}
+
+// byteRange represents an inclusive range of bytes within a file
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// rangeMismatchError is returned when the upload session rejects the Content-Range of a chunk
+type rangeMismatchError struct {
+	*GraphError
+}
+
+func (e *rangeMismatchError) Error() string {
+	return fmt.Sprintf("upload session rejected chunk range, %v", e.GraphError)
+}
+
+func (e *rangeMismatchError) Unwrap() error {
+	return e.GraphError
+}
+
+// isRangeMismatch reports whether err indicates that the session expected a different byte range
+func isRangeMismatch(err error) bool {
+	var mismatch *rangeMismatchError
+	return errors.As(err, &mismatch)
+}
+
+// maxSessionRenewals is how often an upload starts over on a new session after the previous one expired
+const maxSessionRenewals = 3
+
+// isSessionExpired reports whether err means the upload session no longer exists; Graph answers
+// requests to an expired or deleted session with 404
+func isSessionExpired(err error) bool {
+	graphErr, ok := AsGraphError(err)
+	return ok && (graphErr.StatusCode == http.StatusNotFound || graphErr.StatusCode == http.StatusGone)
+}
+
+// getNextExpectedRanges queries the upload session for the byte ranges it is still waiting for
+func (client *AzureClient) getNextExpectedRanges(httpClient *http.Client, uploadURL string) ([]string, error) {
+	req, err := http.NewRequest("GET", uploadURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload session status request: %v", err)
+	}
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upload session: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query upload session: %w", parseGraphError(resp))
+	}
+
+	var status struct {
+		NextExpectedRanges []string `json:"nextExpectedRanges"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse upload session status: %v", err)
+	}
+
+	return status.NextExpectedRanges, nil
+}
+
+// parseExpectedRanges converts Graph's "start-end" / "start-" range strings into byte ranges
+func parseExpectedRanges(ranges []string, totalSize int64) ([]byteRange, error) {
+	parsed := make([]byteRange, 0, len(ranges))
+	for _, r := range ranges {
+		parts := strings.SplitN(r, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid expected range: %q", r)
+		}
+
+		start, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expected range %q: %v", r, err)
+		}
+
+		end := totalSize - 1
+		if parts[1] != "" {
+			end, err = strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expected range %q: %v", r, err)
+			}
+		}
+
+		parsed = append(parsed, byteRange{start: start, end: end})
+	}
+	return parsed, nil
+}
+
+// missingRanges returns the parts of [start, end] that are still listed in the expected ranges
+func missingRanges(expected []byteRange, start, end int64) []byteRange {
+	var missing []byteRange
+	for _, r := range expected {
+		lo, hi := r.start, r.end
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo <= hi {
+			missing = append(missing, byteRange{start: lo, end: hi})
+		}
+	}
+	return missing
+}
+
+// DeleteUploadSession cancels an upload session so OneDrive discards the bytes it received; the
+// upload URL is pre-authenticated, so no access token is sent
+func (client *AzureClient) DeleteUploadSession(httpClient *http.Client, uploadURL string) error {
+	req, err := http.NewRequest("DELETE", uploadURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create upload session delete request: %v", err)
+	}
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload session: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete upload session: %w", parseGraphError(resp))
+	}
+	return nil
+}
+
+// uploadChunkRealigned uploads a chunk and, if the session rejects its range, re-queries
+// nextExpectedRanges and only sends the bytes of the chunk that the session is still missing.
+// A retry of a failed chunk starts with the query, since the failed attempt may have delivered part
+// of the chunk before the connection dropped.
+func (client *AzureClient) uploadChunkRealigned(httpClient *http.Client, session *uploadSession, c chunk, retry bool) (bool, error) {
+	if retry {
+		return client.uploadMissing(httpClient, session, c)
+	}
+
+	success, err := client.uploadChunk(httpClient, session, c)
+	if success || !isRangeMismatch(err) {
+		return success, err
+	}
+
+	fmt.Printf("Chunk %d-%d was rejected (%v), realigning with upload session...\n", c.start, c.end, err)
+	success, realignErr := client.uploadMissing(httpClient, session, c)
+	if realignErr != nil {
+		return false, fmt.Errorf("%v (realign failed: %v)", err, realignErr)
+	}
+	return success, nil
+}
+
+// uploadMissing queries nextExpectedRanges and sends the parts of a chunk the session hasn't received
+func (client *AzureClient) uploadMissing(httpClient *http.Client, session *uploadSession, c chunk) (bool, error) {
+	start, end := c.start, c.end
+	ranges, err := client.getNextExpectedRanges(httpClient, session.uploadURL)
+	if err != nil {
+		return false, err
+	}
+
+	expected, err := parseExpectedRanges(ranges, session.totalSize)
+	if err != nil {
+		return false, err
+	}
+
+	// Anything of this chunk that is no longer expected has already been received
+	var received int64 = end - start + 1
+	for _, r := range missingRanges(expected, start, end) {
+		received -= r.end - r.start + 1
+	}
+	session.tracker.add(received)
+
+	// The received part was sent by an attempt whose response got lost, so it was never hashed;
+	// hash the whole chunk from its source instead of only the parts sent below
+	var hash *quickXorState
+	if session.hash != nil && !c.hashed {
+		hash = &quickXorState{}
+		if _, err := io.Copy(io.Discard, &hashingReader{r: c.reader(session), state: hash, offset: start}); err != nil {
+			session.hashMu.Lock()
+			session.hashFailed = true
+			session.hashMu.Unlock()
+		}
+	}
+
+	// Parts sent before a failure are counted again by the next query, so take them back out of the progress
+	sent := received
+	for _, r := range missingRanges(expected, start, end) {
+		part := c.slice(r)
+		part.hashed = true
+		if success, err := client.uploadChunk(httpClient, session, part); !success {
+			session.tracker.add(-sent)
+			return false, err
+		}
+		sent += r.end - r.start + 1
+	}
+
+	if hash != nil {
+		session.addHash(hash)
+	}
+	return true, nil
+}
+
+// splitRanges splits byte ranges into chunks of at most chunkSize bytes
+func splitRanges(ranges []byteRange, chunkSize int64) []byteRange {
+	var chunks []byteRange
+	for _, r := range ranges {
+		for start := r.start; start <= r.end; start += chunkSize {
+			chunks = append(chunks, byteRange{start: start, end: min(start+chunkSize-1, r.end)})
+		}
+	}
+	return chunks
+}
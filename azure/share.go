@@ -0,0 +1,120 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// SharingLink represents a sharing link created for a drive item
+type SharingLink struct {
+	Type   string `json:"type"`
+	Scope  string `json:"scope"`
+	WebURL string `json:"webUrl"`
+}
+
+// CreateLink creates (or returns the existing) sharing link of the given type ("view", "edit" or "embed")
+// and scope ("anonymous" or "organization") for the item with the given ID
+func (client *AzureClient) CreateLink(httpClient *http.Client, itemID, linkType, scope string) (*SharingLink, error) {
+	// Ensure the access token is valid
+	if err := client.EnsureTokenValid(httpClient); err != nil {
+		return nil, err
+	}
+
+	// Lookups are allowed on the way down to the roots, so an ID may belong to a folder above them;
+	// the item's own path has to be inside them
+	if client.accessPolicy != nil {
+		var remotePath string
+		if slices.Contains(client.accessPolicy.Operations, OpShare) && len(client.accessPolicy.Roots) > 0 {
+			var err error
+			if remotePath, err = client.itemPath(httpClient, itemID); err != nil {
+				return nil, err
+			}
+		}
+		if err := client.checkAccess(OpShare, remotePath); err != nil {
+			return nil, err
+		}
+	}
+
+	requestBody := map[string]string{"type": linkType}
+	if scope != "" {
+		requestBody["scope"] = scope
+	}
+	body, _ := json.Marshal(requestBody)
+
+	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s/createLink", itemID)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sharing link request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sharing link: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 201 for a new link, 200 if an identical link already existed
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to create sharing link: %w", parseGraphError(resp))
+	}
+
+	var response struct {
+		Link SharingLink `json:"link"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to parse sharing link response: %v", err)
+	}
+
+	return &response.Link, nil
+}
+
+// itemPath returns the path on the drive of the item with the given ID
+func (client *AzureClient) itemPath(httpClient *http.Client, itemID string) (string, error) {
+	requestURL := fmt.Sprintf("https://graph.microsoft.com/v1.0/me/drive/items/%s?$select=name,parentReference", url.PathEscape(itemID))
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+client.currentToken())
+
+	resp, err := client.do(httpClient, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch item metadata: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch item metadata: %w", parseGraphError(resp))
+	}
+
+	var item struct {
+		Name            string `json:"name"`
+		ParentReference struct {
+			Path string `json:"path"` // e.g. /drive/root:/Folder, percent-encoded; missing for the root itself
+		} `json:"parentReference"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return "", fmt.Errorf("failed to parse item metadata: %v", err)
+	}
+
+	if item.ParentReference.Path == "" {
+		return "", nil
+	}
+	parent, ok := strings.CutPrefix(item.ParentReference.Path, "/drive/root:")
+	if !ok {
+		return "", fmt.Errorf("item '%s' is not in the drive's folders: %w", itemID, ErrNotAllowed)
+	}
+	if unescaped, err := url.PathUnescape(parent); err == nil {
+		parent = unescaped
+	}
+	return JoinRemotePath(parent, item.Name).String(), nil
+}
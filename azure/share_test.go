@@ -0,0 +1,93 @@
+package azure
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateLinkChecksAllowedRoots(t *testing.T) {
+	// Parent paths as Graph reports them; the root item has none
+	items := map[string]struct{ name, parent string }{
+		"root":    {"root", ""},
+		"public":  {"Public", "/drive/root:"},
+		"file":    {"a b.txt", "/drive/root:/Public/My%20Docs"},
+		"private": {"Private", "/drive/root:"},
+		"similar": {"Publicity", "/drive/root:"},
+		"shared":  {"Public", "/drives/other/root:"},
+	}
+	var links int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strings.CutPrefix(r.URL.Path, "/v1.0/me/drive/items/")
+		if id, ok := strings.CutSuffix(id, "/createLink"); ok && r.Method == http.MethodPost {
+			links++
+			json.NewEncoder(w).Encode(map[string]any{"link": map[string]string{"type": "view", "webUrl": "https://example.com/" + id}})
+			return
+		}
+		item, ok := items[id]
+		if !ok || r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": "itemNotFound"}})
+			return
+		}
+		body := map[string]any{"id": id, "name": item.name}
+		if item.parent != "" {
+			body["parentReference"] = map[string]string{"path": item.parent}
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	httpClient := &http.Client{Transport: rewriteHost{target: target}}
+
+	tests := []struct {
+		name    string
+		ops     string
+		roots   string
+		itemID  string
+		allowed bool
+	}{
+		{"no policy", "", "", "root", true},
+		{"file inside a root", "share", "Public", "file", true},
+		{"the root folder itself", "share", "/public/", "public", true},
+		{"folder above the root", "share", "Public/My Docs", "public", false},
+		{"drive root", "share", "Public", "root", false},
+		{"folder outside the roots", "share", "Public", "private", false},
+		{"name sharing a prefix", "share", "Public", "similar", false},
+		{"item of another drive", "share", "Public", "shared", false},
+		{"share not allowed", "upload,list", "Public", "file", false},
+		{"anywhere without roots", "share", "", "root", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &AzureClient{AccessToken: "token", Expiration: time.Now().Add(time.Hour)}
+			if tt.name != "no policy" {
+				policy, err := ParseAccessPolicy(tt.ops, tt.roots)
+				if err != nil {
+					t.Fatal(err)
+				}
+				client.UseAccessPolicy(policy)
+			}
+
+			links = 0
+			link, err := client.CreateLink(httpClient, tt.itemID, "view", "")
+			if tt.allowed {
+				if err != nil || link == nil || links != 1 {
+					t.Fatalf("CreateLink() = %v, %v after %d link requests, want a link", link, err, links)
+				}
+				return
+			}
+			if !errors.Is(err, ErrNotAllowed) {
+				t.Errorf("CreateLink() error = %v, want ErrNotAllowed", err)
+			}
+			if links != 0 {
+				t.Errorf("CreateLink() sent %d link requests despite being refused", links)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package azure
+
+import "sync/atomic"
+
+// Stats counts what a client has done since it was created, for monitoring long runs
+type Stats struct {
+	UploadedBytes      int64 // Bytes of chunks Graph accepted
+	ChunkRetries       int64 // Chunk uploads retried after an error
+	TokenRefreshes     int64 // Access tokens refreshed
+	ThrottledResponses int64 // 429 and 503 responses to any request
+	ActiveTransfers    int64 // Chunk uploads and download parts in progress right now
+}
+
+// clientStats holds the counters behind Stats, updated by all workers of a client
+type clientStats struct {
+	uploadedBytes      atomic.Int64
+	chunkRetries       atomic.Int64
+	tokenRefreshes     atomic.Int64
+	throttledResponses atomic.Int64
+}
+
+// Stats returns the client's counters as of now
+func (client *AzureClient) Stats() Stats {
+	client.throttling.mu.Lock()
+	active := client.throttling.chunks.inFlight
+	client.throttling.mu.Unlock()
+
+	return Stats{
+		UploadedBytes:      client.stats.uploadedBytes.Load(),
+		ChunkRetries:       client.stats.chunkRetries.Load(),
+		TokenRefreshes:     client.stats.tokenRefreshes.Load(),
+		ThrottledResponses: client.stats.throttledResponses.Load(),
+		ActiveTransfers:    int64(active),
+	}
+}
+
+// throttled records a throttled response and lowers the client's parallelism while Graph throttles it
+func (client *AzureClient) throttled() {
+	client.stats.throttledResponses.Add(1)
+	client.throttling.throttled()
+}
@@ -0,0 +1,131 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How the number of transfers in progress adapts to throttling: it is halved when Graph throttles a
+// request, at most once per throttleCooldown since the transfers in progress at the time of a burst of
+// 429 responses are all answered alike, and raised by one per throttleRampInterval without throttling
+// until it is back to where it was
+const (
+	throttleCooldown     = 5 * time.Second
+	throttleRampInterval = 30 * time.Second
+)
+
+// transferSlots counts the transfers of one kind in progress
+type transferSlots struct {
+	inFlight int
+	max      int // Fixed limit, e.g. from UseConnectionLimit (0 for none)
+}
+
+// throttleControl bounds the chunk uploads, download parts and batch files a client transfers at
+// once, lowering the bound while Graph throttles the client; the zero value doesn't limit anything
+type throttleControl struct {
+	mu         sync.Mutex
+	chunks     transferSlots // Chunk uploads and parallel download parts
+	files      transferSlots // Files of batch uploads, each with its own chunk workers
+	limit      int           // Transfers of each kind allowed at once while throttled (0 when not throttled)
+	peak       int           // Chunk transfers in progress when throttling started, which ramping up returns to
+	lastChange time.Time
+	lastHit    time.Time     // When Graph last throttled a request
+	wake       chan struct{} // Closed when a transfer ends or the limit rises, to wake waiting transfers
+}
+
+// acquire waits until another transfer of the kind counted by slots may start and returns the
+// function that ends it
+func (control *throttleControl) acquire(ctx context.Context, slots *transferSlots) (func(), error) {
+	for {
+		control.mu.Lock()
+		if (slots.max == 0 || slots.inFlight < slots.max) && (control.limit == 0 || slots.inFlight < control.limit) {
+			slots.inFlight++
+			control.mu.Unlock()
+			return func() { control.release(slots) }, nil
+		}
+		if control.wake == nil {
+			control.wake = make(chan struct{})
+		}
+		wake := control.wake
+		control.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release ends a transfer started by acquire, raising the limit if throttling has eased
+func (control *throttleControl) release(slots *transferSlots) {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+
+	slots.inFlight--
+	if control.limit > 0 && time.Since(control.lastChange) >= throttleRampInterval {
+		control.limit++
+		control.lastChange = time.Now()
+		if control.limit >= control.peak {
+			control.limit = 0
+			fmt.Println("Throttling has eased, transferring at full parallelism again.")
+		} else {
+			fmt.Printf("Throttling has eased, transferring up to %d at once.\n", control.limit)
+		}
+	}
+	if control.wake != nil {
+		close(control.wake)
+		control.wake = nil
+	}
+}
+
+// throttled halves the number of transfers allowed at once after Graph throttled a request
+func (control *throttleControl) throttled() {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+
+	control.lastHit = time.Now()
+	current := control.limit
+	if current == 0 {
+		current = control.chunks.inFlight
+	}
+	reduced := max(current/2, 1)
+	if reduced >= current || time.Since(control.lastChange) < throttleCooldown {
+		return
+	}
+	if control.limit == 0 {
+		control.peak = current
+	}
+	control.limit = reduced
+	control.lastChange = time.Now()
+	fmt.Printf("Graph is throttling requests, transferring up to %d at once until it eases.\n", reduced)
+}
+
+// active reports whether Graph is throttling the client: its transfers are held below their usual
+// parallelism, or it throttled a request within the last throttleCooldown
+func (control *throttleControl) active() bool {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	return control.limit > 0 || (!control.lastHit.IsZero() && time.Since(control.lastHit) < throttleCooldown)
+}
+
+// isThrottledStatus reports whether a response status means Graph is throttling the client
+func isThrottledStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// AcquireFile waits until throttling allows another file of a batch upload to start and returns the
+// function that ends it. Batch uploads call it for each file, so that throttling reduces the number of
+// files in progress along with the number of chunks.
+func (client *AzureClient) AcquireFile(ctx context.Context) (func(), error) {
+	return client.throttling.acquire(ctx, &client.throttling.files)
+}
+
+// Throttled reports whether Graph is throttling the client right now, so work that can go elsewhere,
+// such as the pending files of a batch upload, doesn't have to wait for the throttling to ease
+func (client *AzureClient) Throttled() bool {
+	return client.throttling.active()
+}
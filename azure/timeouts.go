@@ -0,0 +1,41 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Timeouts bound how long a single request may take, so slow links can take as long as they need
+// for data while a hung metadata request still fails fast; zero means no limit
+type Timeouts struct {
+	Metadata time.Duration // Token refreshes, lookups, listings, session creation and other small requests
+	Data     time.Duration // Each chunk upload, counted per attempt
+}
+
+// UseTimeouts sets the per-request timeouts of the client
+func (client *AzureClient) UseTimeouts(timeouts Timeouts) {
+	client.timeouts = timeouts
+}
+
+// withTimeout returns req bound to a deadline of timeout, and the function that releases it
+func withTimeout(req *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	if timeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
+
+// cancelOnClose releases a request's deadline once its response body has been closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
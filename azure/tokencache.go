@@ -0,0 +1,178 @@
+package azure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TokenCache persists refreshed tokens, encrypted, so successive runs don't each pay a refresh round trip.
+// The key is derived from a random key kept per user in a file only the user can read, so copies of
+// the cache and the config alone can't decrypt it. It doesn't protect the tokens from other programs
+// running as the same user, which can read the key file too.
+type TokenCache struct {
+	Path string
+	key  [32]byte
+}
+
+// cachedToken is the encrypted payload stored in the token cache
+type cachedToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiration   time.Time `json:"expiration"`
+}
+
+// tokenCacheKeySize is the size of the per-user key, an AES-256 key
+const tokenCacheKeySize = 32
+
+// UseTokenCache enables the token cache at path: a cached token newer than the configured one is
+// loaded immediately, and every token refreshed afterwards is written back
+func (client *AzureClient) UseTokenCache(path, remoteConfig string) error {
+	userKey, err := loadTokenCacheKey()
+	if err != nil {
+		return fmt.Errorf("failed to load token cache key: %v", err)
+	}
+	cache := &TokenCache{
+		Path: path,
+		key:  sha256.Sum256([]byte("ksau-token-cache\x00" + string(userKey) + "\x00" + remoteConfig + "\x00" + client.ClientID)),
+	}
+	return client.UseTokenStore(cache)
+}
+
+// tokenCacheKeyPath returns the file that holds the per-user token cache key, in the user's config
+// directory
+func tokenCacheKeyPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "ksau-go", "token-cache.key"), nil
+}
+
+// loadTokenCacheKey reads the per-user token cache key, generating it on first use. The file is
+// created with mode 0600 in a 0700 directory, and linked into place so concurrent first runs all end
+// up with the same key.
+func loadTokenCacheKey() ([]byte, error) {
+	path, err := tokenCacheKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	if key, err := os.ReadFile(path); err == nil && len(key) == tokenCacheKeySize {
+		return key, nil
+	} else if err == nil {
+		return nil, fmt.Errorf("%s is corrupted; delete it to generate a new key", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key := make([]byte, tokenCacheKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".token-cache.key-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(key)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Another process may have created the key in the meantime; its key wins
+	if err := os.Link(tmp.Name(), path); errors.Is(err, os.ErrExist) {
+		return os.ReadFile(path)
+	} else if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadToken reads the cached token, or returns nil if nothing is cached yet
+func (cache *TokenCache) LoadToken() (*Token, error) {
+	token, err := cache.load()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Token{AccessToken: token.AccessToken, TokenType: "Bearer", RefreshToken: token.RefreshToken, Expiry: token.Expiration}, nil
+}
+
+// load reads and decrypts the cached token
+func (cache *TokenCache) load() (*cachedToken, error) {
+	data, err := os.ReadFile(cache.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cache.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("token cache is corrupted")
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token cache: %v", err)
+	}
+
+	var token cachedToken
+	if err := json.Unmarshal(plaintext, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token cache: %v", err)
+	}
+	return &token, nil
+}
+
+// SaveToken encrypts and writes the token to the cache
+func (cache *TokenCache) SaveToken(token *Token) error {
+	plaintext, err := json.Marshal(cachedToken{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken, Expiration: token.Expiry})
+	if err != nil {
+		return err
+	}
+
+	gcm, err := cache.cipher()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cache.Path), 0o700); err != nil {
+		return err
+	}
+
+	tmpPath := cache.Path + ".tmp"
+	if err := os.WriteFile(tmpPath, gcm.Seal(nonce, nonce, plaintext, nil), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, cache.Path)
+}
+
+// cipher returns the AES-GCM cipher for the cache key
+func (cache *TokenCache) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cache.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
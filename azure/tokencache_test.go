@@ -0,0 +1,55 @@
+package azure
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenCacheKey(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	cachePath := filepath.Join(t.TempDir(), "token-oned.cache")
+
+	client := &AzureClient{ClientID: "id", ClientSecret: "secret"}
+	if err := client.UseTokenCache(cachePath, "oned"); err != nil {
+		t.Fatalf("UseTokenCache failed: %v", err)
+	}
+	token := &Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour).Round(time.Second)}
+	if err := client.persisters[0].SaveToken(token); err != nil {
+		t.Fatalf("SaveToken failed: %v", err)
+	}
+
+	keyPath, err := tokenCacheKeyPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatalf("key file not created: %v", err)
+	}
+	if info.Size() != tokenCacheKeySize {
+		t.Errorf("key file has %d bytes, want %d", info.Size(), tokenCacheKeySize)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("key file mode = %v, want 0600", perm)
+	}
+
+	// Another run of the same user reads the token back with the same key
+	reloaded := &AzureClient{ClientID: "id", ClientSecret: "secret"}
+	if err := reloaded.UseTokenCache(cachePath, "oned"); err != nil {
+		t.Fatalf("UseTokenCache failed on reload: %v", err)
+	}
+	if reloaded.RefreshToken != "refresh" || !reloaded.Expiration.Equal(token.Expiry) {
+		t.Errorf("reloaded token = %q expiring %v", reloaded.RefreshToken, reloaded.Expiration)
+	}
+
+	// With the same config but another user's key, the cache can't be decrypted
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	other := &AzureClient{ClientID: "id", ClientSecret: "secret"}
+	if err := other.UseTokenCache(cachePath, "oned"); err == nil {
+		t.Errorf("cache decrypted with another user's key, got refresh token %q", other.RefreshToken)
+	}
+}
@@ -0,0 +1,56 @@
+package azure
+
+import "fmt"
+
+// TokenPersister saves the tokens an AzureClient refreshes so they outlive the process, e.g. by writing
+// them back to the config they were loaded from
+type TokenPersister interface {
+	SaveToken(token *Token) error
+}
+
+// TokenStore keeps a client's tokens in external storage such as a database, keyring or secret
+// manager. LoadToken returns nil without an error if nothing has been stored yet.
+type TokenStore interface {
+	TokenPersister
+	LoadToken() (*Token, error)
+}
+
+// AddTokenPersister registers a persister that every refreshed token is saved to
+func (client *AzureClient) AddTokenPersister(persister TokenPersister) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.persisters = append(client.persisters, persister)
+}
+
+// UseTokenStore loads the token kept in store if it is newer than the client's current one, and saves
+// every token refreshed afterwards to it
+func (client *AzureClient) UseTokenStore(store TokenStore) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.persisters = append(client.persisters, store)
+
+	token, err := store.LoadToken()
+	if err != nil {
+		return err
+	}
+
+	if token != nil && token.Expiry.After(client.Expiration) {
+		client.AccessToken = token.AccessToken
+		client.RefreshToken = token.RefreshToken
+		client.Expiration = token.Expiry
+	}
+	return nil
+}
+
+// NewAzureClientFromTokenStore initializes an AzureClient whose tokens live entirely in store,
+// for programs that don't keep an rclone config
+func NewAzureClientFromTokenStore(clientID, clientSecret string, store TokenStore) (*AzureClient, error) {
+	client := &AzureClient{ClientID: clientID, ClientSecret: clientSecret}
+	if err := client.UseTokenStore(store); err != nil {
+		return nil, fmt.Errorf("failed to load token: %w", err)
+	}
+	if client.RefreshToken == "" {
+		return nil, fmt.Errorf("no token found in the token store")
+	}
+	return client, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// bandwidthSlot is the bandwidth limit from a time of day until the next slot of a schedule
+type bandwidthSlot struct {
+	start time.Duration // Since midnight
+	rate  int64         // Bytes/s, 0 for no limit
+}
+
+// parseBandwidth parses a -bwlimit value: a single rate such as 4M, or a schedule of
+// HH:MM,rate entries such as "08:00,1M 23:00,off" where each rate applies from its time of day
+// until the next entry's, wrapping around midnight. A rate of "off" means no limit. In a daemon
+// job, the job's own limit replaces it and the daemon's maximum caps it.
+func parseBandwidth(value string) (azure.BandwidthFunc, error) {
+	limit, err := parseBandwidthSchedule(value)
+	if err != nil {
+		return nil, err
+	}
+	return runningJobLimits.bandwidth(limit, runningMaxLimits), nil
+}
+
+// parseBandwidthSchedule parses a -bwlimit value as given
+func parseBandwidthSchedule(value string) (azure.BandwidthFunc, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "off" {
+		return nil, nil
+	}
+
+	if !strings.Contains(value, ",") {
+		rate, err := parseSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth limit '%s': %v", value, err)
+		}
+		return func(time.Time) int64 { return rate }, nil
+	}
+
+	var slots []bandwidthSlot
+	for _, entry := range strings.Fields(value) {
+		clock, rateValue, ok := strings.Cut(entry, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid bandwidth schedule entry '%s': expected HH:MM,rate", entry)
+		}
+		start, err := time.Parse("15:04", clock)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time in bandwidth schedule entry '%s': expected HH:MM", entry)
+		}
+
+		var rate int64
+		if rateValue != "off" {
+			if rate, err = parseSize(rateValue); err != nil {
+				return nil, fmt.Errorf("invalid rate in bandwidth schedule entry '%s': %v", entry, err)
+			}
+		}
+		slots = append(slots, bandwidthSlot{start: time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute, rate: rate})
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].start < slots[j].start })
+
+	return func(now time.Time) int64 {
+		sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+		// Before the first entry of the day, the last entry of the previous day still applies
+		rate := slots[len(slots)-1].rate
+		for _, slot := range slots {
+			if slot.start > sinceMidnight {
+				break
+			}
+			rate = slot.rate
+		}
+		return rate
+	}, nil
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// Conflict resolution strategies of bisync, for files changed on both sides since the last run
+const (
+	conflictNewer    = "newer"     // The side modified last wins
+	conflictKeepBoth = "keep-both" // The remote version keeps the name, the local one is kept as a conflict copy
+	conflictPrompt   = "prompt"    // Ask for every conflict
+)
+
+// bisyncEntry is the state of a file when both sides last agreed on it
+type bisyncEntry struct {
+	Size         int64     `json:"size"`
+	QuickXorHash string    `json:"quickxorhash"`
+	ModTime      time.Time `json:"mod_time"` // Local modification time, to notice local changes without hashing
+}
+
+// bisyncSnapshot records the files of a local/remote folder pair after the last bisync run
+type bisyncSnapshot struct {
+	LocalDir   string                 `json:"local_dir"`
+	RemotePath string                 `json:"remote_path"`
+	SyncedAt   time.Time              `json:"synced_at"`
+	Files      map[string]bisyncEntry `json:"files"`
+	path       string
+}
+
+// bisyncAction is what a bisync run does with one file
+type bisyncAction struct {
+	rel  string
+	kind string // "upload", "download", "delete-remote", "delete-local" or "keep-both"
+}
+
+// runBisync implements the bisync command, which synchronizes a local and a remote folder in both
+// directions. A snapshot of the last run tells which side changed a file; files changed on both
+// sides are resolved with the -conflict strategy.
+func runBisync(args []string) int {
+	fs := flag.NewFlagSet("bisync", flag.ExitOnError)
+	conflict := fs.String("conflict", conflictKeepBoth, "How to resolve files changed on both sides: newer, keep-both or prompt (default: 'keep-both')")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be transferred and deleted (default: false)")
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	parallelChunks := fs.Int("parallel", 1, "Number of parallel chunks to upload (default: 1)")
+	bwLimit := fs.String("bwlimit", "", "Limit the transfer rate in bytes/s, e.g. 4M, or follow a schedule such as \"08:00,1M 23:00,off\" (default: no limit)")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification of uploaded files (default: false)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	noDelta := fs.Bool("no-delta", false, "List the whole remote folder instead of only fetching the changes since the last run (default: false)")
+	maxDelete := fs.String("max-delete", "50%", "Refuse to delete more than this many files on either side, or this percentage of the files of the last run, e.g. 100 or 25% (default: '50%')")
+	force := fs.Bool("force", false, "Apply the changes even if they exceed -max-delete (default: false)")
+	trashDir := fs.String("trash-dir", "", "Directory to move deleted local files to instead of deleting them (default: <state-dir>/bisync-trash)")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for the sync snapshots, saved remote trees and cached tokens (default: '.ksau-state')")
+	filterOptions := registerFilterFlags(fs)
+	registerConfigFlag(fs)
+	registerMetricsFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Println("Usage: ksau-go bisync [flags] <local-dir> <remote:dir>")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	if *conflict != conflictNewer && *conflict != conflictKeepBoth && *conflict != conflictPrompt {
+		fmt.Printf("Error: unknown conflict strategy '%s'\n", *conflict)
+		return exitUsage
+	}
+	if *stateDir == "" {
+		fmt.Println("Error: bisync needs a -state-dir to keep its snapshot in")
+		return exitUsage
+	}
+	deleteLimit, err := parseDeleteLimit(*maxDelete)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	if *trashDir == "" {
+		*trashDir = filepath.Join(*stateDir, "bisync-trash")
+	}
+	localDir := longPath(fs.Arg(0))
+
+	info, err := os.Stat(localDir)
+	if err != nil || !info.IsDir() {
+		fmt.Printf("Error: '%s' is not a local directory\n", fs.Arg(0))
+		return exitUsage
+	}
+
+	filter, err := filterOptions.build()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	bandwidth, err := parseBandwidth(*bwLimit)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, fs.Arg(1))
+	if code != exitOK {
+		return code
+	}
+	if err := startMetricsServer(); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	client.UseBandwidthLimit(bandwidth)
+	remoteDir := paths[0]
+
+	configData, _ := loadConfig()
+	remote, _ := resolveRemote(configData, fs.Arg(1), *remoteConfig)
+	retryPolicy, err := remoteRetryPolicy(configData, remote, azure.DefaultRetryPolicy())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	snapshotPath := bisyncSnapshotPath(*stateDir, localDir, remote, remoteDir)
+	snapshot, err := loadBisyncSnapshot(snapshotPath)
+	if err != nil {
+		fmt.Println("Failed to load sync snapshot:", err)
+		return exitFailure
+	}
+	if snapshot.SyncedAt.IsZero() {
+		fmt.Println("No previous sync found; files on only one side are copied to the other.")
+	}
+	snapshot.LocalDir = fs.Arg(0)
+	snapshot.RemotePath = filepath.ToSlash(remoteDir)
+
+	httpClient := &http.Client{}
+
+	fmt.Printf("Listing %s...\n", remoteDir)
+	treeDir := *stateDir
+	if *noDelta {
+		treeDir = ""
+	}
+	remoteFiles, err := listRemoteFiles(client, httpClient, treeDir, remote, remoteDir)
+	if err != nil {
+		if graphErr, ok := azure.AsGraphError(err); !ok || graphErr.StatusCode != http.StatusNotFound {
+			printError("Failed to list remote folder", err)
+			return exitCodeFor(err)
+		}
+		// A folder that synced before and is gone now was more likely moved, renamed or mistyped than
+		// emptied; treating it as empty would delete every local file
+		if len(snapshot.Files) > 0 {
+			fmt.Printf("%sError: remote folder '%s' doesn't exist, but the last sync had %d files in it. If it was moved or renamed, "+
+				"sync with its new path; to start over, delete %s%s\n", ColorRed, remoteDir, len(snapshot.Files), snapshotPath, ColorReset)
+			return exitNotFound
+		}
+		remoteFiles = make(map[string]azure.DriveItem)
+	}
+
+	localFiles := make(map[string]os.FileInfo)
+	ignores, err := walkLocal(localDir, filter, func(rel string, d os.DirEntry) error {
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		localFiles[rel] = info
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Failed to walk directory:", err)
+		return exitFailure
+	}
+	// Excluded and ignored files are left alone on both sides and dropped from the snapshot
+	removeExcluded(remoteFiles, filter, ignores)
+	localSizes := make(map[string]int64)
+	for rel, info := range localFiles {
+		localSizes[rel] = info.Size()
+	}
+	tooLargeOrSmall := sizeExcluded(filter, localSizes, remoteFiles)
+	for rel := range tooLargeOrSmall {
+		delete(localFiles, rel)
+		delete(remoteFiles, rel)
+	}
+
+	// Every file either side has now or had at the last run
+	var rels []string
+	seen := make(map[string]bool)
+	for _, files := range []map[string]bool{keys(localFiles), keys(remoteFiles), keys(snapshot.Files)} {
+		for rel := range files {
+			if !seen[rel] && filter.includes(rel) && !ignores.ignoredPath(rel) && !tooLargeOrSmall[rel] {
+				seen[rel] = true
+				rels = append(rels, rel)
+			}
+		}
+	}
+	sort.Strings(rels)
+
+	var actions []bisyncAction
+	for _, rel := range rels {
+		kind, err := bisyncDecide(rel, localDir, localFiles, remoteFiles, snapshot.Files, *conflict, *dryRun)
+		if err != nil {
+			fmt.Printf("Failed to compare '%s': %v\n", rel, err)
+			return exitFailure
+		}
+		if kind != "" {
+			fmt.Printf("%-14s %s\n", kind+":", rel)
+			actions = append(actions, bisyncAction{rel: rel, kind: kind})
+		}
+	}
+
+	fmt.Printf("%d changes to apply\n", len(actions))
+	if !allowDeletes(actions, len(snapshot.Files), deleteLimit, *force) {
+		return exitFailure
+	}
+	if *dryRun {
+		return exitOK
+	}
+
+	// Ctrl+C stops the upload and cleans up its session instead of killing the process mid-transfer
+	gracefulShutdown.Store(true)
+
+	opts := uploadOptions{
+		remoteConfig:   remote,
+		chunkSize:      *chunkSize,
+		parallelChunks: *parallelChunks,
+		retryPolicy:    retryPolicy,
+		skipHash:       *skipHash,
+		hashRetries:    5,
+		hashRetryDelay: 10 * time.Second,
+		conflict:       azure.ConflictReplace,
+	}
+	run := &bisyncRun{client: client, httpClient: httpClient, opts: opts, localDir: localDir, remoteDir: remoteDir, remoteFiles: remoteFiles,
+		trashDir: filepath.Join(*trashDir, time.Now().Format("2006-01-02_150405"))}
+
+	// Files whose action failed keep their old snapshot entry, so the change is picked up again next time
+	exitCode := exitOK
+	failed := make(map[string]bool)
+	for _, action := range actions {
+		if interrupted.Err() != nil {
+			exitCode = exitInterrupted
+			failed[action.rel] = true
+			continue
+		}
+		if err := run.apply(action); err != nil {
+			printError(fmt.Sprintf("Failed to %s '%s'", action.kind, action.rel), err)
+			failed[action.rel] = true
+			exitCode = exitCodeFor(err)
+		}
+	}
+
+	// Record what both sides agree on now
+	files := make(map[string]bisyncEntry)
+	for _, rel := range rels {
+		if failed[rel] {
+			if entry, ok := snapshot.Files[rel]; ok {
+				files[rel] = entry
+			}
+			continue
+		}
+		entry, ok, err := run.entry(rel, remoteFiles, snapshot.Files)
+		if err != nil {
+			fmt.Printf("%sWarning: failed to record '%s' in the sync snapshot: %v%s\n", ColorYellow, rel, err, ColorReset)
+			continue
+		}
+		if ok {
+			files[rel] = entry
+		}
+	}
+	for _, conflictRel := range run.conflictCopies {
+		if entry, ok, err := run.entry(conflictRel, nil, nil); err == nil && ok {
+			files[conflictRel] = entry
+		}
+	}
+	snapshot.Files = files
+	snapshot.SyncedAt = time.Now().UTC()
+	if err := snapshot.save(); err != nil {
+		fmt.Println("Failed to save sync snapshot:", err)
+		return exitFailure
+	}
+
+	if run.trashed > 0 {
+		fmt.Printf("Moved %d deleted local files to %s\n", run.trashed, run.trashDir)
+	}
+	if len(failed) > 0 {
+		fmt.Printf("%sSync incomplete: %d of %d changes failed%s\n", ColorRed, len(failed), len(actions), ColorReset)
+		return exitCode
+	}
+	fmt.Printf("%sSync complete: %d changes applied%s\n", ColorGreen, len(actions), ColorReset)
+	return exitOK
+}
+
+// bisyncDecide compares a file on both sides with the snapshot and returns what to do with it,
+// or "" if nothing needs to change
+func bisyncDecide(rel, localDir string, localFiles map[string]os.FileInfo, remoteFiles map[string]azure.DriveItem, previous map[string]bisyncEntry, conflict string, dryRun bool) (string, error) {
+	local, inLocal := localFiles[rel]
+	item, inRemote := remoteFiles[rel]
+	entry, inSnapshot := previous[rel]
+	localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+
+	// A local file whose size and time match the snapshot is unchanged; one that was only touched
+	// still has the same hash
+	localChanged := inLocal != inSnapshot
+	if inLocal && inSnapshot && (local.Size() != entry.Size || !local.ModTime().Equal(entry.ModTime)) {
+		localChanged = true
+		if local.Size() == entry.Size {
+			hash, err := QuickXorHash(localPath)
+			if err != nil {
+				return "", err
+			}
+			localChanged = hash != entry.QuickXorHash
+		}
+	}
+	remoteChanged := inRemote != inSnapshot
+	if inRemote && inSnapshot {
+		remoteChanged = item.Size != entry.Size || remoteHash(&item) != entry.QuickXorHash
+	}
+
+	switch {
+	case !localChanged && !remoteChanged:
+		return "", nil
+	case localChanged && !remoteChanged:
+		if !inLocal {
+			return "delete-remote", nil
+		}
+		return "upload", nil
+	case remoteChanged && !localChanged:
+		if !inRemote {
+			return "delete-local", nil
+		}
+		return "download", nil
+	}
+
+	// Changed on both sides; a change wins over a deletion
+	switch {
+	case !inLocal && !inRemote:
+		return "", nil
+	case !inRemote:
+		return "upload", nil
+	case !inLocal:
+		return "download", nil
+	}
+
+	// The same change made on both sides isn't a conflict
+	same, err := sameContent(localPath, &item)
+	if err != nil {
+		return "", err
+	}
+	if same {
+		return "", nil
+	}
+
+	switch conflict {
+	case conflictNewer:
+		if local.ModTime().After(remoteModTime(&item)) {
+			return "upload", nil
+		}
+		return "download", nil
+	case conflictPrompt:
+		if dryRun {
+			return "conflict", nil
+		}
+		return askConflict(rel), nil
+	default:
+		return "keep-both", nil
+	}
+}
+
+// askConflict asks which version of a file changed on both sides to keep
+func askConflict(rel string) string {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("%s'%s' changed on both sides. Keep [l]ocal, [r]emote or [b]oth? %s", ColorYellow, rel, ColorReset)
+		answer, err := reader.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "l", "local":
+			return "upload"
+		case "r", "remote":
+			return "download"
+		case "b", "both":
+			return "keep-both"
+		}
+		if err != nil {
+			// No answer can be read, so keep both rather than lose either version
+			return "keep-both"
+		}
+	}
+}
+
+// bisyncRun applies the actions of a bisync run
+type bisyncRun struct {
+	client         *azure.AzureClient
+	httpClient     *http.Client
+	opts           uploadOptions
+	localDir       string
+	remoteDir      string
+	remoteFiles    map[string]azure.DriveItem // Remote files as listed before the run
+	conflictCopies []string                   // Conflict copies of local files uploaded by keep-both
+	trashDir       string                     // Where local files deleted by this run are moved to
+	trashed        int
+}
+
+// apply carries out one action
+func (run *bisyncRun) apply(action bisyncAction) error {
+	localPath := filepath.Join(run.localDir, filepath.FromSlash(action.rel))
+	remotePath := remoteJoin(run.remoteDir, action.rel)
+
+	switch action.kind {
+	case "upload":
+		return run.upload(action.rel)
+	case "download":
+		return run.download(action.rel)
+	case "delete-remote":
+		return run.client.Delete(run.httpClient, remotePath)
+	case "delete-local":
+		if err := moveFile(localPath, filepath.Join(run.trashDir, filepath.FromSlash(action.rel))); err != nil {
+			return err
+		}
+		run.trashed++
+		return nil
+	case "keep-both":
+		// The local version moves aside under a conflict name on both sides, making room for the remote one
+		conflictRel := conflictCopyName(action.rel)
+		if err := os.Rename(localPath, filepath.Join(run.localDir, filepath.FromSlash(conflictRel))); err != nil {
+			return err
+		}
+		fmt.Printf("Keeping the local version as %s\n", conflictRel)
+		if err := run.upload(conflictRel); err != nil {
+			return err
+		}
+		run.conflictCopies = append(run.conflictCopies, conflictRel)
+		return run.download(action.rel)
+	}
+	return fmt.Errorf("unknown action '%s'", action.kind)
+}
+
+// upload uploads a local file over the remote one
+func (run *bisyncRun) upload(rel string) error {
+	remotePath := remoteJoin(run.remoteDir, rel)
+	if _, err := run.client.EnsureFolder(run.httpClient, azure.NewRemotePath(remotePath).Dir().String()); err != nil {
+		return err
+	}
+	_, err := uploadEntry(run.client, run.httpClient, run.opts, filepath.Join(run.localDir, filepath.FromSlash(rel)), remotePath)
+	return err
+}
+
+// download replaces a local file with the remote one, writing to a temporary file first so an
+// interrupted download doesn't destroy the local version
+func (run *bisyncRun) download(rel string) error {
+	localPath := filepath.Join(run.localDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(localPath), ".ksau-bisync-*")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Downloading %s...\n", rel)
+	_, err = run.client.Download(run.httpClient, remoteJoin(run.remoteDir, rel), tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), localPath); err != nil {
+		return err
+	}
+
+	// The local copy keeps the remote modification time, so a later run doesn't see it as newer
+	if item, ok := run.remoteFiles[rel]; ok {
+		setLocalModTime(localPath, &item)
+	}
+	return nil
+}
+
+// entry returns the snapshot entry of a file both sides now agree on, or false if it exists on neither
+func (run *bisyncRun) entry(rel string, remoteFiles map[string]azure.DriveItem, previous map[string]bisyncEntry) (bisyncEntry, bool, error) {
+	info, err := os.Stat(filepath.Join(run.localDir, filepath.FromSlash(rel)))
+	if os.IsNotExist(err) {
+		return bisyncEntry{}, false, nil
+	}
+	if err != nil {
+		return bisyncEntry{}, false, err
+	}
+
+	// Reuse a hash that is known to describe the current content instead of reading the file again
+	hash := ""
+	if item, ok := remoteFiles[rel]; ok && item.Size == info.Size() {
+		if old, ok := previous[rel]; ok && old.QuickXorHash == remoteHash(&item) && old.ModTime.Equal(info.ModTime()) {
+			hash = old.QuickXorHash
+		}
+	}
+	if hash == "" {
+		if hash, err = QuickXorHash(filepath.Join(run.localDir, filepath.FromSlash(rel))); err != nil {
+			return bisyncEntry{}, false, err
+		}
+	}
+	return bisyncEntry{Size: info.Size(), QuickXorHash: hash, ModTime: info.ModTime()}, true, nil
+}
+
+// deleteLimit is the most files a bisync run may delete on either side: count files, or percent of
+// the files of the last run
+type deleteLimit struct {
+	count   int
+	percent float64
+}
+
+// parseDeleteLimit parses a -max-delete value, a number of files or a percentage such as 25%
+func parseDeleteLimit(value string) (deleteLimit, error) {
+	if number, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err := strconv.ParseFloat(number, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return deleteLimit{}, fmt.Errorf("invalid -max-delete '%s': expected a number of files or a percentage from 0%% to 100%%", value)
+		}
+		return deleteLimit{count: -1, percent: percent}, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return deleteLimit{}, fmt.Errorf("invalid -max-delete '%s': expected a number of files or a percentage from 0%% to 100%%", value)
+	}
+	return deleteLimit{count: count}, nil
+}
+
+// checkDeleteLimit returns an error if the actions delete more files on either side than the limit
+// allows, out of the previous files of the last run
+func checkDeleteLimit(actions []bisyncAction, previous int, limit deleteLimit) error {
+	deletes := make(map[string]int)
+	for _, action := range actions {
+		deletes[action.kind]++
+	}
+	for _, side := range []struct{ kind, name string }{{"delete-local", "local"}, {"delete-remote", "remote"}} {
+		n := deletes[side.kind]
+		switch {
+		case limit.count >= 0 && n > limit.count:
+			return fmt.Errorf("%d %s files would be deleted, more than -max-delete %d", n, side.name, limit.count)
+		case limit.count < 0 && n > 0 && float64(n) > float64(previous)*limit.percent/100:
+			return fmt.Errorf("%d of the %d files of the last run would be deleted on the %s side, more than -max-delete %g%%", n, previous, side.name, limit.percent)
+		}
+	}
+	return nil
+}
+
+// allowDeletes reports whether the actions may be applied: their deletes are within the limit, or
+// -force applies them anyway with a warning
+func allowDeletes(actions []bisyncAction, previous int, limit deleteLimit, force bool) bool {
+	err := checkDeleteLimit(actions, previous, limit)
+	if err == nil {
+		return true
+	}
+	if !force {
+		fmt.Printf("%sError: %v; nothing was changed. Check the paths and filters, or rerun with -force to apply the changes anyway%s\n", ColorRed, err, ColorReset)
+		return false
+	}
+	fmt.Printf("%sWarning: %v; applying them anyway because of -force%s\n", ColorYellow, err, ColorReset)
+	return true
+}
+
+// moveFile moves a file to dst, creating its folder, copying it if a rename can't cross filesystems
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	in.Close()
+	return os.Remove(src)
+}
+
+// conflictCopyName returns the name a local version is kept under when keeping both versions,
+// e.g. notes.txt becomes notes (local conflict 2006-01-02 150405).txt
+func conflictCopyName(rel string) string {
+	ext := filepath.Ext(rel)
+	return fmt.Sprintf("%s (local conflict %s)%s", strings.TrimSuffix(rel, ext), time.Now().Format("2006-01-02 150405"), ext)
+}
+
+// remoteHash returns the QuickXorHash of a remote file, or "" if Graph didn't report one
+func remoteHash(item *azure.DriveItem) string {
+	if item.File == nil {
+		return ""
+	}
+	return item.File.Hashes.QuickXorHash
+}
+
+// remoteModTime returns the client-side modification time of a remote file if it has one
+func remoteModTime(item *azure.DriveItem) time.Time {
+	if item.FileSystemInfo != nil && !item.FileSystemInfo.LastModifiedDateTime.IsZero() {
+		return item.FileSystemInfo.LastModifiedDateTime
+	}
+	return item.LastModifiedDateTime
+}
+
+// keys returns the set of keys of a map
+func keys[V any](m map[string]V) map[string]bool {
+	set := make(map[string]bool, len(m))
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+// bisyncSnapshotPath returns the snapshot file of a local/remote folder pair
+func bisyncSnapshotPath(stateDir, localDir, remote, remoteDir string) string {
+	if absPath, err := filepath.Abs(localDir); err == nil {
+		localDir = absPath
+	}
+	sum := sha256.Sum256([]byte(localDir + "\n" + remote + ":" + filepath.ToSlash(remoteDir)))
+	return filepath.Join(stateDir, "bisync-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadBisyncSnapshot reads the snapshot at path; a missing one is empty
+func loadBisyncSnapshot(path string) (*bisyncSnapshot, error) {
+	snapshot := &bisyncSnapshot{Files: make(map[string]bisyncEntry), path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if snapshot.Files == nil {
+		snapshot.Files = make(map[string]bisyncEntry)
+	}
+	return snapshot, nil
+}
+
+// save writes the snapshot atomically, so an interrupted run can't leave a truncated one behind
+func (snapshot *bisyncSnapshot) save() error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(snapshot.path), 0o700); err != nil {
+		return err
+	}
+
+	tmpPath := snapshot.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, snapshot.path)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// writeTestFile writes content to rel below dir with the given modification time
+func writeTestFile(t *testing.T, dir, rel, content string, modTime time.Time) string {
+	t.Helper()
+	filePath := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+// hashOf returns the QuickXorHash of content
+func hashOf(t *testing.T, content string) string {
+	t.Helper()
+	hash, err := QuickXorHash(writeTestFile(t, t.TempDir(), "hash", content, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestBisyncDecide(t *testing.T) {
+	base := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	later := base.Add(time.Hour)
+
+	// Empty contents mean the file doesn't exist on that side or in the snapshot of the last run
+	tests := []struct {
+		name       string
+		local      string
+		remote     string
+		snapshot   string
+		localTime  time.Time // Zero for base
+		remoteTime time.Time // Zero for base
+		conflict   string
+		dryRun     bool
+		want       string
+	}{
+		{name: "unchanged", local: "v1", remote: "v1", snapshot: "v1", want: ""},
+		{name: "only touched locally", local: "v1", remote: "v1", snapshot: "v1", localTime: later, want: ""},
+		{name: "changed locally", local: "v2", remote: "v1", snapshot: "v1", localTime: later, want: "upload"},
+		{name: "grown locally", local: "v1 and more", remote: "v1", snapshot: "v1", want: "upload"},
+		{name: "changed remotely", local: "v1", remote: "v2", snapshot: "v1", want: "download"},
+		{name: "deleted locally", remote: "v1", snapshot: "v1", want: "delete-remote"},
+		{name: "deleted remotely", local: "v1", snapshot: "v1", want: "delete-local"},
+		{name: "deleted locally, changed remotely", remote: "v2", snapshot: "v1", want: "download"},
+		{name: "deleted remotely, changed locally", local: "v2", snapshot: "v1", localTime: later, want: "upload"},
+		{name: "deleted on both sides", snapshot: "v1", want: ""},
+		{name: "new locally", local: "v1", want: "upload"},
+		{name: "new remotely", remote: "v1", want: "download"},
+		{name: "same change on both sides", local: "v2", remote: "v2", snapshot: "v1", localTime: later, want: ""},
+		{name: "same new file on both sides", local: "v1", remote: "v1", want: ""},
+		{name: "conflict keeps both", local: "v2", remote: "v3", snapshot: "v1", localTime: later, conflict: conflictKeepBoth, want: "keep-both"},
+		{name: "conflict, local newer", local: "v2", remote: "v3", snapshot: "v1", localTime: later, conflict: conflictNewer, want: "upload"},
+		{name: "conflict, remote newer", local: "v2", remote: "v3", snapshot: "v1", localTime: later, remoteTime: later.Add(time.Hour), conflict: conflictNewer, want: "download"},
+		{name: "conflict prompt on a dry run", local: "v2", remote: "v3", snapshot: "v1", localTime: later, conflict: conflictPrompt, dryRun: true, want: "conflict"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const rel = "docs/file.txt"
+			localDir := t.TempDir()
+			localFiles := make(map[string]os.FileInfo)
+			remoteFiles := make(map[string]azure.DriveItem)
+			previous := make(map[string]bisyncEntry)
+
+			if tt.local != "" {
+				localTime := tt.localTime
+				if localTime.IsZero() {
+					localTime = base
+				}
+				info, err := os.Stat(writeTestFile(t, localDir, rel, tt.local, localTime))
+				if err != nil {
+					t.Fatal(err)
+				}
+				localFiles[rel] = info
+			}
+			if tt.remote != "" {
+				remoteTime := tt.remoteTime
+				if remoteTime.IsZero() {
+					remoteTime = base
+				}
+				item := azure.DriveItem{Name: "file.txt", Size: int64(len(tt.remote)), LastModifiedDateTime: remoteTime, File: &azure.FileFacet{}}
+				item.File.Hashes.QuickXorHash = hashOf(t, tt.remote)
+				remoteFiles[rel] = item
+			}
+			if tt.snapshot != "" {
+				previous[rel] = bisyncEntry{Size: int64(len(tt.snapshot)), QuickXorHash: hashOf(t, tt.snapshot), ModTime: base}
+			}
+
+			got, err := bisyncDecide(rel, localDir, localFiles, remoteFiles, previous, tt.conflict, tt.dryRun)
+			if err != nil {
+				t.Fatalf("bisyncDecide() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("bisyncDecide() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDeleteLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    deleteLimit
+		wantErr bool
+	}{
+		{"50", deleteLimit{count: 50}, false},
+		{"0", deleteLimit{count: 0}, false},
+		{"25%", deleteLimit{count: -1, percent: 25}, false},
+		{"12.5%", deleteLimit{count: -1, percent: 12.5}, false},
+		{"0%", deleteLimit{count: -1, percent: 0}, false},
+		{"100%", deleteLimit{count: -1, percent: 100}, false},
+		{"101%", deleteLimit{}, true},
+		{"-5%", deleteLimit{}, true},
+		{"-1", deleteLimit{}, true},
+		{"1.5", deleteLimit{}, true},
+		{"%", deleteLimit{}, true},
+		{"many", deleteLimit{}, true},
+		{"", deleteLimit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDeleteLimit(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDeleteLimit(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseDeleteLimit(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// deleteActions returns local deletes, remote deletes and uploads of numbered files
+func deleteActions(local, remote, uploads int) []bisyncAction {
+	var actions []bisyncAction
+	for kind, n := range map[string]int{"delete-local": local, "delete-remote": remote, "upload": uploads} {
+		for i := 0; i < n; i++ {
+			actions = append(actions, bisyncAction{rel: kind + "/" + string(rune('a'+i)), kind: kind})
+		}
+	}
+	return actions
+}
+
+func TestCheckDeleteLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		actions  []bisyncAction
+		previous int
+		limit    string
+		wantErr  bool
+	}{
+		{"no deletes with a zero count", deleteActions(0, 0, 5), 10, "0", false},
+		{"one delete with a zero count", deleteActions(1, 0, 0), 10, "0", true},
+		{"count reached", deleteActions(2, 2, 0), 10, "2", false},
+		{"count exceeded locally", deleteActions(3, 0, 0), 10, "2", true},
+		{"count exceeded remotely", deleteActions(0, 3, 0), 10, "2", true},
+		{"uploads don't count", deleteActions(1, 1, 20), 10, "1", false},
+		{"percent reached on each side", deleteActions(2, 2, 0), 10, "20%", false},
+		{"percent exceeded", deleteActions(0, 3, 0), 10, "20%", true},
+		{"everything at 100%", deleteActions(10, 0, 0), 10, "100%", false},
+		{"no deletes at 0%", deleteActions(0, 0, 3), 10, "0%", false},
+		{"one delete at 0%", deleteActions(1, 0, 0), 10, "0%", true},
+		{"deletes without a last run", deleteActions(1, 0, 0), 0, "50%", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, err := parseDeleteLimit(tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkDeleteLimit(tt.actions, tt.previous, limit)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkDeleteLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllowDeletes(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []bisyncAction
+		force   bool
+		want    bool
+	}{
+		{"within the limit", deleteActions(1, 1, 0), false, true},
+		{"within the limit with -force", deleteActions(1, 1, 0), true, true},
+		{"over the limit", deleteActions(5, 0, 0), false, false},
+		{"over the limit with -force", deleteActions(5, 0, 0), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowDeletes(tt.actions, 10, deleteLimit{count: 2}, tt.force); got != tt.want {
+				t.Errorf("allowDeletes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBisyncDeleteLocalMovesToTrash(t *testing.T) {
+	localDir := t.TempDir()
+	trashDir := filepath.Join(t.TempDir(), "bisync-trash", "2026-01-02_030405")
+	run := &bisyncRun{localDir: localDir, trashDir: trashDir}
+
+	for _, rel := range []string{"top.txt", "docs/nested/file.txt"} {
+		writeTestFile(t, localDir, rel, "content of "+rel, time.Now())
+		if err := run.apply(bisyncAction{rel: rel, kind: "delete-local"}); err != nil {
+			t.Fatalf("apply(%s) error = %v", rel, err)
+		}
+		if _, err := os.Stat(filepath.Join(localDir, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+			t.Errorf("%s is still in the local folder: %v", rel, err)
+		}
+		content, err := os.ReadFile(filepath.Join(trashDir, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Fatalf("%s isn't in the trash: %v", rel, err)
+		}
+		if string(content) != "content of "+rel {
+			t.Errorf("trashed %s = %q", rel, content)
+		}
+	}
+	if run.trashed != 2 {
+		t.Errorf("trashed = %d, want 2", run.trashed)
+	}
+
+	// A missing file is an error and isn't counted
+	if err := run.apply(bisyncAction{rel: "missing.txt", kind: "delete-local"}); err == nil {
+		t.Error("apply() of a missing file succeeded")
+	}
+	if run.trashed != 2 {
+		t.Errorf("trashed = %d after a failed move, want 2", run.trashed)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "fmt"
+
+// runBot implements the bot command, which keeps running and uploads the files sent to a chat bot
+// of the platform named by its first argument
+func runBot(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Usage: ksau-go bot <telegram> [flags]")
+		return exitUsage
+	}
+	switch args[0] {
+	case "telegram":
+		return runTelegramBot(args[1:])
+	default:
+		fmt.Printf("Error: unknown bot platform '%s'; expected telegram\n", args[0])
+		return exitUsage
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// telegramDefaultAPI is the public Bot API, which only lets bots download files of up to 20 MB
+const telegramDefaultAPI = "https://api.telegram.org"
+
+// telegramDownloadLimit is the size of the largest file the public Bot API lets bots download
+const telegramDownloadLimit = 20 << 20
+
+// telegramBot uploads the documents sent to a Telegram bot and replies with their download URLs
+type telegramBot struct {
+	apiURL     string
+	token      string
+	httpClient *http.Client
+	client     *azure.AzureClient
+	opts       uploadOptions
+	remoteDir  string
+	allowed    map[int64]bool // Chats and users that may upload; empty allows everyone
+	slots      chan struct{}  // Limits the uploads running at the same time
+	wg         sync.WaitGroup
+}
+
+// telegramResponse is the envelope of every Bot API response
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// telegramUpdate is an incoming update; only messages are asked for
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+// telegramMessage is the part of a message the bot uses
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	From      *struct {
+		ID int64 `json:"id"`
+	} `json:"from"`
+	Chat struct {
+		ID   int64  `json:"id"`
+		Type string `json:"type"`
+	} `json:"chat"`
+	Text     string            `json:"text"`
+	Document *telegramDocument `json:"document"`
+}
+
+// telegramDocument is a file sent as a document
+type telegramDocument struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileName     string `json:"file_name"`
+	FileSize     int64  `json:"file_size"`
+}
+
+// runTelegramBot implements bot telegram, which uploads the documents sent to a Telegram bot into a
+// remote folder and replies to each with its download URL
+func runTelegramBot(args []string) int {
+	fs := flag.NewFlagSet("bot telegram", flag.ExitOnError)
+	token := fs.String("token", "", "Bot token from @BotFather (default: $KSAU_TELEGRAM_TOKEN)")
+	remoteFolder := fs.String("remote", "", "Remote folder to upload into, relative to the remote's root folder (default: the root folder)")
+	allow := fs.String("allow", "", "Comma-separated chat and user IDs that may upload; send /start to the bot to find them (default: everyone)")
+	apiURL := fs.String("api-url", telegramDefaultAPI, "Bot API server; a local server lifts the 20 MB limit on files bots can download (default: '"+telegramDefaultAPI+"')")
+	transfers := fs.Int("transfers", 2, "Number of files to upload at the same time (default: 2)")
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	parallelChunks := fs.Int("parallel", 1, "Number of parallel chunks to upload per file (default: 1)")
+	conflict := fs.String("conflict", string(azure.ConflictRename), "What to do when a file with the same name already exists remotely: rename, replace or fail (default: 'rename')")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification (default: false)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	registerMetricsFlag(fs)
+	fs.Parse(args)
+
+	if *token == "" {
+		*token = os.Getenv("KSAU_TELEGRAM_TOKEN")
+	}
+	if *token == "" || fs.NArg() != 0 {
+		fmt.Println("Usage: ksau-go bot telegram -token <bot token> [flags]")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	conflictBehavior, err := azure.ParseConflictBehavior(*conflict)
+	if err != nil {
+		fmt.Printf("Error: invalid -conflict: %v\n", err)
+		return exitUsage
+	}
+	if *transfers < 1 {
+		fmt.Println("Error: -transfers must be at least 1")
+		return exitUsage
+	}
+	allowed := make(map[int64]bool)
+	for _, value := range strings.Split(*allow, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			fmt.Printf("Error: invalid chat or user ID '%s' in -allow\n", value)
+			return exitUsage
+		}
+		allowed[id] = true
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, *remoteFolder)
+	if code != exitOK {
+		return code
+	}
+	if err := startMetricsServer(); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	configData, _ := loadConfig()
+	remote, _ := resolveRemote(configData, *remoteFolder, *remoteConfig)
+	retryPolicy, err := remoteRetryPolicy(configData, remote, azure.DefaultRetryPolicy())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	bot := &telegramBot{
+		apiURL:     strings.TrimSuffix(*apiURL, "/"),
+		token:      *token,
+		httpClient: &http.Client{},
+		client:     client,
+		remoteDir:  paths[0],
+		allowed:    allowed,
+		slots:      make(chan struct{}, *transfers),
+		opts: uploadOptions{
+			remoteConfig:   remote,
+			chunkSize:      *chunkSize,
+			parallelChunks: *parallelChunks,
+			retryPolicy:    retryPolicy,
+			skipHash:       *skipHash,
+			hashRetries:    5,
+			hashRetryDelay: 10 * time.Second,
+			conflict:       conflictBehavior,
+		},
+	}
+
+	var me struct {
+		Username string `json:"username"`
+	}
+	if err := bot.call(context.Background(), "getMe", nil, &me); err != nil {
+		printError("Failed to reach the Telegram bot", err)
+		var apiErr *telegramError
+		if errors.As(err, &apiErr) && apiErr.code == http.StatusUnauthorized {
+			return exitAuth
+		}
+		return exitFailure
+	}
+	if len(allowed) == 0 {
+		fmt.Printf("%sWarning: anyone who finds @%s can upload to this remote; use -allow to restrict it to your chats.%s\n", ColorYellow, me.Username, ColorReset)
+	}
+
+	// Ctrl+C stops the uploads in progress and cleans up their sessions instead of killing the process mid-transfer
+	gracefulShutdown.Store(true)
+	fmt.Printf("Uploading the files sent to @%s to %s (press Ctrl+C to stop)\n", me.Username, bot.remoteDir)
+	code = bot.poll()
+	bot.wg.Wait()
+	return code
+}
+
+// poll receives updates until interrupted and handles each message
+func (bot *telegramBot) poll() int {
+	var offset int64
+	for {
+		var updates []telegramUpdate
+		params := map[string]any{"offset": offset, "timeout": 50, "allowed_updates": []string{"message"}}
+		err := bot.call(interrupted, "getUpdates", params, &updates)
+		if interrupted.Err() != nil {
+			// Confirm the updates already handled so they aren't delivered again on the next start
+			bot.call(context.Background(), "getUpdates", map[string]any{"offset": offset, "timeout": 0, "limit": 1}, nil)
+			fmt.Println("Waiting for uploads in progress to stop...")
+			return exitOK
+		}
+		if err != nil {
+			var apiErr *telegramError
+			if errors.As(err, &apiErr) && apiErr.code == http.StatusUnauthorized {
+				printError("The bot token was revoked", err)
+				return exitAuth
+			}
+			printError("Failed to receive updates; retrying", err)
+			delay := 5 * time.Second
+			if apiErr != nil && apiErr.retryAfter > 0 {
+				delay = time.Duration(apiErr.retryAfter) * time.Second
+			}
+			select {
+			case <-interrupted.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message != nil {
+				bot.handle(update.Message)
+			}
+		}
+	}
+}
+
+// handle answers a message: documents are uploaded, and /start and /help explain how to use the bot
+func (bot *telegramBot) handle(message *telegramMessage) {
+	if message.Document == nil {
+		// Commands in groups may be addressed to the bot, as in /start@ksau_bot
+		command, _, _ := strings.Cut(message.Text, " ")
+		command, _, _ = strings.Cut(command, "@")
+		if command == "/start" || command == "/help" {
+			text := fmt.Sprintf("Send me a file as a document and I'll upload it and reply with its download URL.\n\nChat ID: %d", message.Chat.ID)
+			if message.From != nil {
+				text += fmt.Sprintf("\nYour user ID: %d", message.From.ID)
+			}
+			bot.reply(message, text)
+		}
+		return
+	}
+
+	if !bot.isAllowed(message) {
+		fmt.Printf("%sIgnoring a file from chat %d, which isn't allowed to upload.%s\n", ColorYellow, message.Chat.ID, ColorReset)
+		bot.reply(message, fmt.Sprintf("This chat isn't allowed to upload. Ask the bot's owner to add chat ID %d to -allow.", message.Chat.ID))
+		return
+	}
+
+	bot.wg.Add(1)
+	go func() {
+		defer bot.wg.Done()
+		select {
+		case bot.slots <- struct{}{}:
+		case <-interrupted.Done():
+			return
+		}
+		defer func() { <-bot.slots }()
+		bot.upload(message)
+	}()
+}
+
+// isAllowed reports whether the sender or chat of a message may upload
+func (bot *telegramBot) isAllowed(message *telegramMessage) bool {
+	if len(bot.allowed) == 0 || bot.allowed[message.Chat.ID] {
+		return true
+	}
+	return message.From != nil && bot.allowed[message.From.ID]
+}
+
+// upload downloads a document from Telegram, streaming it into the remote folder, and replies with
+// its download URL or what went wrong
+func (bot *telegramBot) upload(message *telegramMessage) {
+	document := message.Document
+	name := document.FileName
+	if name == "" {
+		name = document.FileUniqueID
+	}
+	// Telegram allows names OneDrive doesn't, so fix them instead of failing the upload
+	remoteName := sanitizeName(filepath.Base(name))
+	remoteFilePath := remoteJoin(bot.remoteDir, remoteName)
+	fmt.Printf("\n[%s] Uploading %s (%s) from chat %d\n", time.Now().Format("15:04:05"), remoteName, formatBytes(document.FileSize), message.Chat.ID)
+
+	if document.FileSize > telegramDownloadLimit && bot.apiURL == telegramDefaultAPI {
+		fmt.Printf("%sSkipping %s: Telegram only lets bots download files of up to 20 MB.%s\n", ColorYellow, remoteName, ColorReset)
+		bot.reply(message, fmt.Sprintf("%s is %s, but Telegram only lets bots download files of up to 20 MB. The bot's owner can lift the limit by running a local Bot API server and passing it with -api-url.", remoteName, formatBytes(document.FileSize)))
+		return
+	}
+
+	result, err := bot.transfer(document, remoteName, remoteFilePath)
+	switch {
+	case errors.Is(err, context.Canceled):
+		fmt.Printf("%sUpload of '%s' interrupted.%s\n", ColorYellow, remoteName, ColorReset)
+		bot.reply(message, fmt.Sprintf("The upload of %s was interrupted because the bot is stopping. Send it again once it's back.", remoteName))
+	case err != nil:
+		printError(fmt.Sprintf("Failed to upload '%s'", remoteName), err)
+		bot.reply(message, fmt.Sprintf("Failed to upload %s: %v", remoteName, err))
+	case result.downloadURL != "":
+		bot.reply(message, fmt.Sprintf("Uploaded %s (%s):\n%s", remoteName, formatBytes(result.size), result.downloadURL))
+	default:
+		bot.reply(message, fmt.Sprintf("Uploaded %s (%s) to %s", remoteName, formatBytes(result.size), remoteFilePath))
+	}
+}
+
+// transfer uploads a document. A local Bot API server started with --local returns the path of the
+// file on its disk, which is uploaded from there; otherwise the file is streamed from the API.
+func (bot *telegramBot) transfer(document *telegramDocument, remoteName, remoteFilePath string) (*uploadResult, error) {
+	var file struct {
+		FilePath string `json:"file_path"`
+		FileSize int64  `json:"file_size"`
+	}
+	if err := bot.call(interrupted, "getFile", map[string]any{"file_id": document.FileID}, &file); err != nil {
+		return nil, fmt.Errorf("failed to look up the file on Telegram: %w", err)
+	}
+
+	opts := bot.opts
+	opts.label = remoteName
+	if filepath.IsAbs(file.FilePath) {
+		if _, err := os.Stat(file.FilePath); err == nil {
+			return uploadEntry(bot.client, bot.httpClient, opts, file.FilePath, remoteFilePath)
+		}
+	}
+
+	fileURL := fmt.Sprintf("%s/file/bot%s/%s", bot.apiURL, bot.token, strings.TrimPrefix(file.FilePath, "/"))
+	req, err := http.NewRequestWithContext(interrupted, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, bot.redact(err)
+	}
+	resp, err := bot.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the file from Telegram: %w", bot.redact(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download the file from Telegram: %s", resp.Status)
+	}
+
+	opts.reader = resp.Body
+	opts.size = resp.ContentLength
+	if opts.size < 0 {
+		opts.size = file.FileSize
+	}
+	return uploadEntry(bot.client, bot.httpClient, opts, "", remoteFilePath)
+}
+
+// reply sends text in answer to a message, logging failures since there is no one else to tell
+func (bot *telegramBot) reply(message *telegramMessage, text string) {
+	params := map[string]any{
+		"chat_id":          message.Chat.ID,
+		"text":             text,
+		"reply_parameters": map[string]any{"message_id": message.MessageID, "allow_sending_without_reply": true},
+	}
+	if err := bot.call(context.Background(), "sendMessage", params, nil); err != nil {
+		fmt.Printf("%sWarning: failed to reply in chat %d: %v%s\n", ColorYellow, message.Chat.ID, err, ColorReset)
+	}
+}
+
+// telegramError is an error the Bot API answered with
+type telegramError struct {
+	code        int
+	description string
+	retryAfter  int // Seconds to wait before retrying after being rate limited
+}
+
+func (e *telegramError) Error() string {
+	return fmt.Sprintf("telegram: %s (%d)", e.description, e.code)
+}
+
+// call calls a Bot API method with params as JSON and decodes its result into result (if not nil)
+func (bot *telegramBot) call(ctx context.Context, method string, params, result any) error {
+	body := []byte("{}")
+	if params != nil {
+		var err error
+		if body, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, bot.apiURL+"/bot"+bot.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return bot.redact(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := bot.httpClient.Do(req)
+	if err != nil {
+		return bot.redact(err)
+	}
+	defer resp.Body.Close()
+
+	var response telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("telegram: invalid response to %s (%s): %v", method, resp.Status, err)
+	}
+	if !response.OK {
+		return &telegramError{code: response.ErrorCode, description: response.Description, retryAfter: response.Parameters.RetryAfter}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// redact removes the bot token from errors, which quote the request URL it is part of
+func (bot *telegramBot) redact(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = strings.ReplaceAll(urlErr.URL, bot.token, "<token>")
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// casStore uploads files under a hash-derived path (cas/ab/cd/<hash>) and records a name→hash manifest
+type casStore struct {
+	remoteFolder string
+	manifestPath string
+	mu           *sync.Mutex // Shared with the stores of other remotes that record to the same manifest
+	manifest     map[string]casEntry
+}
+
+// casEntry is a single manifest record mapping a logical name to its stored content
+type casEntry struct {
+	Hash        string    `json:"hash"`
+	Remote      string    `json:"remote,omitempty"` // Remote the content is stored on
+	RemotePath  string    `json:"remote_path"`
+	Size        int64     `json:"size"`
+	DownloadURL string    `json:"download_url,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// newCASStore creates a content-addressed store rooted at remoteFolder/cas, merging any existing manifest
+func newCASStore(remoteFolder, manifestPath string) (*casStore, error) {
+	store := &casStore{
+		remoteFolder: remoteJoin(remoteFolder, "cas"),
+		manifestPath: manifestPath,
+		mu:           &sync.Mutex{},
+		manifest:     make(map[string]casEntry),
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAS manifest: %v", err)
+	}
+	if err := json.Unmarshal(data, &store.manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse CAS manifest: %v", err)
+	}
+	return store, nil
+}
+
+// onRemote returns a store rooted at remoteFolder/cas on another remote that records its uploads in
+// the same manifest, for batches whose files are spread over several remotes
+func (store *casStore) onRemote(remoteFolder string) *casStore {
+	return &casStore{
+		remoteFolder: remoteJoin(remoteFolder, "cas"),
+		manifestPath: store.manifestPath,
+		mu:           store.mu,
+		manifest:     store.manifest,
+	}
+}
+
+// casPath converts a Base64 QuickXorHash into its content-addressed remote path
+func (store *casStore) casPath(quickXorHash string) (string, string, error) {
+	raw, err := base64.StdEncoding.DecodeString(quickXorHash)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid QuickXorHash: %v", err)
+	}
+	hexHash := hex.EncodeToString(raw)
+	return remoteJoin(store.remoteFolder, hexHash[0:2], hexHash[2:4], hexHash), hexHash, nil
+}
+
+// upload stores localPath by content, skipping the transfer if identical content is already stored,
+// and records it in the manifest under name
+func (store *casStore) upload(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, localPath, name string) (*uploadResult, error) {
+	localHash, err := QuickXorHash(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate local QuickXorHash: %v", err)
+	}
+
+	remotePath, hexHash, err := store.casPath(localHash)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Content address: %s\n", remotePath)
+
+	var result *uploadResult
+	item, err := client.GetItem(httpClient, remotePath)
+	if err == nil && !item.IsFolder() {
+		fmt.Printf("%sIdentical content already stored, skipping upload.%s\n", ColorYellow, ColorReset)
+		result = &uploadResult{fileID: item.ID, size: item.Size, quickXorHash: localHash}
+		printDownloadURL(result, opts.remoteConfig, remotePath)
+	} else {
+		if result, err = uploadFile(client, httpClient, opts, localPath, remotePath); err != nil {
+			return result, err
+		}
+	}
+
+	// A dry run uploaded nothing, so there is nothing to record
+	if opts.dryRun {
+		return result, nil
+	}
+
+	store.mu.Lock()
+	store.manifest[filepath.ToSlash(name)] = casEntry{
+		Hash:        hexHash,
+		Remote:      opts.remoteConfig,
+		RemotePath:  filepath.ToSlash(remotePath),
+		Size:        result.size,
+		DownloadURL: result.downloadURL,
+		UploadedAt:  time.Now().UTC(),
+	}
+	store.mu.Unlock()
+
+	return result, store.save()
+}
+
+// save writes the manifest to disk; encoding/json sorts the names so diffs stay stable
+func (store *casStore) save() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	data, err := json.MarshalIndent(store.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode CAS manifest: %v", err)
+	}
+	if err := os.WriteFile(store.manifestPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write CAS manifest: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// runCat implements the cat command, which streams a remote file, or part of it, to stdout so it
+// can be piped into other tools; messages go to stderr to keep the output clean
+func runCat(args []string) int {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	offset := fs.Int64("offset", 0, "Start at this byte; negative values count from the end of the file (default: 0)")
+	count := fs.Int64("count", -1, "Only output this many bytes (default: -1, up to the end of the file)")
+	bwLimit := fs.String("bwlimit", "", "Limit the transfer rate in bytes/s, e.g. 4M, or follow a schedule such as \"08:00,1M 23:00,off\" (default: no limit)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: ksau-go cat [flags] <remote-path>")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+
+	bandwidth, err := parseBandwidth(*bwLimit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, fs.Arg(0))
+	if code != exitOK {
+		return code
+	}
+	client.UseBandwidthLimit(bandwidth)
+
+	// Buffer the output so small reads don't each become a write to the pipe
+	out := bufio.NewWriterSize(os.Stdout, 256*1024)
+	_, err = client.DownloadRange(&http.Client{}, paths[0], *offset, *count, out)
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		fprintError(os.Stderr, "Failed to read file", err)
+		return exitCodeFor(err)
+	}
+	return exitOK
+}
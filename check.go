@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// runCheck implements the check command, which compares a local directory with a remote folder
+// without transferring anything: it reports files that exist on only one side, files whose sizes
+// differ and files of the same size whose QuickXorHash differs. With -download-sample, a random
+// sample of the matching files is downloaded and compared byte for byte, to catch what the hashes can't.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	sizeOnly := fs.Bool("size-only", false, "Only compare sizes, without hashing the local files (default: false)")
+	oneWay := fs.Bool("one-way", false, "Only check that the local files exist remotely, ignoring remote files missing locally (default: false)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	downloadSample := fs.String("download-sample", "", "Also download this share of the matching files, e.g. 5%, or this many of them, e.g. 20, and compare them byte for byte with the local files (default: none)")
+	filterOptions := registerFilterFlags(fs)
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Println("Usage: ksau-go check [flags] <local-dir> <remote:dir>")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	localDir := longPath(fs.Arg(0))
+
+	info, err := os.Stat(localDir)
+	if err != nil || !info.IsDir() {
+		fmt.Printf("Error: '%s' is not a local directory\n", fs.Arg(0))
+		return exitUsage
+	}
+
+	filter, err := filterOptions.build()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	var sample sampleSize
+	if *downloadSample != "" {
+		if sample, err = parseSampleSize(*downloadSample); err != nil {
+			fmt.Println("Error:", err)
+			return exitUsage
+		}
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, fs.Arg(1))
+	if code != exitOK {
+		return code
+	}
+	remoteDir := paths[0]
+
+	httpClient := &http.Client{}
+
+	fmt.Printf("Listing %s...\n", remoteDir)
+	remoteFiles := make(map[string]azure.DriveItem)
+	if err := listRemoteTree(client, httpClient, remoteDir, "", remoteFiles); err != nil {
+		printError("Failed to list remote folder", err)
+		return exitCodeFor(err)
+	}
+
+	var localFiles []string
+	localSizes := make(map[string]int64)
+	ignores, err := walkLocal(localDir, filter, func(rel string, d os.DirEntry) error {
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		localFiles = append(localFiles, rel)
+		localSizes[rel] = info.Size()
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Failed to walk directory:", err)
+		return exitFailure
+	}
+	removeExcluded(remoteFiles, filter, ignores)
+	tooLargeOrSmall := sizeExcluded(filter, localSizes, remoteFiles)
+	fmt.Printf("Checking %d local files against %d remote files...\n", len(localFiles), len(remoteFiles))
+
+	var matching, missingRemote, missingLocal, sizeDiffers, hashDiffers int
+	var matched []string
+	for _, rel := range localFiles {
+		if tooLargeOrSmall[rel] {
+			delete(remoteFiles, rel)
+			continue
+		}
+		item, exists := remoteFiles[rel]
+		delete(remoteFiles, rel)
+
+		switch {
+		case !exists:
+			fmt.Printf("%sMissing remotely: %s%s\n", ColorRed, rel, ColorReset)
+			missingRemote++
+		case localSizes[rel] != item.Size:
+			fmt.Printf("%sSize differs:     %s (local %s, remote %s)%s\n", ColorRed, rel, formatBytes(localSizes[rel]), formatBytes(item.Size), ColorReset)
+			sizeDiffers++
+		case *sizeOnly:
+			matching++
+			matched = append(matched, rel)
+		default:
+			localHash, err := QuickXorHash(filepath.Join(localDir, filepath.FromSlash(rel)))
+			if err != nil {
+				fmt.Printf("Failed to hash '%s': %v\n", rel, err)
+				return exitFailure
+			}
+			if localHash != remoteHash(&item) {
+				fmt.Printf("%sHash differs:     %s (local %s, remote %s)%s\n", ColorRed, rel, localHash, remoteHash(&item), ColorReset)
+				hashDiffers++
+				continue
+			}
+			matching++
+			matched = append(matched, rel)
+		}
+	}
+
+	if !*oneWay {
+		var extra []string
+		for rel := range remoteFiles {
+			if !tooLargeOrSmall[rel] {
+				extra = append(extra, rel)
+			}
+		}
+		sort.Strings(extra)
+		for _, rel := range extra {
+			fmt.Printf("%sMissing locally:  %s%s\n", ColorRed, rel, ColorReset)
+		}
+		missingLocal = len(extra)
+	}
+
+	var contentDiffers int
+	if n := sample.of(len(matched)); n > 0 {
+		fmt.Printf("Downloading %d of the %d matching files to compare them byte for byte...\n", n, len(matched))
+		rand.Shuffle(len(matched), func(i, j int) { matched[i], matched[j] = matched[j], matched[i] })
+		for _, rel := range matched[:n] {
+			if interrupted.Err() != nil {
+				fmt.Printf("%sCheck interrupted.%s\n", ColorYellow, ColorReset)
+				return exitInterrupted
+			}
+			remotePath := remoteJoin(remoteDir, rel)
+			offset, err := compareDownload(client, httpClient, remotePath, filepath.Join(localDir, filepath.FromSlash(rel)))
+			switch {
+			case errors.Is(err, errContentDiffers):
+				fmt.Printf("%sContent differs:  %s (from byte %d)%s\n", ColorRed, rel, offset, ColorReset)
+				contentDiffers++
+				matching--
+			case err != nil:
+				printError(fmt.Sprintf("Failed to download '%s'", remotePath), err)
+				return exitCodeFor(err)
+			}
+		}
+	}
+
+	fmt.Printf("%d matching, %d missing remotely, %d missing locally, %d size mismatches, %d hash mismatches\n", matching, missingRemote, missingLocal, sizeDiffers, hashDiffers)
+	if sample.set() {
+		fmt.Printf("%d of %d downloaded files differ\n", contentDiffers, sample.of(len(matched)))
+	}
+	if missingRemote+missingLocal+sizeDiffers+hashDiffers+contentDiffers > 0 {
+		fmt.Printf("%sCheck failed: the local and remote files differ%s\n", ColorRed, ColorReset)
+		return exitIntegrity
+	}
+	fmt.Printf("%sCheck passed: all files match%s\n", ColorGreen, ColorReset)
+	return exitOK
+}
+
+// sampleSize is how many files check downloads: count files, or percent of the matching files
+type sampleSize struct {
+	count   int
+	percent float64
+}
+
+// parseSampleSize parses a -download-sample value, a number of files or a percentage such as 5%
+func parseSampleSize(value string) (sampleSize, error) {
+	if number, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err := strconv.ParseFloat(number, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return sampleSize{}, fmt.Errorf("invalid -download-sample '%s': expected a number of files or a percentage from 0%% to 100%%", value)
+		}
+		return sampleSize{percent: percent}, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return sampleSize{}, fmt.Errorf("invalid -download-sample '%s': expected a number of files or a percentage from 0%% to 100%%", value)
+	}
+	return sampleSize{count: count}, nil
+}
+
+// set reports whether a sample was asked for
+func (sample sampleSize) set() bool {
+	return sample.count > 0 || sample.percent > 0
+}
+
+// of returns the number of files to download out of n; a percentage rounds up, so a small folder
+// still gets at least one file checked
+func (sample sampleSize) of(n int) int {
+	if sample.percent > 0 {
+		return min(int(math.Ceil(float64(n)*sample.percent/100)), n)
+	}
+	return min(sample.count, n)
+}
+
+// errContentDiffers is returned by compareDownload when the remote file's bytes differ from the local file's
+var errContentDiffers = errors.New("content differs")
+
+// compareDownload downloads the file at remotePath and compares it with the local file as it
+// arrives, without storing it. On a difference it returns errContentDiffers and the offset of the
+// first byte that differs.
+func compareDownload(client *azure.AzureClient, httpClient *http.Client, remotePath, localPath string) (int64, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	compare := &compareWriter{local: file}
+	if _, err := client.Download(httpClient, remotePath, compare); err != nil {
+		if compare.differs {
+			return compare.offset, errContentDiffers
+		}
+		return 0, err
+	}
+
+	// The remote file may also end before the local one
+	if n, _ := file.Read(make([]byte, 1)); n > 0 {
+		return compare.offset, errContentDiffers
+	}
+	return 0, nil
+}
+
+// compareWriter compares the bytes written to it with those read from a local file, failing the
+// write at the first difference
+type compareWriter struct {
+	local   io.Reader
+	buf     []byte
+	offset  int64 // Bytes that matched so far
+	differs bool
+}
+
+func (w *compareWriter) Write(p []byte) (int, error) {
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	local := w.buf[:len(p)]
+	n, _ := io.ReadFull(w.local, local)
+	for i := range n {
+		if local[i] != p[i] {
+			w.offset += int64(i)
+			w.differs = true
+			return i, errContentDiffers
+		}
+	}
+	w.offset += int64(n)
+	if n < len(p) {
+		w.differs = true
+		return n, errContentDiffers
+	}
+	return len(p), nil
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// configPath is the rclone.conf on disk selected with -config, if any
+var configPath string
+
+// loadedConfig caches the rclone config once it has been read, and loadedConfigPath records the
+// file it came from (empty for the embedded config); loadedConfigDetected is set when that file is
+// rclone's own config, used because no config was given. configMu guards them for commands that
+// reload the config while running.
+var (
+	configMu             sync.Mutex
+	loadedConfig         []byte
+	loadedConfigPath     string
+	loadedConfigDetected bool
+)
+
+// registerConfigFlag adds the -config flag to a command's flag set, along with the network flags
+// every command that talks to Graph accepts
+func registerConfigFlag(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", "", "Path to an rclone.conf on disk (default: $KSAU_CONFIG, then rclone's own config, then the embedded config)")
+	registerNetworkFlags(fs)
+}
+
+// loadConfig returns the rclone config data in use: the file given with -config or KSAU_CONFIG,
+// then rclone's default config if it exists, falling back to the config embedded at build time.
+// Commands load the config before their first request, so it also applies the network options.
+func loadConfig() ([]byte, error) {
+	if err := configureNetwork(); err != nil {
+		return nil, err
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	if loadedConfig != nil {
+		return loadedConfig, nil
+	}
+
+	path := configPath
+	if path == "" {
+		path = os.Getenv("KSAU_CONFIG")
+	}
+	detected := false
+	if path == "" {
+		if defaultPath := defaultRcloneConfigPath(); defaultPath != "" {
+			if _, err := os.Stat(defaultPath); err == nil {
+				path, detected = defaultPath, true
+			}
+		}
+	}
+
+	if path != "" {
+		configData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		loadedConfig, loadedConfigPath, loadedConfigDetected = configData, path, detected
+		return loadedConfig, nil
+	}
+
+	configData, err := configFile.ReadFile("rclone.conf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded config file: %v", err)
+	}
+
+	loadedConfig = configData
+	return loadedConfig, nil
+}
+
+// currentConfigPath returns the file the config in use was loaded from, or "" for the embedded config
+func currentConfigPath() string {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return loadedConfigPath
+}
+
+// defaultRcloneConfigPath returns where rclone itself looks for its config: $RCLONE_CONFIG, or
+// rclone.conf under %APPDATA%\rclone on Windows and $XDG_CONFIG_HOME/rclone or ~/.config/rclone elsewhere
+func defaultRcloneConfigPath() string {
+	if path := os.Getenv("RCLONE_CONFIG"); path != "" {
+		return path
+	}
+
+	if runtime.GOOS == "windows" {
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			return filepath.Join(appData, "rclone", "rclone.conf")
+		}
+		return ""
+	}
+
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		return filepath.Join(configHome, "rclone", "rclone.conf")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "rclone", "rclone.conf")
+}
+
+// writableConfigPath returns the config file that changes such as new tokens are written to: the
+// file in use, or rclone's default config if only the embedded config is available
+func writableConfigPath() (string, error) {
+	if configPath != "" {
+		return configPath, nil
+	}
+	if path := os.Getenv("KSAU_CONFIG"); path != "" {
+		return path, nil
+	}
+	if path := defaultRcloneConfigPath(); path != "" {
+		return path, nil
+	}
+	return "", fmt.Errorf("no config file location found; pass one with -config")
+}
+
+// configLockTimeout bounds how long to wait for another process writing the config, and how old a
+// lock may get before it is considered left behind by a crashed process
+const configLockTimeout = 10 * time.Second
+
+// lockConfigFile takes an exclusive lock on the config file at path through a .lock file next to it,
+// so concurrent ksau-go processes don't overwrite each other's changes
+func lockConfigFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(configLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to lock config file: %v", err)
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > configLockTimeout {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for config lock %s", lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// configTokenStore writes refreshed tokens back to a remote's section of the config file, so the
+// stored refresh token never goes stale
+type configTokenStore struct {
+	path   string
+	remote string
+}
+
+// SaveToken replaces the token key of the remote's section
+func (store *configTokenStore) SaveToken(token *azure.Token) error {
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to encode token: %v", err)
+	}
+	return updateConfigSection(store.path, store.remote, map[string]string{"token": string(tokenJSON)})
+}
+
+// updateConfigSection sets keys in a section of the config file at path, creating the section or the
+// file as needed. Other sections, keys and comments are kept as they are, and so are the file's
+// permissions; a symlink is followed so the file it points to is updated rather than replaced.
+func updateConfigSection(path, section string, values map[string]string) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+
+	unlock, err := lockConfigFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+
+	// Replace existing keys in place and remember where the section ends to append the others
+	pending := make(map[string]bool, len(values))
+	for _, key := range keys {
+		pending[key] = true
+	}
+	sectionEnd := -1
+	inSection := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			inSection = strings.Trim(trimmed, "[]") == section
+			if inSection {
+				sectionEnd = i + 1
+			}
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		if key, _, found := strings.Cut(trimmed, "="); found {
+			key = strings.TrimSpace(key)
+			if pending[key] {
+				lines[i] = key + " = " + values[key]
+				delete(pending, key)
+			}
+		}
+		if trimmed != "" {
+			sectionEnd = i + 1
+		}
+	}
+
+	var added []string
+	for _, key := range keys {
+		if pending[key] {
+			added = append(added, key+" = "+values[key])
+		}
+	}
+	if sectionEnd < 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+section+"]")
+		lines = append(lines, added...)
+	} else {
+		lines = append(lines[:sectionEnd], append(added, lines[sectionEnd:]...)...)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+
+	return nil
+}
+
+// configRemotes returns the names of the OneDrive remotes defined in the config, sorted
+func configRemotes(configData []byte) []string {
+	var remotes []string
+	for _, remote := range azure.RcloneRemotes(configData) {
+		if remoteType, _ := remoteSetting(configData, remote, "type"); remoteType == "onedrive" {
+			remotes = append(remotes, remote)
+		}
+	}
+	sort.Strings(remotes)
+	return remotes
+}
+
+// remoteSetting returns a ksau-specific key from a remote's config section, if set
+func remoteSetting(configData []byte, remote, key string) (string, bool) {
+	configMap, err := azure.ParseRcloneConfigData(configData, remote)
+	if err != nil {
+		return "", false
+	}
+	value, ok := configMap[key]
+	return value, ok && value != ""
+}
+
+// remoteRootFolder returns the default root folder of a remote: its root_folder config key,
+// falling back to the built-in mapping and then the drive root
+func remoteRootFolder(configData []byte, remote string) string {
+	if rootFolder, ok := remoteSetting(configData, remote, "root_folder"); ok {
+		return rootFolder
+	}
+	return rootFolders[remote]
+}
+
+// remoteBaseURL returns the index base URL of a remote: its base_url config key, falling back to the built-in mapping
+func remoteBaseURL(configData []byte, remote string) (string, bool) {
+	if baseURL, ok := remoteSetting(configData, remote, "base_url"); ok {
+		return baseURL, true
+	}
+	baseURL, ok := baseURLs[remote]
+	return baseURL, ok
+}
+
+// remoteRoots parses the roots config key of a remote, which maps logical root names to folders
+// on the drive, e.g. "roms:Public/ROMs, builds:Public/builds"
+func remoteRoots(configData []byte, remote string) map[string]string {
+	roots := make(map[string]string)
+
+	value, ok := remoteSetting(configData, remote, "roots")
+	if !ok {
+		return roots
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		name, folder, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || strings.TrimSpace(name) == "" {
+			continue
+		}
+		roots[strings.TrimSpace(name)] = strings.Trim(strings.TrimSpace(folder), "/")
+	}
+	return roots
+}
+
+// remoteAccessPolicy returns the access policy of the remote's allow key, a comma-separated list of the
+// operations it may be used for, confined to the folders of its allow_roots key or, without one, to its
+// root folder and configured roots. It returns nil if the remote has no allow key.
+func remoteAccessPolicy(configData []byte, remote string) (*azure.AccessPolicy, error) {
+	operations, ok := remoteSetting(configData, remote, "allow")
+	if !ok {
+		return nil, nil
+	}
+
+	roots, ok := remoteSetting(configData, remote, "allow_roots")
+	if !ok {
+		folders := []string{remoteRootFolder(configData, remote)}
+		for _, folder := range remoteRoots(configData, remote) {
+			folders = append(folders, folder)
+		}
+		// A root at the top of the drive leaves nothing to confine
+		if slices.Contains(folders, "") {
+			folders = nil
+		}
+		roots = strings.Join(folders, ",")
+	}
+
+	policy, err := azure.ParseAccessPolicy(operations, roots)
+	if err != nil {
+		return nil, fmt.Errorf("remote '%s': allow: %v", remote, err)
+	}
+	return policy, nil
+}
+
+// remoteRetryPolicy overrides the rules of policy with the remote's retry_throttled, retry_network,
+// retry_server and retry_other config keys, each written as retries:delay[:max-delay]
+func remoteRetryPolicy(configData []byte, remote string, policy azure.RetryPolicy) (azure.RetryPolicy, error) {
+	rules := map[string]*azure.RetryRule{
+		azure.ErrorClassThrottled: &policy.Throttled,
+		azure.ErrorClassNetwork:   &policy.Network,
+		azure.ErrorClassServer:    &policy.Server,
+		azure.ErrorClassOther:     &policy.Other,
+	}
+
+	for class, rule := range rules {
+		value, ok := remoteSetting(configData, remote, "retry_"+class)
+		if !ok {
+			continue
+		}
+		parsed, err := azure.ParseRetryRule(value)
+		if err != nil {
+			return policy, fmt.Errorf("remote '%s': retry_%s: %v", remote, class, err)
+		}
+		*rule = parsed
+	}
+	return policy, nil
+}
+
+// remoteRequestLimit returns the limit the remote's request_rate (requests per second) and
+// request_concurrency (requests in progress at once) config keys put on its Graph requests
+func remoteRequestLimit(configData []byte, remote string) (azure.RequestLimit, error) {
+	var limit azure.RequestLimit
+	if value, ok := remoteSetting(configData, remote, "request_rate"); ok {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate < 0 {
+			return limit, fmt.Errorf("remote '%s': request_rate: invalid number of requests per second '%s'", remote, value)
+		}
+		limit.PerSecond = rate
+	}
+	if value, ok := remoteSetting(configData, remote, "request_concurrency"); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return limit, fmt.Errorf("remote '%s': request_concurrency: invalid number of requests '%s'", remote, value)
+		}
+		limit.Concurrent = n
+	}
+	return limit, nil
+}
+
+// retentionRule is an entry of a remote's retention key: files below folder that weren't modified for
+// age are pruned by maintenance
+type retentionRule struct {
+	folder string // Full path on the drive
+	age    time.Duration
+}
+
+// remoteRetention parses the retention config key of a remote, which lists folders with how long
+// their files are kept, e.g. "nightly:14d, logs/ci:72h". Folders are resolved like -remote, so they
+// may start with one of the remote's roots.
+func remoteRetention(configData []byte, remote string) ([]retentionRule, error) {
+	value, ok := remoteSetting(configData, remote, "retention")
+	if !ok {
+		return nil, nil
+	}
+
+	var rules []retentionRule
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		i := strings.LastIndex(entry, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("remote '%s': retention: entry '%s' isn't folder:age", remote, entry)
+		}
+		folder, ageValue := strings.Trim(strings.TrimSpace(entry[:i]), "/"), strings.TrimSpace(entry[i+1:])
+		// Pruning a whole drive is never what an entry with a missing folder meant
+		if folder == "" {
+			return nil, fmt.Errorf("remote '%s': retention: entry '%s' has no folder", remote, entry)
+		}
+		age, err := parseAge(ageValue)
+		if err != nil {
+			return nil, fmt.Errorf("remote '%s': retention: %v", remote, err)
+		}
+		rules = append(rules, retentionRule{folder: resolveRemoteOn(configData, folder, remote), age: age})
+	}
+	return rules, nil
+}
+
+// resolveRemote resolves a remote path spec to a remote name and a full path on its drive.
+// Specs of the form "remote:path" select the remote, and their first path element may name one
+// of the remote's configured roots; other specs are relative to defaultRemote's root folder.
+func resolveRemote(configData []byte, spec, defaultRemote string) (string, string) {
+	remote, rest := defaultRemote, spec
+
+	if name, path, found := strings.Cut(spec, ":"); found && !strings.Contains(name, "/") {
+		remote, rest = name, path
+
+		rootName, remainder, _ := strings.Cut(strings.TrimLeft(rest, "/"), "/")
+		if folder, ok := remoteRoots(configData, remote)[rootName]; ok {
+			return remote, remoteJoin(folder, remainder)
+		}
+	}
+
+	return remote, remoteJoin(remoteRootFolder(configData, remote), rest)
+}
+
+// remoteJoin joins path elements into a drive path with forward slashes whatever the local OS;
+// elements may be relative local paths, whose separators are converted
+func remoteJoin(elem ...string) string {
+	return azure.JoinRemotePath(elem...).String()
+}
+
+// resolveRemoteOn resolves a remote path spec on the given remote instead of the one it names. A
+// remote: prefix is dropped, so remote:root/path uses the given remote's root of the same name if
+// it has one.
+func resolveRemoteOn(configData []byte, spec, remote string) string {
+	if name, rest, found := strings.Cut(spec, ":"); found && !strings.Contains(name, "/") {
+		spec = rest
+	}
+	_, folder := resolveRemote(configData, remote+":"+spec, remote)
+	return folder
+}
+
+// setupRemote reads the config, resolves the remote path specs of a command and initializes the
+// client for their remote. All specs must refer to the same remote. On failure it prints the error
+// and returns a non-zero exit code.
+func setupRemote(remoteConfig, stateDir string, specs ...string) (*azure.AzureClient, []string, int) {
+	configData, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		return nil, nil, exitFailure
+	}
+
+	remote := remoteConfig
+	paths := make([]string, len(specs))
+	for i, spec := range specs {
+		specRemote, fullPath := resolveRemote(configData, spec, remoteConfig)
+		if i > 0 && specRemote != remote {
+			fmt.Printf("Error: paths on different remotes ('%s' and '%s') cannot be combined\n", remote, specRemote)
+			return nil, nil, exitUsage
+		}
+		remote = specRemote
+		paths[i] = fullPath
+	}
+
+	client, err := newClient(configData, remote, stateDir)
+	if err != nil {
+		fmt.Println("Failed to initialize client:", err)
+		return nil, nil, exitFailure
+	}
+
+	return client, paths, exitOK
+}
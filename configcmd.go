@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// refreshTokenLifetime is how long Microsoft keeps an unused refresh token valid; a token whose
+// access token expired longer ago than this can no longer be refreshed
+const refreshTokenLifetime = 90 * 24 * time.Hour
+
+// rcloneOneDriveKeys are the keys of rclone's onedrive backend, which ksau-go accepts even where it
+// doesn't use them, so one config works for both
+var rcloneOneDriveKeys = []string{
+	"type", "client_id", "client_secret", "token", "auth_url", "token_url", "client_credentials", "tenant",
+	"region", "upload_cutoff", "chunk_size", "drive_id", "drive_type", "root_folder_id", "access_scopes",
+	"disable_site_permission", "expose_onenote_files", "server_side_across_configs", "list_chunk",
+	"no_versions", "hard_delete", "link_scope", "link_type", "link_password", "hash_type", "av_override",
+	"delta", "metadata_permissions", "encoding", "description",
+}
+
+// ksauConfigKeys are the keys ksau-go adds to a remote's section
+var ksauConfigKeys = []string{
+	"root_folder", "base_url", "url_template", "roots", "index_prime", "upload_webhook",
+	"upload_webhook_secret", "allow", "allow_roots", "request_rate", "request_concurrency",
+	"retry_throttled", "retry_network", "retry_server", "retry_other", "retry_metadata", "retention",
+}
+
+// secretConfigKeys are the keys whose values config show and list never print
+var secretConfigKeys = []string{"client_secret", "upload_webhook_secret", "link_password"}
+
+// configKey is a key = value line of a config section
+type configKey struct {
+	name  string
+	value string
+	line  int
+}
+
+// configSection is a section of an rclone config, with its keys in file order
+type configSection struct {
+	name string
+	line int
+	keys []configKey
+}
+
+// value returns the value of a key of the section, if set; the last value wins, as in ParseRcloneConfigData
+func (section *configSection) value(name string) (string, bool) {
+	for i := len(section.keys) - 1; i >= 0; i-- {
+		if section.keys[i].name == name {
+			return section.keys[i].value, true
+		}
+	}
+	return "", false
+}
+
+// configProblem is something wrong with a config; errors break the remote, warnings may not
+type configProblem struct {
+	line    int
+	section string
+	err     bool
+	message string
+}
+
+// runConfig implements the config command, whose subcommands inspect the rclone config in use
+func runConfig(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Usage: ksau-go config <validate|list|show> [flags]")
+		return exitUsage
+	}
+	switch args[0] {
+	case "validate":
+		return runConfigValidate(args[1:])
+	case "list":
+		return runConfigList(args[1:])
+	case "show":
+		return runConfigShow(args[1:])
+	default:
+		fmt.Printf("Error: unknown config command '%s'; expected validate, list or show\n", args[0])
+		return exitUsage
+	}
+}
+
+// runConfigValidate implements config validate, which checks the config without making any requests
+func runConfigValidate(args []string) int {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	remoteConfig := fs.String("remote-config", "", "Only validate this remote configuration section (default: all sections)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	configData, source, code := loadConfigSource()
+	if code != exitOK {
+		return code
+	}
+
+	sections, problems := parseConfigSections(configData)
+	if *remoteConfig != "" {
+		i := slices.IndexFunc(sections, func(section configSection) bool { return section.name == *remoteConfig })
+		if i < 0 {
+			fmt.Printf("Error: %s has no section [%s]\n", source, *remoteConfig)
+			return exitNotFound
+		}
+		sections, problems = sections[i:i+1], nil
+	}
+	for i := range sections {
+		problems = append(problems, validateConfigSection(configData, &sections[i])...)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+
+	errCount := 0
+	for _, problem := range problems {
+		color, kind := ColorYellow, "warning"
+		if problem.err {
+			color, kind = ColorRed, "error"
+			errCount++
+		}
+		location := source
+		if problem.line > 0 {
+			location = fmt.Sprintf("%s:%d", source, problem.line)
+		}
+		if problem.section != "" {
+			fmt.Printf("%s%s: %s: [%s] %s%s\n", color, location, kind, problem.section, problem.message, ColorReset)
+		} else {
+			fmt.Printf("%s%s: %s: %s%s\n", color, location, kind, problem.message, ColorReset)
+		}
+	}
+
+	if errCount > 0 {
+		fmt.Printf("%s%s: errors: %d, warnings: %d%s\n", ColorRed, source, errCount, len(problems)-errCount, ColorReset)
+		return exitFailure
+	}
+	fmt.Printf("%s%s: no errors, warnings: %d%s\n", ColorGreen, source, len(problems), ColorReset)
+	return exitOK
+}
+
+// parseConfigSections splits config data into its sections the way ParseRcloneConfigData reads it,
+// reporting the lines it ignores and sections or keys that are defined twice. Sections are in the
+// order they first appear.
+func parseConfigSections(configData []byte) ([]configSection, []configProblem) {
+	var sections []configSection
+	var problems []configProblem
+	index := make(map[string]int)
+	current := -1
+
+	for i, line := range strings.Split(string(configData), "\n") {
+		lineNo := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.Trim(line, "[]")
+			// Like ParseRcloneConfigData, keys of a repeated section add to the earlier one
+			if earlier, ok := index[name]; ok {
+				problems = append(problems, configProblem{lineNo, name, false, fmt.Sprintf("section is defined again; its keys are merged with the one on line %d", sections[earlier].line)})
+				current = earlier
+				continue
+			}
+			index[name] = len(sections)
+			current = len(sections)
+			sections = append(sections, configSection{name: name, line: lineNo})
+			continue
+		}
+
+		name, value, found := strings.Cut(line, "=")
+		switch {
+		case !found:
+			problems = append(problems, configProblem{lineNo, "", true, fmt.Sprintf("'%s' is neither a [section] nor a key = value line", line)})
+		case current < 0:
+			problems = append(problems, configProblem{lineNo, "", true, fmt.Sprintf("key '%s' is outside any section", strings.TrimSpace(name))})
+		default:
+			section := &sections[current]
+			name = strings.TrimSpace(name)
+			if _, ok := section.value(name); ok {
+				problems = append(problems, configProblem{lineNo, section.name, true, fmt.Sprintf("key '%s' is set again, overriding the earlier value", name)})
+			}
+			section.keys = append(section.keys, configKey{name, strings.TrimSpace(value), lineNo})
+		}
+	}
+	return sections, problems
+}
+
+// validateConfigSection checks the keys of a section: that a OneDrive remote has the keys it needs,
+// that its token can still be refreshed, that ksau-go's own keys parse, and that no key is unknown
+func validateConfigSection(configData []byte, section *configSection) []configProblem {
+	var problems []configProblem
+	report := func(line int, err bool, format string, args ...any) {
+		problems = append(problems, configProblem{line, section.name, err, fmt.Sprintf(format, args...)})
+	}
+
+	remoteType, ok := section.value("type")
+	if !ok {
+		report(section.line, true, "missing key 'type'; OneDrive remotes need 'type = onedrive'")
+		return problems
+	}
+	if remoteType != "onedrive" {
+		report(section.line, false, "type '%s' isn't onedrive; ksau-go ignores this section", remoteType)
+		return problems
+	}
+
+	lines := make(map[string]int)
+	for _, key := range section.keys {
+		lines[key.name] = key.line
+		if !slices.Contains(rcloneOneDriveKeys, key.name) && !slices.Contains(ksauConfigKeys, key.name) {
+			report(key.line, false, "unknown key '%s' is ignored", key.name)
+		}
+	}
+	for _, name := range []string{"client_id", "token"} {
+		if value, _ := section.value(name); value == "" {
+			report(section.line, true, "missing key '%s'; run 'ksau-go login -remote-config %s' to sign in", name, section.name)
+		}
+	}
+	if value, _ := section.value("drive_id"); value == "" {
+		report(section.line, false, "missing key 'drive_id'; requests go to the signed-in account's default drive")
+	}
+	if value, ok := section.value("drive_type"); ok && !slices.Contains([]string{"personal", "business", "documentLibrary"}, value) {
+		report(lines["drive_type"], true, "drive_type '%s' isn't personal, business or documentLibrary", value)
+	}
+
+	if value, _ := section.value("token"); value != "" {
+		if message, err := checkConfigToken(value, section.name); message != "" {
+			report(lines["token"], err, "%s", message)
+		}
+	}
+
+	for _, name := range []string{"base_url", "upload_webhook"} {
+		if value, ok := section.value(name); ok {
+			if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				report(lines[name], true, "%s '%s' isn't an http or https URL", name, value)
+			}
+		}
+	}
+	if value, ok := section.value("index_prime"); ok && value != "url" {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			report(lines["index_prime"], true, "index_prime '%s' is neither 'url' nor an http or https URL", value)
+		}
+	}
+	if value, ok := section.value("url_template"); ok {
+		baseURL, _ := remoteBaseURL(configData, section.name)
+		data := downloadURLData{BaseURL: baseURL, Path: "a/b.zip", FileName: "b.zip", FileID: "ID", RootFolder: remoteRootFolder(configData, section.name), Remote: section.name}
+		if _, err := executeURLTemplate(section.name, value, data); err != nil {
+			report(lines["url_template"], true, "%v", err)
+		}
+	}
+	if value, ok := section.value("roots"); ok {
+		for _, entry := range strings.Split(value, ",") {
+			if name, _, found := strings.Cut(strings.TrimSpace(entry), ":"); !found || strings.TrimSpace(name) == "" {
+				report(lines["roots"], true, "roots entry '%s' isn't name:folder; it is ignored", strings.TrimSpace(entry))
+			}
+		}
+	}
+
+	// The settings' parsers name the remote and key in their errors, which locate them here already
+	reportSetting := func(err error) {
+		message := strings.TrimPrefix(err.Error(), fmt.Sprintf("remote '%s': ", section.name))
+		key, _, _ := strings.Cut(message, ":")
+		report(lines[key], true, "%s", message)
+	}
+	if _, err := remoteAccessPolicy(configData, section.name); err != nil {
+		reportSetting(err)
+	}
+	for _, class := range []string{azure.ErrorClassThrottled, azure.ErrorClassNetwork, azure.ErrorClassServer, azure.ErrorClassOther, "metadata"} {
+		if value, ok := section.value("retry_" + class); ok {
+			if _, err := azure.ParseRetryRule(value); err != nil {
+				reportSetting(fmt.Errorf("retry_%s: %v", class, err))
+			}
+		}
+	}
+	if _, err := remoteRequestLimit(configData, section.name); err != nil {
+		reportSetting(err)
+	}
+	if _, err := remoteRetention(configData, section.name); err != nil {
+		reportSetting(err)
+	}
+	return problems
+}
+
+// checkConfigToken checks that a token value is the JSON rclone writes and that its refresh token can
+// still be used, returning what's wrong and whether it is an error
+func checkConfigToken(value, remote string) (string, bool) {
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		Expiry       string `json:"expiry"`
+	}
+	if err := json.Unmarshal([]byte(value), &token); err != nil {
+		return fmt.Sprintf("token isn't valid JSON: %v", err), true
+	}
+	if token.RefreshToken == "" {
+		return fmt.Sprintf("token has no refresh_token, so it can't be renewed; run 'ksau-go login -remote-config %s'", remote), true
+	}
+	expiry, err := time.Parse(time.RFC3339, token.Expiry)
+	if err != nil {
+		return fmt.Sprintf("token expiry '%s' isn't an RFC 3339 time", token.Expiry), true
+	}
+	if age := time.Since(expiry); age > refreshTokenLifetime {
+		return fmt.Sprintf("token expired %d days ago, so its refresh token has most likely expired too; run 'ksau-go login -remote-config %s'", int(age.Hours()/24), remote), true
+	}
+	return "", false
+}
+
+// runConfigList implements config list, which prints the remotes of the config in use with their
+// effective root folder and base URL
+func runConfigList(args []string) int {
+	fs := flag.NewFlagSet("config list", flag.ExitOnError)
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	configData, source, code := loadConfigSource()
+	if code != exitOK {
+		return code
+	}
+	sections, _ := parseConfigSections(configData)
+	fmt.Printf("Config: %s\n\n", source)
+	if len(sections) == 0 {
+		fmt.Println("No remotes configured.")
+		return exitOK
+	}
+
+	fmt.Printf("%-16s %-10s %-16s %-24s %-40s %s\n", "REMOTE", "TYPE", "DRIVE TYPE", "ROOT FOLDER", "BASE URL", "TOKEN")
+	for _, section := range sections {
+		remoteType, _ := section.value("type")
+		if remoteType != "onedrive" {
+			fmt.Printf("%-16s %-10s %-16s %-24s %-40s %s\n", section.name, orDash(remoteType), "-", "-", "-", "-")
+			continue
+		}
+		driveType, _ := section.value("drive_type")
+		baseURL, _ := remoteBaseURL(configData, section.name)
+		fmt.Printf("%-16s %-10s %-16s %-24s %-40s %s\n", section.name, remoteType, orDash(driveType),
+			"/"+remoteRootFolder(configData, section.name), orDash(baseURL), configTokenStatus(&section))
+	}
+	return exitOK
+}
+
+// runConfigShow implements config show, which prints a remote's section of the config in use with its
+// secrets redacted, followed by the built-in defaults it relies on
+func runConfigShow(args []string) int {
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: ksau-go config show [flags] <remote>")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	remote := fs.Arg(0)
+
+	configData, source, code := loadConfigSource()
+	if code != exitOK {
+		return code
+	}
+	sections, _ := parseConfigSections(configData)
+	i := slices.IndexFunc(sections, func(section configSection) bool { return section.name == remote })
+	if i < 0 {
+		fmt.Printf("Error: %s has no section [%s]; configured: %s\n", source, remote, strings.Join(configRemotes(configData), ", "))
+		return exitNotFound
+	}
+	section := &sections[i]
+
+	fmt.Printf("# From %s\n", source)
+	fmt.Printf("[%s]\n", section.name)
+	for _, key := range section.keys {
+		fmt.Printf("%s = %s\n", key.name, redactConfigValue(key.name, key.value))
+	}
+
+	var defaults []string
+	if _, ok := section.value("root_folder"); !ok {
+		if rootFolder := rootFolders[section.name]; rootFolder != "" {
+			defaults = append(defaults, "root_folder = "+rootFolder)
+		}
+	}
+	if _, ok := section.value("base_url"); !ok {
+		if baseURL, ok := baseURLs[section.name]; ok {
+			defaults = append(defaults, "base_url = "+baseURL)
+		}
+	}
+	if len(defaults) > 0 {
+		fmt.Println("# Built-in defaults for keys the section doesn't set:")
+		for _, line := range defaults {
+			fmt.Printf("# %s\n", line)
+		}
+	}
+	return exitOK
+}
+
+// loadConfigSource loads the config in use and describes where it came from. On failure it prints
+// the error and returns the exit code.
+func loadConfigSource() ([]byte, string, int) {
+	configData, err := loadConfig()
+	if err != nil {
+		printError("Failed to load config", err)
+		return nil, "", exitFailure
+	}
+	if loadedConfigPath == "" {
+		return configData, "embedded config", exitOK
+	}
+	return configData, loadedConfigPath, exitOK
+}
+
+// redactConfigValue hides the secrets of a config value: secret keys entirely, and the access and
+// refresh tokens of a token, keeping its expiry visible
+func redactConfigValue(key, value string) string {
+	if value == "" {
+		return value
+	}
+	if slices.Contains(secretConfigKeys, key) {
+		return "<redacted>"
+	}
+	if key != "token" {
+		return value
+	}
+
+	var token map[string]any
+	if err := json.Unmarshal([]byte(value), &token); err != nil {
+		return "<redacted>"
+	}
+	for _, field := range []string{"access_token", "refresh_token"} {
+		if _, ok := token[field]; ok {
+			token[field] = "<redacted>"
+		}
+	}
+	var redacted strings.Builder
+	encoder := json.NewEncoder(&redacted)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(token); err != nil {
+		return "<redacted>"
+	}
+	return strings.TrimSpace(redacted.String())
+}
+
+// configTokenStatus summarizes whether a remote's token can still be used, for config list
+func configTokenStatus(section *configSection) string {
+	value, _ := section.value("token")
+	if value == "" {
+		return ColorRed + "missing" + ColorReset
+	}
+	if message, _ := checkConfigToken(value, section.name); message != "" {
+		return ColorRed + "needs login" + ColorReset
+	}
+	return ColorGreen + "ok" + ColorReset
+}
+
+// orDash returns value, or "-" for an empty value in a table
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// configReloadDelay lets an editor finish writing the config before it is read again
+const configReloadDelay = 500 * time.Millisecond
+
+// watchConfig reloads the config file in use when it changes on disk or the process receives SIGHUP,
+// for commands that keep running, until the command is interrupted. A new config replaces the old
+// one only if it has no errors; reloaded is called with it, or with the error that kept it out.
+func watchConfig(reloaded func(configData []byte, err error)) {
+	path := currentConfigPath()
+	if path == "" {
+		// The embedded config can't change while running
+		return
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// Editors often replace the file rather than write to it, so the folder is watched
+	var events chan fsnotify.Event
+	watched := map[string]bool{filepath.Clean(path): true}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		watched[resolved] = true
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		for file := range watched {
+			if err = watcher.Add(filepath.Dir(file)); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("%sWarning: not watching %s for changes, send SIGHUP to reload it: %v%s\n", ColorYellow, path, err, ColorReset)
+		if watcher != nil {
+			watcher.Close()
+			watcher = nil
+		}
+	}
+	if watcher != nil {
+		events = watcher.Events
+	}
+
+	go func() {
+		defer signal.Stop(hangup)
+		if watcher != nil {
+			defer watcher.Close()
+		}
+		var pending <-chan time.Time
+		for {
+			select {
+			case <-interrupted.Done():
+				return
+			case <-hangup:
+				pending = time.After(0)
+			case event := <-events:
+				if watched[filepath.Clean(event.Name)] {
+					pending = time.After(configReloadDelay)
+				}
+			case <-pending:
+				pending = nil
+				configData, changed, err := reloadConfig(path)
+				switch {
+				case err != nil:
+					fmt.Printf("%sWarning: keeping the previous config: %v%s\n", ColorYellow, err, ColorReset)
+				case changed:
+					fmt.Printf("[%s] Reloaded config from %s: remotes %v\n", time.Now().Format("2006-01-02 15:04:05"), path, configRemotes(configData))
+				}
+				reloaded(configData, err)
+			}
+		}
+	}()
+}
+
+// reloadConfig reads the config file at path again and makes it the config in use if it has no
+// errors, reporting whether it differs from the one it replaces
+func reloadConfig(path string) ([]byte, bool, error) {
+	configData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	sections, problems := parseConfigSections(configData)
+	for i := range sections {
+		problems = append(problems, validateConfigSection(configData, &sections[i])...)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+	var errs []configProblem
+	for _, problem := range problems {
+		if problem.err {
+			errs = append(errs, problem)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, false, fmt.Errorf("%s has %d errors, the first at line %d: [%s] %s; see 'ksau-go config validate'", path, len(errs), errs[0].line, errs[0].section, errs[0].message)
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	changed := !bytes.Equal(configData, loadedConfig)
+	loadedConfig = configData
+	return configData, changed, nil
+}
+
+// servedClient is the client of a remote that a long-running command uses for every request. It is
+// replaced by a client set up from the new config when the config is reloaded, picking up changed
+// credentials, tokens and limits; requests in progress finish with the client they started with.
+type servedClient struct {
+	remote   string
+	stateDir string
+	current  atomic.Pointer[azure.AzureClient]
+}
+
+// newServedClient holds client, the client of remote, for serving
+func newServedClient(remote, stateDir string, client *azure.AzureClient) *servedClient {
+	served := &servedClient{remote: remote, stateDir: stateDir}
+	served.current.Store(client)
+	return served
+}
+
+// get returns the client to use for a request
+func (served *servedClient) get() *azure.AzureClient {
+	return served.current.Load()
+}
+
+// reload replaces the client with one set up from configData, keeping the current one if that fails
+func (served *servedClient) reload(configData []byte) {
+	client, err := newClient(configData, served.remote, served.stateDir)
+	if err != nil {
+		fmt.Printf("%sWarning: keeping the previous client of remote '%s': %v%s\n", ColorYellow, served.remote, err, ColorReset)
+		return
+	}
+	served.current.Store(client)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// eraseLine clears the rest of the terminal line after a progress redraw
+var eraseLine = "\033[K"
+
+// disableANSI drops colors and escape sequences for consoles that would print them literally
+func disableANSI() {
+	ColorReset, ColorGreen, ColorYellow, ColorRed = "", "", "", ""
+	eraseLine = ""
+}
+
+// interrupted is cancelled on the first Ctrl+C or SIGTERM of a command that shuts down gracefully
+var interrupted, cancelInterrupted = context.WithCancel(context.Background())
+
+// gracefulShutdown is set by commands that stop and clean up once interrupted is cancelled
+// instead of being killed outright
+var gracefulShutdown atomic.Bool
+
+// handleInterrupt restores the terminal and exits with the conventional status when the user
+// presses Ctrl+C or the process is asked to terminate. Commands with gracefulShutdown set are
+// asked to stop first; a second signal exits immediately.
+func handleInterrupt() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if gracefulShutdown.Load() {
+			fmt.Printf("%s\nInterrupted, cleaning up (press Ctrl+C again to quit immediately)...\n", ColorReset)
+			cancelInterrupted()
+			<-signals
+		}
+		fmt.Printf("%s\nInterrupted.\n", ColorReset)
+		os.Exit(exitInterrupted)
+	}()
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setupConsole prepares the terminal for output; nothing is needed outside Windows
+func setupConsole() {}
+
+// longPath returns path unchanged; only Windows limits the length of local paths
+func longPath(path string) string {
+	return path
+}
+
+// fileCreationTime returns the zero time; creation times are only read on Windows
+func fileCreationTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+// separateProcessGroup keeps a terminal's Ctrl+C from reaching a child process, so it only gets the
+// single interrupt its parent passes on and can stop gracefully
+func separateProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
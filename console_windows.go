@@ -0,0 +1,67 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// enableVirtualTerminalProcessing is the console mode flag that makes Windows interpret ANSI escape sequences
+const enableVirtualTerminalProcessing = 0x0004
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// setupConsole enables ANSI escape sequences on the Windows console so colors and the progress bar
+// render, and falls back to plain output on consoles that don't support them
+func setupConsole() {
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		handle := syscall.Handle(f.Fd())
+
+		var mode uint32
+		if err := syscall.GetConsoleMode(handle, &mode); err != nil {
+			// Not a console, e.g. redirected to a file
+			continue
+		}
+		if mode&enableVirtualTerminalProcessing != 0 {
+			continue
+		}
+		if ok, _, _ := procSetConsoleMode.Call(uintptr(handle), uintptr(mode|enableVirtualTerminalProcessing)); ok == 0 {
+			disableANSI()
+		}
+	}
+}
+
+// longPath converts a local path into its \\?\ form when it is too long for the classic 260
+// character limit, so deeply nested build outputs can still be read and written
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil || len(abs) < 248 {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// fileCreationTime returns the time a local file was created, or the zero time if it isn't known
+func fileCreationTime(info os.FileInfo) time.Time {
+	attrs, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(0, attrs.CreationTime.Nanoseconds())
+}
+
+// separateProcessGroup does nothing on Windows: processes can't be interrupted there except by the
+// console's Ctrl+C, which child processes therefore keep receiving themselves
+func separateProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// runCopy implements the cp command, which duplicates a remote item on the server without transferring data locally
+func runCopy(args []string) int {
+	fs := flag.NewFlagSet("cp", flag.ExitOnError)
+	noWait := fs.Bool("no-wait", false, "Start the copy and print its monitor URL instead of waiting for it to finish (default: false)")
+	pollInterval := fs.Duration("poll-interval", 2*time.Second, "Interval between copy status checks (default: 2s)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ksau-go cp [flags] <source> <destination>")
+		fmt.Fprintln(fs.Output(), "Paths are relative to the remote's root folder, or remote:root/path to use one of its configured roots. If the destination is an existing folder the source is copied into it.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, fs.Arg(0), fs.Arg(1))
+	if code != exitOK {
+		return code
+	}
+	srcPath, destPath := paths[0], paths[1]
+
+	httpClient := &http.Client{}
+
+	// Copy into the destination if it is a folder, otherwise treat it as the new item's path
+	destFolder, name := azure.NewRemotePath(destPath).Dir().String(), azure.NewRemotePath(destPath).Base()
+	if dest, err := client.GetItem(httpClient, destPath); err == nil && dest.IsFolder() {
+		destFolder, name = destPath, azure.NewRemotePath(srcPath).Base()
+	}
+
+	monitorURL, err := client.Copy(httpClient, srcPath, destFolder, name)
+	if err != nil {
+		printError("Failed to start copy", err)
+		return exitCodeFor(err)
+	}
+	fmt.Printf("Copying %s to %s...\n", srcPath, remoteJoin(destFolder, name))
+
+	if *noWait {
+		fmt.Printf("Monitor URL: %s\n", monitorURL)
+		return exitOK
+	}
+
+	startTime := time.Now()
+	_, err = client.WaitForCopy(httpClient, monitorURL, *pollInterval, func(status *azure.CopyStatus) {
+		fmt.Printf("Copy %s: %.1f%%\n", status.Status, status.PercentageComplete)
+	})
+	if err != nil {
+		printError("Copy failed", err)
+		return exitCodeFor(err)
+	}
+
+	fmt.Printf("%sCopy completed in %s%s\n", ColorGreen, time.Since(startTime).Round(time.Second), ColorReset)
+	return exitOK
+}
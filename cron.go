@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression: the minutes, hours, days of the month, months and days
+// of the week at which a job runs, as bit sets
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	anyDay, anyWeekday                     bool // The day of the month or of the week was left open with *
+}
+
+// cronMacros are the shorthands cron accepts for common schedules
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonthNames   = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a standard five-field cron expression, e.g. "0 2 * * *" for 02:00 every day, or
+// one of the @daily style macros. Fields accept *, numbers, names of months and weekdays, ranges
+// (1-5), lists (1,15) and steps (*/15, 8-18/2); Sunday is 0 or 7.
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s': expected 5 fields (minute hour day month weekday)", expr)
+	}
+
+	schedule := &cronSchedule{
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid minute in '%s': %v", expr, err)
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid hour in '%s': %v", expr, err)
+	}
+	if schedule.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid day of the month in '%s': %v", expr, err)
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("invalid month in '%s': %v", expr, err)
+	}
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdayNames); err != nil {
+		return nil, fmt.Errorf("invalid day of the week in '%s': %v", expr, err)
+	}
+	// 7 is another name for Sunday
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+	return schedule, nil
+}
+
+// parseCronField parses one field of a cron expression into the set of values it matches
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s'", stepPart)
+			}
+		}
+
+		first, last := min, max
+		if rangePart != "*" {
+			low, high, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if first, err = parseCronValue(low, min, max, names); err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				if last, err = parseCronValue(high, min, max, names); err != nil {
+					return 0, err
+				}
+				if last < first {
+					return 0, fmt.Errorf("invalid range '%s'", rangePart)
+				}
+			} else if hasStep {
+				// n/step means from n to the end
+				last = max
+			}
+		}
+
+		for value := first; value <= last; value += step {
+			set |= 1 << value
+		}
+	}
+	return set, nil
+}
+
+// parseCronValue parses a number or name within a field's range
+func parseCronValue(value string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(value, name) {
+			return i, nil
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("'%s' is not between %d and %d", value, min, max)
+	}
+	return n, nil
+}
+
+// next returns the first time after t that the schedule matches, in t's location, or the zero time
+// if there is none within five years, e.g. for February 30
+func (schedule *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case schedule.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !schedule.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case schedule.hours&(1<<uint(t.Hour())) == 0:
+			// Truncate would round in UTC, which is off for zones with half-hour offsets
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case schedule.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay reports whether the schedule runs on t's day. As in cron, a day that matches either the
+// day of the month or the day of the week does when both are restricted.
+func (schedule *cronSchedule) matchesDay(t time.Time) bool {
+	day := schedule.days&(1<<uint(t.Day())) != 0
+	weekday := schedule.weekdays&(1<<uint(t.Weekday())) != 0
+	if schedule.anyDay || schedule.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// States of a job in the daemon's queue
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobPaused    = "paused"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// queuedJob is a transfer job of the daemon: ksau-go arguments run as a separate process
+type queuedJob struct {
+	ID       int       `json:"id"`
+	Args     []string  `json:"args"`
+	Dir      string    `json:"dir"` // Working directory of the jobs add that queued it, for relative paths
+	State    string    `json:"state"`
+	Added    time.Time `json:"added"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"` // Why the job couldn't be started
+	Log      string    `json:"log"`
+	Limits   jobLimits `json:"limits"` // Bandwidth, chunk size and parallelism the job chose, within the daemon's maximums
+}
+
+// transferQueue is the daemon's queue as persisted in the state directory
+type transferQueue struct {
+	NextID int          `json:"next_id"`
+	Jobs   []*queuedJob `json:"jobs"`
+}
+
+// daemon runs the jobs of a persistent queue, a few at a time, and takes commands over a unix socket
+type daemon struct {
+	queuePath string
+	logDir    string
+	transfers int
+	max       jobLimits // Most a job may choose for itself; jobs that don't choose are held to it too
+	mu        sync.Mutex
+	queue     transferQueue
+	running   map[int]*runningJob
+	wake      chan struct{}
+	wg        sync.WaitGroup
+	configErr error // Why the config file was last rejected on reload; queued jobs wait until it is fixed
+}
+
+// runningJob is the process of a running job
+type runningJob struct {
+	cancel context.CancelFunc
+	stopAs string // State to leave the job in once its process has stopped after a pause or cancel
+}
+
+// daemonFlags are the flags the daemon and jobs commands share to find the daemon's socket
+type daemonFlags struct {
+	stateDir string
+	socket   string
+}
+
+// registerDaemonFlags adds the state directory and socket flags to fs
+func registerDaemonFlags(fs *flag.FlagSet) *daemonFlags {
+	opts := &daemonFlags{}
+	fs.StringVar(&opts.stateDir, "state-dir", ".ksau-state", "Directory for the daemon's queue, job logs and socket (default: '.ksau-state')")
+	fs.StringVar(&opts.socket, "socket", "", "Unix socket the daemon listens on (default: $KSAU_DAEMON_SOCKET, then <state-dir>/daemon.sock)")
+	return opts
+}
+
+// socketPath returns the path of the daemon's socket
+func (opts *daemonFlags) socketPath() string {
+	if opts.socket != "" {
+		return opts.socket
+	}
+	if path := os.Getenv("KSAU_DAEMON_SOCKET"); path != "" {
+		return path
+	}
+	return filepath.Join(opts.stateDir, "daemon.sock")
+}
+
+// runDaemon implements the daemon command, which keeps running and works through a queue of
+// transfer jobs that survives restarts. Jobs are added and managed with the jobs command.
+func runDaemon(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	daemonOpts := registerDaemonFlags(fs)
+	transfers := fs.Int("transfers", 1, "Number of jobs to run at the same time (default: 1)")
+	jobsFile := fs.String("schedule", "", "Also run the recurring jobs of this jobs file, as the schedule command does (default: none)")
+	maxFlags := registerMaxLimitFlags(fs)
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fmt.Println("Usage: ksau-go daemon [flags]")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	if *transfers < 1 {
+		fmt.Println("Error: -transfers must be at least 1")
+		return exitUsage
+	}
+	maxLimits, err := maxFlags.parse()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	// Jobs read the config themselves; the daemon loads it to watch it for changes
+	if _, err := loadConfig(); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+
+	var sched *scheduler
+	if *jobsFile != "" {
+		jobs, err := loadJobs(*jobsFile)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return exitUsage
+		}
+		if sched, err = newScheduler(jobs, daemonOpts.stateDir, ""); err != nil {
+			fmt.Println("Error:", err)
+			return exitFailure
+		}
+		sched.env = maxLimits.env(maxLimitEnvPrefix)
+	}
+
+	d := &daemon{
+		queuePath: filepath.Join(daemonOpts.stateDir, "queue.json"),
+		logDir:    filepath.Join(daemonOpts.stateDir, "jobs"),
+		transfers: *transfers,
+		max:       maxLimits,
+		running:   make(map[int]*runningJob),
+		wake:      make(chan struct{}, 1),
+	}
+	if err := d.load(); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	if err := os.MkdirAll(d.logDir, 0o700); err != nil {
+		fmt.Println("Error: failed to create log directory:", err)
+		return exitFailure
+	}
+	if sched != nil {
+		if err := os.MkdirAll(sched.logDir, 0o700); err != nil {
+			fmt.Println("Error: failed to create log directory:", err)
+			return exitFailure
+		}
+	}
+
+	listener, err := listenDaemonSocket(daemonOpts.socketPath())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	server := &http.Server{Handler: d.handler()}
+	go server.Serve(listener)
+
+	shareConfig()
+	gracefulShutdown.Store(true)
+	watchConfig(d.configReloaded)
+
+	fmt.Printf("Daemon listening on %s with %d jobs queued (press Ctrl+C to stop)\n", daemonOpts.socketPath(), d.count(jobQueued))
+	scheduled := make(chan struct{})
+	if sched != nil {
+		go func() {
+			defer close(scheduled)
+			sched.loop()
+		}()
+	} else {
+		close(scheduled)
+	}
+
+	d.dispatch()
+
+	server.Shutdown(context.Background())
+	fmt.Println("Waiting for running jobs to stop...")
+	d.wg.Wait()
+	<-scheduled
+	fmt.Println("Stopped.")
+	return exitOK
+}
+
+// listenDaemonSocket listens on the daemon's unix socket, replacing the socket file of a daemon that
+// didn't shut down cleanly but refusing to take over from one that is still running
+func listenDaemonSocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already running at %s", path)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	// Anyone who can reach the socket can run transfers with the daemon's credentials
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict access to %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// load reads the queue. Jobs that were running when the daemon last stopped are queued again.
+func (d *daemon) load() error {
+	data, err := os.ReadFile(d.queuePath)
+	if os.IsNotExist(err) {
+		d.queue.NextID = 1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &d.queue); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", d.queuePath, err)
+	}
+	for _, job := range d.queue.Jobs {
+		if job.State == jobRunning {
+			job.State = jobQueued
+		}
+	}
+	return nil
+}
+
+// save writes the queue, replacing the file atomically. The caller holds d.mu.
+func (d *daemon) save() {
+	data, err := json.MarshalIndent(&d.queue, "", "  ")
+	if err == nil {
+		tmpPath := d.queuePath + ".tmp"
+		if err = os.WriteFile(tmpPath, data, 0o600); err == nil {
+			err = os.Rename(tmpPath, d.queuePath)
+		}
+	}
+	if err != nil {
+		fmt.Printf("%sWarning: failed to save the job queue: %v%s\n", ColorYellow, err, ColorReset)
+	}
+}
+
+// count returns the number of jobs in a state
+func (d *daemon) count(state string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, job := range d.queue.Jobs {
+		if job.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// dispatch starts queued jobs in the order they were added, up to the number of transfers at a
+// time, until interrupted
+func (d *daemon) dispatch() {
+	for {
+		d.mu.Lock()
+		for _, job := range d.queue.Jobs {
+			if len(d.running) >= d.transfers || d.configErr != nil {
+				break
+			}
+			if job.State == jobQueued {
+				d.start(job)
+			}
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-interrupted.Done():
+			return
+		case <-d.wake:
+		}
+	}
+}
+
+// configReloaded is called when the config file changed or the daemon received SIGHUP. Jobs started
+// from then on run with the new config, while running jobs keep the one they started with. While
+// the config has errors, queued jobs are held rather than started only to fail.
+func (d *daemon) configReloaded(configData []byte, err error) {
+	d.mu.Lock()
+	held := d.configErr != nil
+	d.configErr = err
+	d.mu.Unlock()
+	switch {
+	case err != nil && !held:
+		fmt.Println("Queued jobs are held until the config is fixed.")
+	case err == nil && held:
+		fmt.Println("Config fixed; starting queued jobs again.")
+	}
+	d.poke()
+}
+
+// poke makes dispatch look for jobs to start
+func (d *daemon) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start runs a job in the background. The caller holds d.mu.
+func (d *daemon) start(job *queuedJob) {
+	ctx, cancel := context.WithCancel(interrupted)
+	d.running[job.ID] = &runningJob{cancel: cancel}
+	job.State = jobRunning
+	job.Started = time.Now()
+	job.Finished = time.Time{}
+	job.Error = ""
+	d.save()
+	fmt.Printf("[%s] Starting job %d: ksau-go %s\n", job.Started.Format("2006-01-02 15:04:05"), job.ID, formatJobArgs(job.Args))
+
+	args, dir, logPath := job.Args, job.Dir, job.Log
+	env := append(job.Limits.env(jobLimitEnvPrefix), d.max.env(maxLimitEnvPrefix)...)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer cancel()
+		exitCode, err := runJobProcess(ctx, args, dir, logPath, env)
+		d.finish(job, exitCode, err)
+	}()
+}
+
+// finish records how a job's process ended. A job stopped by the daemon shutting down is queued
+// again, to run from the start on its next launch.
+func (d *daemon) finish(job *queuedJob, exitCode int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stopAs := d.running[job.ID].stopAs
+	delete(d.running, job.ID)
+
+	job.Finished = time.Now()
+	job.ExitCode = exitCode
+	if err != nil {
+		job.Error = err.Error()
+	}
+	switch {
+	case stopAs != "":
+		job.State = stopAs
+	case interrupted.Err() != nil:
+		job.State = jobQueued
+	case err == nil && exitCode == exitOK:
+		job.State = jobDone
+	default:
+		job.State = jobFailed
+	}
+	d.save()
+
+	timestamp := job.Finished.Format("2006-01-02 15:04:05")
+	switch job.State {
+	case jobDone:
+		fmt.Printf("%s[%s] Job %d finished in %s%s\n", ColorGreen, timestamp, job.ID, job.Finished.Sub(job.Started).Round(time.Second), ColorReset)
+	case jobFailed:
+		fmt.Printf("%s[%s] Job %d failed with exit code %d; see %s%s\n", ColorRed, timestamp, job.ID, exitCode, job.Log, ColorReset)
+	default:
+		fmt.Printf("[%s] Job %d %s\n", timestamp, job.ID, job.State)
+	}
+	d.poke()
+}
+
+// handler serves the control API the jobs command uses
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		writeDaemonJSON(w, http.StatusOK, d.queue.Jobs)
+	})
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Args   []string  `json:"args"`
+			Dir    string    `json:"dir"`
+			Limits jobLimits `json:"limits"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Args) == 0 {
+			writeDaemonError(w, http.StatusBadRequest, "expected the arguments of the job")
+			return
+		}
+		if request.Limits.ChunkSize < 0 || request.Limits.Parallel < 0 || request.Limits.BwLimit < 0 {
+			writeDaemonError(w, http.StatusBadRequest, "limits can't be negative")
+			return
+		}
+		if err := request.Limits.check(d.max); err != nil {
+			writeDaemonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeDaemonJSON(w, http.StatusCreated, d.add(request.Args, request.Dir, request.Limits))
+	})
+	mux.HandleFunc("POST /jobs/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeDaemonError(w, http.StatusNotFound, fmt.Sprintf("no job %s", r.PathValue("id")))
+			return
+		}
+		job, status, err := d.control(id, r.PathValue("action"))
+		if err != nil {
+			writeDaemonError(w, status, err.Error())
+			return
+		}
+		writeDaemonJSON(w, http.StatusOK, job)
+	})
+	return mux
+}
+
+// add queues a job and returns a copy of it
+func (d *daemon) add(args []string, dir string, limits jobLimits) queuedJob {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job := &queuedJob{ID: d.queue.NextID, Args: args, Dir: dir, State: jobQueued, Added: time.Now(), Limits: limits}
+	d.queue.NextID++
+	if logDir, err := filepath.Abs(d.logDir); err == nil {
+		job.Log = filepath.Join(logDir, strconv.Itoa(job.ID)+".log")
+	} else {
+		job.Log = filepath.Join(d.logDir, strconv.Itoa(job.ID)+".log")
+	}
+	d.queue.Jobs = append(d.queue.Jobs, job)
+	d.save()
+	d.poke()
+	return *job
+}
+
+// control cancels, pauses or resumes a job and returns a copy of it, or the HTTP status and error
+// for an unknown job or an action that doesn't apply to the job's state. A running job that is
+// cancelled or paused is interrupted and takes its new state once its process has stopped.
+func (d *daemon) control(id int, action string) (queuedJob, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var job *queuedJob
+	for _, candidate := range d.queue.Jobs {
+		if candidate.ID == id {
+			job = candidate
+		}
+	}
+	if job == nil {
+		return queuedJob{}, http.StatusNotFound, fmt.Errorf("no job %d", id)
+	}
+
+	var target string
+	switch action {
+	case "cancel":
+		target = jobCancelled
+	case "pause":
+		target = jobPaused
+	case "resume":
+		target = jobQueued
+	default:
+		return queuedJob{}, http.StatusNotFound, fmt.Errorf("unknown action '%s'", action)
+	}
+
+	switch {
+	case action == "resume" && job.State == jobPaused,
+		action == "pause" && job.State == jobQueued,
+		action == "cancel" && (job.State == jobQueued || job.State == jobPaused):
+		job.State = target
+		d.poke()
+	case action != "resume" && job.State == jobRunning:
+		process := d.running[id]
+		process.stopAs = target
+		process.cancel()
+	default:
+		return queuedJob{}, http.StatusConflict, fmt.Errorf("can't %s job %d: it is %s", action, id, job.State)
+	}
+	d.save()
+	return *job, http.StatusOK, nil
+}
+
+// writeDaemonJSON answers a control request with a JSON body
+func writeDaemonJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeDaemonError answers a control request with an error
+func writeDaemonError(w http.ResponseWriter, status int, message string) {
+	writeDaemonJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// dedupIndexName is the name of the hash index kept in the root of a deduplicated folder
+const dedupIndexName = ".ksau-index.json"
+
+// dedupIndex maps the QuickXorHash of every file under a remote folder to where it is stored, so
+// uploads can skip content that is already present anywhere under the folder
+type dedupIndex struct {
+	remoteFolder string
+	mu           sync.Mutex
+	entries      map[string]dedupEntry
+	dirty        bool
+}
+
+// dedupEntry is a single index record; Path is relative to the indexed folder
+type dedupEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// loadDedupIndex downloads the hash index of remoteFolder, or builds it by scanning the folder if it
+// doesn't exist yet or rebuild is set
+func loadDedupIndex(client *azure.AzureClient, httpClient *http.Client, remoteFolder string, rebuild bool) (*dedupIndex, error) {
+	index := &dedupIndex{
+		remoteFolder: remoteFolder,
+		entries:      make(map[string]dedupEntry),
+	}
+
+	if !rebuild {
+		var buf bytes.Buffer
+		_, err := client.Download(httpClient, remoteJoin(remoteFolder, dedupIndexName), &buf)
+		if err == nil {
+			if err := json.Unmarshal(buf.Bytes(), &index.entries); err != nil {
+				return nil, fmt.Errorf("failed to parse hash index: %v", err)
+			}
+			fmt.Printf("Loaded hash index with %d entries\n", len(index.entries))
+			return index, nil
+		}
+		if graphErr, ok := azure.AsGraphError(err); !ok || graphErr.StatusCode != http.StatusNotFound {
+			return nil, fmt.Errorf("failed to download hash index: %w", err)
+		}
+	}
+
+	fmt.Printf("Building hash index of %s...\n", remoteFolder)
+	if err := index.scan(client, httpClient, ""); err != nil {
+		return nil, err
+	}
+	index.dirty = true
+	fmt.Printf("Indexed %d files\n", len(index.entries))
+	return index, nil
+}
+
+// scan adds every file below the relative folder rel to the index
+func (index *dedupIndex) scan(client *azure.AzureClient, httpClient *http.Client, rel string) error {
+	items, err := client.ListChildren(httpClient, remoteJoin(index.remoteFolder, rel))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		itemPath := remoteJoin(rel, item.Name)
+		if item.IsFolder() {
+			if err := index.scan(client, httpClient, itemPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if itemPath == dedupIndexName || item.File == nil || item.File.Hashes.QuickXorHash == "" {
+			continue
+		}
+		index.entries[item.File.Hashes.QuickXorHash] = dedupEntry{Path: itemPath, Size: item.Size}
+	}
+	return nil
+}
+
+// lookup returns the full remote path of already stored content with the given hash, if any
+func (index *dedupIndex) lookup(quickXorHash string) (string, bool) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	entry, ok := index.entries[quickXorHash]
+	if !ok {
+		return "", false
+	}
+	return remoteJoin(index.remoteFolder, entry.Path), true
+}
+
+// add records newly uploaded content at remotePath, if it lies under the indexed folder
+func (index *dedupIndex) add(quickXorHash, remotePath string, size int64) {
+	rel, ok := azure.NewRemotePath(remotePath).Rel(azure.NewRemotePath(index.remoteFolder))
+	if !ok {
+		return
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.entries[quickXorHash] = dedupEntry{Path: rel.String(), Size: size}
+	index.dirty = true
+}
+
+// save uploads the index back to the folder if it changed
+func (index *dedupIndex) save(client *azure.AzureClient, httpClient *http.Client) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if !index.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(index.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode hash index: %v", err)
+	}
+	if _, err := client.PutSmallFile(httpClient, remoteJoin(index.remoteFolder, dedupIndexName), data); err != nil {
+		return fmt.Errorf("failed to upload hash index: %w", err)
+	}
+	index.dirty = false
+	return nil
+}
+
+// upload skips the upload if identical content is already indexed, otherwise uploads the file
+// and adds it to the index
+func (index *dedupIndex) upload(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, localPath, remoteFilePath string) (*uploadResult, error) {
+	localHash, err := QuickXorHash(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate local QuickXorHash: %v", err)
+	}
+
+	if existingPath, ok := index.lookup(localHash); ok {
+		item, err := client.GetItem(httpClient, existingPath)
+		if err == nil && !item.IsFolder() && item.File != nil && item.File.Hashes.QuickXorHash == localHash {
+			fmt.Printf("%sIdentical content already stored at %s, skipping upload.%s\n", ColorYellow, existingPath, ColorReset)
+			result := &uploadResult{fileID: item.ID, size: item.Size, quickXorHash: localHash}
+			printDownloadURL(result, opts.remoteConfig, existingPath)
+			return result, nil
+		}
+		// The indexed copy is gone or changed, so upload and let the new copy replace the entry
+		fmt.Printf("%sIndexed copy at %s is stale, uploading.%s\n", ColorYellow, existingPath, ColorReset)
+	}
+
+	result, err := uploadFile(client, httpClient, opts, localPath, remoteFilePath)
+	if err != nil {
+		return result, err
+	}
+
+	index.add(localHash, remoteFilePath, result.size)
+	return result, nil
+}
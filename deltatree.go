@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// remoteTree is a remote folder's items as of its deltaLink, kept between runs so a sync only has
+// to fetch the items that changed since instead of listing the whole tree
+type remoteTree struct {
+	RootID    string                    `json:"root_id"`
+	DeltaLink string                    `json:"delta_link"`
+	Items     map[string]remoteTreeItem `json:"items"` // By item ID
+	path      string
+}
+
+// remoteTreeItem is a file or folder of a remoteTree
+type remoteTreeItem struct {
+	ParentID string          `json:"parent_id"`
+	Item     azure.DriveItem `json:"item"`
+}
+
+// listRemoteFiles returns every file below remoteDir keyed by its slash-separated relative path,
+// like listRemoteTree. With a stateDir it uses Graph's delta API and remembers the tree there, so
+// repeated runs only fetch what changed; drives that don't support delta queries on the folder
+// are listed in full.
+func listRemoteFiles(client *azure.AzureClient, httpClient *http.Client, stateDir, remote, remoteDir string) (map[string]azure.DriveItem, error) {
+	files := make(map[string]azure.DriveItem)
+	if stateDir == "" {
+		return files, listRemoteTree(client, httpClient, remoteDir, "", files)
+	}
+
+	tree, err := syncRemoteTree(client, httpClient, remoteDir, remoteTreePath(stateDir, remote, remoteDir))
+	if err == nil {
+		return tree.files(), nil
+	}
+	if graphErr, ok := azure.AsGraphError(err); ok && graphErr.StatusCode == http.StatusNotFound {
+		return nil, err
+	}
+
+	fmt.Printf("%sChange tracking unavailable (%v), listing the whole folder%s\n", ColorYellow, err, ColorReset)
+	return files, listRemoteTree(client, httpClient, remoteDir, "", files)
+}
+
+// syncRemoteTree brings the tree saved at statePath up to date with the changes the delta API
+// reports and saves it again; without a usable saved tree the whole folder is fetched
+func syncRemoteTree(client *azure.AzureClient, httpClient *http.Client, remoteDir, statePath string) (*remoteTree, error) {
+	tree, err := loadRemoteTree(statePath)
+	if err != nil {
+		fmt.Printf("%sWarning: ignoring saved remote tree: %v%s\n", ColorYellow, err, ColorReset)
+		tree = &remoteTree{path: statePath}
+	}
+
+	if tree.RootID == "" {
+		root, err := client.GetItem(httpClient, remoteDir)
+		if err != nil {
+			return nil, err
+		}
+		if !root.IsFolder() {
+			return nil, fmt.Errorf("'%s' is not a folder", remoteDir)
+		}
+		tree = &remoteTree{RootID: root.ID, Items: make(map[string]remoteTreeItem), path: statePath}
+	}
+
+	changes, deltaLink, err := client.Delta(httpClient, remoteDir, tree.DeltaLink)
+	if graphErr, ok := azure.AsGraphError(err); ok && graphErr.StatusCode == http.StatusGone && tree.DeltaLink != "" {
+		fmt.Println("Saved change token expired, fetching the whole folder again.")
+		tree.Items = make(map[string]remoteTreeItem)
+		changes, deltaLink, err = client.Delta(httpClient, remoteDir, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tree.DeltaLink != "" {
+		fmt.Printf("Fetched %d changes since the last run\n", len(changes))
+	}
+	tree.apply(changes)
+	tree.DeltaLink = deltaLink
+
+	if err := tree.save(); err != nil {
+		fmt.Printf("%sWarning: failed to save remote tree: %v%s\n", ColorYellow, err, ColorReset)
+	}
+	return tree, nil
+}
+
+// apply records added, changed and deleted items
+func (tree *remoteTree) apply(changes []azure.DeltaItem) {
+	for _, change := range changes {
+		if change.Deleted {
+			delete(tree.Items, change.ID)
+			continue
+		}
+		tree.Items[change.ID] = remoteTreeItem{ParentID: change.ParentID, Item: change.DriveItem}
+	}
+}
+
+// files returns the files of the tree keyed by their slash-separated path relative to its root;
+// items whose parents are no longer in the tree have been deleted with them and are left out
+func (tree *remoteTree) files() map[string]azure.DriveItem {
+	files := make(map[string]azure.DriveItem)
+	for _, entry := range tree.Items {
+		if entry.Item.IsFolder() {
+			continue
+		}
+		if rel, ok := tree.relPath(entry); ok {
+			files[rel] = entry.Item
+		}
+	}
+	return files
+}
+
+// relPath returns the path of an item relative to the root by following its parents
+func (tree *remoteTree) relPath(entry remoteTreeItem) (string, bool) {
+	rel := entry.Item.Name
+	for depth := 0; entry.ParentID != tree.RootID; depth++ {
+		parent, ok := tree.Items[entry.ParentID]
+		if !ok || depth > len(tree.Items) {
+			return "", false
+		}
+		rel = path.Join(parent.Item.Name, rel)
+		entry = parent
+	}
+	return rel, true
+}
+
+// remoteTreePath returns the file a remote folder's tree is kept in
+func remoteTreePath(stateDir, remote, remoteDir string) string {
+	sum := sha256.Sum256([]byte(remote + ":" + filepath.ToSlash(remoteDir)))
+	return filepath.Join(stateDir, "delta-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadRemoteTree reads the tree saved at path; a missing one is empty
+func loadRemoteTree(path string) (*remoteTree, error) {
+	tree := &remoteTree{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tree, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, tree); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if tree.Items == nil {
+		tree.Items = make(map[string]remoteTreeItem)
+	}
+	return tree, nil
+}
+
+// save writes the tree atomically
+func (tree *remoteTree) save() error {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(tree.path), 0o700); err != nil {
+		return err
+	}
+
+	tmpPath := tree.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, tree.path)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// doctorEndpoints are the hosts every remote needs to reach: sign-in for token refreshes and Graph
+var doctorEndpoints = []string{"https://login.microsoftonline.com/", "https://graph.microsoft.com/v1.0/"}
+
+// doctorProbeSize is the size of the test upload, small enough for a single request
+const doctorProbeSize = 1 << 20
+
+// doctor runs the checks and counts their outcomes
+type doctor struct {
+	failures int
+	warnings int
+	exitCode int // Exit code of the first failure
+}
+
+// runDoctor implements the doctor command, which checks everything an upload depends on, in the
+// order it is needed, and says how to fix what's wrong
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	remoteConfig := fs.String("remote-config", "", "Only check this remote configuration section (default: all remotes)")
+	noUpload := fs.Bool("no-upload", false, "Skip the test upload, leaving the drive untouched (default: false)")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	d := &doctor{}
+	fmt.Println("Config")
+	configData, err := loadConfig()
+	if err != nil {
+		d.fail("load the config", err, "Check the file given with -config or KSAU_CONFIG, and the network options (-proxy, -ca-cert, -tls-min-version).")
+		return d.summary()
+	}
+	if loadedConfigPath != "" {
+		d.ok(fmt.Sprintf("Using %s", loadedConfigPath))
+	} else {
+		d.ok("Using the config embedded at build time")
+	}
+
+	remotes := []string{*remoteConfig}
+	if *remoteConfig == "" {
+		remotes = configRemotes(configData)
+	} else if !slices.Contains(configRemotes(configData), *remoteConfig) {
+		d.fail(fmt.Sprintf("find remote '%s'", *remoteConfig), errors.New("no such section in the config"), fmt.Sprintf("The config has: %v.", configRemotes(configData)))
+		return d.summary()
+	}
+	if len(remotes) == 0 {
+		d.fail("find a remote", errors.New("the config has no onedrive sections"), "Run 'ksau-go login' to create one, or point -config at an rclone.conf that has one.")
+		return d.summary()
+	}
+	d.ok(fmt.Sprintf("Remotes: %v", remotes))
+
+	fmt.Println("\nNetwork")
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	for _, endpoint := range doctorEndpoints {
+		d.checkEndpoint(httpClient, endpoint)
+	}
+
+	for _, remote := range remotes {
+		fmt.Printf("\nRemote %s\n", remote)
+		d.checkRemote(configData, remote, *stateDir, !*noUpload)
+	}
+	return d.summary()
+}
+
+// ok reports a passed check
+func (d *doctor) ok(message string) {
+	fmt.Printf("  %s[ ok ]%s %s\n", ColorGreen, ColorReset, message)
+}
+
+// warn reports a problem that doesn't stop uploads, with how to fix it
+func (d *doctor) warn(message, hint string) {
+	d.warnings++
+	fmt.Printf("  %s[warn]%s %s\n", ColorYellow, ColorReset, message)
+	fmt.Printf("         %s\n", hint)
+}
+
+// fail reports a failed check with the error and how to fix it
+func (d *doctor) fail(what string, err error, hint string) {
+	d.failures++
+	if d.exitCode == exitOK {
+		d.exitCode = exitCodeFor(err)
+	}
+	fmt.Printf("  %s[FAIL]%s Failed to %s: %v\n", ColorRed, ColorReset, what, err)
+	fmt.Printf("         %s\n", hint)
+}
+
+// summary prints the number of problems found and returns the exit code of the first failure
+func (d *doctor) summary() int {
+	fmt.Println()
+	switch {
+	case d.failures > 0:
+		fmt.Printf("%sProblems found: %d, warnings: %d.%s\n", ColorRed, d.failures, d.warnings, ColorReset)
+		return d.exitCode
+	case d.warnings > 0:
+		fmt.Printf("%sNo problems found, warnings: %d.%s\n", ColorYellow, d.warnings, ColorReset)
+	default:
+		fmt.Printf("%sEverything looks good.%s\n", ColorGreen, ColorReset)
+	}
+	return exitOK
+}
+
+// checkEndpoint checks that a Microsoft endpoint answers; any HTTP status will do, since the request
+// isn't authenticated
+func (d *doctor) checkEndpoint(httpClient *http.Client, endpoint string) {
+	start := time.Now()
+	resp, err := httpClient.Get(endpoint)
+	if err == nil {
+		resp.Body.Close()
+		d.ok(fmt.Sprintf("Reached %s in %s", endpoint, formatLatency(time.Since(start))))
+		return
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &certErr):
+		d.fail("reach "+endpoint, err, "The server certificate isn't trusted, e.g. behind a TLS-intercepting firewall: pass its CA certificate with -ca-cert or KSAU_CA_CERT.")
+	case errors.As(err, &dnsErr):
+		d.fail("reach "+endpoint, err, "The name couldn't be resolved: check the DNS settings, or set -proxy or KSAU_PROXY if the network only allows a proxy out.")
+	default:
+		d.fail("reach "+endpoint, err, "Check the internet connection and firewall, or set -proxy or KSAU_PROXY if the network requires a proxy.")
+	}
+}
+
+// checkRemote checks a remote's config, token, folders and, with upload set, times a test upload
+func (d *doctor) checkRemote(configData []byte, remote, stateDir string, upload bool) {
+	client, err := newClient(configData, remote, stateDir)
+	if err != nil {
+		d.fail("set up the client", err, fmt.Sprintf("Fix the [%s] section of the config; it needs client_id, client_secret and token.", remote))
+		return
+	}
+	d.ok("Config section is valid")
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	start := time.Now()
+	if err := client.RefreshAccessToken(httpClient); err != nil {
+		hint := "Check the network checks above and try again."
+		if exitCodeFor(err) == exitAuth {
+			hint = fmt.Sprintf("The refresh token was revoked or has expired: run 'ksau-go login -remote-config %s' to sign in again.", remote)
+		}
+		d.fail("refresh the access token", err, hint)
+		return
+	}
+	d.ok(fmt.Sprintf("Refreshed the access token in %s", formatLatency(time.Since(start))))
+
+	rootFolder := remoteRootFolder(configData, remote)
+	rootOK := d.checkFolder(client, httpClient, remote, "root_folder", rootFolder)
+	roots := remoteRoots(configData, remote)
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d.checkFolder(client, httpClient, remote, "root "+name, roots[name])
+	}
+
+	if _, ok := remoteBaseURL(configData, remote); !ok {
+		if _, ok := remoteSetting(configData, remote, "url_template"); !ok {
+			d.warn("No base_url or url_template, so uploads won't print download URLs", "Set base_url to the address of the index that serves the root folder.")
+		}
+	}
+
+	if !upload || !rootOK {
+		return
+	}
+	if policy, _ := remoteAccessPolicy(configData, remote); policy != nil && (!slices.Contains(policy.Operations, azure.OpUpload) || !slices.Contains(policy.Operations, azure.OpDelete)) {
+		d.ok("Skipped the test upload: the remote's allow key doesn't permit both upload and delete")
+		return
+	}
+	d.checkUpload(client, httpClient, rootFolder)
+}
+
+// checkFolder checks that a folder named in the remote's config exists, reporting whether it does
+func (d *doctor) checkFolder(client *azure.AzureClient, httpClient *http.Client, remote, key, folder string) bool {
+	item, err := client.GetItem(httpClient, folder)
+	switch {
+	case err == nil && item.IsFolder():
+		d.ok(fmt.Sprintf("%s '/%s' exists", key, folder))
+		return true
+	case err == nil:
+		d.fail(fmt.Sprintf("use %s '/%s'", key, folder), errors.New("it is a file, not a folder"), "Point the key at a folder in the config.")
+	case exitCodeFor(err) == exitNotFound:
+		d.fail(fmt.Sprintf("find %s '/%s'", key, folder), err, fmt.Sprintf("Create it with 'ksau-go mkdir -remote-config %s /%s', or fix the key in the config.", remote, folder))
+	default:
+		d.fail(fmt.Sprintf("look up %s '/%s'", key, folder), err, "Check the remote's drive_id and the account's access to the folder.")
+	}
+	return false
+}
+
+// checkUpload times the upload of a small file to the root folder, then deletes it
+func (d *doctor) checkUpload(client *azure.AzureClient, httpClient *http.Client, rootFolder string) {
+	data := make([]byte, doctorProbeSize)
+	rand.Read(data)
+	probePath := remoteJoin(rootFolder, fmt.Sprintf(".ksau-doctor-%d", time.Now().UnixNano()))
+
+	start := time.Now()
+	if _, err := client.PutSmallFile(httpClient, probePath, data); err != nil {
+		hint := "Check that the account can write to the root folder."
+		if exitCodeFor(err) == exitQuota {
+			hint = "The drive is full: free up space or upload to another remote."
+		}
+		d.fail("upload a test file", err, hint)
+		return
+	}
+	elapsed := time.Since(start)
+	speed := int64(float64(doctorProbeSize) / elapsed.Seconds())
+	d.ok(fmt.Sprintf("Uploaded %s in %s (%s/s)", formatBytes(doctorProbeSize), formatLatency(elapsed), formatBytes(speed)))
+
+	if err := client.Delete(httpClient, probePath); err != nil {
+		d.warn(fmt.Sprintf("Failed to delete the test file /%s: %v", probePath, err), "Delete it by hand with 'ksau-go rm'.")
+	}
+}
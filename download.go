@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// runDownload implements the download command, which saves a remote file, or with -r a whole
+// folder, locally. Files are written to .partial files first, so an interrupted download resumes
+// when rerun.
+func runDownload(args []string) int {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	remotePath := fs.String("remote", "", "Path of the remote file, or with -r folder, to download, relative to the remote's root folder (required)")
+	outPath := fs.String("out", "", "Local path to save the file or folder to (defaults to the remote name in the current directory)")
+	recursive := fs.Bool("r", false, "Download a remote folder with everything below it; -out is then the local directory to mirror it into (default: false)")
+	transfers := fs.Int("transfers", 1, "Number of files to download at the same time with -r (default: 1)")
+	streams := fs.Int("streams", 4, "Number of ranged requests to download a large file with at the same time (default: 4)")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification of the downloaded file (default: false)")
+	bwLimit := fs.String("bwlimit", "", "Limit the transfer rate in bytes/s, e.g. 4M, or follow a schedule such as \"08:00,1M 23:00,off\" (default: no limit)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens and the state of interrupted downloads (default: '.ksau-state')")
+	filterOptions := registerFilterFlags(fs)
+	registerConfigFlag(fs)
+	registerMetricsFlag(fs)
+	fs.Parse(args)
+
+	if *remotePath == "" {
+		fmt.Println("Error: the -remote flag is required")
+		fs.Usage()
+		return exitUsage
+	}
+	if *streams < 1 {
+		fmt.Println("Error: -streams must be at least 1")
+		return exitUsage
+	}
+
+	filter, err := filterOptions.build()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	bandwidth, err := parseBandwidth(*bwLimit)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, *remotePath)
+	if code != exitOK {
+		return code
+	}
+	if err := startMetricsServer(); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	client.UseBandwidthLimit(bandwidth)
+	fullRemotePath := paths[0]
+
+	localPath := *outPath
+	if localPath == "" {
+		localPath = azure.NewRemotePath(fullRemotePath).Base()
+	}
+	localPath = longPath(localPath)
+
+	// No overall timeout: a large download takes far longer than a metadata call
+	httpClient := &http.Client{}
+
+	item, err := client.GetItem(httpClient, fullRemotePath)
+	if err != nil {
+		printError("Failed to get remote file", err)
+		return exitCodeFor(err)
+	}
+
+	opts := downloadOptions{streams: *streams, skipHash: *skipHash, stateDir: *stateDir, remoteConfig: *remoteConfig, transfers: *transfers}
+	if item.IsFolder() {
+		if !*recursive {
+			fmt.Printf("Error: '%s' is a folder; use -r to download it with its contents\n", fullRemotePath)
+			return exitUsage
+		}
+		return downloadFolder(client, httpClient, opts, filter, fullRemotePath, localPath)
+	}
+
+	fmt.Printf("Downloading %s to %s...\n", fullRemotePath, localPath)
+
+	// Stopped cleanly on Ctrl+C, so the .partial file and its state are kept for resuming
+	gracefulShutdown.Store(true)
+
+	startTime := time.Now()
+	if err := downloadFile(client, httpClient, item, fullRemotePath, localPath, opts); err != nil {
+		printError("Failed to download file", err)
+		if _, statErr := os.Stat(localPath + partialSuffix); statErr == nil {
+			fmt.Printf("%sPartial download kept in %s; rerun the same command to resume.%s\n", ColorYellow, localPath+partialSuffix, ColorReset)
+		}
+		return exitCodeFor(err)
+	}
+
+	fmt.Printf("%sDownloaded %s in %s%s\n", ColorGreen, formatBytes(item.Size), time.Since(startTime).Round(time.Millisecond), ColorReset)
+	return exitOK
+}
+
+// downloadOptions holds the settings shared by the files of a download
+type downloadOptions struct {
+	streams      int
+	skipHash     bool
+	stateDir     string
+	remoteConfig string
+	transfers    int // Files downloaded at the same time, which then log progress lines instead of sharing one
+}
+
+// downloadFile downloads the remote file item at remotePath into localPath.partial, resuming an
+// earlier attempt recorded in the state directory, and only renames it to localPath once it is
+// complete and its QuickXorHash matches. A failed download keeps the .partial file and its state.
+func downloadFile(client *azure.AzureClient, httpClient *http.Client, item *azure.DriveItem, remotePath, localPath string, opts downloadOptions) error {
+	partialPath := localPath + partialSuffix
+	state, err := loadDownloadState(downloadStatePath(opts.stateDir, localPath, opts.remoteConfig, remotePath))
+	if err != nil {
+		fmt.Printf("%sWarning: failed to load download state, starting over: %v%s\n", ColorYellow, err, ColorReset)
+		state = &downloadState{path: downloadStatePath(opts.stateDir, localPath, opts.remoteConfig, remotePath)}
+	}
+
+	// Only resume if the remote file is still the version the .partial file holds parts of
+	flags := os.O_RDWR | os.O_CREATE
+	_, statErr := os.Stat(partialPath)
+	resume := statErr == nil && state.matches(remotePath, item) && len(state.CompletedRanges) > 0
+	if resume {
+		fmt.Printf("Resuming download, %s of %s already downloaded.\n", formatBytes(state.completedBytes()), formatBytes(item.Size))
+	} else {
+		state.reset(remotePath, item)
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(partialPath, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %v", err)
+	}
+	if err := state.save(); err != nil {
+		fmt.Printf("%sWarning: failed to save download state: %v%s\n", ColorYellow, err, ColorReset)
+	}
+
+	bar := newProgressBar()
+	if opts.transfers > 1 {
+		bar.isTTY = false
+		bar.label = filepath.Base(localPath)
+	}
+	bar.resumeFrom(state.completedBytes())
+	var saveErr sync.Once
+	_, err = client.DownloadParallel(httpClient, azure.DownloadParams{
+		RemotePath: remotePath,
+		Streams:    opts.streams,
+		Progress:   bar.update,
+		Context:    interrupted,
+		Completed:  state.CompletedRanges,
+		PartDone: func(start, end int64) {
+			if err := state.markCompleted(start, end); err != nil {
+				saveErr.Do(func() {
+					fmt.Printf("%sWarning: failed to save download state: %v%s\n", ColorYellow, err, ColorReset)
+				})
+			}
+		},
+	}, file)
+	bar.finish()
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Nothing to resume from, so don't leave an empty .partial file behind
+		if len(state.CompletedRanges) == 0 {
+			os.Remove(partialPath)
+			state.remove()
+		}
+		return err
+	}
+
+	if !opts.skipHash {
+		if err := verifyDownload(partialPath, item); err != nil {
+			// Parts of another version of the file can't be told apart, so start over next time
+			os.Remove(partialPath)
+			state.remove()
+			return err
+		}
+	}
+
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return fmt.Errorf("failed to move download into place: %v", err)
+	}
+	state.remove()
+	setLocalModTime(localPath, item)
+	return nil
+}
+
+// downloadTarget is a remote file of a folder download and where it is saved
+type downloadTarget struct {
+	name      string // Slash-separated path relative to the downloaded folder
+	item      azure.DriveItem
+	localPath string
+}
+
+// downloadPlan is what a folder download creates: its local folders and the files to download into them
+type downloadPlan struct {
+	folders []string
+	targets []downloadTarget
+}
+
+// list adds the folders and files below the relative folder rel of remoteDir that the filter
+// includes, following every page of each listing
+func (plan *downloadPlan) list(client *azure.AzureClient, httpClient *http.Client, filter *fileFilter, remoteDir, localDir, rel string) error {
+	items, err := client.ListChildren(httpClient, remoteJoin(remoteDir, rel))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		itemRel := path.Join(rel, item.Name)
+		localPath := filepath.Join(localDir, filepath.FromSlash(itemRel))
+		if item.IsFolder() {
+			if filter.excludesDir(itemRel) {
+				continue
+			}
+			plan.folders = append(plan.folders, localPath)
+			if err := plan.list(client, httpClient, filter, remoteDir, localDir, itemRel); err != nil {
+				return err
+			}
+			continue
+		}
+		if !filter.includes(itemRel) || !filter.includesSize(item.Size) {
+			continue
+		}
+		plan.targets = append(plan.targets, downloadTarget{name: itemRel, item: item, localPath: localPath})
+	}
+	return nil
+}
+
+// downloadSummary collects the results of a folder download
+type downloadSummary struct {
+	total           int
+	downloaded      int
+	downloadedBytes int64
+	unchanged       int // Files skipped because the local copy was already identical
+	failed          []string
+	startTime       time.Time
+}
+
+// downloadFolder mirrors the remote folder remoteDir into localDir, opts.transfers files at a time.
+// Local files that already have the remote content are left alone, so a rerun only downloads what
+// is missing or changed.
+func downloadFolder(client *azure.AzureClient, httpClient *http.Client, opts downloadOptions, filter *fileFilter, remoteDir, localDir string) int {
+	fmt.Printf("Listing %s...\n", remoteDir)
+	plan := &downloadPlan{folders: []string{localDir}}
+	if err := plan.list(client, httpClient, filter, remoteDir, localDir, ""); err != nil {
+		printError("Failed to list remote folder", err)
+		return exitCodeFor(err)
+	}
+
+	for _, folder := range plan.folders {
+		if err := os.MkdirAll(folder, 0o755); err != nil {
+			fmt.Printf("Failed to create local folder '%s': %v\n", folder, err)
+			return exitFailure
+		}
+	}
+
+	summary := &downloadSummary{total: len(plan.targets), startTime: time.Now()}
+	var targets []downloadTarget
+	for _, target := range plan.targets {
+		if same, err := sameContent(target.localPath, &target.item); err == nil && same {
+			summary.unchanged++
+			continue
+		}
+		targets = append(targets, target)
+	}
+	fmt.Printf("%d files to download, %d already up to date\n", len(targets), summary.unchanged)
+
+	// Stopped cleanly on Ctrl+C, so the .partial files and their state are kept for resuming
+	gracefulShutdown.Store(true)
+
+	exitCode := exitOK
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for range max(opts.transfers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				target := targets[i]
+				fmt.Printf("\n[%d/%d] Downloading %s\n", i+1, len(targets), target.name)
+
+				err := downloadFile(client, httpClient, &target.item, remoteJoin(remoteDir, target.name), target.localPath, opts)
+
+				mu.Lock()
+				switch {
+				case errors.Is(err, context.Canceled):
+					fmt.Printf("%sDownload of '%s' interrupted.%s\n", ColorYellow, target.name, ColorReset)
+					summary.failed = append(summary.failed, fmt.Sprintf("%s: %v", target.name, err))
+				case err != nil:
+					printError(fmt.Sprintf("Failed to download '%s'", target.name), err)
+					summary.failed = append(summary.failed, fmt.Sprintf("%s: %v", target.name, err))
+					exitCode = exitCodeFor(err)
+				default:
+					summary.downloaded++
+					summary.downloadedBytes += target.item.Size
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range targets {
+		if interrupted.Err() != nil {
+			fmt.Printf("%sInterrupted; %d files not downloaded.%s\n", ColorYellow, len(targets)-i, ColorReset)
+			mu.Lock()
+			exitCode = exitInterrupted
+			mu.Unlock()
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-interrupted.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	summary.print()
+	if exitCode == exitOK && interrupted.Err() != nil {
+		exitCode = exitInterrupted
+	}
+	return exitCode
+}
+
+// print prints the number of files and bytes downloaded and lists the failed files
+func (summary *downloadSummary) print() {
+	fmt.Println()
+	fmt.Printf("Downloaded %d/%d files (%s) in %s\n", summary.downloaded, summary.total, formatBytes(summary.downloadedBytes), time.Since(summary.startTime).Round(time.Second))
+	if summary.unchanged > 0 {
+		fmt.Printf("%d files already up to date\n", summary.unchanged)
+	}
+	if len(summary.failed) > 0 {
+		fmt.Printf("%sFailed downloads:%s\n", ColorRed, ColorReset)
+		for _, f := range summary.failed {
+			fmt.Printf("  %s\n", f)
+		}
+	}
+}
+
+// verifyDownload compares the QuickXorHash of a downloaded file with the remote one
+func verifyDownload(localPath string, item *azure.DriveItem) error {
+	expected := remoteHash(item)
+	if expected == "" {
+		fmt.Printf("%sWarning: no QuickXorHash reported for '%s', skipping verification.%s\n", ColorYellow, item.Name, ColorReset)
+		return nil
+	}
+	localHash, err := QuickXorHash(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to calculate local QuickXorHash: %v", err)
+	}
+	if localHash != expected {
+		return fmt.Errorf("%w (local %s, remote %s)", errHashMismatch, localHash, expected)
+	}
+	return nil
+}
+
+// setLocalModTime gives a downloaded file the modification time of the remote file it came from
+func setLocalModTime(localPath string, item *azure.DriveItem) {
+	modTime := remoteModTime(item)
+	if modTime.IsZero() {
+		return
+	}
+	if err := os.Chtimes(localPath, time.Time{}, modTime); err != nil {
+		fmt.Printf("%sWarning: failed to set modification time of '%s': %v%s\n", ColorYellow, localPath, err, ColorReset)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// partialSuffix is appended to the name of a file while it is being downloaded
+const partialSuffix = ".partial"
+
+// downloadState records which ranges of a .partial file are complete, so an interrupted download
+// can resume instead of starting over
+type downloadState struct {
+	RemotePath      string     `json:"remote_path"`
+	Size            int64      `json:"size"`
+	QuickXorHash    string     `json:"quick_xor_hash"`
+	ModTime         time.Time  `json:"mod_time"` // Remote modification time, to notice a file that changed in the meantime
+	CompletedRanges [][2]int64 `json:"completed_ranges"`
+	path            string
+	mu              sync.Mutex
+}
+
+// downloadStatePath returns the state file used for downloading remotePath to localPath
+func downloadStatePath(stateDir, localPath, remote, remotePath string) string {
+	if absPath, err := filepath.Abs(localPath); err == nil {
+		localPath = absPath
+	}
+	sum := sha256.Sum256([]byte(localPath + "\n" + remote + ":" + remotePath))
+	return filepath.Join(stateDir, "download-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadDownloadState reads the state at path; a missing one is empty
+func loadDownloadState(path string) (*downloadState, error) {
+	state := &downloadState{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// matches reports whether the state was recorded for the same version of the remote file
+func (state *downloadState) matches(remotePath string, item *azure.DriveItem) bool {
+	return state.RemotePath == remotePath && state.Size == item.Size && state.QuickXorHash == remoteHash(item) &&
+		state.ModTime.Equal(item.LastModifiedDateTime)
+}
+
+// reset starts the state over for a fresh download of item
+func (state *downloadState) reset(remotePath string, item *azure.DriveItem) {
+	state.RemotePath = remotePath
+	state.Size = item.Size
+	state.QuickXorHash = remoteHash(item)
+	state.ModTime = item.LastModifiedDateTime
+	state.CompletedRanges = nil
+}
+
+// completedBytes returns the number of bytes the completed ranges cover
+func (state *downloadState) completedBytes() int64 {
+	var total int64
+	for _, r := range state.CompletedRanges {
+		total += r[1] - r[0] + 1
+	}
+	return total
+}
+
+// markCompleted records a range written to the .partial file and persists the state
+func (state *downloadState) markCompleted(start, end int64) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.CompletedRanges = append(state.CompletedRanges, [2]int64{start, end})
+	return state.saveLocked()
+}
+
+// save persists the state to disk
+func (state *downloadState) save() error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	return state.saveLocked()
+}
+
+// saveLocked writes the state atomically; callers must hold state.mu
+func (state *downloadState) saveLocked() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(state.path), 0o700); err != nil {
+		return err
+	}
+
+	tmpPath := state.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, state.path)
+}
+
+// remove deletes the state file
+func (state *downloadState) remove() {
+	os.Remove(state.path)
+}
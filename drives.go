@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+// runDrives implements the drives command, which lists the drives a remote's credentials can access
+func runDrives(args []string) int {
+	fs := flag.NewFlagSet("drives", flag.ExitOnError)
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	client, _, code := setupRemote(*remoteConfig, *stateDir)
+	if code != exitOK {
+		return code
+	}
+
+	httpClient := &http.Client{}
+
+	drives, err := client.ListDrives(httpClient)
+	if err != nil {
+		printError("Failed to list drives", err)
+		return exitCodeFor(err)
+	}
+
+	for _, drive := range drives {
+		marker := " "
+		if drive.ID == client.DriveID {
+			marker = "*"
+		}
+		free := "unknown"
+		if drive.Quota != nil {
+			free = formatBytes(drive.Quota.Remaining) + " free"
+		}
+		fmt.Printf("%s %s  %-12s %-30s %s\n", marker, drive.ID, drive.DriveType, drive.Name, free)
+	}
+
+	return exitOK
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// failoverRemotes returns the remotes to retry an upload on after it failed on a full drive: the
+// other remotes that allow uploads, starting with the one after the failed remote by name
+func failoverRemotes(configData []byte, failed string) ([]string, error) {
+	remotes, err := uploadRemotes(configData)
+	if err != nil {
+		return nil, err
+	}
+	remotes = slices.DeleteFunc(remotes, func(remote string) bool { return remote == failed })
+
+	next := 0
+	for next < len(remotes) && remotes[next] < failed {
+		next++
+	}
+	return slices.Concat(remotes[next:], remotes[:next]), nil
+}
+
+// uploadWithFailover retries an upload that failed with err because the drive of the remote failed
+// is full on the other remotes in turn, until one has room or fails for another reason. It reports
+// which remote ends up hosting the file and returns the error of the last attempt.
+func uploadWithFailover(configData []byte, failed string, err error, upload func(remote string) error) error {
+	remotes, listErr := failoverRemotes(configData, failed)
+	if listErr != nil {
+		return listErr
+	}
+	if len(remotes) == 0 {
+		fmt.Printf("%sNo other remote allows uploads to fail over to.%s\n", ColorYellow, ColorReset)
+	}
+
+	for _, remote := range remotes {
+		fmt.Printf("%sRemote '%s' is out of space, retrying on remote '%s'...%s\n", ColorYellow, failed, remote, ColorReset)
+		if err = upload(remote); err == nil {
+			fmt.Printf("%sFile hosted on remote '%s'.%s\n", ColorGreen, remote, ColorReset)
+			return nil
+		}
+		if exitCodeFor(err) != exitQuota {
+			return err
+		}
+		failed = remote
+	}
+	return err
+}
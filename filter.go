@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// fileFilter decides which files of a directory operation are included. A file is skipped if it
+// matches an exclude pattern, or if there are include patterns and it matches none of them.
+// Patterns without a slash are matched against every element of a file's relative path, so *.tmp
+// matches temp files anywhere and node_modules everything below such a folder; patterns with a
+// slash are matched against the whole relative path.
+type fileFilter struct {
+	include []string
+	exclude []string
+	minSize int64 // Smallest file size to include
+	maxSize int64 // Largest file size to include (0 for no limit)
+}
+
+// filterFlags holds the filter flags of a command until they are parsed
+type filterFlags struct {
+	include    stringList
+	exclude    stringList
+	filterFile string
+	minSize    string
+	maxSize    string
+}
+
+// registerFilterFlags adds the -include, -exclude, -filter-file, -min-size and -max-size flags to a command's flag set
+func registerFilterFlags(fs *flag.FlagSet) *filterFlags {
+	flags := &filterFlags{}
+	fs.Var(&flags.include, "include", "Only include files matching this glob, e.g. *.zip; can be repeated")
+	fs.Var(&flags.exclude, "exclude", "Skip files and folders matching this glob, e.g. *.tmp or node_modules; can be repeated")
+	fs.StringVar(&flags.filterFile, "filter-file", "", "File of filter rules, one per line: '+ pattern' to include, '- pattern' to exclude, '#' for comments")
+	fs.StringVar(&flags.minSize, "min-size", "", "Skip files smaller than this size, e.g. 1 to skip empty files or 100K (default: no limit)")
+	fs.StringVar(&flags.maxSize, "max-size", "", "Skip files larger than this size, e.g. 10G (default: no limit)")
+	return flags
+}
+
+// build returns the filter the flags describe, or nil if they don't filter anything
+func (flags *filterFlags) build() (*fileFilter, error) {
+	filter := &fileFilter{include: flags.include, exclude: flags.exclude}
+	if flags.filterFile != "" {
+		if err := filter.load(flags.filterFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, patterns := range [][]string{filter.include, filter.exclude} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter pattern '%s': %v", pattern, err)
+			}
+		}
+	}
+	var err error
+	if flags.minSize != "" {
+		if filter.minSize, err = parseSize(flags.minSize); err != nil {
+			return nil, fmt.Errorf("invalid -min-size: %v", err)
+		}
+	}
+	if flags.maxSize != "" {
+		if filter.maxSize, err = parseSize(flags.maxSize); err != nil {
+			return nil, fmt.Errorf("invalid -max-size: %v", err)
+		}
+		if filter.maxSize < filter.minSize {
+			return nil, fmt.Errorf("-max-size is smaller than -min-size")
+		}
+	}
+	if len(filter.include) == 0 && len(filter.exclude) == 0 && filter.minSize == 0 && filter.maxSize == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// load adds the rules of a filter file
+func (filter *fileFilter) load(filterPath string) error {
+	file, err := os.Open(filterPath)
+	if err != nil {
+		return fmt.Errorf("failed to open filter file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			filter.include = append(filter.include, strings.TrimSpace(line[2:]))
+		case strings.HasPrefix(line, "- "):
+			filter.exclude = append(filter.exclude, strings.TrimSpace(line[2:]))
+		default:
+			return fmt.Errorf("%s:%d: rules must start with '+ ' or '- '", filterPath, lineNumber)
+		}
+	}
+	return scanner.Err()
+}
+
+// includes reports whether the file at the slash-separated relative path rel is included
+func (filter *fileFilter) includes(rel string) bool {
+	if filter == nil {
+		return true
+	}
+	for _, pattern := range filter.exclude {
+		if matchFilterPattern(pattern, rel) {
+			return false
+		}
+	}
+	if len(filter.include) == 0 {
+		return true
+	}
+	for _, pattern := range filter.include {
+		if matchFilterPattern(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesDir reports whether the folder at the slash-separated relative path rel is excluded as a
+// whole, so a walk doesn't need to descend into it
+func (filter *fileFilter) excludesDir(rel string) bool {
+	if filter == nil {
+		return false
+	}
+	for _, pattern := range filter.exclude {
+		if matchFilterPattern(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// includesSize reports whether a file of this size is within the size limits
+func (filter *fileFilter) includesSize(size int64) bool {
+	if filter == nil {
+		return true
+	}
+	return size >= filter.minSize && (filter.maxSize == 0 || size <= filter.maxSize)
+}
+
+// sizeExcluded returns the relative paths of files whose local or remote size is outside the size
+// limits. They are left out on both sides, so a file that only fits the limits on one side is
+// neither copied nor deleted.
+func sizeExcluded(filter *fileFilter, localSizes map[string]int64, remoteFiles map[string]azure.DriveItem) map[string]bool {
+	excluded := make(map[string]bool)
+	for rel, size := range localSizes {
+		if !filter.includesSize(size) {
+			excluded[rel] = true
+		}
+	}
+	for rel, item := range remoteFiles {
+		if !filter.includesSize(item.Size) {
+			excluded[rel] = true
+		}
+	}
+	return excluded
+}
+
+// removeExcluded deletes the files the filter doesn't include or the ignore rules ignore from a
+// listing keyed by relative path
+func removeExcluded(files map[string]azure.DriveItem, filter *fileFilter, ignores *ignoreList) {
+	for rel := range files {
+		if !filter.includes(rel) || ignores.ignoredPath(rel) {
+			delete(files, rel)
+		}
+	}
+}
+
+// matchFilterPattern matches a pattern against a relative path as described on fileFilter
+func matchFilterPattern(pattern, rel string) bool {
+	if strings.Contains(pattern, "/") {
+		matched, _ := path.Match(strings.TrimPrefix(pattern, "/"), rel)
+		return matched
+	}
+	for _, element := range strings.Split(rel, "/") {
+		if matched, _ := path.Match(pattern, element); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSize parses a size such as 500, 64K, 1.5M or 10GiB; units are powers of 1024 like formatBytes
+func parseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	multiplier := int64(1)
+	if number != "" {
+		if exp := strings.IndexByte("KMGTPE", number[len(number)-1]); exp >= 0 {
+			multiplier = int64(1) << (10 * (exp + 1))
+			number = number[:len(number)-1]
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
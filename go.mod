@@ -2,4 +2,16 @@ module github.com/ksauraj/ksau-oned-api
 
 go 1.23.4
 
-require github.com/rclone/rclone v1.68.2
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/rclone/rclone v1.68.2
+	golang.org/x/sys v0.24.0
+	google.golang.org/grpc v1.67.1
+	google.golang.org/protobuf v1.35.2
+)
+
+require (
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
+)
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// maxDumpedBody bounds how much of a request or response body -dump-http logs
+const maxDumpedBody = 16 * 1024
+
+// Secrets -dump-http replaces with [REDACTED]: tokens and client secrets in JSON and form bodies,
+// and the tempauth parameter that makes upload and download URLs work without a token
+var dumpRedactions = []*regexp.Regexp{
+	regexp.MustCompile(`("(?:access_token|refresh_token|id_token|client_secret)"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`(?m)((?:^|&)(?:access_token|refresh_token|client_secret|code|device_code)=)[^&\s]*`),
+	regexp.MustCompile(`((?i:tempauth)=)[^&"\s]+`),
+}
+
+// httpDumper logs requests and their responses for -dump-http, one at a time so the lines of
+// concurrent requests don't interleave
+type httpDumper struct {
+	mu   sync.Mutex
+	out  io.Writer
+	next atomic.Int64
+}
+
+// dumper is shared by all clients of a run, so the requests of several remotes are numbered together
+var dumper *httpDumper
+
+// dumpMiddleware returns the middleware that logs requests to -dump-http-file, or stderr without one
+func dumpMiddleware() (azure.Middleware, error) {
+	if dumper == nil {
+		var out io.Writer = os.Stderr
+		if dumpHTTPFile != "" {
+			file, err := os.OpenFile(dumpHTTPFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open HTTP dump file: %v", err)
+			}
+			out = file
+		}
+		dumper = &httpDumper{out: out}
+	}
+	return dumper.wrap, nil
+}
+
+// wrap logs each request sent through next and the response it gets
+func (d *httpDumper) wrap(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		id := d.next.Add(1)
+
+		var body []byte
+		if req.Body != nil && isTextContent(req.Header.Get("Content-Type")) && req.ContentLength > 0 && req.ContentLength <= maxDumpedBody {
+			var err error
+			if body, err = io.ReadAll(req.Body); err != nil {
+				return nil, err
+			}
+			req.Body.Close()
+			// A RoundTripper must not modify the request it was given
+			req = req.Clone(req.Context())
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		d.write(fmt.Sprintf(">>> #%d %s %s", id, req.Method, req.URL), req.Header, body, req.Header.Get("Content-Type"), req.ContentLength)
+
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			d.write(fmt.Sprintf("<<< #%d %v (%s)", id, err, elapsed), nil, nil, "", 0)
+			return nil, err
+		}
+
+		body = nil
+		contentType := resp.Header.Get("Content-Type")
+		if isTextContent(contentType) {
+			body, err = io.ReadAll(io.LimitReader(resp.Body, maxDumpedBody+1))
+			if err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+			// The caller still reads the whole body, including what was logged
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		}
+		d.write(fmt.Sprintf("<<< #%d %s (%s)", id, resp.Status, elapsed), resp.Header, body, contentType, resp.ContentLength)
+		return resp, nil
+	})
+}
+
+// write logs one request or response: its first line, headers with credentials redacted and the
+// text body, or a note about a body that isn't shown
+func (d *httpDumper) write(first string, header http.Header, body []byte, contentType string, length int64) {
+	var b strings.Builder
+	b.WriteString(first + "\n")
+
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			if name == "Authorization" {
+				scheme, _, _ := strings.Cut(value, " ")
+				value = scheme + " [REDACTED]"
+			}
+			b.WriteString(name + ": " + value + "\n")
+		}
+	}
+
+	switch {
+	case len(body) > maxDumpedBody:
+		b.WriteString("\n" + string(body[:maxDumpedBody]) + "\n[truncated]\n")
+	case len(body) > 0:
+		b.WriteString("\n" + string(body) + "\n")
+	case length > 0:
+		if contentType == "" {
+			contentType = "unknown"
+		}
+		fmt.Fprintf(&b, "\n[%d byte body of type %s not shown]\n", length, contentType)
+	}
+
+	text := b.String()
+	for _, re := range dumpRedactions {
+		text = re.ReplaceAllString(text, "${1}[REDACTED]")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintln(d.out, text)
+}
+
+// isTextContent reports whether a body of this content type is readable text worth logging
+func isTextContent(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	return strings.Contains(contentType, "json") || strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "x-www-form-urlencoded") || strings.Contains(contentType, "xml")
+}
+
+// roundTripperFunc adapts a function to the http.RoundTripper interface
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the file in a local tree listing paths to skip, with gitignore syntax
+const ignoreFileName = ".ksauignore"
+
+// ignoreRule is a pattern of a .ksauignore file
+type ignoreRule struct {
+	base     string // Slash-separated folder of the .ksauignore file, relative to the walked directory ("" for its root)
+	pattern  string
+	negate   bool // ! re-includes paths an earlier rule ignored
+	dirOnly  bool // A trailing / only matches folders
+	anchored bool // A leading or inner / matches relative to base instead of at any depth
+}
+
+// ignoreList holds the rules of the .ksauignore files read during a walk. Like gitignore, the last
+// matching rule decides, and rules only apply below the folder of their file.
+type ignoreList struct {
+	rules []ignoreRule
+}
+
+// load reads the .ksauignore file of the folder at the slash-separated relative path rel, if it has one
+func (list *ignoreList) load(localDir, rel string) error {
+	base := ""
+	if rel != "." {
+		base = rel
+	}
+	file, err := os.Open(filepath.Join(localDir, filepath.FromSlash(base), ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// \# and \! start patterns with a literal # or !
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		list.rules = append(list.rules, rule)
+	}
+	return scanner.Err()
+}
+
+// ignored reports whether the rules ignore the file or folder at the slash-separated relative path rel
+func (list *ignoreList) ignored(rel string, isDir bool) bool {
+	if list == nil {
+		return false
+	}
+	ignored := false
+	for _, rule := range list.rules {
+		sub := rel
+		if rule.base != "" {
+			if !strings.HasPrefix(rel, rule.base+"/") {
+				continue
+			}
+			sub = strings.TrimPrefix(rel, rule.base+"/")
+		}
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		var matched bool
+		if rule.anchored {
+			matched = matchPathGlob(strings.Split(rule.pattern, "/"), strings.Split(sub, "/"))
+		} else {
+			matched, _ = path.Match(rule.pattern, path.Base(sub))
+		}
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// ignoredPath reports whether the file at rel or any of its folders is ignored, for paths that
+// weren't found by walking the tree, such as remote files
+func (list *ignoreList) ignoredPath(rel string) bool {
+	elements := strings.Split(rel, "/")
+	for i := 1; i < len(elements); i++ {
+		if list.ignored(strings.Join(elements[:i], "/"), true) {
+			return true
+		}
+	}
+	return list.ignored(rel, false)
+}
+
+// matchPathGlob matches path elements against pattern elements, where ** matches any number of elements
+func matchPathGlob(pattern, elements []string) bool {
+	if len(pattern) == 0 {
+		return len(elements) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elements); i++ {
+			if matchPathGlob(pattern[1:], elements[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elements) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], elements[0]); !matched {
+		return false
+	}
+	return matchPathGlob(pattern[1:], elements[1:])
+}
+
+// walkLocal walks localDir and calls visit with the slash-separated relative path ("." for the root)
+// of every folder and regular file that the filter and the .ksauignore files in the tree include.
+// It returns the ignore rules it read, so they can be applied to remote files as well.
+func walkLocal(localDir string, filter *fileFilter, visit func(rel string, d fs.DirEntry) error) (*ignoreList, error) {
+	ignores := &ignoreList{}
+	err := filepath.WalkDir(localDir, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, walkPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if rel != "." && (filter.excludesDir(rel) || ignores.ignored(rel, true)) {
+				return filepath.SkipDir
+			}
+			// A folder's own rules apply to everything below it
+			if err := ignores.load(localDir, rel); err != nil {
+				return err
+			}
+			return visit(rel, d)
+		}
+		if !d.Type().IsRegular() || !filter.includes(rel) || ignores.ignored(rel, false) {
+			return nil
+		}
+		return visit(rel, d)
+	})
+	return ignores, err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// primeIndexCache runs the remote's index_prime hook for a freshly uploaded file so its download URL
+// works before the index refreshes its cache on its own. The hook is either "url", which requests the
+// download URL with a cache-busting query, or a URL template such as a revalidation endpoint, where
+// {path} is replaced with the file's path on the index and {url} with its download URL.
+func primeIndexCache(remoteConfig, downloadURL string) error {
+	configData, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	hook, ok := remoteSetting(configData, remoteConfig, "index_prime")
+	if !ok {
+		return nil
+	}
+
+	var hookURL string
+	if hook == "url" {
+		separator := "?"
+		if strings.Contains(downloadURL, "?") {
+			separator = "&"
+		}
+		hookURL = downloadURL + separator + "ksau=" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	} else {
+		baseURL, _ := remoteBaseURL(configData, remoteConfig)
+		indexPath, _ := url.PathUnescape(strings.TrimPrefix(downloadURL, baseURL))
+		hookURL = strings.NewReplacer("{path}", url.QueryEscape(indexPath), "{url}", url.QueryEscape(downloadURL)).Replace(hook)
+	}
+
+	req, err := http.NewRequest("GET", hookURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create index prime request: %v", err)
+	}
+	// Only the index's own response is cached; don't download the file itself
+	req.Header.Set("Range", "bytes=0-0")
+
+	httpClient := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to prime index cache: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("failed to prime index cache: %s returned %s", hookURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// jobLimits are the transfer settings a job given to a server mode (daemon jobs, serve grpc uploads)
+// can choose for itself, so that a bulk sync can be held back while interactive uploads run at full
+// speed. The server's maximums are jobLimits too. Zero leaves a setting to the job's own flags, or
+// for maximums, unbounded.
+type jobLimits struct {
+	BwLimit   int64 `json:"bwlimit,omitempty"`    // Transfer rate in bytes/s
+	ChunkSize int64 `json:"chunk_size,omitempty"` // Chunk size of uploads in bytes
+	Parallel  int   `json:"parallel,omitempty"`   // Parallel chunks per uploaded file
+}
+
+// jobLimitFlags holds the values of the flags of jobLimits until they are parsed
+type jobLimitFlags struct {
+	bwLimit   string
+	chunkSize int64
+	parallel  int
+}
+
+// Environment variables that pass a daemon job's limits and the daemon's maximums to its process
+const (
+	jobLimitEnvPrefix = "KSAU_JOB_"
+	maxLimitEnvPrefix = "KSAU_MAX_"
+)
+
+// runningJobLimits are the limits of the job this process runs for the daemon, and runningMaxLimits
+// the daemon's maximums; both are zero when the process doesn't run a daemon job
+var runningJobLimits, runningMaxLimits = jobLimitsFromEnv(jobLimitEnvPrefix), jobLimitsFromEnv(maxLimitEnvPrefix)
+
+// registerJobLimitFlags adds the flags of a job's own limits to fs
+func registerJobLimitFlags(fs *flag.FlagSet) *jobLimitFlags {
+	flags := &jobLimitFlags{}
+	fs.StringVar(&flags.bwLimit, "bwlimit", "", "Limit the job's transfer rate in bytes/s, e.g. 4M, replacing its own -bwlimit (default: its own)")
+	fs.Int64Var(&flags.chunkSize, "chunk-size", 0, "Chunk size of the job's uploads in bytes, replacing its own -chunk-size (default: its own)")
+	fs.IntVar(&flags.parallel, "parallel", 0, "Parallel chunks per file of the job's uploads, replacing its own -parallel (default: its own)")
+	return flags
+}
+
+// registerMaxLimitFlags adds the flags of the maximums a server allows its jobs to fs
+func registerMaxLimitFlags(fs *flag.FlagSet) *jobLimitFlags {
+	flags := &jobLimitFlags{}
+	fs.StringVar(&flags.bwLimit, "max-bwlimit", "", "Highest transfer rate in bytes/s a job may use, e.g. 10M; jobs that don't set a limit get this one (default: no limit)")
+	fs.Int64Var(&flags.chunkSize, "max-chunk-size", 0, "Largest chunk size in bytes a job may upload with (default: no limit)")
+	fs.IntVar(&flags.parallel, "max-parallel", 0, "Most parallel chunks per file a job may upload (default: no limit)")
+	return flags
+}
+
+// parse returns the limits the flags give
+func (flags *jobLimitFlags) parse() (jobLimits, error) {
+	limits := jobLimits{ChunkSize: flags.chunkSize, Parallel: flags.parallel}
+	if flags.bwLimit != "" && flags.bwLimit != "off" {
+		rate, err := parseSize(flags.bwLimit)
+		if err != nil {
+			return jobLimits{}, fmt.Errorf("invalid bandwidth limit '%s': %v", flags.bwLimit, err)
+		}
+		limits.BwLimit = rate
+	}
+	if limits.ChunkSize < 0 || limits.Parallel < 0 {
+		return jobLimits{}, fmt.Errorf("chunk size and parallel chunks can't be negative")
+	}
+	return limits, nil
+}
+
+// check returns an error if limits go beyond the maximums in maxLimits
+func (limits jobLimits) check(maxLimits jobLimits) error {
+	if maxLimits.BwLimit > 0 && limits.BwLimit > maxLimits.BwLimit {
+		return fmt.Errorf("bandwidth limit %s/s exceeds the server's maximum of %s/s", formatBytes(limits.BwLimit), formatBytes(maxLimits.BwLimit))
+	}
+	if maxLimits.ChunkSize > 0 && limits.ChunkSize > maxLimits.ChunkSize {
+		return fmt.Errorf("chunk size %s exceeds the server's maximum of %s", formatBytes(limits.ChunkSize), formatBytes(maxLimits.ChunkSize))
+	}
+	if maxLimits.Parallel > 0 && limits.Parallel > maxLimits.Parallel {
+		return fmt.Errorf("%d parallel chunks exceed the server's maximum of %d", limits.Parallel, maxLimits.Parallel)
+	}
+	return nil
+}
+
+// String describes the limits that are set, e.g. for jobs list
+func (limits jobLimits) String() string {
+	var parts []string
+	if limits.BwLimit > 0 {
+		parts = append(parts, "bwlimit "+formatBytes(limits.BwLimit)+"/s")
+	}
+	if limits.ChunkSize > 0 {
+		parts = append(parts, "chunk size "+formatBytes(limits.ChunkSize))
+	}
+	if limits.Parallel > 0 {
+		parts = append(parts, fmt.Sprintf("%d parallel", limits.Parallel))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// bandwidth returns the bandwidth limit of a job with these limits whose flags give limit: the job's
+// own rate replaces it, and maxLimits caps it
+func (limits jobLimits) bandwidth(limit azure.BandwidthFunc, maxLimits jobLimits) azure.BandwidthFunc {
+	if rate := limits.BwLimit; rate > 0 {
+		limit = func(time.Time) int64 { return rate }
+	}
+	if maxLimits.BwLimit <= 0 {
+		return limit
+	}
+	if limit == nil {
+		return func(time.Time) int64 { return maxLimits.BwLimit }
+	}
+	return func(now time.Time) int64 {
+		if rate := limit(now); rate > 0 && rate < maxLimits.BwLimit {
+			return rate
+		}
+		return maxLimits.BwLimit
+	}
+}
+
+// applyTo sets the chunk size and parallel chunks of uploads with opts to the job's own where it
+// chose them, keeping those of the flags otherwise, all within maxLimits
+func (limits jobLimits) applyTo(opts *uploadOptions, maxLimits jobLimits) {
+	if limits.ChunkSize > 0 {
+		opts.chunkSize = limits.ChunkSize
+	}
+	if limits.Parallel > 0 {
+		opts.parallelChunks = limits.Parallel
+	}
+	if maxLimits.ChunkSize > 0 {
+		opts.chunkSize = min(opts.chunkSize, maxLimits.ChunkSize)
+		opts.maxChunkSize = maxLimits.ChunkSize
+	}
+	if maxLimits.Parallel > 0 {
+		opts.parallelChunks = min(opts.parallelChunks, maxLimits.Parallel)
+	}
+}
+
+// env returns the environment variables that pass the limits, with the prefix of jobLimitEnvPrefix
+// or maxLimitEnvPrefix, to a job's process
+func (limits jobLimits) env(prefix string) []string {
+	var env []string
+	if limits.BwLimit > 0 {
+		env = append(env, prefix+"BWLIMIT="+strconv.FormatInt(limits.BwLimit, 10))
+	}
+	if limits.ChunkSize > 0 {
+		env = append(env, prefix+"CHUNK_SIZE="+strconv.FormatInt(limits.ChunkSize, 10))
+	}
+	if limits.Parallel > 0 {
+		env = append(env, prefix+"PARALLEL="+strconv.Itoa(limits.Parallel))
+	}
+	return env
+}
+
+// jobLimitsFromEnv reads the limits env passed with prefix; values that don't parse are ignored
+func jobLimitsFromEnv(prefix string) jobLimits {
+	var limits jobLimits
+	limits.BwLimit, _ = strconv.ParseInt(os.Getenv(prefix+"BWLIMIT"), 10, 64)
+	limits.ChunkSize, _ = strconv.ParseInt(os.Getenv(prefix+"CHUNK_SIZE"), 10, 64)
+	limits.Parallel, _ = strconv.Atoi(os.Getenv(prefix + "PARALLEL"))
+	return limits
+}
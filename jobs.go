@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// errDaemonNotRunning is returned when nothing listens on the daemon's socket
+var errDaemonNotRunning = errors.New("daemon isn't running")
+
+// runJobs implements the jobs command, which adds jobs to the daemon's queue and lists and manages them
+func runJobs(args []string) int {
+	if len(args) < 1 {
+		fmt.Println("Usage: ksau-go jobs <add|list|cancel|pause|resume> [flags] [args]")
+		return exitUsage
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("jobs "+action, flag.ExitOnError)
+	daemonOpts := registerDaemonFlags(fs)
+	var limitFlags *jobLimitFlags
+	if action == "add" {
+		limitFlags = registerJobLimitFlags(fs)
+	}
+	fs.Parse(args[1:])
+	client := daemonClient(daemonOpts.socketPath())
+
+	var code int
+	switch action {
+	case "add":
+		if fs.NArg() == 0 {
+			fmt.Println("Usage: ksau-go jobs add [flags] [--] <ksau-go arguments>")
+			fs.PrintDefaults()
+			return exitUsage
+		}
+		limits, err := limitFlags.parse()
+		if err != nil {
+			fmt.Println("Error:", err)
+			return exitUsage
+		}
+		code = addJob(client, daemonOpts.socketPath(), fs.Args(), limits)
+	case "list":
+		code = listJobs(client, daemonOpts.socketPath())
+	case "cancel", "pause", "resume":
+		if fs.NArg() == 0 {
+			fmt.Printf("Usage: ksau-go jobs %s [flags] <id>...\n", action)
+			fs.PrintDefaults()
+			return exitUsage
+		}
+		for _, arg := range fs.Args() {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Printf("Error: invalid job ID '%s'\n", arg)
+				return exitUsage
+			}
+			var job queuedJob
+			err = daemonRequest(client, daemonOpts.socketPath(), http.MethodPost, fmt.Sprintf("/jobs/%d/%s", id, action), nil, &job)
+			if err != nil {
+				fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+				code = exitFailure
+				continue
+			}
+			if job.State == jobRunning {
+				fmt.Printf("Stopping job %d...\n", id)
+			} else {
+				fmt.Printf("Job %d is %s.\n", id, job.State)
+			}
+		}
+	default:
+		fmt.Printf("Error: unknown jobs command '%s'\n", action)
+		return exitUsage
+	}
+	return code
+}
+
+// addJob queues a job with the current directory as its working directory and the limits it chose
+func addJob(client *http.Client, socketPath string, args []string, limits jobLimits) int {
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	request := map[string]any{"args": args, "dir": dir, "limits": limits}
+	var job queuedJob
+	if err := daemonRequest(client, socketPath, http.MethodPost, "/jobs", request, &job); err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		return exitFailure
+	}
+	fmt.Printf("Queued job %d (log: %s)\n", job.ID, job.Log)
+	return exitOK
+}
+
+// listJobs prints the jobs of the queue, oldest first
+func listJobs(client *http.Client, socketPath string) int {
+	var jobs []queuedJob
+	if err := daemonRequest(client, socketPath, http.MethodGet, "/jobs", nil, &jobs); err != nil {
+		fmt.Printf("%sError: %v%s\n", ColorRed, err, ColorReset)
+		return exitFailure
+	}
+	fmt.Printf("%-5s %-10s %-17s %-5s %s\n", "ID", "STATE", "ADDED", "EXIT", "COMMAND")
+	for _, job := range jobs {
+		exitCode := ""
+		if job.State == jobDone || job.State == jobFailed {
+			exitCode = strconv.Itoa(job.ExitCode)
+		}
+		command := formatJobArgs(job.Args)
+		if limits := job.Limits.String(); limits != "" {
+			command += " (" + limits + ")"
+		}
+		fmt.Printf("%-5d %-10s %-17s %-5s %s\n", job.ID, job.State, job.Added.Local().Format("2006-01-02 15:04"), exitCode, command)
+	}
+	return exitOK
+}
+
+// formatJobArgs joins a job's arguments for display, quoting those with spaces
+func formatJobArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// daemonClient returns an HTTP client that talks to the daemon over its unix socket
+func daemonClient(socketPath string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+}
+
+// daemonRequest sends a control request to the daemon and decodes its answer into result
+func daemonRequest(client *http.Client, socketPath, method, path string, body, result any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	// The host is ignored: every connection goes to the socket
+	req, err := http.NewRequest(method, "http://ksau-daemon"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%w at %s; start it with ksau-go daemon", errDaemonNotRunning, socketPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var daemonErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&daemonErr) != nil || daemonErr.Error == "" {
+			return fmt.Errorf("daemon answered %s", resp.Status)
+		}
+		return errors.New(daemonErr.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+// runLink implements the link command, which creates a OneDrive sharing link for a remote item
+func runLink(args []string) int {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	remotePath := fs.String("remote", "", "Remote file or folder to share, relative to the remote's root folder (required)")
+	linkType := fs.String("type", "view", "Type of link to create: view, edit or embed (default: 'view')")
+	scope := fs.String("scope", "anonymous", "Who the link works for: anonymous or organization (default: 'anonymous')")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	// Allow the path to be given as a positional argument
+	if *remotePath == "" && fs.NArg() > 0 {
+		*remotePath = fs.Arg(0)
+	}
+	if *remotePath == "" {
+		fmt.Println("Error: a remote path is required")
+		fs.Usage()
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, *remotePath)
+	if code != exitOK {
+		return code
+	}
+
+	httpClient := &http.Client{}
+
+	item, err := client.GetItem(httpClient, paths[0])
+	if err != nil {
+		printError("Failed to find remote item", err)
+		return exitCodeFor(err)
+	}
+
+	link, err := client.CreateLink(httpClient, item.ID, *linkType, *scope)
+	if err != nil {
+		printError("Failed to create sharing link", err)
+		return exitCodeFor(err)
+	}
+
+	fmt.Printf("%sSharing link (%s, %s):%s %s%s%s\n", ColorGreen, link.Type, link.Scope, ColorReset, ColorGreen, link.WebURL, ColorReset)
+	return exitOK
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// runLogin implements the login command, which authorizes ksau-go with a Microsoft account and writes
+// the resulting token into the remote's config section
+func runLogin(args []string) int {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section to write the token to (default: 'oned')")
+	clientID := fs.String("client-id", "", "App (client) ID to authorize (default: the remote's client_id)")
+	clientSecret := fs.String("client-secret", "", "App client secret (default: the remote's client_secret)")
+	port := fs.Int("port", 53682, "Local port for the OAuth redirect; the app must allow http://localhost:<port>/ as a redirect URI (default: 53682)")
+	deviceCode := fs.Bool("device-code", false, "Authorize with a code entered on another device, for headless servers without a browser (default: false)")
+	noBrowser := fs.Bool("no-browser", false, "Only print the authorization URL instead of opening it in a browser (default: false)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "How long to wait for the authorization to complete (default: 5m)")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if err := configureNetwork(); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	// Reuse the app credentials of an existing section
+	if configData, err := loadConfig(); err == nil {
+		if *clientID == "" {
+			*clientID, _ = remoteSetting(configData, *remoteConfig, "client_id")
+		}
+		if *clientSecret == "" {
+			*clientSecret, _ = remoteSetting(configData, *remoteConfig, "client_secret")
+		}
+	}
+	if *clientID == "" {
+		fmt.Printf("Error: no client_id configured for remote '%s'; pass one with -client-id\n", *remoteConfig)
+		return exitUsage
+	}
+
+	configFilePath, err := writableConfigPath()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	if *deviceCode {
+		code, err := azure.RequestDeviceCode(httpClient, *clientID)
+		if err != nil {
+			printError("Failed to start device code authorization", err)
+			return exitCodeFor(err)
+		}
+
+		fmt.Println(code.Message)
+		fmt.Println("Waiting for authorization...")
+
+		token, err := azure.PollDeviceToken(httpClient, *clientID, code)
+		if err != nil {
+			printError("Authorization failed", err)
+			return exitAuth
+		}
+
+		return saveLogin(httpClient, configFilePath, *remoteConfig, *clientID, *clientSecret, token, *stateDir)
+	}
+
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		fmt.Println("Failed to generate OAuth state:", err)
+		return exitFailure
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	if err != nil {
+		fmt.Println("Failed to start the redirect listener:", err)
+		return exitFailure
+	}
+	redirectURI := fmt.Sprintf("http://localhost:%d/", *port)
+
+	code, err := waitForAuthCode(listener, azure.AuthCodeURL(*clientID, redirectURI, hex.EncodeToString(state)), hex.EncodeToString(state), !*noBrowser, *timeout)
+	if err != nil {
+		fmt.Printf("%sAuthorization failed: %v%s\n", ColorRed, err, ColorReset)
+		return exitAuth
+	}
+
+	token, err := azure.ExchangeAuthCode(httpClient, *clientID, *clientSecret, code, redirectURI)
+	if err != nil {
+		printError("Failed to get token", err)
+		return exitCodeFor(err)
+	}
+
+	return saveLogin(httpClient, configFilePath, *remoteConfig, *clientID, *clientSecret, token, *stateDir)
+}
+
+// waitForAuthCode serves the OAuth redirect on listener, sends the user to authURL and returns the
+// authorization code once the browser comes back with the expected state
+func waitForAuthCode(listener net.Listener, authURL, state string, openURL bool, timeout time.Duration) (string, error) {
+	type authResult struct {
+		code string
+		err  error
+	}
+	results := make(chan authResult, 1)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var result authResult
+		switch {
+		case query.Get("error") != "":
+			result.err = fmt.Errorf("%s: %s", query.Get("error"), query.Get("error_description"))
+		case query.Get("state") != state:
+			http.Error(w, "Invalid state", http.StatusBadRequest)
+			return
+		case query.Get("code") == "":
+			http.Error(w, "Missing authorization code", http.StatusBadRequest)
+			return
+		default:
+			result.code = query.Get("code")
+		}
+
+		if result.err != nil {
+			fmt.Fprintf(w, "Authorization failed: %v\nYou can close this window.\n", result.err)
+		} else {
+			fmt.Fprintln(w, "ksau-go is authorized. You can close this window.")
+		}
+		select {
+		case results <- result:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	fmt.Println("Open the following URL in a browser to authorize ksau-go:")
+	fmt.Println()
+	fmt.Println(authURL)
+	fmt.Println()
+	if openURL {
+		if err := openBrowser(authURL); err != nil {
+			fmt.Printf("%sCould not open a browser (%v); open the URL manually.%s\n", ColorYellow, err, ColorReset)
+		}
+	}
+	fmt.Println("Waiting for authorization...")
+
+	select {
+	case result := <-results:
+		return result.code, result.err
+	case <-time.After(timeout):
+		return "", fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// openBrowser opens url in the user's default browser
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		return exec.Command("open", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
+
+// saveLogin looks up the account's drive and writes the token and app credentials into the remote's
+// config section; the remote's cached token is dropped so the new one takes effect
+func saveLogin(httpClient *http.Client, configFilePath, remote, clientID, clientSecret string, token *azure.Token, stateDir string) int {
+	client := azure.NewAzureClientFromToken(clientID, clientSecret, token)
+	if err := decorateClient(client); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	drive, err := client.GetDrive(httpClient, "")
+	if err != nil {
+		printError("Failed to look up the account's drive", err)
+		return exitCodeFor(err)
+	}
+
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		fmt.Println("Failed to encode token:", err)
+		return exitFailure
+	}
+
+	values := map[string]string{
+		"type":       "onedrive",
+		"client_id":  clientID,
+		"token":      string(tokenJSON),
+		"drive_id":   drive.ID,
+		"drive_type": drive.DriveType,
+	}
+	if clientSecret != "" {
+		values["client_secret"] = clientSecret
+	}
+	if err := updateConfigSection(configFilePath, remote, values); err != nil {
+		fmt.Println("Failed to save token:", err)
+		return exitFailure
+	}
+
+	if stateDir != "" {
+		os.Remove(filepath.Join(stateDir, "token-"+remote+".cache"))
+	}
+
+	fmt.Printf("%sLogged in to drive %s (%s); token saved to [%s] in %s%s\n", ColorGreen, drive.ID, drive.DriveType, remote, configFilePath, ColorReset)
+	return exitOK
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// runList implements the ls command, which lists the contents of a remote folder
+func runList(args []string) int {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	remotePath := fs.String("remote", "", "Remote folder to list, relative to the remote's root folder (default: the root folder)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	// Allow the folder to be given as a positional argument
+	if *remotePath == "" && fs.NArg() > 0 {
+		*remotePath = fs.Arg(0)
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, *remotePath)
+	if code != exitOK {
+		return code
+	}
+
+	httpClient := &http.Client{}
+
+	items, err := client.ListChildren(httpClient, paths[0])
+	if err != nil {
+		printError("Failed to list folder", err)
+		return exitCodeFor(err)
+	}
+
+	// Folders first, then files, each alphabetically
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].IsFolder() != items[j].IsFolder() {
+			return items[i].IsFolder()
+		}
+		return items[i].Name < items[j].Name
+	})
+
+	var totalSize int64
+	for _, item := range items {
+		kind := "-"
+		name := item.Name
+		if item.IsFolder() {
+			kind = "d"
+			name += "/"
+		}
+		fmt.Printf("%s %14s  %s  %s\n", kind, formatBytes(item.Size), item.LastModifiedDateTime.Local().Format("2006-01-02 15:04"), name)
+		totalSize += item.Size
+	}
+	fmt.Printf("%d items, %s\n", len(items), formatBytes(totalSize))
+
+	return exitOK
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/ksauraj/ksau-oned-api/azure" // Adjust the import path
@@ -26,22 +27,41 @@ const (
 	largeFileSize  = 1024 * 1024 * 1024 // 1 GB
 )
 
-// ANSI color codes for terminal output
-const (
+// ANSI color codes for terminal output; cleared on consoles without ANSI support
+var (
 	ColorReset  = "\033[0m"
 	ColorGreen  = "\033[32m"
 	ColorYellow = "\033[33m"
 	ColorRed    = "\033[31m"
 )
 
-// Root folders for each remote configuration (will soon move to config file)
+// defaultMetadataTimeout bounds each metadata request unless -metadata-timeout says otherwise
+const defaultMetadataTimeout = 30 * time.Second
+
+// defaultItemCacheTTL is how long item metadata is reused within a run unless -item-cache-ttl says otherwise
+const defaultItemCacheTTL = time.Minute
+
+// Exit codes reported to calling scripts
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitAuth        = 3
+	exitNotFound    = 4
+	exitQuota       = 5
+	exitThrottled   = 6
+	exitIntegrity   = 7
+	exitInterrupted = 130
+)
+
+// Default root folders for each remote configuration, used when its config section sets no root_folder
 var rootFolders = map[string]string{
 	"hakimionedrive": "Public",
 	"oned":           "",
 	"saurajcf":       "MY_BOMT_STUFFS",
 }
 
-// Base URLs for each remote configuration (will soon move to config file)
+// Default base URLs for each remote configuration, used when its config section sets no base_url
 var baseURLs = map[string]string{
 	"hakimionedrive": "https://onedrive-vercel-index-kohl-eight-30.vercel.app",
 	"oned":           "https://index.sauraj.eu.org",
@@ -101,179 +121,552 @@ func getQuickXorHashWithRetry(client *azure.AzureClient, httpClient *http.Client
 	return "", fmt.Errorf("failed to retrieve remote QuickXorHash after %d retries", maxRetries)
 }
 
+// exitCodeFor maps an error to an exit code based on the Graph error code it carries
+func exitCodeFor(err error) int {
+	if errors.Is(err, errHashMismatch) {
+		return exitIntegrity
+	}
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
+	}
+	if errors.Is(err, azure.ErrNotAllowed) {
+		return exitUsage
+	}
+
+	graphErr, ok := azure.AsGraphError(err)
+	if !ok {
+		return exitFailure
+	}
+
+	switch {
+	case graphErr.StatusCode == http.StatusUnauthorized, graphErr.Code == "InvalidAuthenticationToken", graphErr.Code == "invalid_grant", graphErr.Code == "unauthenticated":
+		return exitAuth
+	case graphErr.StatusCode == http.StatusNotFound, graphErr.Code == "itemNotFound":
+		return exitNotFound
+	case graphErr.StatusCode == http.StatusInsufficientStorage, graphErr.Code == "quotaLimitReached":
+		return exitQuota
+	case graphErr.StatusCode == http.StatusTooManyRequests, graphErr.Code == "activityLimitReached":
+		return exitThrottled
+	default:
+		return exitFailure
+	}
+}
+
+// printError prints an error along with its Graph error code, if one is available
+func printError(message string, err error) {
+	fprintError(os.Stdout, message, err)
+}
+
+// fprintError is printError writing to w, e.g. stderr for commands whose stdout is data
+func fprintError(w io.Writer, message string, err error) {
+	if graphErr, ok := azure.AsGraphError(err); ok && graphErr.Code != "" {
+		fmt.Fprintf(w, "%s%s: %v [%s]%s\n", ColorRed, message, err, graphErr.Code, ColorReset)
+		return
+	}
+	fmt.Fprintf(w, "%s%s: %v%s\n", ColorRed, message, err, ColorReset)
+}
+
 func main() {
+	setupConsole()
+	handleInterrupt()
+	os.Exit(run())
+}
+
+// run executes the command line and returns the process exit code
+func run() int {
+	// Dispatch subcommands; without one the tool runs in upload mode
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "download":
+			return runDownload(os.Args[2:])
+		case "cat":
+			return runCat(os.Args[2:])
+		case "ls":
+			return runList(os.Args[2:])
+		case "rm":
+			return runRemove(os.Args[2:])
+		case "cp":
+			return runCopy(os.Args[2:])
+		case "drives":
+			return runDrives(os.Args[2:])
+		case "mkdir":
+			return runMkdir(os.Args[2:])
+		case "link":
+			return runLink(os.Args[2:])
+		case "ping":
+			return runPing(os.Args[2:])
+		case "doctor":
+			return runDoctor(os.Args[2:])
+		case "config":
+			return runConfig(os.Args[2:])
+		case "login":
+			return runLogin(os.Args[2:])
+		case "verify":
+			return runVerify(os.Args[2:])
+		case "check":
+			return runCheck(os.Args[2:])
+		case "release-verify":
+			return runReleaseVerify(os.Args[2:])
+		case "sync":
+			return runSync(os.Args[2:])
+		case "watch":
+			return runWatch(os.Args[2:])
+		case "schedule":
+			return runSchedule(os.Args[2:])
+		case "daemon":
+			return runDaemon(os.Args[2:])
+		case "jobs":
+			return runJobs(os.Args[2:])
+		case "service":
+			return runService(os.Args[2:])
+		case "bot":
+			return runBot(os.Args[2:])
+		case "mirror-github":
+			return runMirrorGitHub(os.Args[2:])
+		case "bisync":
+			return runBisync(os.Args[2:])
+		case "maintenance":
+			return runMaintenance(os.Args[2:])
+		case "serve":
+			return runServe(os.Args[2:])
+		}
+	}
+
 	// Define command-line flags
-	filePath := flag.String("file", "", "Path to the local file to upload (required)")
-	remoteFolder := flag.String("remote", "", "Remote folder on OneDrive to upload the file (required)")
+	var filePatterns stringList
+	flag.Var(&filePatterns, "file", "Path to the local file or directory to upload (required); repeat it or use globs such as *.zip to upload several files")
+	remoteFolder := flag.String("remote", "", "Remote folder on OneDrive to upload the file, or remote:root/path to use a configured root (required)")
 	remoteFileName := flag.String("remote-name", "", "Optional: Remote filename (defaults to local filename if not provided)")
-	remoteConfig := flag.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	remoteConfig := flag.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf, or auto for the remote with the most free space or auto:round-robin for each remote in turn (default: 'oned')")
 	chunkSize := flag.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	sessionPool := flag.Int("session-pool", 4, "Number of upload sessions to create ahead of time when uploading a directory, which speeds up many small files (default: 4, 0 disables)")
 	parallelChunks := flag.Int("parallel", 1, "Number of parallel chunks to upload (default: 1)")
-	maxRetries := flag.Int("retries", 3, "Maximum number of retries for uploading chunks (default: 3)")
-	retryDelay := flag.Duration("retry-delay", 5*time.Second, "Delay between retries (default: 5s)")
+	transfers := flag.Int("transfers", 1, "Number of files to upload at the same time when uploading a directory or several files, each with its own -parallel chunks (default: 1)")
+	maxConnections := flag.Int("max-connections", 0, "Maximum number of chunk uploads in progress at once, shared by all -transfers (default: 0, no limit)")
+	bwLimit := flag.String("bwlimit", "", "Limit the transfer rate in bytes/s, e.g. 4M, or follow a schedule such as \"08:00,1M 23:00,off\" (default: no limit)")
+	maxRetries := flag.Int("retries", 3, "Retry every class of chunk upload error this many times, overriding the per-class defaults")
+	retryDelay := flag.Duration("retry-delay", 5*time.Second, "With -retries, constant delay between retries (default: 5s)")
+	metadataTimeout := flag.Duration("metadata-timeout", defaultMetadataTimeout, "Timeout of each metadata request such as lookups, listings and upload session creation (default: 30s, 0 disables)")
+	chunkTimeout := flag.Duration("chunk-timeout", 0, "Timeout of each chunk upload attempt; timed out chunks are retried (default: 0, no limit)")
+	minSpeed := flag.Int64("min-speed", 0, "Abort and retry a chunk on a fresh connection if it transfers slower than this many bytes/s (default: 0, disabled)")
+	minSpeedWindow := flag.Duration("min-speed-window", 30*time.Second, "How long a chunk may stay below -min-speed before it is retried (default: 30s)")
+	shareType := flag.String("share", "", "Also create a OneDrive sharing link of this type after upload: view, edit or embed (default: none)")
+	shareScope := flag.String("share-scope", "anonymous", "Scope of the -share link: anonymous or organization (default: 'anonymous')")
 	showQuota := flag.Bool("show-quota", false, "Display quota information for all remotes and exit")
+	driveID := flag.String("drive-id", "", "With -show-quota, report on this drive ID using the -remote-config credentials instead of every remote's own drive")
 	skipHash := flag.Bool("skip-hash", false, "Skip QuickXorHash verification (default: false)")
 	hashRetries := flag.Int("hash-retries", 5, "Maximum number of retries for fetching QuickXorHash (default: 5)")
 	hashRetryDelay := flag.Duration("hash-retry-delay", 10*time.Second, "Delay between QuickXorHash retries (default: 10s)")
+	conflict := flag.String("conflict", string(azure.ConflictRename), "What to do when a file with the same name already exists remotely: rename, replace or fail (default: 'rename')")
+	sanitize := flag.Bool("sanitize", false, "Replace the characters OneDrive doesn't allow in names (\"*:<>?/\\|) with _ and remove trailing dots and spaces, warning about each renamed file or folder (default: false)")
+	dryRun := flag.Bool("dry-run", false, "Only print the files that would be uploaded and the folders that would be created, without changing the remote (default: false)")
+	skipExisting := flag.Bool("skip-existing", false, "Skip files that already exist remotely with the same size and QuickXorHash, so reruns only upload what changed (default: false)")
+	useCAS := flag.Bool("cas", false, "Store uploads under a content-addressed path (remote/cas/ab/cd/<hash>) and record them in a manifest")
+	casManifest := flag.String("cas-manifest", "cas-manifest.json", "Local name→hash manifest updated by -cas uploads (default: 'cas-manifest.json')")
+	dedup := flag.Bool("dedup", false, "Skip files whose content already exists anywhere under the -remote folder, using a hash index stored in it")
+	dedupRebuild := flag.Bool("dedup-rebuild", false, "With -dedup, rebuild the hash index by scanning the -remote folder instead of downloading it")
+	failover := flag.Bool("failover", false, "If a single-file upload fails because the drive is full, retry it on the other configured remotes in turn (default: false)")
+	shiftThrottled := flag.Bool("shift-throttled", false, "While Graph throttles the remote a directory or several files upload to, send the pending files to the other configured remotes that aren't throttled (default: false)")
+	mirror := flag.String("mirror", "", "Upload a single file to each of these comma-separated remotes at once instead of -remote-config, reading it only once, e.g. oned,backup (default: none)")
+	resume := flag.Bool("resume", false, "Resume an interrupted upload from its saved upload session (default: false)")
+	stateDir := flag.String("state-dir", ".ksau-state", "Directory for saved upload sessions and cached tokens (default: '.ksau-state')")
+	filterOptions := registerFilterFlags(flag.CommandLine)
+	registerConfigFlag(flag.CommandLine)
+	registerMetricsFlag(flag.CommandLine)
+	stableFor := flag.Duration("stable-for", 0, "Skip files modified within this duration, e.g. 30s, since they may still be being written (default: 0, disabled)")
+	itemCacheTTL := flag.Duration("item-cache-ttl", defaultItemCacheTTL, "Reuse remote file and folder metadata younger than this instead of fetching it again (default: 1m, 0 disables)")
+	persistItemCache := flag.Bool("item-cache-persist", false, "Keep the item metadata cache in -state-dir so later runs can reuse it within -item-cache-ttl (default: false)")
+	quotaTimeout := flag.Duration("quota-timeout", 10*time.Second, "With -show-quota or -remote-config auto, timeout for each remote's quota requests (default: 10s)")
+	quotaJSON := flag.Bool("json", false, "With -show-quota, print the quota of all remotes as one JSON array (default: false)")
+	minFree := flag.String("min-free", "", "With -show-quota, warn and exit with code 5 if any remote has less free space than this, e.g. 50G (default: no threshold)")
+	quotaCacheTTL := flag.Duration("quota-cache-ttl", 0, "Reuse quota results younger than this across runs, e.g. 5m (default: 0, disabled)")
 
 	flag.Parse()
 
 	// Read the embedded config file
-	configData, err := configFile.ReadFile("rclone.conf")
+	configData, err := loadConfig()
 	if err != nil {
-		fmt.Println("Failed to read embedded config file:", err)
-		return
+		fmt.Println(err)
+		return exitFailure
 	}
 
-	// Initialize AzureClient for each remote configuration
-	httpClient := &http.Client{Timeout: 10 * time.Second}
+	// Initialize AzureClient for each remote configuration; requests are bounded by the client's per-request timeouts
+	httpClient := &http.Client{}
 
-	if *showQuota {
-		for remote := range rootFolders {
-			client, err := azure.NewAzureClientFromRcloneConfigData(configData, remote)
-			if err != nil {
-				fmt.Printf("Failed to initialize client for remote '%s': %v\n", remote, err)
-				continue
-			}
+	var minFreeBytes int64
+	if *minFree != "" {
+		if minFreeBytes, err = parseSize(*minFree); err != nil {
+			fmt.Println("Error: invalid -min-free:", err)
+			return exitUsage
+		}
+	}
 
-			quota, err := client.GetDriveQuota(httpClient)
-			if err != nil {
-				fmt.Printf("Failed to fetch quota information for remote '%s': %v\n", remote, err)
-				continue
-			}
+	if *showQuota && *driveID != "" {
+		client, err := newClient(configData, *remoteConfig, *stateDir)
+		if err != nil {
+			fmt.Println("Failed to initialize client:", err)
+			return exitFailure
+		}
 
-			azure.DisplayQuotaInfo(remote, quota)
+		quota, err := client.GetDriveQuotaForDrive(httpClient, *driveID)
+		if err != nil {
+			printError(fmt.Sprintf("Failed to fetch quota information for drive '%s'", *driveID), err)
+			return exitCodeFor(err)
 		}
-		return
+
+		name := fmt.Sprintf("%s (drive %s)", *remoteConfig, *driveID)
+		azure.DisplayQuotaInfo(name, quota)
+		if warning := lowSpaceWarning(name, quota, minFreeBytes); warning != "" {
+			fmt.Printf("%s%s%s\n", ColorRed, warning, ColorReset)
+			return exitQuota
+		}
+		return exitOK
+	}
+
+	if *showQuota {
+		quotaCache := azure.NewQuotaCache(*quotaCacheTTL, quotaCachePath())
+		return showQuotas(configData, configRemotes(configData), *stateDir, quotaCache, *quotaTimeout, *quotaJSON, minFreeBytes)
 	}
 
 	// Check if the file and remote flags are provided
-	if *filePath == "" || *remoteFolder == "" {
+	if len(filePatterns) == 0 || *remoteFolder == "" {
 		fmt.Println("Error: both -file and -remote flags are required")
 		flag.Usage()
-		return
+		return exitUsage
 	}
 
-	// Get file info
-	fileInfo, err := os.Stat(*filePath)
+	conflictBehavior, err := azure.ParseConflictBehavior(*conflict)
 	if err != nil {
-		fmt.Println("Failed to get file info:", err)
-		return
+		fmt.Printf("Error: invalid -conflict: %v\n", err)
+		return exitUsage
 	}
-	fileSize := fileInfo.Size()
 
-	// Dynamically select chunk size if not specified by the user
-	if *chunkSize == 0 {
-		*chunkSize = getChunkSize(fileSize)
-		fmt.Printf("Selected chunk size: %d bytes (based on file size: %d bytes)\n", *chunkSize, fileSize)
-	} else {
-		fmt.Printf("Using user-specified chunk size: %d bytes\n", *chunkSize)
+	filter, err := filterOptions.build()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	bandwidth, err := parseBandwidth(*bwLimit)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
 	}
 
-	// Determine the remote filename
-	localFileName := filepath.Base(*filePath) // Get the local filename
-	remoteFilePath := filepath.Join(*remoteFolder, localFileName)
-	if *remoteFileName != "" {
-		// If a custom remote filename is provided, use it
-		remoteFilePath = filepath.Join(*remoteFolder, *remoteFileName)
+	// Content-addressed uploads are already deduplicated by their path
+	if *dedup && *useCAS {
+		fmt.Println("Error: -dedup cannot be combined with -cas")
+		return exitUsage
+	}
+	// The hash index and the content-addressed folder belong to the first remote
+	if *failover && (*dedup || *useCAS) {
+		fmt.Println("Error: -failover cannot be combined with -dedup or -cas")
+		return exitUsage
+	}
+	if *shiftThrottled && *dedup {
+		fmt.Println("Error: -shift-throttled cannot be combined with -dedup")
+		return exitUsage
 	}
 
-	// Add the root folder for the selected remote configuration
-	rootFolder, exists := rootFolders[*remoteConfig]
-	if !exists {
-		fmt.Printf("Error: no root folder defined for remote-config '%s'\n", *remoteConfig)
-		return
+	// Mirror copies are streamed from one read of the file, which can't be resumed
+	if *mirror != "" && (*failover || *dedup || *useCAS || *resume) {
+		fmt.Println("Error: -mirror cannot be combined with -failover, -dedup, -cas or -resume")
+		return exitUsage
+	}
+	var mirrorRemotes []string
+	if *mirror != "" {
+		if mirrorRemotes, err = parseMirrorRemotes(configData, *mirror); err != nil {
+			fmt.Println("Error:", err)
+			return exitUsage
+		}
 	}
-	fullRemotePath := filepath.Join(rootFolder, remoteFilePath)
-	fmt.Printf("Full remote path: %s\n", fullRemotePath)
 
-	// Initialize AzureClient using the embedded config and specified remote section
-	client, err := azure.NewAzureClientFromRcloneConfigData(configData, *remoteConfig)
+	filePaths, err := expandFilePatterns(filePatterns)
 	if err != nil {
-		fmt.Println("Failed to initialize client:", err)
-		return
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	if len(filePaths) > 1 && *remoteFileName != "" {
+		fmt.Println("Error: -remote-name can only be used when uploading a single file")
+		return exitUsage
 	}
 
-	// Prepare upload parameters
-	params := azure.UploadParams{
-		FilePath:       *filePath,
-		RemoteFilePath: fullRemotePath,
-		ChunkSize:      *chunkSize,
-		ParallelChunks: *parallelChunks,
-		MaxRetries:     *maxRetries,
-		RetryDelay:     *retryDelay,
-		AccessToken:    client.AccessToken,
+	// Get file info; long Windows paths need the \\?\ form to be opened
+	filePath := longPath(filePaths[0])
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		fmt.Println("Failed to get file info:", err)
+		return exitFailure
+	}
+	if mirrorRemotes != nil && (len(filePaths) > 1 || fileInfo.IsDir()) {
+		fmt.Println("Error: -mirror can only be used when uploading a single file")
+		return exitUsage
 	}
 
-	fileID, err := client.Upload(httpClient, params)
+	// Resolve the remote folder against the remote's root folders; remote:root/path selects a configured root
+	defaultRemote := *remoteConfig
+	if mirrorRemotes != nil {
+		defaultRemote = mirrorRemotes[0]
+	}
+	remote, fullRemoteFolder := resolveRemote(configData, *remoteFolder, defaultRemote)
+	if isAutoRemote(remote) {
+		quotaCache := azure.NewQuotaCache(*quotaCacheTTL, quotaCachePath())
+		if remote, err = pickRemote(configData, remote, *stateDir, quotaCache, *quotaTimeout); err != nil {
+			fmt.Println("Failed to select a remote:", err)
+			return exitFailure
+		}
+		remote, fullRemoteFolder = resolveRemote(configData, *remoteFolder, remote)
+	}
+
+	// Initialize AzureClient using the embedded config and the selected remote section
+	client, err := newClient(configData, remote, *stateDir)
 	if err != nil {
-		fmt.Println("Failed to upload file:", err)
-		return
+		fmt.Println("Failed to initialize client:", err)
+		return exitFailure
+	}
+	if err := startMetricsServer(); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
 	}
 
-	//fmt.Printf("File ID: %s\n", fileID)
+	itemCachePath := ""
+	if *persistItemCache && *stateDir != "" {
+		itemCachePath = filepath.Join(*stateDir, "items-"+remote+".json")
+	}
+	itemCache := azure.NewItemCache(*itemCacheTTL, itemCachePath)
+	client.UseItemCache(itemCache)
+	client.UseTimeouts(azure.Timeouts{Metadata: *metadataTimeout, Data: *chunkTimeout})
+	client.UseConnectionLimit(*maxConnections)
+	client.UseBandwidthLimit(bandwidth)
+
+	// Per-class retry defaults, unless -retries/-retry-delay ask for the same rule everywhere
+	baseRetryPolicy := azure.DefaultRetryPolicy()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "retries" || f.Name == "retry-delay" {
+			baseRetryPolicy = azure.UniformRetryPolicy(*maxRetries, *retryDelay)
+		}
+	})
+	retryPolicy, err := remoteRetryPolicy(configData, remote, baseRetryPolicy)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
 
-	if fileID != "" {
-		fmt.Println("File uploaded successfully.")
-		//fmt.Printf("File ID: %s\n", fileID)
+	opts := uploadOptions{
+		remoteConfig:   remote,
+		chunkSize:      *chunkSize,
+		parallelChunks: *parallelChunks,
+		retryPolicy:    retryPolicy,
+		skipHash:       *skipHash,
+		hashRetries:    *hashRetries,
+		hashRetryDelay: *hashRetryDelay,
+		stateDir:       *stateDir,
+		resume:         *resume,
+		minSpeed:       *minSpeed,
+		minSpeedWindow: *minSpeedWindow,
+		sessionPool:    *sessionPool,
+		transfers:      *transfers,
+		shareType:      *shareType,
+		shareScope:     *shareScope,
+		stableFor:      *stableFor,
+		skipExisting:   *skipExisting,
+		conflict:       conflictBehavior,
+		dryRun:         *dryRun,
+		sanitize:       *sanitize,
+		filter:         filter,
+	}
 
-		// Generate the download URL
-		baseURL, exists := baseURLs[*remoteConfig]
-		if !exists {
-			fmt.Printf("Error: no base URL defined for remote-config '%s'\n", *remoteConfig)
-			return
+	if *useCAS {
+		if opts.cas, err = newCASStore(fullRemoteFolder, *casManifest); err != nil {
+			fmt.Println("Failed to open CAS manifest:", err)
+			return exitFailure
 		}
+	}
 
-		// Construct the URL path
-		urlPath := filepath.Join(*remoteFolder, localFileName)
-		if *remoteFileName != "" {
-			urlPath = filepath.Join(*remoteFolder, *remoteFileName)
+	if *dedup {
+		if opts.dedup, err = loadDedupIndex(client, httpClient, fullRemoteFolder, *dedupRebuild); err != nil {
+			printError("Failed to load hash index", err)
+			return exitCodeFor(err)
 		}
+	}
 
-		// Encode the URL path
-		urlPath = strings.ReplaceAll(urlPath, " ", "%20")
+	// Determine the remote filename
+	localFileName := filepath.Base(filePath) // Get the local filename
+	if *remoteFileName != "" {
+		// If a custom remote filename is provided, use it
+		localFileName = *remoteFileName
+	}
+	if *sanitize && len(filePaths) == 1 {
+		localFileName = sanitizedPath(localFileName)
+	}
+	remoteFilePath := remoteJoin(fullRemoteFolder, localFileName)
 
-		// Generate the full download URL
-		downloadURL := fmt.Sprintf("%s/%s", baseURL, urlPath)
-		fmt.Printf("%sDownload URL:%s %s%s%s\n", ColorGreen, ColorReset, ColorGreen, downloadURL, ColorReset)
+	// remoteUpload sets up the client and options for uploading to another remote, as -failover and
+	// -mirror do, with the same settings as the selected remote
+	remoteUpload := func(other string) (*azure.AzureClient, uploadOptions, error) {
+		otherClient, err := newClient(configData, other, *stateDir)
+		if err != nil {
+			return nil, opts, fmt.Errorf("failed to initialize client: %v", err)
+		}
+		otherClient.UseTimeouts(azure.Timeouts{Metadata: *metadataTimeout, Data: *chunkTimeout})
+		otherClient.UseConnectionLimit(*maxConnections)
+		otherClient.UseBandwidthLimit(bandwidth)
+
+		otherOpts := opts
+		otherOpts.remoteConfig = other
+		otherOpts.shift = nil
+		if otherOpts.retryPolicy, err = remoteRetryPolicy(configData, other, baseRetryPolicy); err != nil {
+			return nil, opts, err
+		}
+		if opts.cas != nil {
+			otherOpts.cas = opts.cas.onRemote(resolveRemoteOn(configData, *remoteFolder, other))
+		}
+		return otherClient, otherOpts, nil
+	}
 
-		// Skip hash verification if requested
-		if *skipHash {
-			fmt.Println("Skipping QuickXorHash verification.")
-			return
+	// Files of batch uploads go to the other remotes while this one is throttled
+	if *shiftThrottled && (len(filePaths) > 1 || fileInfo.IsDir()) {
+		if opts.shift, err = newRemoteShifter(configData, remote, fullRemoteFolder, *remoteFolder, remoteUpload); err != nil {
+			fmt.Println("Error:", err)
+			return exitUsage
 		}
+	}
 
-		fmt.Println("Verifying file integrity...")
+	// Ctrl+C stops the upload and cleans up its session instead of killing the process mid-transfer
+	gracefulShutdown.Store(true)
 
-		// Calculate the local QuickXorHash
-		localHash, err := QuickXorHash(*filePath)
+	// Directories are uploaded recursively into a folder of the same name
+	exitCode := exitOK
+	if len(filePaths) > 1 {
+		// Several files are uploaded into the remote folder under their own names
+		targets, err := fileTargets(filePaths, fullRemoteFolder, *sanitize)
 		if err != nil {
-			fmt.Printf("Failed to calculate local QuickXorHash: %v\n", err)
-			return
+			fmt.Println("Error:", err)
+			return exitUsage
+		}
+		var summary *uploadSummary
+		summary, exitCode = uploadFiles(client, httpClient, opts, targets)
+		summary.print()
+	} else if fileInfo.IsDir() {
+		exitCode = uploadDirectory(client, httpClient, opts, filePath, remoteFilePath)
+	} else if mirrorRemotes != nil {
+		var targets []*mirrorTarget
+		for _, mirrorRemote := range mirrorRemotes {
+			target := &mirrorTarget{remote: mirrorRemote, remoteFilePath: remoteJoin(resolveRemoteOn(configData, *remoteFolder, mirrorRemote), localFileName)}
+			if target.client, target.opts, err = remoteUpload(mirrorRemote); err != nil {
+				printError(fmt.Sprintf("Failed to set up remote '%s'", mirrorRemote), err)
+				return exitFailure
+			}
+			targets = append(targets, target)
+		}
+		exitCode = mirrorUpload(httpClient, filePath, targets)
+	} else {
+		_, err := uploadEntry(client, httpClient, opts, filePath, remoteFilePath)
+		if *failover && err != nil && exitCodeFor(err) == exitQuota {
+			printError(fmt.Sprintf("Failed to upload file to remote '%s'", remote), err)
+			err = uploadWithFailover(configData, remote, err, func(next string) error {
+				failoverClient, failoverOpts, err := remoteUpload(next)
+				if err != nil {
+					return err
+				}
+				_, err = uploadEntry(failoverClient, httpClient, failoverOpts, filePath, remoteJoin(resolveRemoteOn(configData, *remoteFolder, next), localFileName))
+				return err
+			})
+		}
+		if errors.Is(err, errFileUnstable) {
+			fmt.Printf("%sSkipping upload: %v%s\n", ColorYellow, err, ColorReset)
+		} else if err != nil {
+			printError("Failed to upload file", err)
+			exitCode = exitCodeFor(err)
 		}
+	}
 
-		// Retrieve the remote QuickXorHash with retries
-		remoteHash, err := getQuickXorHashWithRetry(client, httpClient, fileID, *hashRetries, *hashRetryDelay)
+	if err := itemCache.Save(); err != nil {
+		fmt.Printf("%sWarning: failed to save item cache: %v%s\n", ColorYellow, err, ColorReset)
+	}
+
+	// Save the hash index even after failures so the files that did upload are recorded
+	if opts.dedup != nil && !opts.dryRun {
+		if err := opts.dedup.save(client, httpClient); err != nil {
+			printError("Failed to save hash index", err)
+			if exitCode == exitOK {
+				exitCode = exitCodeFor(err)
+			}
+		}
+	}
+
+	return exitCode
+}
+
+// newClient initializes the AzureClient for a remote and enables the token cache in stateDir,
+// so successive runs reuse a refreshed access token instead of refreshing again; refreshed tokens
+// are also written back to the config file the remote came from
+func newClient(configData []byte, remoteConfig, stateDir string) (*azure.AzureClient, error) {
+	client, err := azure.NewAzureClientFromRcloneConfigData(configData, remoteConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests carry their own deadlines, so transfers on slow links aren't cut off by a global client timeout
+	client.UseTimeouts(azure.Timeouts{Metadata: defaultMetadataTimeout})
+
+	// Repeated lookups of the same items within a run are answered from memory
+	client.UseItemCache(azure.NewItemCache(defaultItemCacheTTL, ""))
+
+	policy, err := remoteAccessPolicy(configData, remoteConfig)
+	if err != nil {
+		return nil, err
+	}
+	client.UseAccessPolicy(policy)
+
+	if value, ok := remoteSetting(configData, remoteConfig, "retry_metadata"); ok {
+		rule, err := azure.ParseRetryRule(value)
 		if err != nil {
-			fmt.Printf("Failed to retrieve remote QuickXorHash: %v\n", err)
-			return
+			return nil, fmt.Errorf("remote '%s': retry_metadata: %v", remoteConfig, err)
 		}
-		//fmt.Printf("Remote File ID: %s\n", fileID)
-		//fmt.Printf("Remote QuickXorHash: %s\n", remoteHash)
-
-		// Compare the hashes
-		if localHash != remoteHash {
-			fmt.Printf("Local File Path: %s\n", *filePath)
-			fmt.Printf("Local File Size: %d bytes\n", fileSize)
-			fmt.Printf("Local QuickXorHash: %s\n", localHash)
-			fmt.Printf("%sQuickXorHash mismatch: File integrity verification failed.%s\n", ColorRed, ColorReset)
-		} else {
-			fmt.Printf("%sQuickXorHash match: File integrity verified.%s\n", ColorGreen, ColorReset)
+		client.UseMetadataRetry(rule)
+	}
+
+	requestLimit, err := remoteRequestLimit(configData, remoteConfig)
+	if err != nil {
+		return nil, err
+	}
+	client.UseRequestLimit(requestLimit)
+
+	if err := decorateClient(client); err != nil {
+		return nil, err
+	}
+	trackMetrics(remoteConfig, client)
+
+	// Refreshed tokens are written back to a config file given on disk; the embedded config is
+	// read-only, and rclone's own config, used because none was given, belongs to rclone, so tokens
+	// refreshed for it only go to the token cache, in the user's cache directory without a state directory
+	tokenDir := stateDir
+	switch {
+	case loadedConfigPath != "" && !loadedConfigDetected:
+		client.AddTokenPersister(&configTokenStore{path: loadedConfigPath, remote: remoteConfig})
+	case loadedConfigDetected && tokenDir == "":
+		if cacheDir, err := os.UserCacheDir(); err == nil {
+			tokenDir = filepath.Join(cacheDir, "ksau-go")
 		}
-	} else {
-		fmt.Println("File upload failed.")
 	}
 
+	if tokenDir != "" {
+		cachePath := filepath.Join(tokenDir, "token-"+remoteConfig+".cache")
+		if err := client.UseTokenCache(cachePath, remoteConfig); err != nil {
+			fmt.Printf("Warning: ignoring token cache for remote '%s': %v\n", remoteConfig, err)
+		}
+	}
+
+	return client, nil
+}
+
+// quotaCachePath returns the file used to share cached quota results between runs
+func quotaCachePath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "ksau-go", "quota.json")
 }
 
 // getChunkSize dynamically selects a chunk size based on the file size
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// maintenance cleans up after earlier runs and counts what it removed, for each remote and for the
+// state directory ("local")
+type maintenance struct {
+	httpClient *http.Client
+	stateDir   string
+	trashAge   time.Duration
+	sessionAge time.Duration
+	permanent  bool
+	dryRun     bool
+	auditLog   string
+
+	tallies  []*maintenanceTally
+	failures int
+	exitCode int // Exit code of the first failure
+}
+
+// maintenanceTally counts what maintenance removed for a remote or the state directory
+type maintenanceTally struct {
+	name        string
+	backups     int // Backup folders of transactional syncs
+	pruned      int // Files past the remote's retention
+	prunedBytes int64
+	trash       int // Folders of bisync's trash
+	sessions    int // Stale upload sessions
+}
+
+// runMaintenance implements the maintenance command, which cleans up what earlier runs left behind on
+// each remote: the backups of old transactional syncs, files past the remote's retention key, and in
+// the state directory, bisync's old trash and upload sessions that were abandoned. It is meant to run
+// unattended, e.g. from cron, and exits with the code of the first failure.
+func runMaintenance(args []string) int {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	remoteConfig := fs.String("remote-config", "", "Only maintain this remote configuration section (default: all remotes)")
+	trashAge := fs.String("trash-age", "30d", "Remove the backups of transactional syncs and bisync's trash once they are this old, e.g. 30d or 12h (default: 30d)")
+	sessionAge := fs.String("session-age", "24h", "Abort saved upload sessions that haven't made progress for this long (default: 24h)")
+	permanent := fs.Bool("permanent", false, "Delete remote files and folders permanently instead of moving them to the recycle bin; only supported on OneDrive for Business and SharePoint (default: false)")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be removed (default: false)")
+	auditLog := fs.String("audit-log", "", "Append a JSON line recording each remote deletion to this file (default: none)")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens, sync journals, bisync's trash and saved upload sessions (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	m := &maintenance{httpClient: &http.Client{}, stateDir: *stateDir, permanent: *permanent, dryRun: *dryRun, auditLog: *auditLog}
+	var err error
+	if m.trashAge, err = parseAge(*trashAge); err != nil {
+		fmt.Println("Error: -trash-age:", err)
+		return exitUsage
+	}
+	if m.sessionAge, err = parseAge(*sessionAge); err != nil {
+		fmt.Println("Error: -session-age:", err)
+		return exitUsage
+	}
+
+	configData, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	remotes := []string{*remoteConfig}
+	if *remoteConfig == "" {
+		remotes = configRemotes(configData)
+	} else if !slices.Contains(configRemotes(configData), *remoteConfig) {
+		fmt.Printf("Error: remote '%s' isn't in the config, which has: %v\n", *remoteConfig, configRemotes(configData))
+		return exitUsage
+	}
+	if len(remotes) == 0 {
+		fmt.Println("Error: the config has no onedrive sections")
+		return exitUsage
+	}
+
+	// Ctrl+C stops between items, and the next run picks up the rest
+	gracefulShutdown.Store(true)
+
+	var sessionClient *azure.AzureClient
+	for _, remote := range remotes {
+		fmt.Printf("Remote %s\n", remote)
+		tally := m.tally(remote)
+		client, err := newClient(configData, remote, *stateDir)
+		if err != nil {
+			m.fail("initialize the client", err)
+			continue
+		}
+		if sessionClient == nil {
+			sessionClient = client
+		}
+		m.removeSyncBackups(client, remote, tally)
+		rules, err := remoteRetention(configData, remote)
+		if err != nil {
+			m.fail("read the retention", err)
+			continue
+		}
+		for _, rule := range rules {
+			m.prune(client, remote, rule, tally)
+		}
+	}
+
+	fmt.Printf("State directory %s\n", *stateDir)
+	tally := m.tally("local")
+	m.removeBisyncTrash(tally)
+	if sessionClient != nil {
+		m.abortStaleSessions(sessionClient, tally)
+	}
+
+	if interrupted.Err() != nil {
+		fmt.Printf("%sMaintenance interrupted; run it again to finish.%s\n", ColorYellow, ColorReset)
+		return exitInterrupted
+	}
+	return m.summary()
+}
+
+// parseAge parses an age such as 30d, 12h or 90m; days are 24 hours
+func parseAge(value string) (time.Duration, error) {
+	var age time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age '%s'", value)
+		}
+		age = time.Duration(n * float64(24*time.Hour))
+	} else {
+		var err error
+		if age, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid age '%s', expected e.g. 30d or 12h", value)
+		}
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("age '%s' must be positive", value)
+	}
+	return age, nil
+}
+
+// tally starts counting what is removed for name
+func (m *maintenance) tally(name string) *maintenanceTally {
+	tally := &maintenanceTally{name: name}
+	m.tallies = append(m.tallies, tally)
+	return tally
+}
+
+// fail reports a failed step; maintenance carries on with the next one
+func (m *maintenance) fail(what string, err error) {
+	m.failures++
+	if m.exitCode == exitOK {
+		m.exitCode = exitCodeFor(err)
+	}
+	printError("  Failed to "+what, err)
+}
+
+// removeSyncBackups removes the backup folders of the remote's transactional syncs that finished
+// more than -trash-age ago, with their journals, since the runs can't be rolled back without them
+func (m *maintenance) removeSyncBackups(client *azure.AzureClient, remote string, tally *maintenanceTally) {
+	journals, err := listSyncJournals(m.stateDir)
+	if err != nil {
+		m.fail("read the sync journals", err)
+		return
+	}
+	for _, journal := range journals {
+		if interrupted.Err() != nil {
+			return
+		}
+		ended := journal.Finished
+		if ended.IsZero() {
+			ended = journal.Started
+		}
+		if journal.Remote != remote || time.Since(ended) < m.trashAge {
+			continue
+		}
+
+		// A rolled back run already moved its backups back
+		if journal.RolledBack.IsZero() {
+			fmt.Printf("  Remove backups of sync %s: %s\n", journal.RunID, journal.BackupDir)
+			if err := m.remove(client, remote, journal.BackupDir, 0); err != nil && !isNotFound(err) {
+				m.fail(fmt.Sprintf("remove the backups of sync %s", journal.RunID), err)
+				continue
+			}
+			tally.backups++
+		}
+		if !m.dryRun {
+			if err := os.Remove(journal.path); err != nil {
+				m.fail(fmt.Sprintf("remove the journal of sync %s", journal.RunID), err)
+			}
+		}
+	}
+}
+
+// prune removes the files below the rule's folder that weren't modified within its age
+func (m *maintenance) prune(client *azure.AzureClient, remote string, rule retentionRule, tally *maintenanceTally) {
+	files, err := listRemoteFiles(client, m.httpClient, "", remote, rule.folder)
+	if isNotFound(err) {
+		return
+	}
+	if err != nil {
+		m.fail(fmt.Sprintf("list '%s'", rule.folder), err)
+		return
+	}
+
+	cutoff := time.Now().Add(-rule.age)
+	var expired []string
+	for rel, item := range files {
+		if item.LastModifiedDateTime.Before(cutoff) {
+			expired = append(expired, rel)
+		}
+	}
+	sort.Strings(expired)
+	for _, rel := range expired {
+		if interrupted.Err() != nil {
+			return
+		}
+		remotePath := remoteJoin(rule.folder, rel)
+		item := files[rel]
+		fmt.Printf("  Prune %s (%s, modified %s)\n", remotePath, formatBytes(item.Size), item.LastModifiedDateTime.Local().Format("2006-01-02"))
+		if err := m.remove(client, remote, remotePath, item.Size); err != nil && !isNotFound(err) {
+			m.fail(fmt.Sprintf("prune '%s'", remotePath), err)
+			continue
+		}
+		tally.pruned++
+		tally.prunedBytes += item.Size
+	}
+}
+
+// remove deletes a remote file or folder of size bytes, to the recycle bin unless -permanent is set,
+// and records it in the audit log
+func (m *maintenance) remove(client *azure.AzureClient, remote, remotePath string, size int64) error {
+	if m.dryRun {
+		return nil
+	}
+	mode := "trash"
+	var err error
+	if m.permanent {
+		mode = "permanent"
+		err = client.PermanentDelete(m.httpClient, remotePath)
+	} else {
+		err = client.Delete(m.httpClient, remotePath)
+	}
+	if err != nil {
+		return err
+	}
+	if m.auditLog != "" {
+		if err := appendAuditLog(m.auditLog, auditEntry{Operation: "maintenance", Remote: remote, Path: remotePath, Size: size, Mode: mode}); err != nil {
+			fmt.Printf("  %sWarning: %v%s\n", ColorYellow, err, ColorReset)
+		}
+	}
+	return nil
+}
+
+// removeBisyncTrash removes the folders of bisync's default trash in the state directory that are
+// older than -trash-age; they are named after the time of the run that filled them
+func (m *maintenance) removeBisyncTrash(tally *maintenanceTally) {
+	trashDir := filepath.Join(m.stateDir, "bisync-trash")
+	entries, err := os.ReadDir(trashDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.fail("read "+trashDir, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		runTime, err := time.ParseInLocation("2006-01-02_150405", entry.Name(), time.Local)
+		if !entry.IsDir() || err != nil || time.Since(runTime) < m.trashAge {
+			continue
+		}
+		path := filepath.Join(trashDir, entry.Name())
+		fmt.Printf("  Remove bisync trash %s\n", path)
+		if !m.dryRun {
+			if err := os.RemoveAll(path); err != nil {
+				m.fail("remove "+path, err)
+				continue
+			}
+		}
+		tally.trash++
+	}
+}
+
+// abortStaleSessions cancels the saved upload sessions that haven't made progress for -session-age,
+// so OneDrive discards their bytes and -resume doesn't try them again. The sessions' URLs carry
+// their own authorization, so any remote's client can abort them.
+func (m *maintenance) abortStaleSessions(client *azure.AzureClient, tally *maintenanceTally) {
+	uploads, err := azure.SavedUploads(m.stateDir)
+	if err != nil {
+		m.fail("read the saved upload sessions", err)
+		return
+	}
+	for _, upload := range uploads {
+		if interrupted.Err() != nil {
+			return
+		}
+		if time.Since(upload.Saved) < m.sessionAge {
+			continue
+		}
+		fmt.Printf("  Abort upload session of %s to %s (last progress %s)\n", upload.FilePath, upload.RemoteFilePath, upload.Saved.Format("2006-01-02 15:04"))
+		if !m.dryRun {
+			if err := client.AbortSavedUpload(m.httpClient, upload); err != nil {
+				m.fail(fmt.Sprintf("abort the upload session of %s", upload.FilePath), err)
+				continue
+			}
+		}
+		tally.sessions++
+	}
+}
+
+// summary prints what was removed for each remote and the state directory, and returns the exit code
+// of the first failure
+func (m *maintenance) summary() int {
+	fmt.Println()
+	if m.dryRun {
+		fmt.Println("Summary (dry run, nothing was removed)")
+	} else {
+		fmt.Println("Summary")
+	}
+	for _, tally := range m.tallies {
+		fmt.Printf("  %s: %s\n", tally.name, tally)
+	}
+
+	if m.failures > 0 {
+		fmt.Printf("%sFailures: %d; run maintenance again to retry them.%s\n", ColorRed, m.failures, ColorReset)
+		return m.exitCode
+	}
+	return exitOK
+}
+
+// String describes what was removed, e.g. "removed 2 sync backups, pruned 14 files (1.204 GiB)"
+func (tally *maintenanceTally) String() string {
+	var parts []string
+	if tally.backups > 0 {
+		parts = append(parts, fmt.Sprintf("removed %d sync backups", tally.backups))
+	}
+	if tally.pruned > 0 {
+		parts = append(parts, fmt.Sprintf("pruned %d files (%s)", tally.pruned, formatBytes(tally.prunedBytes)))
+	}
+	if tally.trash > 0 {
+		parts = append(parts, fmt.Sprintf("removed %d bisync trash folders", tally.trash))
+	}
+	if tally.sessions > 0 {
+		parts = append(parts, fmt.Sprintf("aborted %d stale upload sessions", tally.sessions))
+	}
+	if len(parts) == 0 {
+		return "nothing to clean up"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30d", 30 * 24 * time.Hour, false},
+		{"1.5d", 36 * time.Hour, false},
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"0d", 0, true},
+		{"-1h", 0, true},
+		{"d", 0, true},
+		{"30", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAge(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAge(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseAge(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteRetention(t *testing.T) {
+	const section = "[oned]\ntype = onedrive\nroot_folder = Public\nroots = roms:Public/ROMs\n"
+	tests := []struct {
+		name      string
+		retention string
+		want      []retentionRule
+		wantErr   bool
+	}{
+		{"unset", "", nil, false},
+		{"relative to the root folder", "nightly:14d", []retentionRule{{"Public/nightly", 14 * 24 * time.Hour}}, false},
+		{"several entries", "nightly:14d, logs/ci/:72h", []retentionRule{{"Public/nightly", 14 * 24 * time.Hour}, {"Public/logs/ci", 72 * time.Hour}}, false},
+		{"configured root", "roms/old:30d", []retentionRule{{"Public/ROMs/old", 30 * 24 * time.Hour}}, false},
+		{"no age", "nightly", nil, true},
+		{"invalid age", "nightly:soon", nil, true},
+		{"no folder", ":30d", nil, true},
+		{"root folder itself", "/:30d", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := section
+			if tt.retention != "" {
+				config += "retention = " + tt.retention + "\n"
+			}
+			got, err := remoteRetention([]byte(config), "oned")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("remoteRetention() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("remoteRetention() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("rule %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// metricsAddr is the address -metrics-addr serves /metrics on ("" disables it)
+var metricsAddr string
+
+// registerMetricsFlag adds the -metrics-addr flag to the flag set of a command that may run for long
+func registerMetricsFlag(fs *flag.FlagSet) {
+	fs.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics at /metrics on this address while the command runs, e.g. :9090 (default: disabled)")
+}
+
+// metricClients are the clients created in this run, whose stats /metrics reports per remote
+var (
+	metricClientsMu sync.Mutex
+	metricClients   = map[string][]*azure.AzureClient{}
+)
+
+// trackMetrics adds a client to the stats /metrics reports for its remote
+func trackMetrics(remote string, client *azure.AzureClient) {
+	metricClientsMu.Lock()
+	defer metricClientsMu.Unlock()
+	metricClients[remote] = append(metricClients[remote], client)
+}
+
+// metricDefinitions describe the metrics /metrics reports, in order
+var metricDefinitions = []struct {
+	name, kind, help string
+	value            func(azure.Stats) int64
+}{
+	{"ksau_uploaded_bytes_total", "counter", "Bytes of chunks accepted by Graph.", func(s azure.Stats) int64 { return s.UploadedBytes }},
+	{"ksau_chunk_retries_total", "counter", "Chunk uploads retried after an error.", func(s azure.Stats) int64 { return s.ChunkRetries }},
+	{"ksau_token_refreshes_total", "counter", "Access tokens refreshed.", func(s azure.Stats) int64 { return s.TokenRefreshes }},
+	{"ksau_throttled_responses_total", "counter", "429 and 503 responses from Graph.", func(s azure.Stats) int64 { return s.ThrottledResponses }},
+	{"ksau_active_transfers", "gauge", "Chunk uploads and download parts in progress.", func(s azure.Stats) int64 { return s.ActiveTransfers }},
+}
+
+// startMetricsServer serves /metrics on -metrics-addr in the background for the rest of the run;
+// without the flag it does nothing
+func startMetricsServer() error {
+	if metricsAddr == "" {
+		return nil
+	}
+
+	// Listen right away, so a port that is taken is reported before the command starts working
+	listener, err := net.Listen("tcp", metricsAddr)
+	if err != nil {
+		return fmt.Errorf("failed to serve metrics: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	go http.Serve(listener, mux)
+	fmt.Printf("Serving metrics at http://%s/metrics\n", listener.Addr())
+	return nil
+}
+
+// serveMetrics writes the stats of every remote's clients in Prometheus' text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metricClientsMu.Lock()
+	stats := make(map[string][]azure.Stats, len(metricClients))
+	for remote, clients := range metricClients {
+		for _, client := range clients {
+			stats[remote] = append(stats[remote], client.Stats())
+		}
+	}
+	metricClientsMu.Unlock()
+
+	remotes := make([]string, 0, len(stats))
+	for remote := range stats {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, metric := range metricDefinitions {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, remote := range remotes {
+			var total int64
+			for _, s := range stats[remote] {
+				total += metric.value(s)
+			}
+			fmt.Fprintf(w, "%s{remote=\"%s\"} %d\n", metric.name, escapeLabelValue(remote), total)
+		}
+	}
+}
+
+// escapeLabelValue escapes a Prometheus label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
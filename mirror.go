@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// errMirrorStopped is returned to the reader of the local file once every mirror upload has stopped
+// taking its content
+var errMirrorStopped = errors.New("every mirror upload stopped")
+
+// mirrorTarget is one remote a -mirror upload sends the file to
+type mirrorTarget struct {
+	remote         string
+	client         *azure.AzureClient
+	opts           uploadOptions // Options for this remote, e.g. with its own retry policy
+	remoteFilePath string
+	result         *uploadResult
+	err            error
+}
+
+// parseMirrorRemotes parses the comma-separated -mirror remote list, which must name distinct
+// configured remotes
+func parseMirrorRemotes(configData []byte, list string) ([]string, error) {
+	var remotes []string
+	for _, remote := range strings.Split(list, ",") {
+		remote = strings.TrimSpace(remote)
+		if remote == "" {
+			continue
+		}
+		if !slices.Contains(configRemotes(configData), remote) {
+			return nil, fmt.Errorf("-mirror remote '%s' is not configured", remote)
+		}
+		if slices.Contains(remotes, remote) {
+			return nil, fmt.Errorf("-mirror lists remote '%s' twice", remote)
+		}
+		remotes = append(remotes, remote)
+	}
+	if len(remotes) == 0 {
+		return nil, errors.New("-mirror needs at least one remote")
+	}
+	return remotes, nil
+}
+
+// mirrorUpload uploads a local file to every target at once while reading it only once: each block
+// read is passed on to all the uploads, so the slowest remote sets the pace. An upload that fails
+// stops receiving blocks without holding up the others. It prints the download URL of every copy
+// and returns the exit code of the first failed upload.
+func mirrorUpload(httpClient *http.Client, localPath string, targets []*mirrorTarget) int {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		fmt.Println("Failed to get file info:", err)
+		return exitFailure
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		fmt.Println("Failed to open file:", err)
+		return exitFailure
+	}
+	defer file.Close()
+
+	fanOut := &mirrorWriter{}
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		reader, writer := io.Pipe()
+		fanOut.writers = append(fanOut.writers, writer)
+
+		opts := target.opts
+		opts.reader = reader
+		opts.label = target.remote
+		// The uploads share the terminal like parallel transfers do
+		opts.transfers = len(targets)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target.result, target.err = uploadEntry(target.client, httpClient, opts, localPath, target.remoteFilePath)
+			// An upload that skipped the file or failed takes no more blocks
+			reader.CloseWithError(errMirrorStopped)
+		}()
+	}
+
+	// Blocks past the size the upload sessions were created with aren't sent
+	_, copyErr := io.CopyN(fanOut, file, info.Size())
+	if errors.Is(copyErr, errMirrorStopped) {
+		copyErr = nil
+	} else if copyErr != nil {
+		copyErr = fmt.Errorf("failed to read file: %v", copyErr)
+	}
+	fanOut.close(copyErr)
+	wg.Wait()
+
+	fmt.Printf("Mirrored %s to %d remotes:\n", localPath, len(targets))
+	exitCode := exitOK
+	for _, target := range targets {
+		switch {
+		case target.err != nil:
+			fmt.Printf("%s  %s: failed: %v%s\n", ColorRed, target.remote, target.err, ColorReset)
+			if exitCode == exitOK {
+				exitCode = exitCodeFor(target.err)
+			}
+		case target.result.downloadURL != "":
+			fmt.Printf("  %s: %s%s%s\n", target.remote, ColorGreen, target.result.downloadURL, ColorReset)
+		default:
+			fmt.Printf("  %s: %s (no download URL)\n", target.remote, target.remoteFilePath)
+		}
+	}
+	return exitCode
+}
+
+// mirrorWriter writes every block to all the pipes of the mirror uploads, dropping those whose
+// upload stopped reading
+type mirrorWriter struct {
+	writers []*io.PipeWriter
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	live := 0
+	for i, writer := range w.writers {
+		if writer == nil {
+			continue
+		}
+		if _, err := writer.Write(p); err != nil {
+			w.writers[i] = nil
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errMirrorStopped
+	}
+	return len(p), nil
+}
+
+// close ends the content of the uploads still reading, with err if the file couldn't be read
+func (w *mirrorWriter) close(err error) {
+	for _, writer := range w.writers {
+		if writer != nil {
+			writer.CloseWithError(err)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// githubDefaultAPI is the API of github.com; GitHub Enterprise servers have their own
+const githubDefaultAPI = "https://api.github.com"
+
+// githubRelease is the part of a GitHub release the mirror uses
+type githubRelease struct {
+	TagName string        `json:"tag_name"`
+	Name    string        `json:"name"`
+	Assets  []githubAsset `json:"assets"`
+}
+
+// githubAsset is a file attached to a release
+type githubAsset struct {
+	URL  string `json:"url"` // API URL, which serves the content with Accept: application/octet-stream
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// mirroredAsset is an asset uploaded by the mirror, for the table of download URLs
+type mirroredAsset struct {
+	name        string
+	size        int64
+	remotePath  string
+	downloadURL string
+}
+
+// githubError is an error answer of the GitHub API
+type githubError struct {
+	StatusCode int
+	Message    string
+	RateLimit  bool // The API rate limit was exhausted
+}
+
+func (e *githubError) Error() string {
+	return fmt.Sprintf("GitHub: %s (%d)", e.Message, e.StatusCode)
+}
+
+// runMirrorGitHub implements the mirror-github command, which streams the assets of a GitHub
+// release into a remote folder and prints a markdown table of their download URLs for release notes
+func runMirrorGitHub(args []string) int {
+	fs := flag.NewFlagSet("mirror-github", flag.ExitOnError)
+	remoteFolder := fs.String("remote", "", "Remote folder to upload the assets into, relative to the remote's root folder (default: <repo>/<tag>)")
+	token := fs.String("token", "", "GitHub token, for private repositories and a higher API rate limit (default: $GITHUB_TOKEN)")
+	assets := fs.String("assets", "", "Comma-separated patterns such as *.zip,*.img of the assets to mirror (default: all)")
+	apiURL := fs.String("api-url", githubDefaultAPI, "GitHub API, e.g. https://github.example.com/api/v3 for GitHub Enterprise (default: '"+githubDefaultAPI+"')")
+	output := fs.String("output", "", "Also write the markdown table of download URLs to this file (default: none)")
+	skipExisting := fs.Bool("skip-existing", false, "Skip assets whose remote copy has the same size, e.g. when mirroring a release again after a failure (default: false)")
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	parallelChunks := fs.Int("parallel", 1, "Number of parallel chunks to upload per file (default: 1)")
+	conflict := fs.String("conflict", string(azure.ConflictReplace), "What to do when a file with the same name already exists remotely: rename, replace or fail (default: 'replace')")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification (default: false)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	registerMetricsFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: ksau-go mirror-github [flags] <owner/repo[@tag]>")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	repo, tag, _ := strings.Cut(fs.Arg(0), "@")
+	if owner, name, ok := strings.Cut(repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		fmt.Printf("Error: invalid repository '%s': expected owner/repo or owner/repo@tag\n", fs.Arg(0))
+		return exitUsage
+	}
+	conflictBehavior, err := azure.ParseConflictBehavior(*conflict)
+	if err != nil {
+		fmt.Printf("Error: invalid -conflict: %v\n", err)
+		return exitUsage
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(*assets, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Printf("Error: invalid asset pattern '%s'\n", pattern)
+			return exitUsage
+		}
+		patterns = append(patterns, pattern)
+	}
+	if *token == "" {
+		*token = os.Getenv("GITHUB_TOKEN")
+	}
+
+	github := &githubClient{apiURL: strings.TrimSuffix(*apiURL, "/"), token: *token, httpClient: &http.Client{}}
+	release, err := github.release(repo, tag)
+	if err != nil {
+		printError(fmt.Sprintf("Failed to look up the release of %s", fs.Arg(0)), err)
+		return githubExitCode(err)
+	}
+	var selected []githubAsset
+	for _, asset := range release.Assets {
+		if matchesAnyPattern(patterns, asset.Name) {
+			selected = append(selected, asset)
+		}
+	}
+	if len(selected) == 0 {
+		fmt.Printf("Error: release %s of %s has no assets to mirror\n", release.TagName, repo)
+		return exitNotFound
+	}
+
+	spec := *remoteFolder
+	if spec == "" {
+		spec = remoteJoin(path.Base(repo), sanitizeName(release.TagName))
+	}
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, spec)
+	if code != exitOK {
+		return code
+	}
+	if err := startMetricsServer(); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	remoteDir := paths[0]
+	configData, _ := loadConfig()
+	remote, _ := resolveRemote(configData, spec, *remoteConfig)
+	retryPolicy, err := remoteRetryPolicy(configData, remote, azure.DefaultRetryPolicy())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	httpClient := &http.Client{}
+	opts := uploadOptions{
+		remoteConfig:   remote,
+		chunkSize:      *chunkSize,
+		parallelChunks: *parallelChunks,
+		retryPolicy:    retryPolicy,
+		skipHash:       *skipHash,
+		hashRetries:    5,
+		hashRetryDelay: 10 * time.Second,
+		conflict:       conflictBehavior,
+	}
+	// Ctrl+C stops the upload in progress and cleans up its session instead of killing the process mid-transfer
+	gracefulShutdown.Store(true)
+
+	fmt.Printf("Mirroring %d assets of %s %s to %s\n", len(selected), repo, release.TagName, remoteDir)
+	if _, err := client.EnsureFolder(httpClient, remoteDir); err != nil {
+		printError("Failed to create the remote folder", err)
+		return exitCodeFor(err)
+	}
+
+	var mirrored []mirroredAsset
+	exitCode := exitOK
+	for _, asset := range selected {
+		if interrupted.Err() != nil {
+			return exitInterrupted
+		}
+		remoteName := sanitizeName(asset.Name)
+		remoteFilePath := remoteJoin(remoteDir, remoteName)
+		fmt.Printf("\nMirroring %s (%s)\n", asset.Name, formatBytes(asset.Size))
+
+		if *skipExisting {
+			if item, err := client.GetItem(httpClient, remoteFilePath); err == nil && !item.IsFolder() && item.Size == asset.Size {
+				fmt.Printf("%sAlready mirrored, skipping.%s\n", ColorYellow, ColorReset)
+				result := &uploadResult{fileID: item.ID, size: item.Size}
+				printDownloadURL(result, remote, remoteFilePath)
+				mirrored = append(mirrored, mirroredAsset{asset.Name, asset.Size, remoteFilePath, result.downloadURL})
+				continue
+			}
+		}
+
+		result, err := github.mirrorAsset(client, httpClient, opts, asset, remoteFilePath)
+		switch {
+		case errors.Is(err, context.Canceled):
+			fmt.Printf("%sMirroring of '%s' interrupted.%s\n", ColorYellow, asset.Name, ColorReset)
+			return exitInterrupted
+		case err != nil:
+			printError(fmt.Sprintf("Failed to mirror '%s'", asset.Name), err)
+			if exitCode == exitOK {
+				exitCode = githubExitCode(err)
+			}
+		default:
+			mirrored = append(mirrored, mirroredAsset{asset.Name, result.size, remoteFilePath, result.downloadURL})
+		}
+	}
+
+	table := releaseAssetTable(mirrored)
+	fmt.Printf("\nMirrored %d of %d assets:\n\n%s", len(mirrored), len(selected), table)
+	if *output != "" {
+		if err := os.WriteFile(*output, []byte(table), 0o644); err != nil {
+			fmt.Println("Error: failed to write the table:", err)
+			return exitFailure
+		}
+	}
+	return exitCode
+}
+
+// githubClient calls the GitHub REST API
+type githubClient struct {
+	apiURL     string
+	token      string
+	httpClient *http.Client
+}
+
+// get requests an API path, or a full URL of the API, with the given Accept header and returns the
+// response, or the API's error for anything but 200
+func (github *githubClient) get(target, accept string) (*http.Response, error) {
+	if !strings.HasPrefix(target, "https://") && !strings.HasPrefix(target, "http://") {
+		target = github.apiURL + target
+	}
+	req, err := http.NewRequestWithContext(interrupted, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("User-Agent", azure.DefaultUserAgent)
+	// Asset downloads redirect to another host; Go drops the Authorization header when following them
+	if github.token != "" {
+		req.Header.Set("Authorization", "Bearer "+github.token)
+	}
+
+	resp, err := github.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	apiErr := &githubError{StatusCode: resp.StatusCode, Message: resp.Status}
+	var body struct {
+		Message string `json:"message"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Message != "" {
+		apiErr.Message = body.Message
+	}
+	apiErr.RateLimit = resp.Header.Get("X-RateLimit-Remaining") == "0"
+	return nil, apiErr
+}
+
+// release looks up a release by tag, or the latest release if tag is empty
+func (github *githubClient) release(repo, tag string) (*githubRelease, error) {
+	target := "/repos/" + repo + "/releases/latest"
+	if tag != "" {
+		target = "/repos/" + repo + "/releases/tags/" + url.PathEscape(tag)
+	}
+	resp, err := github.get(target, "application/vnd.github+json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("failed to parse the release: %v", err)
+	}
+	return &release, nil
+}
+
+// mirrorAsset streams an asset from GitHub into remoteFilePath
+func (github *githubClient) mirrorAsset(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, asset githubAsset, remoteFilePath string) (*uploadResult, error) {
+	resp, err := github.get(asset.URL, "application/octet-stream")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the asset: %w", err)
+	}
+	defer resp.Body.Close()
+
+	opts.reader = resp.Body
+	opts.size = resp.ContentLength
+	if opts.size < 0 {
+		opts.size = asset.Size
+	}
+	opts.label = asset.Name
+	return uploadEntry(client, httpClient, opts, "", remoteFilePath)
+}
+
+// githubExitCode returns the exit code for an error, including those of the GitHub API
+func githubExitCode(err error) int {
+	var apiErr *githubError
+	if !errors.As(err, &apiErr) {
+		return exitCodeFor(err)
+	}
+	switch {
+	case apiErr.RateLimit, apiErr.StatusCode == http.StatusTooManyRequests:
+		return exitThrottled
+	case apiErr.StatusCode == http.StatusUnauthorized, apiErr.StatusCode == http.StatusForbidden:
+		return exitAuth
+	case apiErr.StatusCode == http.StatusNotFound:
+		return exitNotFound
+	default:
+		return exitFailure
+	}
+}
+
+// matchesAnyPattern reports whether name matches one of the patterns; no patterns match everything
+func matchesAnyPattern(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseAssetTable renders mirrored assets as a markdown table for release notes. Assets without a
+// download URL, e.g. outside the indexed root folder, list their remote path instead.
+func releaseAssetTable(assets []mirroredAsset) string {
+	escape := strings.NewReplacer("|", `\|`, "[", `\[`, "]", `\]`)
+	var table strings.Builder
+	table.WriteString("| File | Size | Download |\n")
+	table.WriteString("| --- | --- | --- |\n")
+	for _, asset := range assets {
+		link := "`" + asset.remotePath + "`"
+		if asset.downloadURL != "" {
+			link = fmt.Sprintf("[Download](%s)", strings.ReplaceAll(asset.downloadURL, ")", "%29"))
+		}
+		fmt.Fprintf(&table, "| %s | %s | %s |\n", escape.Replace(asset.name), formatBytes(asset.size), link)
+	}
+	return table.String()
+}
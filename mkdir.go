@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+)
+
+// runMkdir implements the mkdir command, which creates remote folders ahead of uploads
+func runMkdir(args []string) int {
+	fs := flag.NewFlagSet("mkdir", flag.ExitOnError)
+	parents := fs.Bool("p", false, "Create missing parent folders and don't fail if the folder already exists (default: false)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ksau-go mkdir [flags] <folder>...")
+		fmt.Fprintln(fs.Output(), "Folders are relative to the remote's root folder, or remote:root/path to use one of its configured roots.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, fs.Args()...)
+	if code != exitOK {
+		return code
+	}
+
+	httpClient := &http.Client{}
+
+	exitCode := exitOK
+	for _, fullRemotePath := range paths {
+		if _, err := client.CreateFolder(httpClient, fullRemotePath, *parents); err != nil {
+			printError(fmt.Sprintf("Failed to create folder '%s'", fullRemotePath), err)
+			exitCode = exitCodeFor(err)
+			continue
+		}
+		fmt.Printf("%sCreated %s%s\n", ColorGreen, fullRemotePath, ColorReset)
+	}
+
+	return exitCode
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stringList is a flag that can be given more than once, collecting every value
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// expandFilePatterns expands shell-style globs such as *.zip in the -file values, for shells that
+// don't expand them (e.g. on Windows); other values are kept as they are
+func expandFilePatterns(patterns []string) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			paths = append(paths, pattern)
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match '%s'", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// fileTargets builds the upload targets for several local files uploaded into remoteFolder under
+// their own names, made valid on OneDrive first if sanitize is set; directories are skipped since
+// they can only be uploaded on their own
+func fileTargets(paths []string, remoteFolder string, sanitize bool) ([]uploadTarget, error) {
+	var targets []uploadTarget
+	names := make(map[string]string)
+	for _, path := range paths {
+		info, err := os.Stat(longPath(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file info: %v", err)
+		}
+		if info.IsDir() {
+			fmt.Printf("%sSkipping directory '%s': directories can only be uploaded on their own%s\n", ColorYellow, path, ColorReset)
+			continue
+		}
+
+		// OneDrive names are case-insensitive, so these would end up as the same remote file
+		name := filepath.Base(path)
+		if sanitize {
+			name = sanitizedPath(name)
+		}
+		if other, exists := names[strings.ToLower(name)]; exists {
+			if other == path {
+				continue
+			}
+			return nil, fmt.Errorf("'%s' and '%s' would both be uploaded as '%s'", other, path, name)
+		}
+		names[strings.ToLower(name)] = path
+
+		targets = append(targets, uploadTarget{name: path, localPath: longPath(path), remotePath: remoteJoin(remoteFolder, name)})
+	}
+	return targets, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// Network and request options shared by all commands, set by the flags registerNetworkFlags adds
+// or the matching KSAU_* environment variables
+var (
+	proxyURL           string
+	caCertPath         string
+	tlsMinVersion      string
+	insecureSkipVerify bool
+	networkConfigured  bool
+	userAgent          string
+	requestHeaders     stringList
+	dumpHTTP           bool
+	dumpHTTPFile       string
+)
+
+// registerNetworkFlags adds the proxy, TLS and request header flags to a command's flag set
+func registerNetworkFlags(fs *flag.FlagSet) {
+	fs.StringVar(&proxyURL, "proxy", "", "Send all requests through this proxy, e.g. http://proxy:3128 or socks5://localhost:1080 (default: $KSAU_PROXY, then $HTTPS_PROXY and $HTTP_PROXY)")
+	fs.StringVar(&caCertPath, "ca-cert", "", "PEM file of additional CA certificates to trust, e.g. of a TLS-intercepting firewall (default: $KSAU_CA_CERT)")
+	fs.StringVar(&tlsMinVersion, "tls-min-version", "", "Minimum TLS version to accept: 1.2 or 1.3 (default: $KSAU_TLS_MIN_VERSION, then 1.2)")
+	fs.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Don't verify server certificates; only for debugging, since it exposes tokens to anyone on the path (default: $KSAU_INSECURE_SKIP_VERIFY)")
+	fs.StringVar(&userAgent, "user-agent", "", "User-Agent of all Graph requests, e.g. \"ISV|Contoso|Backup/1.0\" (default: $KSAU_USER_AGENT, then \""+azure.DefaultUserAgent+"\")")
+	fs.Var(&requestHeaders, "header", "Add this header to all Graph requests, written as \"Name: value\"; repeat it for several headers")
+	fs.BoolVar(&dumpHTTP, "dump-http", false, "Log every Graph request and response with headers and text bodies to stderr, with tokens redacted (default: false)")
+	fs.StringVar(&dumpHTTPFile, "dump-http-file", "", "With -dump-http, append the log to this file instead of stderr (default: none)")
+}
+
+// decorateClient applies the -user-agent, -header and -dump-http options to a client's requests
+func decorateClient(client *azure.AzureClient) error {
+	if userAgent == "" {
+		userAgent = os.Getenv("KSAU_USER_AGENT")
+	}
+	client.UseUserAgent(userAgent)
+
+	if len(requestHeaders) > 0 {
+		header := http.Header{}
+		for _, value := range requestHeaders {
+			name, content, found := strings.Cut(value, ":")
+			name = strings.TrimSpace(name)
+			if !found || name == "" || strings.ContainsAny(name, " \t") {
+				return fmt.Errorf("invalid header '%s': expected \"Name: value\"", value)
+			}
+			header.Add(name, strings.TrimSpace(content))
+		}
+		client.UseMiddleware(azure.HeaderMiddleware(header))
+	}
+
+	// Added last, so the log shows requests as they are sent, with the headers above
+	if dumpHTTP || dumpHTTPFile != "" {
+		middleware, err := dumpMiddleware()
+		if err != nil {
+			return err
+		}
+		client.UseMiddleware(middleware)
+	}
+	return nil
+}
+
+// tlsVersions maps the accepted -tls-min-version values to their crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// configureNetwork applies the network options to http.DefaultTransport, which every HTTP client
+// of the commands uses, so Graph, token and index requests all go through the same proxy and TLS
+// settings. Without options the default transport is left alone.
+func configureNetwork() error {
+	if networkConfigured {
+		return nil
+	}
+
+	if proxyURL == "" {
+		proxyURL = os.Getenv("KSAU_PROXY")
+	}
+	if caCertPath == "" {
+		caCertPath = os.Getenv("KSAU_CA_CERT")
+	}
+	if tlsMinVersion == "" {
+		tlsMinVersion = os.Getenv("KSAU_TLS_MIN_VERSION")
+	}
+	if !insecureSkipVerify {
+		if value := os.Getenv("KSAU_INSECURE_SKIP_VERIFY"); value != "" {
+			skip, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid KSAU_INSECURE_SKIP_VERIFY '%s': expected true or false", value)
+			}
+			insecureSkipVerify = skip
+		}
+	}
+	if proxyURL == "" && caCertPath == "" && tlsMinVersion == "" && !insecureSkipVerify {
+		networkConfigured = true
+		return nil
+	}
+
+	base, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("failed to configure network: the default HTTP transport has been replaced")
+	}
+	transport := base.Clone()
+
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil || proxy.Host == "" {
+			return fmt.Errorf("invalid proxy URL '%s'", proxyURL)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("invalid proxy URL '%s': the scheme must be http, https or socks5", proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	if caCertPath != "" {
+		pem, err := os.ReadFile(caCertPath)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificates: %v", err)
+		}
+		// Trust the system's CAs as well, so only the intercepting certificate needs to be given
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("failed to read CA certificates: no PEM certificates found in '%s'", caCertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if tlsMinVersion != "" {
+		version, ok := tlsVersions[tlsMinVersion]
+		if !ok {
+			return fmt.Errorf("invalid TLS version '%s': expected 1.2 or 1.3", tlsMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if insecureSkipVerify {
+		fmt.Printf("%sWarning: server certificates are not verified.%s\n", ColorYellow, ColorReset)
+		tlsConfig.InsecureSkipVerify = true
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	http.DefaultTransport = transport
+	networkConfigured = true
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// pingResult holds the latencies measured for one remote; steps after a failure are left at zero
+type pingResult struct {
+	remote   string
+	token    time.Duration
+	metadata time.Duration
+	upload   time.Duration
+	delete   time.Duration
+	failed   string
+	err      error
+}
+
+// runPing implements the ping command, which measures the latency of each step of talking to Graph per remote
+func runPing(args []string) int {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	remoteConfig := fs.String("remote-config", "", "Only check this remote configuration section (default: all remotes)")
+	noUpload := fs.Bool("no-upload", false, "Skip the upload/delete round trip, leaving the drive untouched (default: false)")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	configData, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	remotes := []string{*remoteConfig}
+	if *remoteConfig == "" {
+		remotes = configRemotes(configData)
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	var results []pingResult
+	for _, remote := range remotes {
+		fmt.Printf("Checking %s...\n", remote)
+		result := pingResult{remote: remote}
+
+		client, err := newClient(configData, remote, *stateDir)
+		if err != nil {
+			result.failed, result.err = "config", err
+		} else {
+			pingRemote(client, httpClient, remoteRootFolder(configData, remote), !*noUpload, &result)
+		}
+		results = append(results, result)
+	}
+
+	fmt.Println()
+	fmt.Printf("%-16s %10s %10s %10s %10s  %s\n", "REMOTE", "TOKEN", "METADATA", "UPLOAD", "DELETE", "STATUS")
+	exitCode := exitOK
+	for _, result := range results {
+		status := ColorGreen + "ok" + ColorReset
+		if result.err != nil {
+			status = fmt.Sprintf("%s%s failed%s", ColorRed, result.failed, ColorReset)
+			exitCode = exitCodeFor(result.err)
+		}
+		fmt.Printf("%-16s %10s %10s %10s %10s  %s\n", result.remote, formatLatency(result.token), formatLatency(result.metadata),
+			formatLatency(result.upload), formatLatency(result.delete), status)
+	}
+
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Println()
+			printError(fmt.Sprintf("%s: %s failed", result.remote, result.failed), result.err)
+		}
+	}
+
+	return exitCode
+}
+
+// pingRemote times a forced token refresh, a metadata lookup of the root folder and, with upload set,
+// a small upload and delete round trip inside it, stopping at the first failing step
+func pingRemote(client *azure.AzureClient, httpClient *http.Client, rootFolder string, upload bool, result *pingResult) {
+	start := time.Now()
+	if err := client.RefreshAccessToken(httpClient); err != nil {
+		result.failed, result.err = "token refresh", err
+		return
+	}
+	result.token = time.Since(start)
+
+	start = time.Now()
+	if _, err := client.GetItem(httpClient, rootFolder); err != nil {
+		result.failed, result.err = "metadata", err
+		return
+	}
+	result.metadata = time.Since(start)
+
+	if !upload {
+		return
+	}
+
+	probePath := remoteJoin(rootFolder, fmt.Sprintf(".ksau-ping-%d", time.Now().UnixNano()))
+
+	start = time.Now()
+	if _, err := client.PutSmallFile(httpClient, probePath, []byte("ksau-go ping\n")); err != nil {
+		result.failed, result.err = "upload", err
+		return
+	}
+	result.upload = time.Since(start)
+
+	start = time.Now()
+	if err := client.Delete(httpClient, probePath); err != nil {
+		result.failed, result.err = "delete", err
+		return
+	}
+	result.delete = time.Since(start)
+}
+
+// formatLatency formats a measured latency, or "-" if the step didn't run
+func formatLatency(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
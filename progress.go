@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress display settings
+const (
+	progressBarWidth     = 30
+	progressRedrawPeriod = 200 * time.Millisecond // Minimum time between redraws on a terminal
+	progressLogPeriod    = 10 * time.Second       // Time between log lines when stdout is not a terminal
+)
+
+// progressBar renders upload progress with throughput and ETA. On a terminal it redraws a
+// single line; otherwise it degrades to periodic log lines.
+type progressBar struct {
+	mu          sync.Mutex
+	isTTY       bool
+	startTime   time.Time
+	lastDraw    time.Time
+	lastBytes   int64
+	speed       float64 // Smoothed bytes per second
+	transferred int64
+	total       int64
+	drawn       bool
+	label       string // Name of the file, shown in log lines when several files upload at once
+	initial     int64  // Bytes transferred by an earlier attempt, left out of the throughput
+}
+
+// newProgressBar creates a progress bar for the current stdout
+func newProgressBar() *progressBar {
+	now := time.Now()
+	return &progressBar{
+		isTTY:     isTerminal(os.Stdout),
+		startTime: now,
+		lastDraw:  now,
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fileInfo.Mode()&os.ModeCharDevice != 0
+}
+
+// resumeFrom marks bytes an earlier attempt already transferred, so they don't count towards the throughput
+func (p *progressBar) resumeFrom(transferred int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.initial = transferred
+	p.lastBytes = transferred
+}
+
+// update records the current progress and redraws if enough time has passed; safe for concurrent use
+func (p *progressBar) update(transferred, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.transferred = transferred
+	p.total = total
+
+	period := progressLogPeriod
+	if p.isTTY {
+		period = progressRedrawPeriod
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(p.lastDraw)
+	if elapsed < period {
+		return
+	}
+
+	// Exponentially smooth the throughput so the ETA doesn't jump around between chunks
+	current := float64(transferred-p.lastBytes) / elapsed.Seconds()
+	if p.speed == 0 {
+		p.speed = current
+	} else {
+		p.speed = 0.7*p.speed + 0.3*current
+	}
+	p.lastBytes = transferred
+	p.lastDraw = now
+
+	p.draw()
+}
+
+// finish draws the final state and ends the progress line
+func (p *progressBar) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.drawn {
+		return
+	}
+
+	elapsed := time.Since(p.startTime).Seconds()
+	if elapsed > 0 {
+		p.speed = float64(p.transferred-p.initial) / elapsed
+	}
+	p.draw()
+	if p.isTTY {
+		fmt.Println()
+	}
+}
+
+// draw prints the progress line; callers must hold p.mu
+func (p *progressBar) draw() {
+	p.drawn = true
+
+	percent := 100.0
+	if p.total > 0 {
+		percent = float64(p.transferred) * 100 / float64(p.total)
+	}
+
+	eta := "--"
+	if p.speed > 0 && p.transferred < p.total {
+		eta = time.Duration(float64(p.total-p.transferred) / p.speed * float64(time.Second)).Round(time.Second).String()
+	}
+
+	stats := fmt.Sprintf("%5.1f%% %s/%s %s/s ETA %s", percent, formatBytes(p.transferred), formatBytes(p.total), formatBytes(int64(p.speed)), eta)
+
+	if !p.isTTY {
+		if p.label != "" {
+			fmt.Printf("Progress (%s): %s\n", p.label, stats)
+		} else {
+			fmt.Printf("Progress: %s\n", stats)
+		}
+		return
+	}
+
+	filled := int(percent / 100 * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	if filled > 0 && filled < progressBarWidth {
+		bar = strings.Repeat("=", filled-1) + ">" + strings.Repeat(" ", progressBarWidth-filled)
+	}
+	fmt.Printf("\r[%s] %s%s", bar, stats, eraseLine)
+}
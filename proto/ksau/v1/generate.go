@@ -0,0 +1,5 @@
+// Package ksauv1 holds the Go code generated from transfer.proto, the gRPC transfer service served
+// by ksau-go serve grpc
+package ksauv1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative transfer.proto
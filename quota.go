@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// quotaReport is the quota of one remote in the -json output of -show-quota
+type quotaReport struct {
+	Remote string `json:"remote"`
+	*azure.DriveQuota
+	Error    string `json:"error,omitempty"`
+	LowSpace bool   `json:"low_space,omitempty"` // Free space is below the -min-free threshold
+	err      error
+}
+
+// lowSpaceWarning returns the warning for a drive with less free space than minFree, or "" if it
+// has enough or no threshold is set
+func lowSpaceWarning(name string, quota *azure.DriveQuota, minFree int64) string {
+	if minFree <= 0 || quota == nil || quota.Remaining >= minFree {
+		return ""
+	}
+	return fmt.Sprintf("Warning: remote '%s' has only %s free, below the threshold of %s", name, formatBytes(quota.Remaining), formatBytes(minFree))
+}
+
+// fetchQuotas fetches the quota of every remote concurrently, each request with its own timeout,
+// and delivers the results in the order they arrive
+func fetchQuotas(configData []byte, remotes []string, stateDir string, quotaCache *azure.QuotaCache, timeout time.Duration) <-chan quotaReport {
+	results := make(chan quotaReport, len(remotes))
+	for _, remote := range remotes {
+		go func() {
+			report := quotaReport{Remote: remote}
+
+			client, err := newClient(configData, remote, stateDir)
+			if err != nil {
+				report.err = fmt.Errorf("failed to initialize client: %v", err)
+			} else {
+				httpClient := &http.Client{Timeout: timeout}
+				report.DriveQuota, report.err = quotaCache.Get(remote, func() (*azure.DriveQuota, error) {
+					return client.GetDriveQuota(httpClient)
+				})
+			}
+
+			if report.err != nil {
+				report.Error = report.err.Error()
+			}
+			results <- report
+		}()
+	}
+	return results
+}
+
+// showQuotas fetches the quota of every remote and prints each result as it arrives, or all of
+// them as one JSON array once done if asJSON is set. Remotes with less than minFree bytes free are
+// warned about and make it return exitQuota.
+func showQuotas(configData []byte, remotes []string, stateDir string, quotaCache *azure.QuotaCache, timeout time.Duration, asJSON bool, minFree int64) int {
+	results := fetchQuotas(configData, remotes, stateDir, quotaCache, timeout)
+
+	var reports []quotaReport
+	lowSpace := 0
+	for range remotes {
+		report := <-results
+		warning := lowSpaceWarning(report.Remote, report.DriveQuota, minFree)
+		if warning != "" {
+			report.LowSpace = true
+			lowSpace++
+		}
+		reports = append(reports, report)
+		if asJSON {
+			// Keep stdout valid JSON for scripts, but still make the warning visible
+			if warning != "" {
+				fmt.Fprintf(os.Stderr, "%s%s%s\n", ColorRed, warning, ColorReset)
+			}
+			continue
+		}
+
+		if report.err != nil {
+			printError(fmt.Sprintf("Failed to fetch quota information for remote '%s'", report.Remote), report.err)
+			fmt.Println()
+			continue
+		}
+		azure.DisplayQuotaInfo(report.Remote, report.DriveQuota)
+		if warning != "" {
+			fmt.Printf("%s%s%s\n\n", ColorRed, warning, ColorReset)
+		}
+	}
+
+	if asJSON {
+		sort.Slice(reports, func(i, j int) bool { return reports[i].Remote < reports[j].Remote })
+		data, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			fmt.Println("Failed to encode quota information:", err)
+			return exitFailure
+		}
+		fmt.Println(string(data))
+	}
+
+	if lowSpace > 0 {
+		return exitQuota
+	}
+	return exitOK
+}
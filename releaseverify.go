@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// releaseAttestation records the result of a release-verify run for release pipelines
+type releaseAttestation struct {
+	Remote     string         `json:"remote"`
+	RemotePath string         `json:"remote_path"`
+	LocalDir   string         `json:"local_dir"`
+	VerifiedAt time.Time      `json:"verified_at"`
+	Verified   bool           `json:"verified"`
+	Files      []attestedFile `json:"files"`
+	Missing    []string       `json:"missing,omitempty"`
+	Mismatched []string       `json:"mismatched,omitempty"`
+	Extra      []string       `json:"extra,omitempty"`
+}
+
+// attestedFile is a file that exists locally and remotely with the same content
+type attestedFile struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	QuickXorHash string `json:"quickxorhash"`
+}
+
+// signedAttestation wraps the encoded attestation with an Ed25519 signature over exactly those bytes
+type signedAttestation struct {
+	Algorithm string `json:"algorithm"`
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+	PublicKey []byte `json:"public_key"`
+}
+
+// runReleaseVerify implements the release-verify command, which confirms that a remote folder is a
+// byte-identical mirror of a local directory: every local file exists remotely with the same
+// QuickXorHash and the remote folder has no extra files
+func runReleaseVerify(args []string) int {
+	fs := flag.NewFlagSet("release-verify", flag.ExitOnError)
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	attestationPath := fs.String("attestation", "", "Write a JSON attestation of the result to this file (default: none)")
+	signKey := fs.String("sign-key", "", "PEM-encoded Ed25519 private key (PKCS #8) to sign the attestation with (default: unsigned)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Println("Usage: ksau-go release-verify [flags] <local-dir> <remote:dir>")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	localDir := longPath(fs.Arg(0))
+
+	info, err := os.Stat(localDir)
+	if err != nil || !info.IsDir() {
+		fmt.Printf("Error: '%s' is not a local directory\n", fs.Arg(0))
+		return exitUsage
+	}
+
+	var key ed25519.PrivateKey
+	if *signKey != "" {
+		if key, err = loadSigningKey(*signKey); err != nil {
+			fmt.Println("Error:", err)
+			return exitUsage
+		}
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, fs.Arg(1))
+	if code != exitOK {
+		return code
+	}
+	remoteDir := paths[0]
+
+	httpClient := &http.Client{}
+
+	fmt.Printf("Listing %s...\n", remoteDir)
+	remoteFiles := make(map[string]azure.DriveItem)
+	if err := listRemoteTree(client, httpClient, remoteDir, "", remoteFiles); err != nil {
+		printError("Failed to list remote folder", err)
+		return exitCodeFor(err)
+	}
+
+	var localFiles []string
+	err = filepath.WalkDir(localDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			rel, err := filepath.Rel(localDir, path)
+			if err != nil {
+				return err
+			}
+			localFiles = append(localFiles, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Failed to walk directory:", err)
+		return exitFailure
+	}
+	fmt.Printf("Verifying %d local files against %d remote files...\n", len(localFiles), len(remoteFiles))
+
+	attestation := releaseAttestation{
+		Remote:     *remoteConfig,
+		RemotePath: filepath.ToSlash(remoteDir),
+		LocalDir:   fs.Arg(0),
+		VerifiedAt: time.Now().UTC(),
+		Files:      []attestedFile{},
+	}
+
+	for _, rel := range localFiles {
+		item, ok := remoteFiles[rel]
+		if !ok {
+			fmt.Printf("%sMissing:    %s%s\n", ColorRed, rel, ColorReset)
+			attestation.Missing = append(attestation.Missing, rel)
+			continue
+		}
+		delete(remoteFiles, rel)
+
+		localHash, err := QuickXorHash(filepath.Join(localDir, filepath.FromSlash(rel)))
+		if err != nil {
+			fmt.Printf("Failed to hash '%s': %v\n", rel, err)
+			return exitFailure
+		}
+
+		remoteHash := ""
+		if item.File != nil {
+			remoteHash = item.File.Hashes.QuickXorHash
+		}
+		if remoteHash != localHash {
+			fmt.Printf("%sMismatched: %s (local %s, remote %s)%s\n", ColorRed, rel, localHash, remoteHash, ColorReset)
+			attestation.Mismatched = append(attestation.Mismatched, rel)
+			continue
+		}
+		attestation.Files = append(attestation.Files, attestedFile{Path: rel, Size: item.Size, QuickXorHash: localHash})
+	}
+
+	for rel := range remoteFiles {
+		attestation.Extra = append(attestation.Extra, rel)
+	}
+	sort.Strings(attestation.Extra)
+	for _, rel := range attestation.Extra {
+		fmt.Printf("%sExtra:      %s%s\n", ColorRed, rel, ColorReset)
+	}
+
+	attestation.Verified = len(attestation.Missing) == 0 && len(attestation.Mismatched) == 0 && len(attestation.Extra) == 0
+
+	if *attestationPath != "" {
+		if err := writeAttestation(*attestationPath, &attestation, key); err != nil {
+			fmt.Println("Failed to write attestation:", err)
+			return exitFailure
+		}
+		fmt.Printf("Attestation written to %s\n", *attestationPath)
+	}
+
+	if !attestation.Verified {
+		fmt.Printf("%sMirror verification failed: %d missing, %d mismatched, %d extra%s\n", ColorRed, len(attestation.Missing), len(attestation.Mismatched), len(attestation.Extra), ColorReset)
+		return exitIntegrity
+	}
+	fmt.Printf("%sMirror verified: %d files match%s\n", ColorGreen, len(attestation.Files), ColorReset)
+	return exitOK
+}
+
+// listRemoteTree adds every file below the relative folder rel of remoteDir to files, keyed by
+// its slash-separated path relative to remoteDir
+func listRemoteTree(client *azure.AzureClient, httpClient *http.Client, remoteDir, rel string, files map[string]azure.DriveItem) error {
+	items, err := client.ListChildren(httpClient, remoteJoin(remoteDir, rel))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		itemPath := remoteJoin(rel, item.Name)
+		if item.IsFolder() {
+			if err := listRemoteTree(client, httpClient, remoteDir, itemPath, files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[itemPath] = item
+	}
+	return nil
+}
+
+// loadSigningKey reads a PEM-encoded PKCS #8 Ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not PEM-encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %v", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an Ed25519 key")
+	}
+	return key, nil
+}
+
+// writeAttestation writes the attestation to path, wrapped in a signed envelope if key is set
+func writeAttestation(path string, attestation *releaseAttestation, key ed25519.PrivateKey) error {
+	data, err := json.MarshalIndent(attestation, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if key != nil {
+		data, err = json.MarshalIndent(signedAttestation{
+			Algorithm: "ed25519",
+			Payload:   data,
+			Signature: ed25519.Sign(key, data),
+			PublicKey: key.Public().(ed25519.PublicKey),
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// removeResult describes a deleted item for -json output
+type removeResult struct {
+	Remote string `json:"remote"`
+	Path   string `json:"path"`
+	ItemID string `json:"item_id"`
+	Folder bool   `json:"folder"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+}
+
+// runRemove implements the rm command, which moves a remote file or folder to the recycle bin or deletes it permanently
+func runRemove(args []string) int {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	remotePath := fs.String("remote", "", "Remote file or folder to delete, relative to the remote's root folder (required)")
+	force := fs.Bool("force", false, "Delete folders without asking for confirmation (default: false)")
+	permanent := fs.Bool("permanent", false, "Delete permanently instead of moving to the recycle bin; only supported on OneDrive for Business and SharePoint (default: false)")
+	asJSON := fs.Bool("json", false, "Print the result as JSON (default: false)")
+	auditLog := fs.String("audit-log", "", "Append a JSON line recording the deletion to this file (default: none)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	// Allow the path to be given as a positional argument
+	if *remotePath == "" && fs.NArg() > 0 {
+		*remotePath = fs.Arg(0)
+	}
+
+	// Refuse to delete the root folder of the remote
+	if strings.Trim(*remotePath, "/. ") == "" {
+		fmt.Println("Error: a remote path is required")
+		fs.Usage()
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, *remotePath)
+	if code != exitOK {
+		return code
+	}
+	fullRemotePath := paths[0]
+
+	// A bare "remote:" spec resolves to the drive root, which is never deleted either
+	if strings.Trim(fullRemotePath, "/. ") == "" {
+		fmt.Println("Error: refusing to delete the drive root")
+		return exitUsage
+	}
+
+	httpClient := &http.Client{}
+
+	item, err := client.GetItem(httpClient, fullRemotePath)
+	if err != nil {
+		printError("Failed to find remote item", err)
+		return exitCodeFor(err)
+	}
+
+	if item.IsFolder() && !*force {
+		question := fmt.Sprintf("Delete folder '%s' with %d items (%s)?", fullRemotePath, item.Folder.ChildCount, formatBytes(item.Size))
+		if *permanent {
+			question = fmt.Sprintf("Permanently delete folder '%s' with %d items (%s)? This can't be undone.", fullRemotePath, item.Folder.ChildCount, formatBytes(item.Size))
+		}
+		if !confirm(question) {
+			fmt.Println("Aborted.")
+			return exitFailure
+		}
+	}
+
+	mode := "trash"
+	if *permanent {
+		mode = "permanent"
+		err = client.PermanentDelete(httpClient, fullRemotePath)
+	} else {
+		err = client.Delete(httpClient, fullRemotePath)
+	}
+	if err != nil {
+		printError("Failed to delete remote item", err)
+		return exitCodeFor(err)
+	}
+
+	configData, _ := loadConfig()
+	remote, _ := resolveRemote(configData, *remotePath, *remoteConfig)
+	result := removeResult{Remote: remote, Path: fullRemotePath, ItemID: item.ID, Folder: item.IsFolder(), Size: item.Size, Mode: mode}
+
+	exitCode := exitOK
+	if *auditLog != "" {
+		entry := auditEntry{Operation: "delete", Remote: remote, Path: fullRemotePath, ItemID: item.ID, Folder: item.IsFolder(), Size: item.Size, Mode: mode}
+		if err := appendAuditLog(*auditLog, entry); err != nil {
+			fmt.Printf("%sWarning: %v%s\n", ColorYellow, err, ColorReset)
+			exitCode = exitFailure
+		}
+	}
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(data))
+		return exitCode
+	}
+
+	if *permanent {
+		fmt.Printf("%sPermanently deleted %s%s\n", ColorGreen, fullRemotePath, ColorReset)
+	} else {
+		fmt.Printf("%sMoved %s to the recycle bin%s\n", ColorGreen, fullRemotePath, ColorReset)
+	}
+	return exitCode
+}
+
+// confirm asks a yes/no question on stdin and reports whether the answer was yes
+func confirm(question string) bool {
+	fmt.Printf("%s%s [y/N]: %s", ColorYellow, question, ColorReset)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
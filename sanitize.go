@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// invalidNameChars are the characters OneDrive doesn't allow in file and folder names
+const invalidNameChars = `"*:<>?/\|`
+
+// sanitizeName makes a file or folder name valid on OneDrive: the characters it doesn't allow are
+// replaced with _ and trailing dots and spaces are removed
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(invalidNameChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// sanitizePath sanitizes every element of a relative local path except . and ..
+func sanitizePath(rel string) string {
+	elements := strings.Split(rel, string(filepath.Separator))
+	for i, element := range elements {
+		if element != "." && element != ".." {
+			elements[i] = sanitizeName(element)
+		}
+	}
+	return filepath.Join(elements...)
+}
+
+// sanitizedPath returns the remote form of a relative local path for -sanitize, warning if the
+// name of the file or folder it points to had to be changed; its parents are warned about on their own
+func sanitizedPath(rel string) string {
+	sanitized := sanitizePath(rel)
+	if name := filepath.Base(rel); sanitizePath(name) != name {
+		fmt.Printf("%sRenaming '%s' to '%s': the name is not valid on OneDrive%s\n", ColorYellow, rel, sanitized, ColorReset)
+	}
+	return sanitized
+}
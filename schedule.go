@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduledJob is a job of a jobs file: ksau-go arguments to run whenever the schedule matches
+type scheduledJob struct {
+	name     string
+	spec     string
+	schedule *cronSchedule
+	args     []string
+}
+
+// jobStatus is the outcome of a job's last run
+type jobStatus struct {
+	LastStart time.Time `json:"last_start"`
+	LastEnd   time.Time `json:"last_end"`
+	ExitCode  int       `json:"exit_code"`
+	Error     string    `json:"error,omitempty"` // Why the job couldn't be started
+}
+
+// scheduler runs the jobs of a jobs file, one run of a job at a time, and records how each run went
+type scheduler struct {
+	jobs       []*scheduledJob
+	logDir     string
+	statusPath string
+	mu         sync.Mutex
+	status     map[string]*jobStatus
+	running    map[string]bool
+	wg         sync.WaitGroup
+	env        []string // Added to the environment of the job processes, e.g. the daemon's maximums
+}
+
+// jobNamePattern restricts job names to what can safely name a log file
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// runSchedule implements the schedule command, which keeps running and starts the jobs of a jobs
+// file at the times their cron expressions give, like a crontab dedicated to ksau-go
+func runSchedule(args []string) int {
+	fs := flag.NewFlagSet("schedule", flag.ExitOnError)
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for the jobs' last-run status (default: '.ksau-state')")
+	logDir := fs.String("log-dir", "", "Directory for the jobs' output, one <name>.log per job (default: <state-dir>/logs)")
+	list := fs.Bool("list", false, "Print each job with its last run and next run, then exit (default: false)")
+	runNow := fs.String("run", "", "Run the named job once now, then exit with its exit code (default: run the schedule)")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: ksau-go schedule [flags] <jobs-file>")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	jobs, err := loadJobs(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	sched, err := newScheduler(jobs, *stateDir, *logDir)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+
+	if *list {
+		sched.print(time.Now())
+		return exitOK
+	}
+	if err := os.MkdirAll(sched.logDir, 0o700); err != nil {
+		fmt.Println("Error: failed to create log directory:", err)
+		return exitFailure
+	}
+	shareConfig()
+	gracefulShutdown.Store(true)
+
+	if *runNow != "" {
+		for _, job := range jobs {
+			if job.name == *runNow {
+				return sched.run(job)
+			}
+		}
+		fmt.Printf("Error: no job named '%s' in %s\n", *runNow, fs.Arg(0))
+		return exitUsage
+	}
+	return sched.loop()
+}
+
+// newScheduler prepares the jobs of a jobs file to run, with their last-run status from stateDir
+// and their logs in logDir ("" for <stateDir>/logs)
+func newScheduler(jobs []*scheduledJob, stateDir, logDir string) (*scheduler, error) {
+	if logDir == "" {
+		logDir = filepath.Join(stateDir, "logs")
+	}
+	sched := &scheduler{
+		jobs:       jobs,
+		logDir:     logDir,
+		statusPath: filepath.Join(stateDir, "schedule-status.json"),
+		running:    make(map[string]bool),
+	}
+	var err error
+	if sched.status, err = loadJobStatus(sched.statusPath); err != nil {
+		return nil, err
+	}
+	return sched, nil
+}
+
+// shareConfig passes the config given with -config on to the ksau-go processes this one starts
+func shareConfig() {
+	if configPath != "" {
+		if absPath, err := filepath.Abs(configPath); err == nil {
+			os.Setenv("KSAU_CONFIG", absPath)
+		}
+	}
+}
+
+// loadJobs reads a jobs file. Each line is a cron expression (or macro such as @daily), a job name
+// and the ksau-go arguments to run, e.g.
+//
+//	0 2 * * *  nightly-builds  sync ~/builds oned:builds
+//
+// Arguments are split at spaces outside quotes, and a leading ~/ is expanded to the home directory.
+// Empty lines and lines starting with # are skipped.
+func loadJobs(path string) ([]*scheduledJob, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open jobs file: %v", err)
+	}
+	defer file.Close()
+
+	var jobs []*scheduledJob
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitJobArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+
+		specFields := 5
+		if strings.HasPrefix(fields[0], "@") {
+			specFields = 1
+		}
+		if len(fields) < specFields+2 {
+			return nil, fmt.Errorf("%s:%d: expected a schedule, a job name and a command", path, lineNumber)
+		}
+		job := &scheduledJob{spec: strings.Join(fields[:specFields], " "), name: fields[specFields], args: fields[specFields+1:]}
+		if job.schedule, err = parseCron(job.spec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		if !jobNamePattern.MatchString(job.name) {
+			return nil, fmt.Errorf("%s:%d: invalid job name '%s': use letters, digits, '.', '_' and '-'", path, lineNumber, job.name)
+		}
+		if names[job.name] {
+			return nil, fmt.Errorf("%s:%d: duplicate job name '%s'", path, lineNumber, job.name)
+		}
+		names[job.name] = true
+		jobs = append(jobs, job)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read jobs file: %v", err)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no jobs in %s", path)
+	}
+	return jobs, nil
+}
+
+// splitJobArgs splits a jobs file line into arguments like a shell would for simple cases: at spaces
+// outside single or double quotes, with backslash escapes inside double quotes
+func splitJobArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, expandHome(current.String()))
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, expandHome(current.String()))
+	}
+	return args, nil
+}
+
+// expandHome replaces a leading ~/ with the home directory
+func expandHome(arg string) string {
+	if rest, found := strings.CutPrefix(arg, "~/"); found {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return arg
+}
+
+// loop starts jobs when they are due until interrupted, then waits for the running ones. Runs that
+// fall due while the previous run of the same job is still going are skipped.
+func (sched *scheduler) loop() int {
+	nextRuns := make(map[*scheduledJob]time.Time)
+	for _, job := range sched.jobs {
+		nextRuns[job] = job.schedule.next(time.Now())
+	}
+	fmt.Printf("Scheduling %d jobs (press Ctrl+C to stop)\n", len(sched.jobs))
+	sched.print(time.Now())
+
+	for {
+		var due time.Time
+		for _, next := range nextRuns {
+			if !next.IsZero() && (due.IsZero() || next.Before(due)) {
+				due = next
+			}
+		}
+		if due.IsZero() {
+			fmt.Println("No job is due to run again.")
+			break
+		}
+
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-interrupted.Done():
+			timer.Stop()
+			fmt.Println("Waiting for running jobs to stop...")
+			sched.wg.Wait()
+			fmt.Println("Stopped.")
+			return exitOK
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		for _, job := range sched.jobs {
+			if next := nextRuns[job]; next.IsZero() || next.After(now) {
+				continue
+			}
+			nextRuns[job] = job.schedule.next(now)
+			sched.mu.Lock()
+			busy := sched.running[job.name]
+			sched.mu.Unlock()
+			if busy {
+				fmt.Printf("%sSkipping job '%s': its previous run is still going.%s\n", ColorYellow, job.name, ColorReset)
+				continue
+			}
+			sched.wg.Add(1)
+			go func() {
+				defer sched.wg.Done()
+				sched.run(job)
+			}()
+		}
+	}
+	sched.wg.Wait()
+	return exitOK
+}
+
+// run runs a job as a separate ksau-go process with its output appended to the job's log, records
+// the outcome and returns the job's exit code. An interrupt is passed on to the job.
+func (sched *scheduler) run(job *scheduledJob) int {
+	sched.mu.Lock()
+	sched.running[job.name] = true
+	sched.mu.Unlock()
+	defer func() {
+		sched.mu.Lock()
+		delete(sched.running, job.name)
+		sched.mu.Unlock()
+	}()
+
+	status := &jobStatus{LastStart: time.Now()}
+	exitCode := sched.exec(job, status)
+	status.LastEnd = time.Now()
+	status.ExitCode = exitCode
+
+	duration := status.LastEnd.Sub(status.LastStart).Round(time.Second)
+	switch {
+	case status.Error != "":
+		fmt.Printf("%s[%s] Job '%s' could not start: %s%s\n", ColorRed, status.LastEnd.Format("2006-01-02 15:04:05"), job.name, status.Error, ColorReset)
+	case exitCode == exitOK:
+		fmt.Printf("%s[%s] Job '%s' finished in %s%s\n", ColorGreen, status.LastEnd.Format("2006-01-02 15:04:05"), job.name, duration, ColorReset)
+	default:
+		fmt.Printf("%s[%s] Job '%s' failed with exit code %d after %s; see %s%s\n", ColorRed, status.LastEnd.Format("2006-01-02 15:04:05"), job.name, exitCode, duration, sched.logPath(job), ColorReset)
+	}
+
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	sched.status[job.name] = status
+	if err := saveJobStatus(sched.statusPath, sched.status); err != nil {
+		fmt.Printf("%sWarning: failed to save job status: %v%s\n", ColorYellow, err, ColorReset)
+	}
+	return exitCode
+}
+
+// exec runs the job's process and returns its exit code; failures to start it are recorded in status
+func (sched *scheduler) exec(job *scheduledJob, status *jobStatus) int {
+	fmt.Printf("[%s] Starting job '%s'\n", status.LastStart.Format("2006-01-02 15:04:05"), job.name)
+	exitCode, err := runJobProcess(interrupted, job.args, "", sched.logPath(job), sched.env)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return exitCode
+}
+
+// runJobProcess runs ksau-go with args in dir ("" for the current directory) and env added to its
+// environment, appending its output to the log at logPath, and returns its exit code. Cancelling
+// ctx interrupts the process like Ctrl+C so it can stop cleanly, and kills it if it hasn't stopped
+// a minute later. The error is only set if the process couldn't be started.
+func runJobProcess(ctx context.Context, args []string, dir, logPath string, env []string) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return exitFailure, err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return exitFailure, fmt.Errorf("failed to open log: %v", err)
+	}
+	defer logFile.Close()
+
+	start := time.Now()
+	fmt.Fprintf(logFile, "=== %s: ksau-go %s\n", start.Format(time.RFC3339), strings.Join(args, " "))
+
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	separateProcessGroup(cmd)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = time.Minute
+	err = cmd.Run()
+	if cmd.ProcessState == nil {
+		fmt.Fprintf(logFile, "=== failed to start: %v\n\n", err)
+		return exitFailure, err
+	}
+
+	// Run reports the cancellation instead of the exit status of a process that stopped after an interrupt
+	exitCode := cmd.ProcessState.ExitCode()
+	if exitCode < 0 || (exitCode == exitOK && ctx.Err() != nil) {
+		exitCode = exitInterrupted
+	}
+	fmt.Fprintf(logFile, "=== %s: exit code %d after %s\n\n", time.Now().Format(time.RFC3339), exitCode, time.Since(start).Round(time.Second))
+	return exitCode, nil
+}
+
+// logPath returns the path of a job's log
+func (sched *scheduler) logPath(job *scheduledJob) string {
+	return filepath.Join(sched.logDir, job.name+".log")
+}
+
+// print lists the jobs with their schedule, last run and next run
+func (sched *scheduler) print(now time.Time) {
+	fmt.Printf("%-20s %-16s %-28s %s\n", "JOB", "SCHEDULE", "LAST RUN", "NEXT RUN")
+	for _, job := range sched.jobs {
+		lastRun := "never"
+		if status, ok := sched.status[job.name]; ok {
+			result := fmt.Sprintf("exit %d", status.ExitCode)
+			if status.Error != "" {
+				result = "not started"
+			} else if status.ExitCode == exitOK {
+				result = "ok"
+			}
+			lastRun = fmt.Sprintf("%s (%s)", status.LastStart.Local().Format("2006-01-02 15:04"), result)
+		}
+		nextRun := "never"
+		if next := job.schedule.next(now); !next.IsZero() {
+			nextRun = next.Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-20s %-16s %-28s %s\n", job.name, job.spec, lastRun, nextRun)
+	}
+}
+
+// loadJobStatus reads the jobs' last-run status; a missing file means no job has run yet
+func loadJobStatus(path string) (map[string]*jobStatus, error) {
+	status := make(map[string]*jobStatus)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return status, nil
+}
+
+// saveJobStatus writes the jobs' last-run status, replacing the file atomically
+func saveJobStatus(path string, status map[string]*jobStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
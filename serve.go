@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// runServe implements the serve command, which keeps running and offers a remote to other programs
+// over the protocol named by its first argument
+func runServe(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Usage: ksau-go serve <web|webdav|http|grpc> [flags]")
+		return exitUsage
+	}
+	switch args[0] {
+	case "web":
+		return runServeWeb(args[1:])
+	case "webdav":
+		return runServeWebDAV(args[1:])
+	case "http":
+		return runServeHTTP(args[1:])
+	case "grpc":
+		return runServeGRPC(args[1:])
+	default:
+		fmt.Printf("Error: unknown serve protocol '%s'; expected web, webdav, http or grpc\n", args[0])
+		return exitUsage
+	}
+}
+
+// serveOptions holds the flags every serve protocol accepts
+type serveOptions struct {
+	addr         string
+	auth         string
+	remoteConfig string
+	stateDir     string
+	clients      []*servedClient // Replaced when the config changes while serving
+}
+
+// registerServeFlags adds the flags every serve protocol accepts to its flag set
+func registerServeFlags(fs *flag.FlagSet, defaultAddr string) *serveOptions {
+	opts := &serveOptions{}
+	fs.StringVar(&opts.addr, "addr", defaultAddr, "Address to listen on; use :port to accept connections from other machines (default: '"+defaultAddr+"')")
+	fs.StringVar(&opts.auth, "auth", "", "Require HTTP basic authentication with these credentials, written as user:password (default: $KSAU_SERVE_AUTH, then none)")
+	fs.StringVar(&opts.remoteConfig, "remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	fs.StringVar(&opts.stateDir, "state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	registerMetricsFlag(fs)
+	return opts
+}
+
+// serve holds client, the client of remote, so that it is set up again from the config when the
+// config file changes while serving
+func (opts *serveOptions) serve(remote string, client *azure.AzureClient) *servedClient {
+	served := newServedClient(remote, opts.stateDir, client)
+	opts.clients = append(opts.clients, served)
+	return served
+}
+
+// serveHTTP serves handler on the -addr address, behind basic authentication when -auth is set,
+// until the command is interrupted; requests in progress are cancelled and waited for. The clients
+// of the served remotes are replaced when the config file changes or on SIGHUP.
+func serveHTTP(opts *serveOptions, name string, handler http.Handler) int {
+	user, password, code := opts.credentials()
+	if code != exitOK {
+		return code
+	}
+	if user != "" {
+		handler = basicAuth(user, password, handler)
+	}
+	listener, code := opts.listen()
+	if code != exitOK {
+		return code
+	}
+
+	// Requests get the interrupted context, so uploads in progress stop on Ctrl+C
+	server := &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return interrupted },
+	}
+	stopped := make(chan struct{})
+	go func() {
+		<-interrupted.Done()
+		server.Shutdown(context.Background())
+		close(stopped)
+	}()
+
+	fmt.Printf("Serving %s for remote '%s' at http://%s/ (press Ctrl+C to stop)\n", name, opts.remoteConfig, listener.Addr())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	<-stopped
+	fmt.Println("Stopped.")
+	return exitOK
+}
+
+// credentials returns the user and password of -auth, falling back to $KSAU_SERVE_AUTH; both are
+// empty if no authentication is required
+func (opts *serveOptions) credentials() (string, string, int) {
+	if opts.auth == "" {
+		opts.auth = os.Getenv("KSAU_SERVE_AUTH")
+	}
+	if opts.auth == "" {
+		return "", "", exitOK
+	}
+	user, password, found := strings.Cut(opts.auth, ":")
+	if !found || user == "" {
+		fmt.Println("Error: -auth must be written as user:password")
+		return "", "", exitUsage
+	}
+	return user, password, exitOK
+}
+
+// listen starts the metrics server and listens on the -addr address, warning when anyone who can
+// reach it could use the remote. From then on the command stops gracefully on Ctrl+C, and the
+// clients of the served remotes are replaced when the config file changes or on SIGHUP.
+func (opts *serveOptions) listen() (net.Listener, int) {
+	if err := startMetricsServer(); err != nil {
+		fmt.Println("Error:", err)
+		return nil, exitUsage
+	}
+
+	listener, err := net.Listen("tcp", opts.addr)
+	if err != nil {
+		fmt.Println("Error: failed to listen:", err)
+		return nil, exitUsage
+	}
+	if opts.auth == "" && !isLoopback(listener.Addr()) {
+		fmt.Printf("%sWarning: anyone who can reach %s can use remote '%s'; set -auth to require a password.%s\n", ColorYellow, listener.Addr(), opts.remoteConfig, ColorReset)
+	}
+
+	gracefulShutdown.Store(true)
+	watchConfig(func(configData []byte, err error) {
+		if err != nil {
+			return
+		}
+		for _, served := range opts.clients {
+			served.reload(configData)
+		}
+	})
+	return listener, exitOK
+}
+
+// basicAuth only passes requests with the given credentials on to next
+func basicAuth(user, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPassword, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(gotUser), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(gotPassword), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ksau-go", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback reports whether a listener only accepts connections from this machine
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+// serveFile sends the content of a drive file, or the part of it the Range header asks for
+func serveFile(w http.ResponseWriter, r *http.Request, client *azure.AzureClient, httpClient *http.Client, remotePath string, item *azure.DriveItem) {
+	header := w.Header()
+	if item.File != nil && item.File.MimeType != "" {
+		header.Set("Content-Type", item.File.MimeType)
+	}
+	if modTime := itemModTime(item); !modTime.IsZero() {
+		header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	header.Set("ETag", itemETag(item))
+	header.Set("Accept-Ranges", "bytes")
+
+	// Clients that already have this version, e.g. in a browser cache, don't need it again
+	if r.Header.Get("If-None-Match") == itemETag(item) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	offset, count := int64(0), int64(-1)
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var ok bool
+		if offset, count, ok = parseByteRange(rangeHeader, item.Size); !ok {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", item.Size))
+			http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if count >= 0 {
+			status = http.StatusPartialContent
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+count-1, item.Size))
+		}
+	}
+	length := count
+	if length < 0 {
+		length = item.Size
+	}
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Once the headers are sent a failure can only cut the response short
+	if _, err := client.DownloadRange(httpClient, remotePath, offset, count, w); err != nil {
+		printError(fmt.Sprintf("Failed to send '%s'", remotePath), err)
+	}
+}
+
+// writeServeError answers a request whose Graph call failed with the closest HTTP status
+func writeServeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	switch exitCodeFor(err) {
+	case exitNotFound:
+		status = http.StatusNotFound
+	case exitUsage:
+		status = http.StatusForbidden
+	case exitQuota:
+		status = http.StatusInsufficientStorage
+	case exitThrottled, exitInterrupted:
+		status = http.StatusServiceUnavailable
+	case exitIntegrity:
+		status = http.StatusInternalServerError
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// itemModTime returns an item's modification time, preferring the one its uploader set
+func itemModTime(item *azure.DriveItem) time.Time {
+	if item.FileSystemInfo != nil && !item.FileSystemInfo.LastModifiedDateTime.IsZero() {
+		return item.FileSystemInfo.LastModifiedDateTime
+	}
+	return item.LastModifiedDateTime
+}
+
+// itemETag returns an entity tag that changes whenever an item's content does
+func itemETag(item *azure.DriveItem) string {
+	if item.File != nil && item.File.Hashes.QuickXorHash != "" {
+		return strconv.Quote(item.File.Hashes.QuickXorHash)
+	}
+	return strconv.Quote(fmt.Sprintf("%s-%d", item.ID, item.LastModifiedDateTime.UnixNano()))
+}
+
+// parseByteRange parses a Range header with a single range into an offset and count for a file of
+// the given size; a count of -1 means the rest of the file. Headers with several ranges are ignored
+// and the whole file is sent. ok is false if the range lies outside the file.
+func parseByteRange(header string, size int64) (int64, int64, bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, -1, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, -1, true
+	}
+
+	if first == "" {
+		// A suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		n = min(n, size)
+		return size - n, n, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+	ksauv1 "github.com/ksauraj/ksau-oned-api/proto/ksau/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcProgressInterval is how often Upload sends its client the progress of the transfer
+const grpcProgressInterval = time.Second
+
+// grpcTransferRetention is how long GetStatus still reports a transfer after it finished
+const grpcTransferRetention = time.Hour
+
+// transferServer implements the TransferService of proto/ksau/v1/transfer.proto
+type transferServer struct {
+	ksauv1.UnimplementedTransferServiceServer
+	remote     string                   // Remote of requests that don't name one
+	clients    map[string]*servedClient // Remotes that can be used, set up at startup
+	httpClient *http.Client
+	opts       uploadOptions // Flags of the command; each upload sets its remote, conflict behavior and content
+	max        jobLimits     // Most an upload may choose for itself
+
+	mu        sync.Mutex
+	transfers map[string]*grpcTransfer
+}
+
+// grpcTransfer is an upload started by Upload, whose status GetStatus reports
+type grpcTransfer struct {
+	mu       sync.Mutex
+	status   *ksauv1.TransferStatus
+	started  time.Time
+	finished time.Time
+}
+
+// grpcConflictBehaviors maps the conflict behaviors of the service to those of uploads
+var grpcConflictBehaviors = map[ksauv1.ConflictBehavior]azure.ConflictBehavior{
+	ksauv1.ConflictBehavior_CONFLICT_BEHAVIOR_UNSPECIFIED: azure.ConflictRename,
+	ksauv1.ConflictBehavior_CONFLICT_BEHAVIOR_RENAME:      azure.ConflictRename,
+	ksauv1.ConflictBehavior_CONFLICT_BEHAVIOR_REPLACE:     azure.ConflictReplace,
+	ksauv1.ConflictBehavior_CONFLICT_BEHAVIOR_FAIL:        azure.ConflictFail,
+}
+
+// runServeGRPC implements serve grpc, which serves the TransferService of proto/ksau/v1 so that
+// programs can upload files, follow their progress and query remotes without running the command line
+func runServeGRPC(args []string) int {
+	fs := flag.NewFlagSet("serve grpc", flag.ExitOnError)
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	parallelChunks := fs.Int("parallel", 1, "Number of parallel chunks to upload per file (default: 1)")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification of every upload, whatever the client asks for (default: false)")
+	maxFlags := registerMaxLimitFlags(fs)
+	serveOpts := registerServeFlags(fs, "127.0.0.1:9090")
+	fs.Parse(args)
+
+	maxLimits, err := maxFlags.parse()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	// The default remote must work; the others are offered if they can be set up
+	client, _, code := setupRemote(serveOpts.remoteConfig, serveOpts.stateDir)
+	if code != exitOK {
+		return code
+	}
+	configData, _ := loadConfig()
+	server := &transferServer{
+		remote:     serveOpts.remoteConfig,
+		clients:    map[string]*servedClient{serveOpts.remoteConfig: serveOpts.serve(serveOpts.remoteConfig, client)},
+		httpClient: &http.Client{},
+		transfers:  make(map[string]*grpcTransfer),
+		max:        maxLimits,
+		opts: uploadOptions{
+			chunkSize:      *chunkSize,
+			parallelChunks: *parallelChunks,
+			skipHash:       *skipHash,
+			hashRetries:    5,
+			hashRetryDelay: 10 * time.Second,
+		},
+	}
+	for _, remote := range configRemotes(configData) {
+		if remote == serveOpts.remoteConfig {
+			continue
+		}
+		client, err := newClient(configData, remote, serveOpts.stateDir)
+		if err != nil {
+			fmt.Printf("%sWarning: not serving remote '%s': %v%s\n", ColorYellow, remote, err, ColorReset)
+			continue
+		}
+		server.clients[remote] = serveOpts.serve(remote, client)
+	}
+
+	user, password, code := serveOpts.credentials()
+	if code != exitOK {
+		return code
+	}
+	var grpcOpts []grpc.ServerOption
+	if user != "" {
+		grpcOpts = append(grpcOpts, grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := checkGRPCAuth(ctx, user, password); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}), grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := checkGRPCAuth(stream.Context(), user, password); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}))
+	}
+	grpcServer := grpc.NewServer(grpcOpts...)
+	ksauv1.RegisterTransferServiceServer(grpcServer, server)
+
+	listener, code := serveOpts.listen()
+	if code != exitOK {
+		return code
+	}
+	stopped := make(chan struct{})
+	go func() {
+		// Uploads in progress are interrupted too, so waiting for them doesn't take long
+		<-interrupted.Done()
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	remotes := make([]string, 0, len(server.clients))
+	for remote := range server.clients {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	fmt.Printf("Serving the transfer service for remotes %v at %s (press Ctrl+C to stop)\n", remotes, listener.Addr())
+	if err := grpcServer.Serve(listener); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	<-stopped
+	fmt.Println("Stopped.")
+	return exitOK
+}
+
+// checkGRPCAuth checks the basic authentication credentials a call carries in its authorization
+// metadata, as -auth requires of HTTP requests
+func checkGRPCAuth(ctx context.Context, user, password string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		encoded, found := strings.CutPrefix(value, "Basic ")
+		if !found {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		gotUser, gotPassword, _ := strings.Cut(string(decoded), ":")
+		if subtle.ConstantTimeCompare([]byte(gotUser), []byte(user)) == 1 && subtle.ConstantTimeCompare([]byte(gotPassword), []byte(password)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "basic authentication required")
+}
+
+// Upload receives a file's header and content and uploads it, sending the progress while it runs and
+// the result once it is uploaded and verified
+func (server *transferServer) Upload(stream ksauv1.TransferService_UploadServer) error {
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := request.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "the first message must carry the upload header")
+	}
+	if header.Size < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid size %d", header.Size)
+	}
+	conflict, ok := grpcConflictBehaviors[header.Conflict]
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown conflict behavior %v", header.Conflict)
+	}
+	filePath := header.RemotePath
+	if name, rest, found := strings.Cut(filePath, ":"); found && !strings.Contains(name, "/") {
+		filePath = rest
+	}
+	if strings.Trim(filePath, `/\`) == "" {
+		return status.Error(codes.InvalidArgument, "remote_path must name a file")
+	}
+	configData, _ := loadConfig()
+	remote, remoteFilePath, err := server.resolve(configData, header.Remote, header.RemotePath)
+	if err != nil {
+		return err
+	}
+	retryPolicy, err := remoteRetryPolicy(configData, remote, azure.DefaultRetryPolicy())
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	limitFlags := jobLimitFlags{bwLimit: header.Bwlimit, chunkSize: header.ChunkSize, parallel: int(header.Parallel)}
+	limits, err := limitFlags.parse()
+	if err == nil {
+		err = limits.check(server.max)
+	}
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The content is passed on to the upload as it arrives
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	streamErr := make(chan error, 1)
+	go func() {
+		err := receiveUploadData(stream, writer, header.Size)
+		streamErr <- err
+		writer.CloseWithError(err)
+	}()
+
+	transfer := server.start(header.Size)
+	opts := server.opts
+	opts.remoteConfig = remote
+	opts.retryPolicy = retryPolicy
+	opts.conflict = conflict
+	opts.skipHash = opts.skipHash || header.SkipHash
+	opts.reader = reader
+	opts.size = header.Size
+	opts.label = path.Base(remoteFilePath)
+	limits.applyTo(&opts, server.max)
+	opts.bandwidth = limits.bandwidth(nil, server.max)
+	verify := !opts.skipHash
+	opts.progress = func(transferred, total int64) { transfer.progress(transferred, total, verify) }
+	fmt.Printf("\nUploading %s (%s) as transfer %s\n", remoteFilePath, formatBytes(header.Size), transfer.status.TransferId)
+
+	// Progress is sent from its own goroutine, which stops before the result is sent
+	done := make(chan struct{})
+	var sending sync.WaitGroup
+	sending.Add(1)
+	go func() {
+		defer sending.Done()
+		ticker := time.NewTicker(grpcProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if stream.Send(&ksauv1.UploadResponse{Event: &ksauv1.UploadResponse_Progress{Progress: transfer.snapshot()}}) != nil {
+					return
+				}
+			}
+		}
+	}()
+	result, err := uploadEntry(server.clients[remote].get(), server.httpClient, opts, "", remoteFilePath)
+	close(done)
+	sending.Wait()
+	transfer.finish(err)
+	if err != nil {
+		printError(fmt.Sprintf("Failed to upload '%s'", remoteFilePath), err)
+		if ctxErr := stream.Context().Err(); ctxErr != nil {
+			return status.FromContextError(ctxErr).Err()
+		}
+		select {
+		case receiveErr := <-streamErr:
+			if receiveErr != nil {
+				return status.Error(codes.InvalidArgument, receiveErr.Error())
+			}
+		default:
+		}
+		return grpcError(err)
+	}
+
+	return stream.Send(&ksauv1.UploadResponse{Event: &ksauv1.UploadResponse_Result{Result: &ksauv1.UploadResult{
+		TransferId:   transfer.status.TransferId,
+		FileId:       result.fileID,
+		RemotePath:   remoteFilePath,
+		Size:         result.size,
+		DownloadUrl:  result.downloadURL,
+		QuickXorHash: result.quickXorHash,
+	}}})
+}
+
+// receiveUploadData writes the content of an upload from the messages after its header to writer.
+// It returns an error if the stream breaks or doesn't carry exactly size bytes, which the upload
+// fails with too.
+func receiveUploadData(stream ksauv1.TransferService_UploadServer, writer io.Writer, size int64) error {
+	var received int64
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			if received != size {
+				return fmt.Errorf("the upload stream ended after %d of %d bytes", received, size)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("the upload stream broke: %w", err)
+		}
+		if request.GetHeader() != nil {
+			return errors.New("the upload header was sent twice")
+		}
+		data := request.GetData()
+		if received += int64(len(data)); received > size {
+			return fmt.Errorf("the upload stream carries more than the %d bytes announced", size)
+		}
+		if _, err := writer.Write(data); err != nil {
+			// The upload stopped reading, so it already failed
+			return nil
+		}
+	}
+}
+
+// resolve returns the remote and full drive path of an upload. The path may name its remote with a
+// remote: prefix, which has to agree with the request's remote if that is set too.
+func (server *transferServer) resolve(configData []byte, remote, remotePath string) (string, string, error) {
+	defaultRemote := remote
+	if defaultRemote == "" {
+		defaultRemote = server.remote
+	}
+	specRemote, fullPath := resolveRemote(configData, remotePath, defaultRemote)
+	if remote != "" && specRemote != remote {
+		return "", "", status.Errorf(codes.InvalidArgument, "remote_path is on remote '%s', not '%s'", specRemote, remote)
+	}
+	if _, ok := server.clients[specRemote]; !ok {
+		return "", "", status.Errorf(codes.NotFound, "remote '%s' is not served", specRemote)
+	}
+	return specRemote, fullPath, nil
+}
+
+// GetStatus returns the status of a transfer that is running or finished within the last hour
+func (server *transferServer) GetStatus(ctx context.Context, request *ksauv1.GetStatusRequest) (*ksauv1.TransferStatus, error) {
+	server.mu.Lock()
+	transfer, ok := server.transfers[request.TransferId]
+	server.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no transfer with ID '%s'", request.TransferId)
+	}
+	return transfer.snapshot(), nil
+}
+
+// ListRemotes returns the remotes the server can upload to
+func (server *transferServer) ListRemotes(ctx context.Context, request *ksauv1.ListRemotesRequest) (*ksauv1.ListRemotesResponse, error) {
+	configData, _ := loadConfig()
+	response := &ksauv1.ListRemotesResponse{}
+	for remote := range server.clients {
+		baseURL, _ := remoteBaseURL(configData, remote)
+		response.Remotes = append(response.Remotes, &ksauv1.Remote{
+			Name:       remote,
+			RootFolder: remoteRootFolder(configData, remote),
+			BaseUrl:    baseURL,
+		})
+	}
+	sort.Slice(response.Remotes, func(i, j int) bool { return response.Remotes[i].Name < response.Remotes[j].Name })
+	return response, nil
+}
+
+// Quota returns the storage quota of a remote's drive
+func (server *transferServer) Quota(ctx context.Context, request *ksauv1.QuotaRequest) (*ksauv1.QuotaResponse, error) {
+	remote := request.Remote
+	if remote == "" {
+		remote = server.remote
+	}
+	served, ok := server.clients[remote]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "remote '%s' is not served", remote)
+	}
+	quota, err := served.get().GetDriveQuota(server.httpClient)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &ksauv1.QuotaResponse{Total: quota.Total, Used: quota.Used, Remaining: quota.Remaining, Deleted: quota.Deleted}, nil
+}
+
+// start registers a new running transfer of size bytes, forgetting those that finished too long ago
+func (server *transferServer) start(size int64) *grpcTransfer {
+	random := make([]byte, 8)
+	rand.Read(random)
+	transfer := &grpcTransfer{
+		status:  &ksauv1.TransferStatus{TransferId: hex.EncodeToString(random), State: ksauv1.TransferState_TRANSFER_STATE_RUNNING, Size: size},
+		started: time.Now(),
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for id, old := range server.transfers {
+		old.mu.Lock()
+		expired := !old.finished.IsZero() && time.Since(old.finished) > grpcTransferRetention
+		old.mu.Unlock()
+		if expired {
+			delete(server.transfers, id)
+		}
+	}
+	server.transfers[transfer.status.TransferId] = transfer
+	return transfer
+}
+
+// progress records the bytes OneDrive has accepted; once it has all of them the content's hash is
+// verified, if it is checked at all
+func (transfer *grpcTransfer) progress(transferred, total int64, verify bool) {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	transfer.status.BytesSent = transferred
+	if elapsed := time.Since(transfer.started).Seconds(); elapsed > 0 {
+		transfer.status.BytesPerSecond = float64(transferred) / elapsed
+	}
+	if verify && transferred == total {
+		transfer.status.State = ksauv1.TransferState_TRANSFER_STATE_VERIFYING
+	}
+}
+
+// finish records the outcome of the transfer
+func (transfer *grpcTransfer) finish(err error) {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	transfer.finished = time.Now()
+	if err == nil {
+		transfer.status.State = ksauv1.TransferState_TRANSFER_STATE_DONE
+		transfer.status.BytesSent = transfer.status.Size
+		return
+	}
+	transfer.status.State = ksauv1.TransferState_TRANSFER_STATE_FAILED
+	transfer.status.Error = err.Error()
+	if graphErr, ok := azure.AsGraphError(err); ok {
+		transfer.status.ErrorCode = graphErr.Code
+	}
+}
+
+// snapshot returns a copy of the transfer's status that can be sent while the transfer goes on
+func (transfer *grpcTransfer) snapshot() *ksauv1.TransferStatus {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return &ksauv1.TransferStatus{
+		TransferId:     transfer.status.TransferId,
+		State:          transfer.status.State,
+		BytesSent:      transfer.status.BytesSent,
+		Size:           transfer.status.Size,
+		BytesPerSecond: transfer.status.BytesPerSecond,
+		Error:          transfer.status.Error,
+		ErrorCode:      transfer.status.ErrorCode,
+	}
+}
+
+// grpcError turns an error of a Graph call into a status with the closest code, as writeServeError
+// does for HTTP
+func grpcError(err error) error {
+	code := codes.Unknown
+	switch exitCodeFor(err) {
+	case exitNotFound:
+		code = codes.NotFound
+	case exitUsage:
+		code = codes.PermissionDenied
+	case exitQuota:
+		code = codes.ResourceExhausted
+	case exitThrottled, exitInterrupted:
+		code = codes.Unavailable
+	case exitIntegrity:
+		code = codes.DataLoss
+	case exitAuth:
+		code = codes.FailedPrecondition
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	_ "embed"
+	"flag"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+//go:embed fileindex.html
+var fileIndexPage string
+
+// fileIndexTemplate renders a folder listing
+var fileIndexTemplate = template.Must(template.New("fileindex").Parse(fileIndexPage))
+
+// fileIndex serves a remote folder read-only: folders as listings and files with range support
+type fileIndex struct {
+	client     *servedClient
+	httpClient *http.Client
+	remote     string
+	root       string // Full path on the drive of the served folder
+}
+
+// fileIndexEntry is a row of a folder listing
+type fileIndexEntry struct {
+	Name     string
+	Href     string
+	Size     string
+	Modified string
+	Folder   bool
+}
+
+// runServeHTTP implements serve http, which lists and streams the files of a remote folder over plain
+// HTTP, like the index front-ends of base_url but served from this machine
+func runServeHTTP(args []string) int {
+	fs := flag.NewFlagSet("serve http", flag.ExitOnError)
+	remoteFolder := fs.String("remote", "", "Remote folder to serve, relative to the remote's root folder (default: the root folder)")
+	serveOpts := registerServeFlags(fs, "127.0.0.1:8080")
+	fs.Parse(args)
+
+	client, paths, code := setupRemote(serveOpts.remoteConfig, serveOpts.stateDir, *remoteFolder)
+	if code != exitOK {
+		return code
+	}
+	configData, _ := loadConfig()
+	remote, _ := resolveRemote(configData, *remoteFolder, serveOpts.remoteConfig)
+
+	index := &fileIndex{client: serveOpts.serve(remote, client), httpClient: &http.Client{}, remote: remote, root: paths[0]}
+	return serveHTTP(serveOpts, "the file index", index)
+}
+
+// ServeHTTP answers a request for a file or folder below the served folder
+func (index *fileIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	remotePath := remoteJoin(index.root, strings.TrimPrefix(urlPath, "/"))
+	client := index.client.get()
+	item, err := client.GetItem(index.httpClient, remotePath)
+	if err != nil {
+		writeServeError(w, err)
+		return
+	}
+	if item.Folder == nil {
+		serveFile(w, r, client, index.httpClient, remotePath, item)
+		return
+	}
+
+	// Listings link to their entries relative to the folder, which only works with a trailing slash
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		target := url.URL{Path: r.URL.Path + "/", RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return
+	}
+	index.list(w, client, urlPath, remotePath)
+}
+
+// list renders the listing of a folder, subfolders first
+func (index *fileIndex) list(w http.ResponseWriter, client *azure.AzureClient, urlPath, remotePath string) {
+	children, err := client.ListChildren(index.httpClient, remotePath)
+	if err != nil {
+		writeServeError(w, err)
+		return
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if (children[i].Folder != nil) != (children[j].Folder != nil) {
+			return children[i].Folder != nil
+		}
+		return strings.ToLower(children[i].Name) < strings.ToLower(children[j].Name)
+	})
+
+	entries := make([]fileIndexEntry, len(children))
+	for i := range children {
+		child := &children[i]
+		entry := fileIndexEntry{
+			Name:   child.Name,
+			Href:   url.PathEscape(child.Name),
+			Size:   formatBytes(child.Size),
+			Folder: child.Folder != nil,
+		}
+		if entry.Folder {
+			entry.Href += "/"
+		}
+		if modTime := itemModTime(child); !modTime.IsZero() {
+			entry.Modified = modTime.Local().Format("2006-01-02 15:04")
+		}
+		entries[i] = entry
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fileIndexTemplate.Execute(w, struct {
+		Remote, Path string
+		Parent       bool
+		Entries      []fileIndexEntry
+	}{index.remote, urlPath, urlPath != "/", entries})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+//go:embed webui.html
+var webUIPage string
+
+// webUITemplate renders the upload page
+var webUITemplate = template.Must(template.New("webui").Parse(webUIPage))
+
+// webUI serves the upload page and receives the files dropped on it
+type webUI struct {
+	client     *servedClient
+	httpClient *http.Client
+	opts       uploadOptions
+	remoteDir  string
+}
+
+// webUploadResponse is what an upload from the page returns
+type webUploadResponse struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	URL   string `json:"url,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// runServeWeb implements serve web, which serves a page to upload files into a remote folder from a
+// browser by dragging and dropping them, showing their progress and download URLs
+func runServeWeb(args []string) int {
+	fs := flag.NewFlagSet("serve web", flag.ExitOnError)
+	remoteFolder := fs.String("remote", "", "Remote folder to upload into, relative to the remote's root folder (default: the root folder)")
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	parallelChunks := fs.Int("parallel", 1, "Number of parallel chunks to upload per file (default: 1)")
+	conflict := fs.String("conflict", string(azure.ConflictRename), "What to do when a file with the same name already exists remotely: rename, replace or fail (default: 'rename')")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification (default: false)")
+	serveOpts := registerServeFlags(fs, "127.0.0.1:8080")
+	fs.Parse(args)
+
+	conflictBehavior, err := azure.ParseConflictBehavior(*conflict)
+	if err != nil {
+		fmt.Printf("Error: invalid -conflict: %v\n", err)
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(serveOpts.remoteConfig, serveOpts.stateDir, *remoteFolder)
+	if code != exitOK {
+		return code
+	}
+	configData, _ := loadConfig()
+	remote, _ := resolveRemote(configData, *remoteFolder, serveOpts.remoteConfig)
+	retryPolicy, err := remoteRetryPolicy(configData, remote, azure.DefaultRetryPolicy())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	ui := &webUI{
+		client:     serveOpts.serve(remote, client),
+		httpClient: &http.Client{},
+		remoteDir:  paths[0],
+		opts: uploadOptions{
+			remoteConfig:   remote,
+			chunkSize:      *chunkSize,
+			parallelChunks: *parallelChunks,
+			retryPolicy:    retryPolicy,
+			skipHash:       *skipHash,
+			hashRetries:    5,
+			hashRetryDelay: 10 * time.Second,
+			conflict:       conflictBehavior,
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", ui.page)
+	mux.HandleFunc("PUT /upload", ui.upload)
+	return serveHTTP(serveOpts, "the upload page", mux)
+}
+
+// page renders the upload page
+func (ui *webUI) page(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	webUITemplate.Execute(w, struct{ Remote, Folder string }{ui.opts.remoteConfig, "/" + ui.remoteDir})
+}
+
+// upload streams the request body into a file named by the name query parameter in the remote
+// folder, answering with its download URL once it is uploaded and verified
+func (ui *webUI) upload(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		writeWebUpload(w, http.StatusBadRequest, webUploadResponse{Name: name, Error: "invalid file name"})
+		return
+	}
+	if r.ContentLength < 0 {
+		writeWebUpload(w, http.StatusLengthRequired, webUploadResponse{Name: name, Error: "the upload needs a Content-Length"})
+		return
+	}
+
+	// Browsers allow names OneDrive doesn't, so fix them instead of failing the upload
+	remoteName := sanitizeName(name)
+	if remoteName != name {
+		fmt.Printf("Renaming '%s' to '%s': the name is not valid on OneDrive\n", name, remoteName)
+	}
+	remoteFilePath := remoteJoin(ui.remoteDir, remoteName)
+	fmt.Printf("\nUploading %s (%s) from %s\n", remoteName, formatBytes(r.ContentLength), r.RemoteAddr)
+
+	opts := ui.opts
+	opts.reader = r.Body
+	opts.size = r.ContentLength
+	opts.label = remoteName
+	result, err := uploadEntry(ui.client.get(), ui.httpClient, opts, "", remoteFilePath)
+	response := webUploadResponse{Name: remoteName, Path: remoteFilePath, Size: r.ContentLength}
+	if err != nil {
+		printError(fmt.Sprintf("Failed to upload '%s'", remoteName), err)
+		response.Error = err.Error()
+		status := http.StatusBadGateway
+		if errors.Is(err, errHashMismatch) {
+			status = http.StatusInternalServerError
+		}
+		writeWebUpload(w, status, response)
+		return
+	}
+	response.URL = result.downloadURL
+	writeWebUpload(w, http.StatusOK, response)
+}
+
+// writeWebUpload answers an upload from the page with its result as JSON
+func writeWebUpload(w http.ResponseWriter, status int, response webUploadResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// davSmallFileSize is the largest file a WebDAV PUT sends to OneDrive in a single request; larger
+// ones go through an upload session
+const davSmallFileSize = 4 * 1024 * 1024
+
+// davLockTimeout is how long clients are told their locks last
+const davLockTimeout = time.Hour
+
+// davAllow lists the methods the server answers, for OPTIONS and 405 responses
+const davAllow = "OPTIONS, PROPFIND, PROPPATCH, GET, HEAD, PUT, MKCOL, DELETE, MOVE, COPY, LOCK, UNLOCK"
+
+// davCopyPollInterval is how often a COPY checks whether Graph's server-side copy has finished
+const davCopyPollInterval = 500 * time.Millisecond
+
+// webDAV serves remotes over WebDAV, translating requests into Graph calls
+type webDAV struct {
+	httpClient *http.Client
+	remotes    []*davRemote // A single remote served at /, or with -all-remotes every remote as a top-level folder
+	all        bool
+}
+
+// davRemote is a remote served over WebDAV
+type davRemote struct {
+	name   string
+	client *servedClient
+	root   string        // Full path on the drive that the remote's WebDAV folder shows
+	opts   uploadOptions // For PUTs of files too large for a single request
+}
+
+// davTarget is the resource a request path names
+type davTarget struct {
+	remote *davRemote // nil for the top-level folder of -all-remotes, which lists the remotes
+	path   string     // Full path on the remote's drive
+	name   string     // Shown as the resource's display name
+}
+
+// runServeWebDAV implements serve webdav, which serves a remote folder, or every remote, over WebDAV
+// so that file managers can mount it, browse it and copy files in and out
+func runServeWebDAV(args []string) int {
+	fs := flag.NewFlagSet("serve webdav", flag.ExitOnError)
+	remoteFolder := fs.String("remote", "", "Remote folder to serve, relative to the remote's root folder (default: the root folder)")
+	allRemotes := fs.Bool("all-remotes", false, "Serve every remote in rclone.conf as a top-level folder, each showing its root folder (default: false)")
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	parallelChunks := fs.Int("parallel", 1, "Number of parallel chunks to upload per file (default: 1)")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification (default: false)")
+	serveOpts := registerServeFlags(fs, "127.0.0.1:8080")
+	fs.Parse(args)
+
+	if *allRemotes && *remoteFolder != "" {
+		fmt.Println("Error: -remote and -all-remotes cannot be combined")
+		return exitUsage
+	}
+
+	configData, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	opts := uploadOptions{
+		chunkSize:      *chunkSize,
+		parallelChunks: *parallelChunks,
+		skipHash:       *skipHash,
+		hashRetries:    5,
+		hashRetryDelay: 10 * time.Second,
+		conflict:       azure.ConflictReplace,
+	}
+
+	dav := &webDAV{httpClient: &http.Client{}, all: *allRemotes}
+	if *allRemotes {
+		// A remote that can't be set up is left out rather than keeping the others from being served
+		for _, remote := range configRemotes(configData) {
+			client, err := newClient(configData, remote, serveOpts.stateDir)
+			if err != nil {
+				fmt.Printf("%sWarning: not serving remote '%s': %v%s\n", ColorYellow, remote, err, ColorReset)
+				continue
+			}
+			served, code := newDAVRemote(configData, remote, serveOpts.serve(remote, client), remoteRootFolder(configData, remote), opts)
+			if code != exitOK {
+				return code
+			}
+			dav.remotes = append(dav.remotes, served)
+		}
+		if len(dav.remotes) == 0 {
+			fmt.Println("Error: no remotes to serve")
+			return exitFailure
+		}
+		names := make([]string, len(dav.remotes))
+		for i, remote := range dav.remotes {
+			names[i] = remote.name
+		}
+		serveOpts.remoteConfig = strings.Join(names, ", ")
+	} else {
+		client, paths, code := setupRemote(serveOpts.remoteConfig, serveOpts.stateDir, *remoteFolder)
+		if code != exitOK {
+			return code
+		}
+		remote, _ := resolveRemote(configData, *remoteFolder, serveOpts.remoteConfig)
+		served, code := newDAVRemote(configData, remote, serveOpts.serve(remote, client), paths[0], opts)
+		if code != exitOK {
+			return code
+		}
+		dav.remotes = []*davRemote{served}
+	}
+
+	return serveHTTP(serveOpts, "WebDAV", dav)
+}
+
+// newDAVRemote prepares a remote for serving over WebDAV with its own retry policy for uploads
+func newDAVRemote(configData []byte, remote string, client *servedClient, root string, opts uploadOptions) (*davRemote, int) {
+	retryPolicy, err := remoteRetryPolicy(configData, remote, azure.DefaultRetryPolicy())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return nil, exitUsage
+	}
+	opts.remoteConfig = remote
+	opts.retryPolicy = retryPolicy
+	return &davRemote{name: remote, client: client, root: root, opts: opts}, exitOK
+}
+
+// ServeHTTP answers a WebDAV request
+func (dav *webDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean("/" + r.URL.Path)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", davAllow)
+		return
+	}
+
+	target, ok := dav.target(urlPath)
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "PROPFIND":
+		dav.propfind(w, r, urlPath, target)
+	case "PROPPATCH":
+		dav.proppatch(w, r, urlPath)
+	case http.MethodGet, http.MethodHead:
+		dav.get(w, r, target)
+	case http.MethodPut:
+		dav.put(w, r, target)
+	case "MKCOL":
+		dav.mkcol(w, r, target)
+	case http.MethodDelete:
+		dav.delete(w, r, target)
+	case "MOVE", "COPY":
+		dav.moveOrCopy(w, r, target)
+	case "LOCK":
+		dav.lock(w, r, urlPath)
+	case "UNLOCK":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", davAllow)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// target returns the resource a cleaned request path names; with -all-remotes the first path
+// element selects the remote, and ok is false if there is no such remote
+func (dav *webDAV) target(urlPath string) (davTarget, bool) {
+	rest := strings.TrimPrefix(urlPath, "/")
+	if !dav.all {
+		remote := dav.remotes[0]
+		name := path.Base(urlPath)
+		if rest == "" {
+			name = remote.name
+		}
+		return davTarget{remote: remote, path: remoteJoin(remote.root, rest), name: name}, true
+	}
+
+	if rest == "" {
+		return davTarget{name: "/"}, true
+	}
+	remoteName, rest, _ := strings.Cut(rest, "/")
+	for _, remote := range dav.remotes {
+		if remote.name == remoteName {
+			return davTarget{remote: remote, path: remoteJoin(remote.root, rest), name: path.Base(urlPath)}, true
+		}
+	}
+	return davTarget{}, false
+}
+
+// propfind lists the properties of a resource and, unless the Depth header is 0, of its children.
+// Depth infinity is answered like 1, as walking a whole drive would take too long.
+func (dav *webDAV) propfind(w http.ResponseWriter, r *http.Request, urlPath string, target davTarget) {
+	depth := r.Header.Get("Depth")
+	href := davHref(urlPath)
+	var responses []davResponse
+
+	if target.remote == nil {
+		responses = append(responses, davFolderResponse("/", target.name))
+		if depth != "0" {
+			for _, remote := range dav.remotes {
+				responses = append(responses, davFolderResponse("/"+url.PathEscape(remote.name)+"/", remote.name))
+			}
+		}
+		writeMultistatus(w, responses)
+		return
+	}
+
+	item, err := target.remote.client.get().GetItem(dav.httpClient, target.path)
+	if err != nil {
+		writeServeError(w, err)
+		return
+	}
+	if item.Folder == nil {
+		writeMultistatus(w, []davResponse{davItemResponse(href, target.name, item)})
+		return
+	}
+
+	if href != "/" {
+		href += "/"
+	}
+	responses = append(responses, davItemResponse(href, target.name, item))
+	if depth != "0" {
+		children, err := target.remote.client.get().ListChildren(dav.httpClient, target.path)
+		if err != nil {
+			writeServeError(w, err)
+			return
+		}
+		for i := range children {
+			childHref := href + url.PathEscape(children[i].Name)
+			if children[i].Folder != nil {
+				childHref += "/"
+			}
+			responses = append(responses, davItemResponse(childHref, children[i].Name, &children[i]))
+		}
+	}
+	writeMultistatus(w, responses)
+}
+
+// proppatch pretends to store the properties a client sets. OneDrive has nowhere to keep them, but
+// clients such as Windows Explorer fail copies when setting their timestamps fails.
+func (dav *webDAV) proppatch(w http.ResponseWriter, r *http.Request, urlPath string) {
+	var props strings.Builder
+	decoder := xml.NewDecoder(r.Body)
+	depth, propDepth := 0, -1
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			depth++
+			if propDepth < 0 && element.Name.Space == "DAV:" && element.Name.Local == "prop" {
+				propDepth = depth
+			} else if propDepth >= 0 && depth == propDepth+1 {
+				if element.Name.Space == "" {
+					fmt.Fprintf(&props, "<%s/>", element.Name.Local)
+				} else {
+					fmt.Fprintf(&props, `<p:%s xmlns:p="%s"/>`, element.Name.Local, xmlEscape(element.Name.Space))
+				}
+			}
+		case xml.EndElement:
+			if depth == propDepth {
+				propDepth = -1
+			}
+			depth--
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprintf(w, `%s<D:multistatus xmlns:D="DAV:"><D:response><D:href>%s</D:href><D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response></D:multistatus>`,
+		xml.Header, xmlEscape(davHref(urlPath)), props.String())
+}
+
+// get sends a file's content, or the part of it the Range header asks for
+func (dav *webDAV) get(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if target.remote == nil {
+		http.Error(w, "Folders are listed with PROPFIND", http.StatusMethodNotAllowed)
+		return
+	}
+	item, err := target.remote.client.get().GetItem(dav.httpClient, target.path)
+	if err != nil {
+		writeServeError(w, err)
+		return
+	}
+	if item.Folder != nil {
+		http.Error(w, "Folders are listed with PROPFIND", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serveFile(w, r, target.remote.client.get(), dav.httpClient, target.path, item)
+}
+
+// put stores the request body as a file, replacing an existing one
+func (dav *webDAV) put(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if target.remote == nil || target.path == target.remote.root {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	existing, err := target.remote.client.get().GetItem(dav.httpClient, target.path)
+	if err != nil {
+		if graphErr, ok := azure.AsGraphError(err); !ok || graphErr.StatusCode != http.StatusNotFound {
+			writeServeError(w, err)
+			return
+		}
+		existing = nil
+	} else if existing.Folder != nil {
+		http.Error(w, "A folder with this name exists", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := dav.upload(r, target); err != nil {
+		printError(fmt.Sprintf("Failed to upload '%s'", target.path), err)
+		writeServeError(w, err)
+		return
+	}
+	if existing != nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// upload sends a PUT's body to OneDrive: small files in one request, larger ones through an upload
+// session while the client sends them. Bodies without a Content-Length, as Finder sends, are stored
+// in a temporary file first, since an upload session needs the size up front.
+func (dav *webDAV) upload(r *http.Request, target davTarget) error {
+	client := target.remote.client.get()
+	data, err := io.ReadAll(io.LimitReader(r.Body, davSmallFileSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read the request: %v", err)
+	}
+	if len(data) <= davSmallFileSize {
+		fmt.Printf("Uploading %s (%s) from %s\n", target.path, formatBytes(int64(len(data))), r.RemoteAddr)
+		_, err := client.PutSmallFile(dav.httpClient, target.path, data)
+		return err
+	}
+
+	reader := io.MultiReader(bytes.NewReader(data), r.Body)
+	size := r.ContentLength
+	if size < 0 {
+		spool, err := os.CreateTemp("", "ksau-webdav-*")
+		if err != nil {
+			return fmt.Errorf("failed to create a temporary file: %v", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if size, err = io.Copy(spool, reader); err != nil {
+			return fmt.Errorf("failed to store the request: %v", err)
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to read the temporary file: %v", err)
+		}
+		reader = spool
+	}
+
+	fmt.Printf("\nUploading %s (%s) from %s\n", target.path, formatBytes(size), r.RemoteAddr)
+	opts := target.remote.opts
+	opts.reader = reader
+	opts.size = size
+	opts.label = path.Base(target.path)
+	_, err = uploadEntry(client, dav.httpClient, opts, "", target.path)
+	return err
+}
+
+// mkcol creates a folder; its parent must exist
+func (dav *webDAV) mkcol(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if r.ContentLength > 0 {
+		http.Error(w, "MKCOL bodies are not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if target.remote == nil || target.path == target.remote.root {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := target.remote.client.get().CreateFolder(dav.httpClient, target.path, false); err != nil {
+		if graphErr, ok := azure.AsGraphError(err); ok {
+			switch {
+			case graphErr.StatusCode == http.StatusConflict, graphErr.Code == "nameAlreadyExists":
+				http.Error(w, "The folder already exists", http.StatusMethodNotAllowed)
+				return
+			case graphErr.StatusCode == http.StatusNotFound:
+				http.Error(w, "The parent folder does not exist", http.StatusConflict)
+				return
+			}
+		}
+		writeServeError(w, err)
+		return
+	}
+	fmt.Printf("Created folder %s\n", target.path)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// delete moves a file or folder to the recycle bin
+func (dav *webDAV) delete(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if target.remote == nil || target.path == target.remote.root {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := target.remote.client.get().Delete(dav.httpClient, target.path); err != nil {
+		writeServeError(w, err)
+		return
+	}
+	fmt.Printf("Deleted %s\n", target.path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moveOrCopy moves or copies a file or folder to the path of the Destination header, which file
+// managers send to rename items and for drag and drop. Both happen on the server within the remote's
+// drive; items can't be moved or copied between the remotes of -all-remotes. An item already at the
+// destination is moved to the recycle bin first, unless the Overwrite header is F.
+func (dav *webDAV) moveOrCopy(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if target.remote == nil || target.path == target.remote.root {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	destination, status, message := dav.destination(r, target)
+	if status != 0 {
+		http.Error(w, message, status)
+		return
+	}
+
+	client := target.remote.client.get()
+	source, err := client.GetItem(dav.httpClient, target.path)
+	if err != nil {
+		writeServeError(w, err)
+		return
+	}
+	destinationDir := azure.NewRemotePath(destination.path).Dir().String()
+	if _, err := client.GetItem(dav.httpClient, destinationDir); err != nil {
+		if isNotFound(err) {
+			http.Error(w, "The destination's parent folder does not exist", http.StatusConflict)
+			return
+		}
+		writeServeError(w, err)
+		return
+	}
+
+	// The destination is replaced, unless the client asked not to
+	created := true
+	if _, err := client.GetItem(dav.httpClient, destination.path); err == nil {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "The destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		if err := client.Delete(dav.httpClient, destination.path); err != nil {
+			writeServeError(w, err)
+			return
+		}
+		created = false
+	} else if !isNotFound(err) {
+		writeServeError(w, err)
+		return
+	}
+
+	destinationName := azure.NewRemotePath(destination.path).Base()
+	if r.Method == "MOVE" {
+		_, err = client.Move(dav.httpClient, target.path, destinationDir, destinationName)
+	} else if source.Folder != nil && r.Header.Get("Depth") == "0" {
+		// A folder copied without its members is just a new folder
+		_, err = client.CreateFolder(dav.httpClient, destination.path, false)
+	} else {
+		var monitorURL string
+		if monitorURL, err = client.Copy(dav.httpClient, target.path, destinationDir, destinationName); err == nil {
+			_, err = client.WaitForCopy(dav.httpClient, monitorURL, davCopyPollInterval, nil)
+		}
+	}
+	if err != nil {
+		printError(fmt.Sprintf("Failed to %s '%s' to '%s'", strings.ToLower(r.Method), target.path, destination.path), err)
+		writeServeError(w, err)
+		return
+	}
+
+	if r.Method == "MOVE" {
+		fmt.Printf("Moved %s to %s\n", target.path, destination.path)
+	} else {
+		fmt.Printf("Copied %s to %s\n", target.path, destination.path)
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// destination returns the resource the Destination header of a MOVE or COPY of target names, or the
+// status and message to refuse the request with
+func (dav *webDAV) destination(r *http.Request, target davTarget) (davTarget, int, string) {
+	header := r.Header.Get("Destination")
+	if header == "" {
+		return davTarget{}, http.StatusBadRequest, "Missing Destination header"
+	}
+	destinationURL, err := url.Parse(header)
+	if err != nil {
+		return davTarget{}, http.StatusBadRequest, "Invalid Destination header"
+	}
+	if destinationURL.Host != "" && destinationURL.Host != r.Host {
+		return davTarget{}, http.StatusBadGateway, "The destination is on another server"
+	}
+
+	destination, ok := dav.target(path.Clean("/" + destinationURL.Path))
+	switch {
+	case !ok:
+		return davTarget{}, http.StatusNotFound, "Not Found"
+	case destination.remote == nil:
+		return davTarget{}, http.StatusForbidden, "The destination is the list of remotes"
+	case destination.remote != target.remote:
+		return davTarget{}, http.StatusBadGateway, "Items can't be moved or copied between remotes"
+	case destination.path == destination.remote.root:
+		return davTarget{}, http.StatusForbidden, "The destination is the served folder itself"
+	case destination.path == target.path:
+		return davTarget{}, http.StatusForbidden, "The source and destination are the same"
+	case strings.HasPrefix(destination.path+"/", target.path+"/"):
+		return davTarget{}, http.StatusForbidden, "The destination is inside the source"
+	}
+	return destination, 0, ""
+}
+
+// lock grants every lock it is asked for without enforcing it. Clients such as macOS Finder only
+// mount a server read-write if it supports locking, and OneDrive can't lock files anyway.
+func (dav *webDAV) lock(w http.ResponseWriter, r *http.Request, urlPath string) {
+	// A refresh names the lock in the If header, e.g. (<opaquelocktoken:...>), instead of sending a body
+	token := ""
+	if _, rest, found := strings.Cut(r.Header.Get("If"), "<"); found {
+		token, _, _ = strings.Cut(rest, ">")
+	}
+	if token == "" {
+		random := make([]byte, 16)
+		rand.Read(random)
+		token = "opaquelocktoken:" + hex.EncodeToString(random)
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `%s<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope><D:depth>0</D:depth><D:timeout>Second-%d</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken><D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock></D:lockdiscovery></D:prop>`,
+		xml.Header, int(davLockTimeout.Seconds()), xmlEscape(token), xmlEscape(davHref(urlPath)))
+}
+
+// davMultistatus is the body of a 207 Multi-Status response
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+// davProp holds the properties PROPFIND reports for every resource
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	CreationDate  string          `xml:"D:creationdate,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// davFolderResponse describes a folder that isn't on a drive, e.g. the list of remotes
+func davFolderResponse(href, name string) davResponse {
+	return davResponse{
+		Href: href,
+		Propstat: davPropstat{
+			Prop:   davProp{DisplayName: name, ResourceType: davResourceType{Collection: &struct{}{}}},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+// davItemResponse describes a drive item
+func davItemResponse(href, name string, item *azure.DriveItem) davResponse {
+	prop := davProp{DisplayName: name, ETag: itemETag(item)}
+	if modTime := itemModTime(item); !modTime.IsZero() {
+		prop.LastModified = modTime.UTC().Format(http.TimeFormat)
+	}
+	if item.FileSystemInfo != nil && !item.FileSystemInfo.CreatedDateTime.IsZero() {
+		prop.CreationDate = item.FileSystemInfo.CreatedDateTime.UTC().Format(time.RFC3339)
+	}
+	if item.Folder != nil {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := item.Size
+		prop.ContentLength = &size
+		if item.File != nil {
+			prop.ContentType = item.File.MimeType
+		}
+	}
+	return davResponse{Href: href, Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"}}
+}
+
+// writeMultistatus answers a PROPFIND
+func writeMultistatus(w http.ResponseWriter, responses []davResponse) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(davMultistatus{Namespace: "DAV:", Responses: responses})
+}
+
+// davHref escapes a cleaned request path for use as an href
+func davHref(urlPath string) string {
+	elements := strings.Split(urlPath, "/")
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return strings.Join(elements, "/")
+}
+
+// xmlEscape escapes text for an XML document
+func xmlEscape(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// serviceOptions describes the daemon a service runs
+type serviceOptions struct {
+	name       string
+	system     bool   // A system-wide systemd unit instead of a user unit
+	executable string // Absolute path of this binary
+	daemonArgs []string
+	stateDir   string // Absolute path of the daemon's state directory
+	logPath    string // File the daemon's output is appended to ("" for the journal)
+	user       string // User a system unit runs as
+}
+
+// runService implements the service command, which installs the daemon as a systemd unit or a
+// Windows service so that it starts with the machine, and removes or reports on it
+func runService(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Usage: ksau-go service <install|uninstall|status> [flags]")
+		return exitUsage
+	}
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		fmt.Println("Error: services are only supported with systemd on Linux and on Windows; run ksau-go daemon from your service manager instead")
+		return exitUsage
+	}
+
+	action := args[0]
+	if action == "run" {
+		return runWindowsService(args[1:])
+	}
+	fs := flag.NewFlagSet("service "+action, flag.ExitOnError)
+	opts := &serviceOptions{}
+	fs.StringVar(&opts.name, "name", "ksau-go", "Name of the service (default: 'ksau-go')")
+	fs.BoolVar(&opts.system, "system", false, "Use a system-wide systemd unit, which needs root, instead of one for the current user; Linux only (default: false)")
+	var stateDir, logPath, jobsFile *string
+	var transfers *int
+	var printOnly *bool
+	if action == "install" {
+		stateDir = fs.String("state-dir", ".ksau-state", "Directory for the daemon's queue, job logs and socket (default: '.ksau-state')")
+		transfers = fs.Int("transfers", 1, "Number of jobs the daemon runs at the same time (default: 1)")
+		jobsFile = fs.String("schedule", "", "Also run the recurring jobs of this jobs file (default: none)")
+		logPath = fs.String("log", "", "Append the daemon's output to this file (default: the journal with systemd, <state-dir>/daemon.log on Windows)")
+		printOnly = fs.Bool("print", false, "Print the unit or the service's command line instead of installing it (default: false)")
+		registerConfigFlag(fs)
+	}
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 0 {
+		fmt.Printf("Usage: ksau-go service %s [flags]\n", action)
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	if !jobNamePattern.MatchString(opts.name) {
+		fmt.Printf("Error: invalid service name '%s': use letters, digits, '.', '_' and '-'\n", opts.name)
+		return exitUsage
+	}
+
+	switch action {
+	case "install":
+		if err := opts.prepare(*stateDir, *logPath, *jobsFile, *transfers); err != nil {
+			fmt.Println("Error:", err)
+			return exitUsage
+		}
+		if runtime.GOOS == "windows" {
+			return opts.windowsService(action, *printOnly)
+		}
+		if *printOnly {
+			fmt.Print(opts.systemdUnit())
+			return exitOK
+		}
+		return opts.installSystemd()
+	case "uninstall", "status":
+		if runtime.GOOS == "windows" {
+			return opts.windowsService(action, false)
+		}
+		if action == "uninstall" {
+			return opts.uninstallSystemd()
+		}
+		return opts.statusSystemd()
+	default:
+		fmt.Printf("Error: unknown service command '%s'; expected install, uninstall or status\n", action)
+		return exitUsage
+	}
+}
+
+// prepare resolves the paths the service needs to absolute ones, since it doesn't start in the
+// current directory, and builds the daemon's arguments
+func (opts *serviceOptions) prepare(stateDir, logPath, jobsFile string, transfers int) error {
+	var err error
+	if opts.executable, err = os.Executable(); err != nil {
+		return err
+	}
+	if opts.stateDir, err = filepath.Abs(stateDir); err != nil {
+		return err
+	}
+	if transfers < 1 {
+		return errors.New("-transfers must be at least 1")
+	}
+	opts.daemonArgs = []string{"daemon", "-state-dir", opts.stateDir, "-transfers", strconv.Itoa(transfers)}
+
+	if jobsFile != "" {
+		if _, err := loadJobs(jobsFile); err != nil {
+			return err
+		}
+		absPath, err := filepath.Abs(jobsFile)
+		if err != nil {
+			return err
+		}
+		opts.daemonArgs = append(opts.daemonArgs, "-schedule", absPath)
+	}
+
+	// The service uses the config this command would, rather than whatever its environment finds
+	path := configPath
+	if path == "" {
+		path = os.Getenv("KSAU_CONFIG")
+	}
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("config file '%s' not found", path)
+		}
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		opts.daemonArgs = append(opts.daemonArgs, "-config", absPath)
+	}
+
+	if logPath == "" && runtime.GOOS == "windows" {
+		logPath = filepath.Join(opts.stateDir, "daemon.log")
+	}
+	if logPath != "" {
+		if opts.logPath, err = filepath.Abs(logPath); err != nil {
+			return err
+		}
+	}
+
+	if opts.system {
+		// Run as the user who installed it rather than as root, so the daemon's files stay theirs
+		opts.user = os.Getenv("SUDO_USER")
+		if opts.user == "" {
+			if current, err := user.Current(); err == nil {
+				opts.user = current.Username
+			}
+		}
+	}
+	return nil
+}
+
+// systemctlArgs returns args for systemctl, addressing the user's service manager unless -system is set
+func (opts *serviceOptions) systemctlArgs(args ...string) []string {
+	if opts.system {
+		return args
+	}
+	return append([]string{"--user"}, args...)
+}
+
+// unitPath returns where the systemd unit file goes
+func (opts *serviceOptions) unitPath() (string, error) {
+	if opts.system {
+		return filepath.Join("/etc/systemd/system", opts.name+".service"), nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "systemd", "user", opts.name+".service"), nil
+}
+
+// systemdUnit returns the unit file that runs the daemon
+func (opts *serviceOptions) systemdUnit() string {
+	execStart := make([]string, 0, len(opts.daemonArgs)+1)
+	for _, arg := range append([]string{opts.executable}, opts.daemonArgs...) {
+		execStart = append(execStart, systemdQuote(arg))
+	}
+
+	var unit strings.Builder
+	unit.WriteString("[Unit]\n")
+	unit.WriteString("Description=ksau-go transfer daemon\n")
+	unit.WriteString("Wants=network-online.target\n")
+	unit.WriteString("After=network-online.target\n\n")
+	unit.WriteString("[Service]\n")
+	fmt.Fprintf(&unit, "ExecStart=%s\n", strings.Join(execStart, " "))
+	if opts.user != "" {
+		fmt.Fprintf(&unit, "User=%s\n", opts.user)
+	}
+	if opts.logPath != "" {
+		fmt.Fprintf(&unit, "StandardOutput=append:%s\n", strings.ReplaceAll(opts.logPath, "%", "%%"))
+		unit.WriteString("StandardError=inherit\n")
+	}
+	// The daemon passes the interrupt on to its jobs itself; a second one would stop them without cleaning up
+	unit.WriteString("KillSignal=SIGINT\n")
+	unit.WriteString("KillMode=mixed\n")
+	unit.WriteString("TimeoutStopSec=90\n")
+	unit.WriteString("Restart=on-failure\n")
+	unit.WriteString("RestartSec=10\n\n")
+	unit.WriteString("[Install]\n")
+	if opts.system {
+		unit.WriteString("WantedBy=multi-user.target\n")
+	} else {
+		unit.WriteString("WantedBy=default.target\n")
+	}
+	return unit.String()
+}
+
+// systemdQuote quotes an argument of a unit's command line
+func systemdQuote(arg string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + replacer.Replace(arg) + `"`
+}
+
+// installSystemd writes the unit, then enables and starts it
+func (opts *serviceOptions) installSystemd() int {
+	path, err := opts.unitPath()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	if err := os.WriteFile(path, []byte(opts.systemdUnit()), 0o644); err != nil {
+		fmt.Println("Error: failed to write the unit:", err)
+		return exitFailure
+	}
+	fmt.Println("Wrote", path)
+
+	if code := runServiceTool("systemctl", opts.systemctlArgs("daemon-reload")...); code != exitOK {
+		return code
+	}
+	if code := runServiceTool("systemctl", opts.systemctlArgs("enable", "--now", opts.name+".service")...); code != exitOK {
+		return code
+	}
+
+	fmt.Printf("%sInstalled and started %s.%s\n", ColorGreen, opts.name, ColorReset)
+	if !opts.system {
+		fmt.Println("User services stop when you log out; run 'loginctl enable-linger' to keep it running and start it at boot.")
+	}
+	opts.printUsage()
+	return exitOK
+}
+
+// uninstallSystemd stops and disables the unit, then removes it
+func (opts *serviceOptions) uninstallSystemd() int {
+	path, err := opts.unitPath()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	if _, err := os.Stat(path); err != nil {
+		fmt.Printf("Error: no service named '%s' is installed (%s not found)\n", opts.name, path)
+		return exitNotFound
+	}
+	if code := runServiceTool("systemctl", opts.systemctlArgs("disable", "--now", opts.name+".service")...); code != exitOK {
+		return code
+	}
+	if err := os.Remove(path); err != nil {
+		fmt.Println("Error: failed to remove the unit:", err)
+		return exitFailure
+	}
+	runServiceTool("systemctl", opts.systemctlArgs("daemon-reload")...)
+	fmt.Printf("%sUninstalled %s; its queue and logs are kept.%s\n", ColorGreen, opts.name, ColorReset)
+	return exitOK
+}
+
+// statusSystemd shows the unit's status; the exit code tells whether the daemon is running
+func (opts *serviceOptions) statusSystemd() int {
+	cmd := exec.Command("systemctl", opts.systemctlArgs("status", "--no-pager", opts.name+".service")...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return exitOK
+	case !errors.As(err, &exitErr):
+		fmt.Printf("%sError: failed to run systemctl: %v%s\n", ColorRed, err, ColorReset)
+		return exitFailure
+	// systemctl status exits with 3 for units that aren't running and 4 for unknown ones
+	case exitErr.ExitCode() == 4:
+		fmt.Printf("No service named '%s' is installed.\n", opts.name)
+		return exitNotFound
+	default:
+		return exitFailure
+	}
+}
+
+// printUsage tells how to reach the installed daemon with the jobs command
+func (opts *serviceOptions) printUsage() {
+	socket := filepath.Join(opts.stateDir, "daemon.sock")
+	fmt.Printf("Add jobs with: ksau-go jobs add -socket %s <arguments>\n", socket)
+	fmt.Printf("or set KSAU_DAEMON_SOCKET=%s to use ksau-go jobs from any directory.\n", socket)
+}
+
+// runServiceTool runs a service manager command with its output shown, and returns exitOK if it succeeded
+func runServiceTool(name string, args ...string) int {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &exitErr):
+		fmt.Printf("%s%s %s failed with exit code %d%s\n", ColorRed, name, strings.Join(args, " "), exitErr.ExitCode(), ColorReset)
+		return exitFailure
+	default:
+		fmt.Printf("%sError: failed to run %s: %v%s\n", ColorRed, name, err, ColorReset)
+		return exitFailure
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// windowsService reports that Windows services can't be managed on this OS
+func (opts *serviceOptions) windowsService(action string, printOnly bool) int {
+	fmt.Println("Error: Windows services can only be managed on Windows")
+	return exitUsage
+}
+
+// runWindowsService reports that service run is only for the Windows service manager
+func runWindowsService(args []string) int {
+	fmt.Println("Error: service run is only started by the Windows service manager; run ksau-go daemon instead")
+	return exitUsage
+}
@@ -0,0 +1,237 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceStopTimeout bounds how long the daemon gets to stop its jobs when the service is stopped,
+// as TimeoutStopSec does for the systemd unit
+const serviceStopTimeout = 90 * time.Second
+
+// serviceStates names the states of a Windows service for status
+var serviceStates = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "starting",
+	svc.StopPending:     "stopping",
+	svc.Running:         "running",
+	svc.ContinuePending: "resuming",
+	svc.PausePending:    "pausing",
+	svc.Paused:          "paused",
+}
+
+// windowsService installs, uninstalls or reports on the Windows service that runs the daemon
+func (opts *serviceOptions) windowsService(action string, printOnly bool) int {
+	if printOnly {
+		args := make([]string, 0, len(opts.daemonArgs)+7)
+		for _, arg := range append([]string{opts.executable}, opts.serviceArgs()...) {
+			args = append(args, syscall.EscapeArg(arg))
+		}
+		fmt.Printf("Service %s runs: %s\n", opts.name, strings.Join(args, " "))
+		return exitOK
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Println("Error: failed to connect to the service manager:", err)
+		fmt.Println("Managing services needs an elevated (Run as administrator) prompt.")
+		return exitFailure
+	}
+	defer m.Disconnect()
+
+	if action == "install" {
+		return opts.installWindowsService(m)
+	}
+	s, err := m.OpenService(opts.name)
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		fmt.Printf("No service named '%s' is installed.\n", opts.name)
+		return exitNotFound
+	}
+	if err != nil {
+		fmt.Printf("Error: failed to open service '%s': %v\n", opts.name, err)
+		return exitFailure
+	}
+	defer s.Close()
+	if action == "uninstall" {
+		return opts.uninstallWindowsService(s)
+	}
+	return opts.statusWindowsService(s)
+}
+
+// serviceArgs returns the arguments the service control manager starts this binary with
+func (opts *serviceOptions) serviceArgs() []string {
+	return append([]string{"service", "run", "-name", opts.name, "-log", opts.logPath}, opts.daemonArgs...)
+}
+
+// installWindowsService registers the daemon as a service that starts with the machine as
+// LocalSystem and is restarted if it fails, then starts it
+func (opts *serviceOptions) installWindowsService(m *mgr.Mgr) int {
+	if s, err := m.OpenService(opts.name); err == nil {
+		s.Close()
+		fmt.Printf("Error: a service named '%s' is already installed; uninstall it first\n", opts.name)
+		return exitUsage
+	}
+	if err := os.MkdirAll(opts.stateDir, 0o700); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+
+	s, err := m.CreateService(opts.name, opts.executable, mgr.Config{
+		DisplayName: "ksau-go transfer daemon",
+		Description: "Works through the ksau-go transfer queue; manage its jobs with ksau-go jobs.",
+		StartType:   mgr.StartAutomatic,
+		// Started once the network is more likely to be up
+		DelayedAutoStart: true,
+	}, opts.serviceArgs()...)
+	if err != nil {
+		fmt.Println("Error: failed to create the service:", err)
+		return exitFailure
+	}
+	defer s.Close()
+
+	// Restart after 10 seconds when the daemon crashes or stops with an error, like Restart=on-failure
+	restart := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 10 * time.Second}}
+	if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err == nil {
+		err = s.SetRecoveryActionsOnNonCrashFailures(true)
+	}
+	if err != nil {
+		fmt.Printf("%sWarning: failed to set the service to restart on failure: %v%s\n", ColorYellow, err, ColorReset)
+	}
+
+	if err := s.Start(); err != nil {
+		fmt.Println("Error: failed to start the service:", err)
+		return exitFailure
+	}
+	fmt.Printf("%sInstalled and started %s; its output goes to %s.%s\n", ColorGreen, opts.name, opts.logPath, ColorReset)
+	opts.printUsage()
+	return exitOK
+}
+
+// uninstallWindowsService stops the service, waiting for the daemon to stop its jobs, then deletes it
+func (opts *serviceOptions) uninstallWindowsService(s *mgr.Service) int {
+	status, err := s.Control(svc.Stop)
+	if err != nil && !errors.Is(err, windows.ERROR_SERVICE_NOT_ACTIVE) {
+		fmt.Println("Error: failed to stop the service:", err)
+		return exitFailure
+	}
+	if err == nil {
+		fmt.Println("Waiting for the daemon to stop...")
+		for deadline := time.Now().Add(serviceStopTimeout); status.State != svc.Stopped && time.Now().Before(deadline); {
+			time.Sleep(500 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		fmt.Println("Error: failed to delete the service:", err)
+		return exitFailure
+	}
+	fmt.Printf("%sUninstalled %s; its queue and logs are kept.%s\n", ColorGreen, opts.name, ColorReset)
+	return exitOK
+}
+
+// statusWindowsService shows the service's state and command line; the exit code tells whether the
+// daemon is running
+func (opts *serviceOptions) statusWindowsService(s *mgr.Service) int {
+	status, err := s.Query()
+	if err != nil {
+		fmt.Println("Error: failed to query the service:", err)
+		return exitFailure
+	}
+	fmt.Printf("%s: %s", opts.name, serviceStates[status.State])
+	if status.State == svc.Running {
+		fmt.Printf(" (process %d)", status.ProcessId)
+	}
+	fmt.Println()
+	if config, err := s.Config(); err == nil {
+		fmt.Println("Command:", config.BinaryPathName)
+	}
+	if status.State != svc.Running {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// daemonService runs the daemon under the service control manager, which asks it to stop instead of
+// sending it Ctrl+C
+type daemonService struct {
+	daemonArgs []string
+	exitCode   int
+}
+
+// runWindowsService implements service run, which the service control manager starts the installed
+// service with: it runs the daemon with its output appended to the log
+func runWindowsService(args []string) int {
+	fs := flag.NewFlagSet("service run", flag.ExitOnError)
+	name := fs.String("name", "ksau-go", "Name of the service (default: 'ksau-go')")
+	logPath := fs.String("log", "", "Append the daemon's output to this file (default: discarded)")
+	fs.Parse(args)
+
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService || fs.Arg(0) != "daemon" {
+		fmt.Println("Error: service run is only started by the Windows service manager; run ksau-go daemon instead")
+		return exitUsage
+	}
+
+	// A service has no console, so its output is only kept in the log
+	disableANSI()
+	if *logPath != "" {
+		logFile, err := os.OpenFile(*logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return exitFailure
+		}
+		defer logFile.Close()
+		os.Stdout, os.Stderr = logFile, logFile
+	}
+
+	service := &daemonService{daemonArgs: fs.Args()[1:]}
+	if err := svc.Run(*name, service); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	return service.exitCode
+}
+
+// Execute runs the daemon until it stops or the service control manager asks it to. A daemon that
+// stops with an error is reported as failed, so the recovery actions restart it.
+func (service *daemonService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan int, 1)
+	go func() {
+		done <- runDaemon(service.daemonArgs)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case service.exitCode = <-done:
+			return service.exitCode != exitOK, uint32(service.exitCode)
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopTimeout.Milliseconds())}
+				fmt.Printf("[%s] Service stop requested\n", time.Now().Format("2006-01-02 15:04:05"))
+				cancelInterrupted()
+				select {
+				case service.exitCode = <-done:
+				case <-time.After(serviceStopTimeout):
+				}
+				return false, 0
+			}
+		}
+	}
+}
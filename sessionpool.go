@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// pooledSession is an upload session created ahead of time for one file
+type pooledSession struct {
+	uploadURL string
+	err       error
+}
+
+// sessionPool creates the upload sessions of the next files of a directory upload while the
+// current one is transferring. For small files creating the session takes longer than sending
+// the data, so overlapping the two speeds up uploads of many files considerably.
+type sessionPool struct {
+	client     *azure.AzureClient
+	httpClient *http.Client
+	sessions   []chan pooledSession
+	slots      chan struct{} // Bounds how many sessions are created ahead of the upload
+	stop       chan struct{}
+	wg         sync.WaitGroup
+
+	mu         sync.Mutex
+	created    int
+	createTime time.Duration // Total time spent creating sessions
+	waitTime   time.Duration // Time the upload spent waiting for sessions that weren't ready yet
+}
+
+// newSessionPool starts creating upload sessions for targets in order, at most size ahead of
+// the file being uploaded; each session carries its local file's timestamps
+func newSessionPool(client *azure.AzureClient, httpClient *http.Client, targets []uploadTarget, size int) *sessionPool {
+	pool := &sessionPool{
+		client:     client,
+		httpClient: httpClient,
+		sessions:   make([]chan pooledSession, len(targets)),
+		slots:      make(chan struct{}, size),
+		stop:       make(chan struct{}),
+	}
+	for i := range pool.sessions {
+		pool.sessions[i] = make(chan pooledSession, 1)
+	}
+
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+		for i, target := range targets {
+			select {
+			case pool.slots <- struct{}{}:
+			case <-pool.stop:
+				return
+			}
+
+			pool.wg.Add(1)
+			go func() {
+				defer pool.wg.Done()
+				var info *azure.FileSystemInfo
+				if fileInfo, err := os.Stat(target.localPath); err == nil {
+					info = localFileSystemInfo(fileInfo)
+				}
+
+				start := time.Now()
+				uploadURL, err := client.CreateUploadSessionWithInfo(httpClient, target.remotePath, info)
+				elapsed := time.Since(start)
+
+				pool.mu.Lock()
+				pool.createTime += elapsed
+				if err == nil {
+					pool.created++
+				}
+				pool.mu.Unlock()
+
+				pool.sessions[i] <- pooledSession{uploadURL: uploadURL, err: err}
+			}()
+		}
+	}()
+
+	return pool
+}
+
+// take waits for the session of file i and frees its slot for the next file; it returns an empty
+// URL if the session couldn't be created, in which case the upload creates its own
+func (pool *sessionPool) take(i int) string {
+	start := time.Now()
+	session := <-pool.sessions[i]
+	waited := time.Since(start)
+	<-pool.slots
+
+	pool.mu.Lock()
+	pool.waitTime += waited
+	pool.mu.Unlock()
+
+	if session.err != nil {
+		fmt.Printf("%sWarning: failed to create upload session ahead of time: %v%s\n", ColorYellow, session.err, ColorReset)
+		return ""
+	}
+	return session.uploadURL
+}
+
+// discard deletes a session that won't be used, so it doesn't linger on OneDrive
+func (pool *sessionPool) discard(uploadURL string) {
+	if uploadURL == "" {
+		return
+	}
+	if err := pool.client.DeleteUploadSession(pool.httpClient, uploadURL); err != nil {
+		fmt.Printf("%sWarning: failed to cancel unused upload session: %v%s\n", ColorYellow, err, ColorReset)
+	}
+}
+
+// close stops creating sessions and deletes the ones created for files that weren't uploaded
+func (pool *sessionPool) close() {
+	close(pool.stop)
+	pool.wg.Wait()
+
+	for _, sessions := range pool.sessions {
+		select {
+		case session := <-sessions:
+			if session.err == nil {
+				pool.discard(session.uploadURL)
+			}
+		default:
+		}
+	}
+}
+
+// summary describes how much session creation time was hidden behind the transfers
+func (pool *sessionPool) summary() string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	saved := max(pool.createTime-pool.waitTime, 0)
+	return fmt.Sprintf("Upload sessions: %d created ahead of time in %s, %s spent waiting for them (%s saved)",
+		pool.created, pool.createTime.Round(time.Millisecond), pool.waitTime.Round(time.Millisecond), saved.Round(time.Millisecond))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// remoteShifter sends the pending files of a batch upload to other remotes while Graph throttles
+// the remote the batch uploads to, instead of leaving them waiting for the throttling to ease. Each
+// file keeps its place relative to the batch's folder, which is resolved on the other remote like
+// -failover does, so remote:root/path goes to that remote's root of the same name.
+type remoteShifter struct {
+	remote  string // Remote the batch uploads to
+	folder  string // The batch's folder on it, which every target is inside
+	remotes []*shiftRemote
+
+	mu      sync.Mutex
+	next    int            // Remote to try first for the next file
+	shifted map[string]int // Files uploaded to each other remote
+}
+
+// shiftRemote is a remote that files of a throttled batch can be shifted to. Its client is only set
+// up when a file is first shifted to it.
+type shiftRemote struct {
+	name   string
+	folder string // The batch's folder on this remote
+	setup  func() (*azure.AzureClient, uploadOptions, error)
+
+	once    sync.Once
+	client  *azure.AzureClient
+	opts    uploadOptions
+	err     error
+	folders sync.Map // Folders created on this remote
+}
+
+// newRemoteShifter shifts files of a batch uploading to folder on remote to the other remotes that
+// allow uploads, in the order -failover tries them. folderSpec is the -remote folder as given,
+// resolved on each remote, and setup sets up the client and options for uploading to a remote.
+func newRemoteShifter(configData []byte, remote, folder, folderSpec string, setup func(remote string) (*azure.AzureClient, uploadOptions, error)) (*remoteShifter, error) {
+	others, err := failoverRemotes(configData, remote)
+	if err != nil {
+		return nil, err
+	}
+	shifter := &remoteShifter{remote: remote, folder: folder, shifted: make(map[string]int)}
+	for _, other := range others {
+		shifter.remotes = append(shifter.remotes, &shiftRemote{
+			name:   other,
+			folder: resolveRemoteOn(configData, folderSpec, other),
+			setup:  func() (*azure.AzureClient, uploadOptions, error) { return setup(other) },
+		})
+	}
+	return shifter, nil
+}
+
+// route returns the remote, client, options and path to upload the batch file at remotePath with:
+// while client, the batch remote's client, is throttled, another remote that isn't, taking turns
+// between them. Without a shifter, or while no other remote can take the file, it stays on client.
+func (shifter *remoteShifter) route(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, remotePath string) (string, *azure.AzureClient, uploadOptions, string) {
+	if shifter == nil || !client.Throttled() {
+		return "", client, opts, remotePath
+	}
+	rel, ok := azure.NewRemotePath(remotePath).Rel(azure.NewRemotePath(shifter.folder))
+	if !ok {
+		return "", client, opts, remotePath
+	}
+
+	shifter.mu.Lock()
+	start := shifter.next
+	shifter.mu.Unlock()
+	for i := range shifter.remotes {
+		other := shifter.remotes[(start+i)%len(shifter.remotes)]
+		otherClient, otherOpts, err := other.get()
+		if err != nil || otherClient.Throttled() {
+			continue
+		}
+
+		// Content-addressed uploads keep the name they are recorded under in the manifest
+		otherPath := remotePath
+		if otherOpts.cas == nil {
+			otherPath = remoteJoin(other.folder, rel.String())
+		}
+		if otherOpts.cas == nil && !otherOpts.dryRun {
+			if err := other.ensureFolder(httpClient, azure.NewRemotePath(otherPath).Dir().String()); err != nil {
+				printError(fmt.Sprintf("Failed to create remote folder on remote '%s'", other.name), err)
+				continue
+			}
+		}
+
+		shifter.mu.Lock()
+		shifter.next = (start + i + 1) % len(shifter.remotes)
+		shifter.shifted[other.name]++
+		shifter.mu.Unlock()
+		return other.name, otherClient, otherOpts, otherPath
+	}
+	return "", client, opts, remotePath
+}
+
+// summary describes the files shifted to other remotes, or returns "" if there were none
+func (shifter *remoteShifter) summary() string {
+	if shifter == nil {
+		return ""
+	}
+	shifter.mu.Lock()
+	defer shifter.mu.Unlock()
+
+	var parts []string
+	total := 0
+	for remote, n := range shifter.shifted {
+		parts = append(parts, fmt.Sprintf("%d to '%s'", n, remote))
+		total += n
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("%d files went to other remotes while remote '%s' was throttled: %s", total, shifter.remote, strings.Join(parts, ", "))
+}
+
+// get sets up the remote's client the first time it is needed
+func (other *shiftRemote) get() (*azure.AzureClient, uploadOptions, error) {
+	other.once.Do(func() {
+		other.client, other.opts, other.err = other.setup()
+		if other.err != nil {
+			fmt.Printf("%sWarning: not shifting files to remote '%s': %v%s\n", ColorYellow, other.name, other.err, ColorReset)
+		}
+	})
+	return other.client, other.opts, other.err
+}
+
+// ensureFolder creates a folder on the remote unless it already did
+func (other *shiftRemote) ensureFolder(httpClient *http.Client, folder string) error {
+	if _, done := other.folders.Load(folder); done {
+		return nil
+	}
+	if _, err := other.client.EnsureFolder(httpClient, folder); err != nil {
+		return err
+	}
+	other.folders.Store(folder, true)
+	return nil
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// runSync implements the sync command, which makes a remote folder match a local directory:
+// new and changed files are uploaded and, with -delete, remote files missing locally are deleted.
+// Files with the same size and QuickXorHash on both sides are left alone. A -transactional run
+// records its changes and keeps the files it replaces or deletes, so -rollback can undo it.
+//
+// When the remote folder's changes can be fetched with the delta API it is compared as a whole.
+// Otherwise it is listed and synced a folder at a time, with the next folders listed in the
+// background while the current one transfers.
+func runSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	deleteExtra := fs.Bool("delete", false, "Move remote files that don't exist locally to the recycle bin (default: false)")
+	dryRun := fs.Bool("dry-run", false, "Only print what would be uploaded and deleted (default: false)")
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	parallelChunks := fs.Int("parallel", 1, "Number of parallel chunks to upload (default: 1)")
+	transfers := fs.Int("transfers", 1, "Number of files to upload at the same time (default: 1)")
+	bwLimit := fs.String("bwlimit", "", "Limit the transfer rate in bytes/s, e.g. 4M, or follow a schedule such as \"08:00,1M 23:00,off\" (default: no limit)")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification of uploaded files (default: false)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	noDelta := fs.Bool("no-delta", false, "List the whole remote folder instead of only fetching the changes since the last run (default: false)")
+	prefetch := fs.Int("prefetch", 4, "Remote folders to list ahead while the current one transfers, when the remote folder is listed in full (default: 4)")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for the remote folder's saved tree and cached tokens (default: '.ksau-state')")
+	transactional := fs.Bool("transactional", false, "Record the run's changes and move the remote files it replaces or deletes to -backup-dir, so -rollback can undo it (default: false)")
+	backupDir := fs.String("backup-dir", ".ksau-backup", "Remote folder transactional runs move replaced and deleted files into, in a folder per run (default: '.ksau-backup' in the remote's root folder)")
+	rollback := fs.String("rollback", "", "Undo the transactional run with this ID, or 'last' for the latest one, instead of syncing (default: none)")
+	filterOptions := registerFilterFlags(fs)
+	registerConfigFlag(fs)
+	registerMetricsFlag(fs)
+	fs.Parse(args)
+
+	if *rollback != "" && fs.NArg() == 0 {
+		return rollbackSync(*stateDir, *rollback, *dryRun)
+	}
+	if fs.NArg() != 2 || *rollback != "" {
+		fmt.Println("Usage: ksau-go sync [flags] <local-dir> <remote:dir>")
+		fmt.Println("       ksau-go sync -rollback <run-id|last> [-dry-run] [-state-dir dir]")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	localDir := longPath(fs.Arg(0))
+
+	info, err := os.Stat(localDir)
+	if err != nil || !info.IsDir() {
+		fmt.Printf("Error: '%s' is not a local directory\n", fs.Arg(0))
+		return exitUsage
+	}
+
+	filter, err := filterOptions.build()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	bandwidth, err := parseBandwidth(*bwLimit)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, fs.Arg(1))
+	if code != exitOK {
+		return code
+	}
+	if err := startMetricsServer(); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	client.UseBandwidthLimit(bandwidth)
+	remoteDir := paths[0]
+
+	configData, _ := loadConfig()
+	remote, _ := resolveRemote(configData, fs.Arg(1), *remoteConfig)
+	retryPolicy, err := remoteRetryPolicy(configData, remote, azure.DefaultRetryPolicy())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	httpClient := &http.Client{}
+
+	plan := &syncPlan{localDir: localDir, remoteDir: remoteDir, filter: filter, localSizes: make(map[string]int64), deleteExtra: *deleteExtra}
+	run := &syncRun{
+		client:     client,
+		httpClient: httpClient,
+		remote:     remote,
+		remoteDir:  remoteDir,
+		stateDir:   *stateDir,
+		folders:    make(map[string]bool),
+		opts: uploadOptions{
+			remoteConfig:   remote,
+			chunkSize:      *chunkSize,
+			parallelChunks: *parallelChunks,
+			retryPolicy:    retryPolicy,
+			skipHash:       *skipHash,
+			hashRetries:    5,
+			hashRetryDelay: 10 * time.Second,
+			transfers:      *transfers,
+			conflict:       azure.ConflictReplace,
+		},
+	}
+
+	// Backups of transactional runs that lie inside the synced folder aren't part of it
+	if *transactional {
+		run.backupDir = resolveRemoteOn(configData, *backupDir, remote)
+		if rel, ok := azure.NewRemotePath(run.backupDir).Rel(azure.NewRemotePath(remoteDir)); ok {
+			if rel.IsRoot() {
+				fmt.Println("Error: -backup-dir can't be the synced folder itself")
+				return exitUsage
+			}
+			plan.backupRel = rel.String()
+		}
+	}
+
+	// Known folders only fetch what changed since the last run; a remote folder that doesn't exist yet is simply empty
+	fmt.Printf("Listing %s...\n", remoteDir)
+	var remoteFiles map[string]azure.DriveItem
+	if !*noDelta {
+		tree, err := syncRemoteTree(client, httpClient, remoteDir, remoteTreePath(*stateDir, remote, remoteDir))
+		switch {
+		case err == nil:
+			remoteFiles = tree.files()
+		case isNotFound(err):
+			remoteFiles = make(map[string]azure.DriveItem)
+		default:
+			fmt.Printf("%sChange tracking unavailable (%v), listing folders as they are synced%s\n", ColorYellow, err, ColorReset)
+		}
+	}
+
+	localDirs := []string{""}
+	localFiles := make(map[string][]string) // Folder -> files in it
+	var localCount int
+	plan.ignores, err = walkLocal(localDir, filter, func(rel string, d os.DirEntry) error {
+		if d.IsDir() {
+			if rel != "." {
+				localDirs = append(localDirs, rel)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		dir := path.Dir(rel)
+		if dir == "." {
+			dir = ""
+		}
+		localFiles[dir] = append(localFiles[dir], rel)
+		plan.localSizes[rel] = info.Size()
+		localCount++
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Failed to walk directory:", err)
+		return exitFailure
+	}
+
+	if remoteFiles == nil {
+		return syncByFolder(plan, run, localDirs, localFiles, *prefetch, *dryRun)
+	}
+
+	var allFiles []string
+	for _, dir := range localDirs {
+		allFiles = append(allFiles, localFiles[dir]...)
+	}
+	plan.removeExcluded(remoteFiles)
+	fmt.Printf("Comparing %d local files with %d remote files...\n", localCount, len(remoteFiles))
+	targets, replaced, err := plan.compare(allFiles, remoteFiles)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+
+	fmt.Printf("%d to upload, %d unchanged, %d to delete\n", len(targets), plan.unchanged, len(plan.extra))
+	if *dryRun || (len(targets) == 0 && len(plan.extra) == 0) {
+		return exitOK
+	}
+
+	run.upload(targets, replaced)
+	return run.finish(plan.extra)
+}
+
+// syncByFolder syncs the remote folder a folder at a time, for remote folders that are listed in
+// full: each folder's listing is compared with the local files in it and its changes are uploaded
+// while the listings of the next prefetch folders are fetched. With -delete, remote folders that
+// don't exist locally are listed as well, after the local ones.
+func syncByFolder(plan *syncPlan, run *syncRun, localDirs []string, localFiles map[string][]string, prefetch int, dryRun bool) int {
+	prefetcher := newRemotePrefetcher(run.client, run.httpClient, run.remoteDir, prefetch)
+	queue := localDirs
+	queued := make(map[string]bool, len(queue))
+	for _, dir := range queue {
+		queued[dir] = true
+	}
+
+	var uploads int
+	for i := 0; i < len(queue); i++ {
+		if interrupted.Err() != nil {
+			fmt.Printf("%sSync interrupted.%s\n", ColorYellow, ColorReset)
+			run.exitCode = exitInterrupted
+			break
+		}
+		for _, next := range queue[i+1 : min(len(queue), i+1+prefetch)] {
+			prefetcher.fetch(next)
+		}
+
+		dir := queue[i]
+		items, err := prefetcher.wait(dir)
+		if err != nil {
+			printError(fmt.Sprintf("Failed to list remote folder '%s'", remoteJoin(run.remoteDir, dir)), err)
+			run.exitCode = exitCodeFor(err)
+			break
+		}
+		remoteFiles := make(map[string]azure.DriveItem)
+		for _, item := range items {
+			rel := remoteJoin(dir, item.Name)
+			if !item.IsFolder() {
+				remoteFiles[rel] = item
+				continue
+			}
+			if plan.deleteExtra && !queued[rel] && !plan.skipsFolder(rel) {
+				queue = append(queue, rel)
+				queued[rel] = true
+			}
+		}
+		plan.removeExcluded(remoteFiles)
+
+		targets, replaced, err := plan.compare(localFiles[dir], remoteFiles)
+		if err != nil {
+			fmt.Println("Error:", err)
+			run.exitCode = exitFailure
+			break
+		}
+		uploads += len(targets)
+		if !dryRun && len(targets) > 0 && run.upload(targets, replaced) == exitInterrupted {
+			break
+		}
+	}
+
+	fmt.Printf("Compared %d folders: %d to upload, %d unchanged, %d to delete\n", len(queued), uploads, plan.unchanged, len(plan.extra))
+	if dryRun {
+		return run.exitCode
+	}
+	return run.finish(plan.extra)
+}
+
+// syncPlan compares local files with the remote ones to find what a sync changes
+type syncPlan struct {
+	localDir    string
+	remoteDir   string
+	filter      *fileFilter
+	ignores     *ignoreList
+	backupRel   string           // Backup folder of a transactional run inside the synced folder, which isn't synced
+	localSizes  map[string]int64 // Sizes of the local files
+	deleteExtra bool
+	unchanged   int      // Files found to be the same on both sides
+	extra       []string // Remote files without a local one, with -delete
+}
+
+// removeExcluded drops the remote files the sync leaves alone, even with -delete: excluded and
+// ignored ones and the backups of transactional runs
+func (plan *syncPlan) removeExcluded(remoteFiles map[string]azure.DriveItem) {
+	if plan.backupRel != "" {
+		for rel := range remoteFiles {
+			if _, ok := azure.NewRemotePath(rel).Rel(azure.NewRemotePath(plan.backupRel)); ok {
+				delete(remoteFiles, rel)
+			}
+		}
+	}
+	removeExcluded(remoteFiles, plan.filter, plan.ignores)
+}
+
+// skipsFolder reports whether a remote folder that doesn't exist locally is left out of the sync
+func (plan *syncPlan) skipsFolder(rel string) bool {
+	if plan.backupRel != "" {
+		if _, ok := azure.NewRemotePath(rel).Rel(azure.NewRemotePath(plan.backupRel)); ok {
+			return true
+		}
+	}
+	return plan.filter.excludesDir(rel) || plan.ignores.ignored(rel, true)
+}
+
+// compare compares the local files rels with remoteFiles, the remote files of the same folders, and
+// returns the files to upload and which of them replace a remote file. Remote files without a local
+// one become extras with -delete.
+func (plan *syncPlan) compare(rels []string, remoteFiles map[string]azure.DriveItem) ([]uploadTarget, map[string]bool, error) {
+	// A file whose size is outside the limits on either side is neither uploaded nor deleted
+	localSizes := make(map[string]int64, len(rels))
+	for _, rel := range rels {
+		localSizes[rel] = plan.localSizes[rel]
+	}
+	tooLargeOrSmall := sizeExcluded(plan.filter, localSizes, remoteFiles)
+	for rel := range tooLargeOrSmall {
+		delete(remoteFiles, rel)
+	}
+
+	// Only files of the same size are hashed; a different size already means the file changed
+	var targets []uploadTarget
+	replaced := make(map[string]bool)
+	for _, rel := range rels {
+		if tooLargeOrSmall[rel] {
+			continue
+		}
+		localPath := filepath.Join(plan.localDir, filepath.FromSlash(rel))
+		item, exists := remoteFiles[rel]
+		delete(remoteFiles, rel)
+
+		if exists {
+			same, err := sameContent(localPath, &item)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to hash '%s': %v", rel, err)
+			}
+			if same {
+				plan.unchanged++
+				continue
+			}
+		}
+
+		action := "New:     "
+		if exists {
+			action = "Changed: "
+			replaced[rel] = true
+		}
+		fmt.Printf("%s%s\n", action, rel)
+		targets = append(targets, uploadTarget{name: rel, localPath: localPath, remotePath: remoteJoin(plan.remoteDir, rel)})
+	}
+
+	if plan.deleteExtra {
+		var extra []string
+		for rel := range remoteFiles {
+			extra = append(extra, rel)
+		}
+		sort.Strings(extra)
+		for _, rel := range extra {
+			fmt.Printf("Extra:   %s\n", rel)
+		}
+		plan.extra = append(plan.extra, extra...)
+	}
+	return targets, replaced, nil
+}
+
+// syncRun makes the changes of a sync: it uploads new and changed files, a batch at a time, and
+// deletes extra remote files once everything is uploaded. A transactional run records each change
+// in its journal, which is started with the first change.
+type syncRun struct {
+	client     *azure.AzureClient
+	httpClient *http.Client
+	opts       uploadOptions
+	remote     string
+	remoteDir  string
+	stateDir   string
+	backupDir  string // Where a transactional run moves replaced and deleted files; "" for other runs
+	journal    *syncJournal
+	folders    map[string]bool // Remote folders known to exist
+	started    bool
+	exitCode   int
+}
+
+// begin prepares the first change of the run
+func (run *syncRun) begin() int {
+	if run.started {
+		return exitOK
+	}
+	run.started = true
+
+	// Ctrl+C stops the upload and cleans up its session instead of killing the process mid-transfer
+	gracefulShutdown.Store(true)
+
+	if run.backupDir != "" {
+		journal, err := newSyncJournal(run.stateDir, run.remote, run.remoteDir, run.backupDir)
+		if err != nil {
+			fmt.Println("Error: failed to start the sync journal:", err)
+			return exitFailure
+		}
+		run.journal = journal
+		fmt.Printf("Transactional sync %s; undo it with 'ksau-go sync -rollback %s'\n", journal.RunID, journal.RunID)
+	}
+	return exitOK
+}
+
+// upload uploads a batch of files, replaced telling which of them replace a remote file, and
+// returns the batch's exit code, which also becomes the run's if it failed
+func (run *syncRun) upload(targets []uploadTarget, replaced map[string]bool) int {
+	code := run.begin()
+	if code == exitOK {
+		code = run.uploadBatch(targets, replaced)
+	}
+	if code != exitOK {
+		run.exitCode = code
+	}
+	return code
+}
+
+func (run *syncRun) uploadBatch(targets []uploadTarget, replaced map[string]bool) int {
+	// Create the folders of the files to upload; the rest of the tree already exists
+	for _, target := range targets {
+		folder := azure.NewRemotePath(target.remotePath).Dir().String()
+		if run.folders[folder] {
+			continue
+		}
+		run.folders[folder] = true
+		if _, err := run.client.EnsureFolder(run.httpClient, folder); err != nil {
+			printError(fmt.Sprintf("Failed to create remote folder '%s'", folder), err)
+			return exitCodeFor(err)
+		}
+	}
+
+	// Replaced files are moved aside before their new version is uploaded
+	if run.journal != nil {
+		for _, target := range targets {
+			var err error
+			if !replaced[target.name] {
+				err = run.journal.record(syncChange{Action: syncActionUpload, Path: target.remotePath})
+			} else {
+				err = run.journal.backup(run.client, run.httpClient, syncActionOverwrite, target.name, target.remotePath)
+			}
+			if err != nil {
+				printError(fmt.Sprintf("Failed to back up '%s'", target.remotePath), err)
+				run.journal.restoreFailed(run.client, run.httpClient)
+				return exitCodeFor(err)
+			}
+		}
+	}
+
+	summary, code := uploadFiles(run.client, run.httpClient, run.opts, targets)
+	summary.print()
+	if code != exitOK && run.journal != nil {
+		run.journal.restoreFailed(run.client, run.httpClient)
+	}
+	return code
+}
+
+// finish deletes the extra remote files, unless an upload failed or was interrupted, so a partial
+// sync never loses files, and returns the run's exit code
+func (run *syncRun) finish(extra []string) int {
+	if run.exitCode != exitOK {
+		if run.journal != nil {
+			fmt.Printf("Undo the files that were uploaded with 'ksau-go sync -rollback %s'\n", run.journal.RunID)
+		}
+		return run.exitCode
+	}
+	if len(extra) > 0 {
+		if code := run.begin(); code != exitOK {
+			return code
+		}
+	}
+
+	deleted := 0
+	for _, rel := range extra {
+		remotePath := remoteJoin(run.remoteDir, rel)
+		var err error
+		if run.journal != nil {
+			err = run.journal.backup(run.client, run.httpClient, syncActionDelete, rel, remotePath)
+		} else {
+			err = run.client.Delete(run.httpClient, remotePath)
+		}
+		if err != nil {
+			printError(fmt.Sprintf("Failed to delete '%s'", remotePath), err)
+			run.exitCode = exitCodeFor(err)
+			continue
+		}
+		deleted++
+	}
+	switch {
+	case len(extra) > 0 && run.journal != nil:
+		fmt.Printf("Moved %d/%d extra remote files to %s\n", deleted, len(extra), run.journal.BackupDir)
+	case len(extra) > 0:
+		fmt.Printf("Moved %d/%d extra remote files to the recycle bin\n", deleted, len(extra))
+	}
+
+	if run.journal != nil {
+		run.journal.Finished = time.Now()
+		if err := run.journal.save(); err != nil {
+			fmt.Printf("%sWarning: failed to save %s: %v%s\n", ColorYellow, run.journal.path, err, ColorReset)
+		}
+	}
+	return run.exitCode
+}
+
+// sameContent reports whether a local file has the same size and QuickXorHash as a remote file
+func sameContent(localPath string, item *azure.DriveItem) (bool, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return false, err
+	}
+	if item.File == nil || item.File.Hashes.QuickXorHash == "" || info.Size() != item.Size {
+		return false, nil
+	}
+
+	localHash, err := QuickXorHash(localPath)
+	if err != nil {
+		return false, err
+	}
+	return localHash == item.File.Hashes.QuickXorHash, nil
+}
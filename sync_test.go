@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// remoteFile returns a listed remote file with content's size and hash
+func remoteFile(t *testing.T, content string) azure.DriveItem {
+	t.Helper()
+	item := azure.DriveItem{Size: int64(len(content)), File: &azure.FileFacet{}}
+	item.File.Hashes.QuickXorHash = hashOf(t, content)
+	return item
+}
+
+func TestSyncPlanDeletes(t *testing.T) {
+	tests := []struct {
+		name         string
+		deleteExtra  bool
+		filter       *fileFilter
+		ignores      *ignoreList
+		backupRel    string
+		wantTargets  []string
+		wantReplaced map[string]bool
+		wantExtra    []string
+	}{
+		{
+			name:         "without -delete",
+			wantTargets:  []string{"changed.txt", "new.txt"},
+			wantReplaced: map[string]bool{"changed.txt": true},
+		},
+		{
+			name:         "with -delete",
+			deleteExtra:  true,
+			wantTargets:  []string{"changed.txt", "new.txt"},
+			wantReplaced: map[string]bool{"changed.txt": true},
+			wantExtra:    []string{".ksau-backup/run/old.txt", "big.bin", "cache.tmp", "debug.log", "old.txt", "sub/old.txt"},
+		},
+		{
+			name:         "excluded, ignored and backed up files are kept",
+			deleteExtra:  true,
+			filter:       &fileFilter{exclude: []string{"*.tmp"}, maxSize: 1000},
+			ignores:      &ignoreList{rules: []ignoreRule{{pattern: "*.log"}}},
+			backupRel:    ".ksau-backup",
+			wantTargets:  []string{"changed.txt", "new.txt"},
+			wantReplaced: map[string]bool{"changed.txt": true},
+			wantExtra:    []string{"old.txt", "sub/old.txt"},
+		},
+		{
+			name:         "an excluded local file is neither uploaded nor deleted",
+			deleteExtra:  true,
+			filter:       &fileFilter{exclude: []string{"changed.txt", "*.tmp", "*.log", "big.bin"}},
+			backupRel:    ".ksau-backup",
+			wantTargets:  []string{"new.txt"},
+			wantReplaced: map[string]bool{},
+			wantExtra:    []string{"old.txt", "sub/old.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localDir := t.TempDir()
+			localFiles := map[string]string{"same.txt": "same", "changed.txt": "local", "new.txt": "new"}
+			localSizes := make(map[string]int64)
+			var rels []string
+			for _, rel := range []string{"changed.txt", "new.txt", "same.txt"} {
+				if !tt.filter.includes(rel) {
+					continue
+				}
+				writeTestFile(t, localDir, rel, localFiles[rel], time.Now())
+				localSizes[rel] = int64(len(localFiles[rel]))
+				rels = append(rels, rel)
+			}
+
+			big := remoteFile(t, "big")
+			big.Size = 1 << 20
+			remoteFiles := map[string]azure.DriveItem{
+				"same.txt":                 remoteFile(t, "same"),
+				"changed.txt":              remoteFile(t, "remote"),
+				"old.txt":                  remoteFile(t, "old"),
+				"sub/old.txt":              remoteFile(t, "old"),
+				"cache.tmp":                remoteFile(t, "cache"),
+				"debug.log":                remoteFile(t, "log"),
+				"big.bin":                  big,
+				".ksau-backup/run/old.txt": remoteFile(t, "backup"),
+			}
+
+			plan := &syncPlan{
+				localDir:    localDir,
+				remoteDir:   "/Backups",
+				filter:      tt.filter,
+				ignores:     tt.ignores,
+				backupRel:   tt.backupRel,
+				localSizes:  localSizes,
+				deleteExtra: tt.deleteExtra,
+			}
+			plan.removeExcluded(remoteFiles)
+			targets, replaced, err := plan.compare(rels, remoteFiles)
+			if err != nil {
+				t.Fatalf("compare() error = %v", err)
+			}
+
+			var names []string
+			for _, target := range targets {
+				names = append(names, target.name)
+			}
+			if !reflect.DeepEqual(names, tt.wantTargets) {
+				t.Errorf("targets = %v, want %v", names, tt.wantTargets)
+			}
+			if !reflect.DeepEqual(replaced, tt.wantReplaced) {
+				t.Errorf("replaced = %v, want %v", replaced, tt.wantReplaced)
+			}
+			if !reflect.DeepEqual(plan.extra, tt.wantExtra) {
+				t.Errorf("extra = %v, want %v", plan.extra, tt.wantExtra)
+			}
+			if tt.filter.includes("same.txt") && plan.unchanged != 1 {
+				t.Errorf("unchanged = %d, want 1", plan.unchanged)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// Actions recorded in a sync journal
+const (
+	syncActionUpload    = "upload"    // A new file was uploaded
+	syncActionOverwrite = "overwrite" // A changed file was uploaded; the file it replaced was moved to Backup
+	syncActionDelete    = "delete"    // An extra file was moved to Backup instead of the recycle bin
+)
+
+// syncJournal records the changes of a transactional sync run, so that sync -rollback can undo them.
+// It is saved after every change, so a run that fails or is interrupted can be undone too.
+type syncJournal struct {
+	RunID      string       `json:"run_id"`
+	Remote     string       `json:"remote"`
+	RemoteDir  string       `json:"remote_dir"`
+	BackupDir  string       `json:"backup_dir"` // Remote folder the run moved replaced and deleted files into
+	Started    time.Time    `json:"started"`
+	Finished   time.Time    `json:"finished"`
+	RolledBack time.Time    `json:"rolled_back"`
+	Changes    []syncChange `json:"changes"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// syncChange is a change of a transactional sync run
+type syncChange struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`             // Remote path of the uploaded or deleted file
+	Backup string `json:"backup,omitempty"` // Remote path the replaced or deleted file was moved to
+}
+
+// syncRunsDir returns the directory the journals of transactional syncs are kept in
+func syncRunsDir(stateDir string) string {
+	return filepath.Join(stateDir, "sync-runs")
+}
+
+// newSyncJournal starts the journal of a transactional sync of remoteDir, whose backups go into a
+// folder named after the run inside backupDir
+func newSyncJournal(stateDir, remote, remoteDir, backupDir string) (*syncJournal, error) {
+	started := time.Now()
+	runID := started.Format("2006-01-02_150405")
+	path := filepath.Join(syncRunsDir(stateDir), runID+".json")
+	for i := 2; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		runID = fmt.Sprintf("%s-%d", started.Format("2006-01-02_150405"), i)
+		path = filepath.Join(syncRunsDir(stateDir), runID+".json")
+	}
+
+	journal := &syncJournal{
+		RunID:     runID,
+		Remote:    remote,
+		RemoteDir: remoteDir,
+		BackupDir: remoteJoin(backupDir, runID),
+		Started:   started,
+		Changes:   []syncChange{},
+		path:      path,
+	}
+	return journal, journal.save()
+}
+
+// loadSyncJournal reads the journal of the run runID, or with "last", of the latest run that hasn't
+// been rolled back
+func loadSyncJournal(stateDir, runID string) (*syncJournal, error) {
+	if runID == "last" {
+		journals, err := listSyncJournals(stateDir)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(journals) - 1; i >= 0; i-- {
+			if journals[i].RolledBack.IsZero() {
+				return journals[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no transactional sync to roll back in %s", syncRunsDir(stateDir))
+	}
+
+	path := filepath.Join(syncRunsDir(stateDir), filepath.Base(runID)+".json")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no transactional sync '%s' in %s", runID, syncRunsDir(stateDir))
+	}
+	if err != nil {
+		return nil, err
+	}
+	journal := &syncJournal{path: path}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return journal, nil
+}
+
+// listSyncJournals reads the journals of all transactional sync runs, oldest first
+func listSyncJournals(stateDir string) ([]*syncJournal, error) {
+	entries, err := os.ReadDir(syncRunsDir(stateDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var runIDs []string
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			runIDs = append(runIDs, id)
+		}
+	}
+	sort.Strings(runIDs)
+
+	var journals []*syncJournal
+	for _, id := range runIDs {
+		journal, err := loadSyncJournal(stateDir, id)
+		if err != nil {
+			return nil, err
+		}
+		journals = append(journals, journal)
+	}
+	return journals, nil
+}
+
+// record adds a change to the journal and saves it
+func (journal *syncJournal) record(change syncChange) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	journal.Changes = append(journal.Changes, change)
+	return journal.saveLocked()
+}
+
+// save writes the journal atomically, so an interrupted run can't leave a truncated one behind
+func (journal *syncJournal) save() error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	return journal.saveLocked()
+}
+
+func (journal *syncJournal) saveLocked() error {
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(journal.path), 0o700); err != nil {
+		return err
+	}
+	tmpPath := journal.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, journal.path)
+}
+
+// backup moves the remote file at remotePath, which is rel inside the synced folder, into the run's
+// backup folder and records why
+func (journal *syncJournal) backup(client *azure.AzureClient, httpClient *http.Client, action, rel, remotePath string) error {
+	backupPath := azure.JoinRemotePath(journal.BackupDir, rel)
+	if _, err := client.EnsureFolder(httpClient, backupPath.Dir().String()); err != nil {
+		return err
+	}
+	if _, err := client.Move(httpClient, remotePath, backupPath.Dir().String(), backupPath.Base()); err != nil {
+		return err
+	}
+	if err := journal.record(syncChange{Action: action, Path: remotePath, Backup: backupPath.String()}); err != nil {
+		return fmt.Errorf("moved '%s' to '%s' but failed to record it: %v", remotePath, backupPath, err)
+	}
+	return nil
+}
+
+// restoreFailed moves the backups of replaced files back where the upload replacing them didn't
+// arrive, so a failed run doesn't leave them missing. The restored files are dropped from the journal.
+func (journal *syncJournal) restoreFailed(client *azure.AzureClient, httpClient *http.Client) {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	changes := journal.Changes[:0]
+	for _, change := range journal.Changes {
+		if change.Action == syncActionOverwrite {
+			_, err := client.GetItem(httpClient, change.Path)
+			if isNotFound(err) {
+				err = restoreBackup(client, httpClient, change)
+				if err == nil {
+					continue
+				}
+			}
+			if err != nil {
+				printError(fmt.Sprintf("Failed to restore '%s' from '%s'", change.Path, change.Backup), err)
+			}
+		}
+		changes = append(changes, change)
+	}
+	journal.Changes = changes
+	if err := journal.saveLocked(); err != nil {
+		fmt.Printf("%sWarning: failed to save %s: %v%s\n", ColorYellow, journal.path, err, ColorReset)
+	}
+}
+
+// restoreBackup moves the backup of a change back to the path it was moved away from
+func restoreBackup(client *azure.AzureClient, httpClient *http.Client, change syncChange) error {
+	target := azure.NewRemotePath(change.Path)
+	if _, err := client.EnsureFolder(httpClient, target.Dir().String()); err != nil {
+		return err
+	}
+	_, err := client.Move(httpClient, change.Backup, target.Dir().String(), target.Base())
+	return err
+}
+
+// rollbackSync undoes the transactional sync run runID, or the latest one with "last": files it
+// uploaded are moved to the recycle bin and the files it replaced or deleted are moved back from the
+// backup folder, last change first. A rollback that fails part way can be run again.
+func rollbackSync(stateDir, runID string, dryRun bool) int {
+	journal, err := loadSyncJournal(stateDir, runID)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitNotFound
+	}
+	if !journal.RolledBack.IsZero() {
+		fmt.Printf("Error: sync %s was already rolled back at %s\n", journal.RunID, journal.RolledBack.Format("2006-01-02 15:04:05"))
+		return exitUsage
+	}
+	fmt.Printf("Rolling back sync %s of %s:%s (%d changes)\n", journal.RunID, journal.Remote, journal.RemoteDir, len(journal.Changes))
+	if journal.Finished.IsZero() {
+		fmt.Printf("%sThe run didn't finish; only the changes it recorded are undone.%s\n", ColorYellow, ColorReset)
+	}
+
+	configData, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	client, err := newClient(configData, journal.Remote, stateDir)
+	if err != nil {
+		fmt.Println("Failed to initialize client:", err)
+		return exitFailure
+	}
+
+	// Ctrl+C stops between changes, and the rollback can be run again to finish
+	gracefulShutdown.Store(true)
+	return journal.rollback(client, &http.Client{}, dryRun)
+}
+
+// rollback undoes the changes of the journal, last change first, and marks it rolled back once all
+// of them are undone
+func (journal *syncJournal) rollback(client *azure.AzureClient, httpClient *http.Client, dryRun bool) int {
+	exitCode := exitOK
+	undone := 0
+	for i := len(journal.Changes) - 1; i >= 0; i-- {
+		if interrupted.Err() != nil {
+			fmt.Printf("%sRollback interrupted; run it again to finish.%s\n", ColorYellow, ColorReset)
+			return exitInterrupted
+		}
+		change := journal.Changes[i]
+		switch change.Action {
+		case syncActionUpload:
+			fmt.Printf("Remove:  %s\n", change.Path)
+		case syncActionOverwrite, syncActionDelete:
+			fmt.Printf("Restore: %s\n", change.Path)
+		}
+		if dryRun {
+			continue
+		}
+		if err := undoSyncChange(client, httpClient, change); err != nil {
+			printError(fmt.Sprintf("Failed to undo the %s of '%s'", change.Action, change.Path), err)
+			exitCode = exitCodeFor(err)
+			continue
+		}
+		undone++
+	}
+	if dryRun {
+		return exitOK
+	}
+
+	fmt.Printf("Undid %d/%d changes\n", undone, len(journal.Changes))
+	if exitCode != exitOK {
+		fmt.Printf("%sRun 'ksau-go sync -rollback %s' again to retry the rest.%s\n", ColorYellow, journal.RunID, ColorReset)
+		return exitCode
+	}
+
+	// The backup folder is empty now
+	if err := client.Delete(httpClient, journal.BackupDir); err != nil && !isNotFound(err) {
+		fmt.Printf("%sWarning: failed to remove backup folder '%s': %v%s\n", ColorYellow, journal.BackupDir, err, ColorReset)
+	}
+	journal.RolledBack = time.Now()
+	if err := journal.save(); err != nil {
+		fmt.Printf("%sWarning: failed to save %s: %v%s\n", ColorYellow, journal.path, err, ColorReset)
+	}
+	fmt.Printf("%sRolled back sync %s.%s\n", ColorGreen, journal.RunID, ColorReset)
+	return exitOK
+}
+
+// undoSyncChange undoes one change of a transactional sync; changes that were already undone are
+// left alone, so a rollback can be retried
+func undoSyncChange(client *azure.AzureClient, httpClient *http.Client, change syncChange) error {
+	if change.Action != syncActionUpload {
+		// A backup that is gone was already moved back by an earlier attempt
+		if _, err := client.GetItem(httpClient, change.Backup); isNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if change.Action != syncActionDelete {
+		if err := client.Delete(httpClient, change.Path); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	if change.Action == syncActionUpload {
+		return nil
+	}
+	return restoreBackup(client, httpClient, change)
+}
+
+// isNotFound reports whether err is Graph reporting that an item doesn't exist
+func isNotFound(err error) bool {
+	graphErr, ok := azure.AsGraphError(err)
+	return ok && graphErr.StatusCode == http.StatusNotFound
+}
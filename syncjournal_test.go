@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// fakeDrive serves the Graph requests of a rollback: looking up, deleting and moving items by path
+// and creating folders. It logs every request that changes the drive and fails those listed in fail.
+type fakeDrive struct {
+	server  *httptest.Server
+	mu      sync.Mutex
+	folders map[string]bool   // Folder paths without a leading slash; the root is implied
+	files   map[string]string // File path -> content
+	fail    map[string]bool   // "METHOD path" of requests to answer with 403
+	log     []string
+}
+
+func newFakeDrive(t *testing.T, folders []string, files map[string]string) *fakeDrive {
+	d := &fakeDrive{folders: make(map[string]bool), files: files, fail: make(map[string]bool)}
+	for _, folder := range folders {
+		d.folders[folder] = true
+	}
+	d.server = httptest.NewServer(d)
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+// client returns a client with a valid token and an HTTP client that sends Graph requests to d
+func (d *fakeDrive) client() (*azure.AzureClient, *http.Client) {
+	target, _ := url.Parse(d.server.URL)
+	httpClient := &http.Client{Transport: rewriteHost{target: target}}
+	return &azure.AzureClient{AccessToken: "token", Expiration: time.Now().Add(time.Hour)}, httpClient
+}
+
+// rewriteHost sends every request to the fake server, whatever host it was for
+type rewriteHost struct {
+	target *url.URL
+}
+
+func (r rewriteHost) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme, req.URL.Host = r.target.Scheme, r.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (d *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v1.0/me/drive/root:")
+	if !ok {
+		d.respond(w, http.StatusBadRequest, "invalidRequest", "unexpected "+r.URL.Path)
+		return
+	}
+	itemPath, children := strings.CutSuffix(strings.TrimPrefix(rest, "/"), ":/children")
+	if r.Method != http.MethodGet {
+		d.log = append(d.log, r.Method+" "+itemPath)
+		if d.fail[r.Method+" "+itemPath] {
+			d.respond(w, http.StatusForbidden, "accessDenied", "Access denied.")
+			return
+		}
+	}
+	_, isFile := d.files[itemPath]
+	if !isFile && !d.folders[itemPath] {
+		d.respond(w, http.StatusNotFound, "itemNotFound", "The resource could not be found.")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet:
+		item := map[string]any{"id": itemPath, "name": path.Base(itemPath)}
+		if !isFile {
+			item["folder"] = map[string]any{}
+		}
+		json.NewEncoder(w).Encode(item)
+	case r.Method == http.MethodDelete:
+		for name := range d.files {
+			if name == itemPath || strings.HasPrefix(name, itemPath+"/") {
+				delete(d.files, name)
+			}
+		}
+		for name := range d.folders {
+			if name == itemPath || strings.HasPrefix(name, itemPath+"/") {
+				delete(d.folders, name)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPatch && isFile:
+		var body struct {
+			ParentReference struct {
+				ID string `json:"id"`
+			} `json:"parentReference"`
+			Name string `json:"name"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		dest := body.ParentReference.ID + "/" + body.Name
+		if _, exists := d.files[dest]; exists {
+			d.respond(w, http.StatusConflict, "nameAlreadyExists", "The specified item name already exists.")
+			return
+		}
+		d.files[dest] = d.files[itemPath]
+		delete(d.files, itemPath)
+		d.log[len(d.log)-1] += " -> " + dest
+		json.NewEncoder(w).Encode(map[string]any{"id": dest, "name": body.Name})
+	case r.Method == http.MethodPost && children:
+		var body struct {
+			Name string `json:"name"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		d.folders[itemPath+"/"+body.Name] = true
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"id": itemPath + "/" + body.Name, "name": body.Name, "folder": map[string]any{}})
+	default:
+		d.respond(w, http.StatusBadRequest, "invalidRequest", "unexpected "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (d *fakeDrive) respond(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": code, "message": message}})
+}
+
+// newRollbackFixture records a transactional run of Sync that replaced a.txt, uploaded new.txt,
+// deleted sub/old.txt and uploaded sub/newer.txt, in that order, and returns its journal and a
+// drive in the state the run left behind
+func newRollbackFixture(t *testing.T) (string, *syncJournal, *fakeDrive) {
+	stateDir := t.TempDir()
+	journal, err := newSyncJournal(stateDir, "oned", "Sync", "Backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := journal.BackupDir
+	for _, change := range []syncChange{
+		{Action: syncActionOverwrite, Path: "Sync/a.txt", Backup: backup + "/a.txt"},
+		{Action: syncActionUpload, Path: "Sync/new.txt"},
+		{Action: syncActionDelete, Path: "Sync/sub/old.txt", Backup: backup + "/sub/old.txt"},
+		{Action: syncActionUpload, Path: "Sync/sub/newer.txt"},
+	} {
+		if err := journal.record(change); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.Finished = time.Now()
+	if err := journal.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	drive := newFakeDrive(t,
+		[]string{"Sync", "Sync/sub", "Backups", backup, backup + "/sub"},
+		map[string]string{
+			"Sync/a.txt":            "new a",
+			backup + "/a.txt":       "old a",
+			"Sync/new.txt":          "new",
+			backup + "/sub/old.txt": "old",
+			"Sync/sub/newer.txt":    "newer",
+		})
+	return stateDir, journal, drive
+}
+
+// checkRolledBack checks that the drive is back to its state before the run and the journal on
+// disk is marked rolled back
+func checkRolledBack(t *testing.T, stateDir string, journal *syncJournal, drive *fakeDrive) {
+	t.Helper()
+	want := map[string]string{"Sync/a.txt": "old a", "Sync/sub/old.txt": "old"}
+	if !reflect.DeepEqual(drive.files, want) {
+		t.Errorf("files = %v, want %v", drive.files, want)
+	}
+	if drive.folders[journal.BackupDir] {
+		t.Errorf("backup folder %s wasn't removed", journal.BackupDir)
+	}
+	saved, err := loadSyncJournal(stateDir, journal.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.RolledBack.IsZero() {
+		t.Error("journal isn't marked rolled back")
+	}
+}
+
+func TestRollbackUndoesLastChangeFirst(t *testing.T) {
+	stateDir, journal, drive := newRollbackFixture(t)
+	client, httpClient := drive.client()
+
+	if code := journal.rollback(client, httpClient, false); code != exitOK {
+		t.Fatalf("rollback() = %d, want %d", code, exitOK)
+	}
+	backup := journal.BackupDir
+	want := []string{
+		"DELETE Sync/sub/newer.txt",
+		fmt.Sprintf("PATCH %s/sub/old.txt -> Sync/sub/old.txt", backup),
+		"DELETE Sync/new.txt",
+		"DELETE Sync/a.txt",
+		fmt.Sprintf("PATCH %s/a.txt -> Sync/a.txt", backup),
+		"DELETE " + backup,
+	}
+	if !reflect.DeepEqual(drive.log, want) {
+		t.Errorf("requests =\n%s\nwant\n%s", strings.Join(drive.log, "\n"), strings.Join(want, "\n"))
+	}
+	checkRolledBack(t, stateDir, journal, drive)
+}
+
+func TestRollbackDryRunChangesNothing(t *testing.T) {
+	_, journal, drive := newRollbackFixture(t)
+	client, httpClient := drive.client()
+
+	if code := journal.rollback(client, httpClient, true); code != exitOK {
+		t.Fatalf("rollback() = %d, want %d", code, exitOK)
+	}
+	if len(drive.log) != 0 {
+		t.Errorf("dry run sent %v", drive.log)
+	}
+	if !journal.RolledBack.IsZero() {
+		t.Error("dry run marked the journal rolled back")
+	}
+}
+
+func TestRollbackResumesAfterFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		fail       string // Request of the first attempt that fails
+		wantResume []string
+	}{
+		{
+			// The replacing upload is already gone when the backup can't be moved back
+			name: "restore of a replaced file fails",
+			fail: "PATCH {backup}/a.txt",
+			wantResume: []string{
+				"DELETE Sync/sub/newer.txt",
+				"DELETE Sync/new.txt",
+				"DELETE Sync/a.txt",
+				"PATCH {backup}/a.txt -> Sync/a.txt",
+				"DELETE {backup}",
+			},
+		},
+		{
+			name: "removal of an upload fails",
+			fail: "DELETE Sync/new.txt",
+			wantResume: []string{
+				"DELETE Sync/sub/newer.txt",
+				"DELETE Sync/new.txt",
+				"DELETE {backup}",
+			},
+		},
+		{
+			name: "restore of a deleted file fails",
+			fail: "PATCH {backup}/sub/old.txt",
+			wantResume: []string{
+				"DELETE Sync/sub/newer.txt",
+				"PATCH {backup}/sub/old.txt -> Sync/sub/old.txt",
+				"DELETE Sync/new.txt",
+				"DELETE {backup}",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateDir, journal, drive := newRollbackFixture(t)
+			client, httpClient := drive.client()
+			expand := func(s string) string { return strings.ReplaceAll(s, "{backup}", journal.BackupDir) }
+
+			// The other changes are still undone; the journal isn't marked and the backups are kept
+			drive.fail[expand(tt.fail)] = true
+			if code := journal.rollback(client, httpClient, false); code == exitOK {
+				t.Fatal("rollback() succeeded despite a failed request")
+			}
+			if !journal.RolledBack.IsZero() {
+				t.Error("partial rollback marked the journal rolled back")
+			}
+			if !drive.folders[journal.BackupDir] {
+				t.Error("partial rollback removed the backup folder")
+			}
+
+			// Running it again from the saved journal finishes without undoing anything twice
+			delete(drive.fail, expand(tt.fail))
+			drive.log = nil
+			resumed, err := loadSyncJournal(stateDir, journal.RunID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code := resumed.rollback(client, httpClient, false); code != exitOK {
+				t.Fatalf("resumed rollback() = %d, want %d", code, exitOK)
+			}
+			var want []string
+			for _, request := range tt.wantResume {
+				want = append(want, expand(request))
+			}
+			if !reflect.DeepEqual(drive.log, want) {
+				t.Errorf("resumed requests =\n%s\nwant\n%s", strings.Join(drive.log, "\n"), strings.Join(want, "\n"))
+			}
+			checkRolledBack(t, stateDir, resumed, drive)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// remotePrefetcher lists the remote folders of a sync in the background, so the listings of the
+// next folders are ready by the time the current one has transferred. At most limit folders are
+// listed at once, which keeps the prefetch from competing with the uploads for Graph's rate limits.
+type remotePrefetcher struct {
+	client     *azure.AzureClient
+	httpClient *http.Client
+	remoteDir  string
+	slots      chan struct{}
+
+	mu       sync.Mutex
+	listings map[string]*remoteListing
+}
+
+// remoteListing is the listing of a remote folder, complete once done is closed
+type remoteListing struct {
+	done  chan struct{}
+	items []azure.DriveItem
+	err   error
+}
+
+// newRemotePrefetcher lists folders inside remoteDir, limit at a time
+func newRemotePrefetcher(client *azure.AzureClient, httpClient *http.Client, remoteDir string, limit int) *remotePrefetcher {
+	return &remotePrefetcher{
+		client:     client,
+		httpClient: httpClient,
+		remoteDir:  remoteDir,
+		slots:      make(chan struct{}, max(limit, 1)),
+		listings:   make(map[string]*remoteListing),
+	}
+}
+
+// fetch starts listing the folder rel in the background unless it already is
+func (prefetcher *remotePrefetcher) fetch(rel string) *remoteListing {
+	prefetcher.mu.Lock()
+	defer prefetcher.mu.Unlock()
+	if listing, ok := prefetcher.listings[rel]; ok {
+		return listing
+	}
+
+	listing := &remoteListing{done: make(chan struct{})}
+	prefetcher.listings[rel] = listing
+	go func() {
+		defer close(listing.done)
+		prefetcher.slots <- struct{}{}
+		defer func() { <-prefetcher.slots }()
+		if listing.err = interrupted.Err(); listing.err != nil {
+			return
+		}
+
+		// A folder that doesn't exist remotely yet is simply empty
+		listing.items, listing.err = prefetcher.client.ListChildren(prefetcher.httpClient, remoteJoin(prefetcher.remoteDir, rel))
+		if isNotFound(listing.err) {
+			listing.items, listing.err = nil, nil
+		}
+	}()
+	return listing
+}
+
+// wait returns the listing of the folder rel, listing it now if it wasn't prefetched, and forgets it
+func (prefetcher *remotePrefetcher) wait(rel string) ([]azure.DriveItem, error) {
+	listing := prefetcher.fetch(rel)
+	<-listing.done
+
+	prefetcher.mu.Lock()
+	delete(prefetcher.listings, rel)
+	prefetcher.mu.Unlock()
+	return listing.items, listing.err
+}
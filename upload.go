@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// errFileUnstable is returned for files modified within -stable-for, which are skipped since they may still be being written
+var errFileUnstable = errors.New("file is still being modified")
+
+// uploadOptions holds the settings shared by every file uploaded in a run
+type uploadOptions struct {
+	remoteConfig   string
+	chunkSize      int64
+	parallelChunks int
+	retryPolicy    azure.RetryPolicy
+	skipHash       bool
+	hashRetries    int
+	hashRetryDelay time.Duration
+	cas            *casStore
+	dedup          *dedupIndex
+	filter         *fileFilter
+	stateDir       string
+	resume         bool
+	minSpeed       int64
+	minSpeedWindow time.Duration
+	shareType      string
+	shareScope     string
+	stableFor      time.Duration
+	skipExisting   bool                   // Skip files whose remote copy already has the same size and QuickXorHash
+	dryRun         bool                   // Only print what would be uploaded and created, without changing the remote
+	sessionPool    int                    // Upload sessions to create ahead of time in batch uploads (0 disables)
+	transfers      int                    // Files uploaded at the same time in a batch
+	conflict       azure.ConflictBehavior // What to do with existing remote files: azure.ConflictRename, ConflictReplace or ConflictFail
+	uploadURL      string                 // Upload session created ahead of time for the current file
+	reader         io.Reader              // Content of the current file to send instead of opening it, e.g. shared by -mirror uploads; such uploads can't be resumed
+	size           int64                  // Size of reader's content when there is no local file, e.g. for uploads from the web UI
+	label          string                 // Names the file in progress lines when several upload at once (default: its base name)
+	progress       azure.ProgressFunc     // Also receives the progress of the current file, e.g. to report it to a serve grpc client
+	bandwidth      azure.BandwidthFunc    // Limits each file's upload on its own, e.g. to a serve grpc upload's bwlimit (nil for none)
+	maxChunkSize   int64                  // Largest chunk size a server mode allows, which dynamically selected sizes are capped to (0 for none)
+	sanitize       bool                   // Replace the characters OneDrive doesn't allow in the remote names of directory uploads
+	shift          *remoteShifter         // Sends the files of batch uploads to other remotes while this one is throttled (nil for none)
+}
+
+// uploadResult describes a successfully uploaded file
+type uploadResult struct {
+	fileID       string
+	size         int64
+	quickXorHash string // Empty if the hash wasn't computed, e.g. with -skip-hash
+	downloadURL  string
+	shareURL     string
+	unchanged    bool // The remote file was already identical, so nothing was uploaded
+}
+
+// uploadFile uploads a single local file to remoteFilePath (a full path on the drive),
+// prints its download URL and verifies its QuickXorHash unless disabled
+func uploadFile(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, localPath, remoteFilePath string) (*uploadResult, error) {
+	// Get file info; content that doesn't come from a local file keeps OneDrive's timestamps
+	fileSize := opts.size
+	var fileSystemInfo *azure.FileSystemInfo
+	if localPath != "" {
+		fileInfo, err := os.Stat(localPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file info: %v", err)
+		}
+		fileSize = fileInfo.Size()
+		fileSystemInfo = localFileSystemInfo(fileInfo)
+	}
+
+	if opts.dryRun {
+		fmt.Printf("Would upload %s (%s) to %s\n", localPath, formatBytes(fileSize), remoteFilePath)
+		return &uploadResult{size: fileSize}, nil
+	}
+
+	// A daemon job's own settings replace the flags, within the daemon's maximums
+	runningJobLimits.applyTo(&opts, runningMaxLimits)
+
+	// Dynamically select chunk size if not specified by the user
+	chunkSize := opts.chunkSize
+	if chunkSize == 0 {
+		chunkSize = getChunkSize(fileSize)
+		if opts.maxChunkSize > 0 {
+			chunkSize = min(chunkSize, opts.maxChunkSize)
+		}
+		fmt.Printf("Selected chunk size: %d bytes (based on file size: %d bytes)\n", chunkSize, fileSize)
+	} else {
+		fmt.Printf("Using user-specified chunk size: %d bytes\n", chunkSize)
+	}
+
+	fullRemotePath := remoteFilePath
+	fmt.Printf("Full remote path: %s\n", fullRemotePath)
+
+	// Prepare upload parameters
+	params := azure.UploadParams{
+		FilePath:         localPath,
+		RemoteFilePath:   fullRemotePath,
+		ChunkSize:        chunkSize,
+		ParallelChunks:   opts.parallelChunks,
+		Retry:            opts.retryPolicy,
+		StateDir:         opts.stateDir,
+		Resume:           opts.resume,
+		MinSpeed:         opts.minSpeed,
+		MinSpeedWindow:   opts.minSpeedWindow,
+		UploadURL:        opts.uploadURL,
+		Context:          interrupted,
+		ConflictBehavior: opts.conflict,
+		FileSystemInfo:   fileSystemInfo,
+		Bandwidth:        opts.bandwidth,
+	}
+	if opts.reader != nil {
+		params.Reader = opts.reader
+		params.Size = fileSize
+	}
+
+	bar := newProgressBar()
+	if opts.transfers > 1 || opts.label != "" {
+		// Parallel files share the terminal, so each logs progress lines naming its file instead of redrawing one line
+		bar.isTTY = false
+		bar.label = opts.label
+		if bar.label == "" {
+			bar.label = filepath.Base(localPath)
+		}
+	}
+	params.Progress = bar.update
+	if opts.progress != nil {
+		params.Progress = func(transferred, total int64) {
+			bar.update(transferred, total)
+			opts.progress(transferred, total)
+		}
+	}
+
+	// The local hash is computed from the chunks as they are sent, so the file isn't read a second time
+	var localHash string
+	if !opts.skipHash {
+		params.Hashed = func(hash string) { localHash = hash }
+	}
+
+	fileID, err := client.Upload(httpClient, params)
+	bar.finish()
+	if err != nil {
+		return nil, err
+	}
+	if fileID == "" {
+		return nil, errors.New("file upload failed")
+	}
+
+	fmt.Println("File uploaded successfully.")
+	result := &uploadResult{fileID: fileID, size: fileSize}
+
+	// Generate the download URL; roots outside the index still upload, they just have no URL
+	printDownloadURL(result, opts.remoteConfig, remoteFilePath)
+
+	// Skip hash verification if requested
+	if opts.skipHash {
+		fmt.Println("Skipping QuickXorHash verification.")
+		return result, nil
+	}
+
+	// Resumed uploads didn't send every byte in this run, so localHash is empty and the file itself is hashed
+	err = verifyFileHash(client, httpClient, localPath, fileID, hashCheck{localHash: localHash, retries: opts.hashRetries, retryDelay: opts.hashRetryDelay})
+	if err == nil {
+		result.quickXorHash = localHash
+	}
+	return result, err
+}
+
+// localFileSystemInfo returns the timestamps of a local file, for its uploaded copy to keep
+func localFileSystemInfo(info os.FileInfo) *azure.FileSystemInfo {
+	return &azure.FileSystemInfo{CreatedDateTime: fileCreationTime(info), LastModifiedDateTime: info.ModTime()}
+}
+
+// uploadEntry uploads a single file, storing it by content instead of by name when -cas is enabled
+// or skipping it if the -dedup index already has its content, and creates a sharing link for it when -share is set
+func uploadEntry(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, localPath, remoteFilePath string) (*uploadResult, error) {
+	// Skip files that were modified too recently to be complete
+	var before os.FileInfo
+	if opts.stableFor > 0 {
+		var err error
+		if before, err = os.Stat(localPath); err != nil {
+			return nil, fmt.Errorf("failed to get file info: %v", err)
+		}
+		if age := time.Since(before.ModTime()); age < opts.stableFor {
+			return nil, fmt.Errorf("%w: modified %s ago, less than -stable-for %s", errFileUnstable, age.Round(time.Second), opts.stableFor)
+		}
+	}
+
+	// Content-addressed paths are only known after hashing, and the CAS store skips known content itself
+	var result *uploadResult
+	var err error
+	if opts.skipExisting && opts.cas == nil {
+		if result, err = unchangedRemote(client, httpClient, opts, localPath, remoteFilePath); err != nil {
+			return nil, err
+		}
+	}
+	if result != nil {
+		// Already identical, nothing to upload
+	} else if opts.cas != nil {
+		result, err = opts.cas.upload(client, httpClient, opts, localPath, remoteFilePath)
+	} else if opts.dedup != nil {
+		result, err = opts.dedup.upload(client, httpClient, opts, localPath, remoteFilePath)
+	} else {
+		result, err = uploadFile(client, httpClient, opts, localPath, remoteFilePath)
+	}
+	if err == nil && before != nil {
+		// A write that started after the stability check makes the uploaded copy incomplete
+		if after, statErr := os.Stat(localPath); statErr != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+			err = fmt.Errorf("file changed while it was being uploaded; the uploaded copy may be incomplete")
+		}
+	}
+	if err == nil && result.downloadURL != "" {
+		if primeErr := primeIndexCache(opts.remoteConfig, result.downloadURL); primeErr != nil {
+			fmt.Printf("%sWarning: %v%s\n", ColorYellow, primeErr, ColorReset)
+		}
+	}
+	if err != nil || opts.dryRun {
+		if err == nil && opts.shareType != "" {
+			fmt.Printf("Would create a %s sharing link\n", opts.shareType)
+		}
+		return result, err
+	}
+
+	if opts.shareType != "" {
+		link, err := client.CreateLink(httpClient, result.fileID, opts.shareType, opts.shareScope)
+		if err != nil {
+			return result, fmt.Errorf("failed to create sharing link: %w", err)
+		}
+		result.shareURL = link.WebURL
+		fmt.Printf("%sSharing link (%s, %s):%s %s%s%s\n", ColorGreen, link.Type, link.Scope, ColorReset, ColorGreen, link.WebURL, ColorReset)
+	}
+
+	// Files skipped as identical weren't uploaded, so there is nothing new to report
+	if !result.unchanged {
+		if hookErr := notifyUploadWebhook(client, httpClient, opts.remoteConfig, remoteFilePath, result); hookErr != nil {
+			fmt.Printf("%sWarning: %v%s\n", ColorYellow, hookErr, ColorReset)
+		}
+	}
+	return result, nil
+}
+
+// unchangedRemote returns the remote file at remoteFilePath if it already has the same size and
+// QuickXorHash as the local file, so the upload can be skipped; otherwise it returns nil
+func unchangedRemote(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, localPath, remoteFilePath string) (*uploadResult, error) {
+	item, err := client.GetItem(httpClient, remoteFilePath)
+	if graphErr, ok := azure.AsGraphError(err); ok && graphErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up remote file: %w", err)
+	}
+	if item.IsFolder() {
+		return nil, nil
+	}
+
+	same, err := sameContent(localPath, item)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate local QuickXorHash: %v", err)
+	}
+	if !same {
+		return nil, nil
+	}
+
+	fmt.Printf("%sIdentical file already at %s, skipping upload.%s\n", ColorYellow, remoteFilePath, ColorReset)
+	result := &uploadResult{fileID: item.ID, size: item.Size, quickXorHash: item.File.Hashes.QuickXorHash, unchanged: true}
+	printDownloadURL(result, opts.remoteConfig, remoteFilePath)
+	return result, nil
+}
+
+// downloadURLFor builds the index download URL for a full drive path, from the remote's url_template
+// if it has one and otherwise by appending the path to its base URL; the index serves the remote's
+// default root folder, so paths outside it have no download URL
+func downloadURLFor(remoteConfig, remoteFilePath, fileID string) (string, error) {
+	configData, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+
+	baseURL, exists := remoteBaseURL(configData, remoteConfig)
+	urlTemplate, hasTemplate := remoteSetting(configData, remoteConfig, "url_template")
+	if !exists && !hasTemplate {
+		return "", fmt.Errorf("no base URL defined for remote-config '%s'", remoteConfig)
+	}
+
+	rootFolder := remoteRootFolder(configData, remoteConfig)
+	filePath := azure.NewRemotePath(remoteFilePath)
+	relPath, ok := filePath.Rel(azure.NewRemotePath(rootFolder))
+	if !ok {
+		return "", fmt.Errorf("'%s' is outside the indexed root folder of remote-config '%s'", remoteFilePath, remoteConfig)
+	}
+
+	if hasTemplate {
+		return executeURLTemplate(remoteConfig, urlTemplate, downloadURLData{
+			BaseURL:    baseURL,
+			Path:       relPath.String(),
+			FileName:   filePath.Base(),
+			FileID:     fileID,
+			RootFolder: rootFolder,
+			Remote:     remoteConfig,
+		})
+	}
+
+	// Encode the URL path
+	urlPath := strings.ReplaceAll(relPath.String(), " ", "%20")
+
+	return fmt.Sprintf("%s/%s", baseURL, urlPath), nil
+}
+
+// printDownloadURL records and prints the index download URL of an uploaded file, warning if it has none
+func printDownloadURL(result *uploadResult, remoteConfig, remoteFilePath string) {
+	downloadURL, err := downloadURLFor(remoteConfig, remoteFilePath, result.fileID)
+	if err != nil {
+		fmt.Printf("%sNo download URL: %v%s\n", ColorYellow, err, ColorReset)
+		return
+	}
+	result.downloadURL = downloadURL
+	fmt.Printf("%sDownload URL:%s %s%s%s\n", ColorGreen, ColorReset, ColorGreen, downloadURL, ColorReset)
+}
+
+// uploadDirectory walks localDir, recreates its folder structure under remoteDir and uploads every file
+func uploadDirectory(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, localDir, remoteDir string) int {
+	var dirs, files []string
+	_, err := walkLocal(localDir, opts.filter, func(rel string, d fs.DirEntry) error {
+		rel = filepath.FromSlash(rel)
+		if d.IsDir() {
+			dirs = append(dirs, rel)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if opts.filter.includesSize(info.Size()) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Failed to walk directory:", err)
+		return exitFailure
+	}
+
+	fmt.Printf("Found %d files in %d folders under %s\n", len(files), len(dirs), localDir)
+
+	// Names OneDrive doesn't allow are changed up front instead of failing each upload; two names
+	// that end up the same would overwrite or rename each other, so they stop the upload
+	remoteRels := make(map[string]string)
+	if opts.sanitize {
+		owners := make(map[string]string)
+		for _, rel := range slices.Concat(dirs, files) {
+			remoteRel := sanitizedPath(rel)
+			if other, exists := owners[strings.ToLower(remoteRel)]; exists {
+				fmt.Printf("Error: '%s' and '%s' would both be uploaded as '%s'\n", other, rel, remoteRel)
+				return exitUsage
+			}
+			owners[strings.ToLower(remoteRel)] = rel
+			remoteRels[rel] = remoteRel
+		}
+	}
+	remotePathOf := func(rel string) string {
+		if remoteRel, ok := remoteRels[rel]; ok {
+			return remoteJoin(remoteDir, remoteRel)
+		}
+		return remoteJoin(remoteDir, rel)
+	}
+
+	// Create the folder structure first so empty folders are mirrored too;
+	// content-addressed uploads don't mirror the tree so there is nothing to create
+	if opts.cas == nil {
+		for _, dir := range dirs {
+			remotePath := remotePathOf(dir)
+			if opts.dryRun {
+				fmt.Printf("Would create folder %s\n", remotePath)
+				continue
+			}
+			if _, err := client.EnsureFolder(httpClient, remotePath); err != nil {
+				printError(fmt.Sprintf("Failed to create remote folder '%s'", remotePath), err)
+				return exitCodeFor(err)
+			}
+		}
+	}
+
+	targets := make([]uploadTarget, len(files))
+	for i, rel := range files {
+		targets[i] = uploadTarget{name: rel, localPath: filepath.Join(localDir, rel), remotePath: remotePathOf(rel)}
+	}
+	summary, exitCode := uploadFiles(client, httpClient, opts, targets)
+
+	// Folder timestamps are set last since OneDrive doesn't touch fileSystemInfo when children change
+	if opts.cas == nil && !opts.dryRun {
+		for _, dir := range dirs {
+			info, err := os.Stat(filepath.Join(localDir, dir))
+			if err != nil {
+				continue
+			}
+			remotePath := remotePathOf(dir)
+			if err := client.SetModTime(httpClient, remotePath, info.ModTime()); err != nil {
+				fmt.Printf("%sWarning: failed to set modification time of '%s': %v%s\n", ColorYellow, remotePath, err, ColorReset)
+			}
+		}
+	}
+
+	summary.print()
+
+	return exitCode
+}
+
+// uploadTarget is a file to upload in a batch, with the name it is reported under
+type uploadTarget struct {
+	name       string
+	localPath  string
+	remotePath string
+}
+
+// uploadSummary collects the outcome of uploading a batch of files
+type uploadSummary struct {
+	total         int
+	uploaded      int // Files whose upload completed, unlike those an interrupt kept from starting
+	uploadedBytes int64
+	failed        []string
+	skipped       []string
+	unchanged     int // Files skipped because the remote copy was already identical
+	dryRun        bool
+	startTime     time.Time
+	pool          *sessionPool
+	shift         *remoteShifter
+}
+
+// uploadFiles uploads a batch of files, opts.transfers at a time, reporting the status of each;
+// it returns the batch's summary and exit code
+func uploadFiles(client *azure.AzureClient, httpClient *http.Client, opts uploadOptions, targets []uploadTarget) (*uploadSummary, int) {
+	summary := &uploadSummary{total: len(targets), startTime: time.Now(), dryRun: opts.dryRun, shift: opts.shift}
+	exitCode := exitOK
+
+	// Creating a session costs a round trip per file, so create them ahead while earlier files transfer;
+	// content-addressed and deduplicated uploads don't know their target up front, resumed ones reuse saved sessions,
+	// dry runs don't upload at all
+	// and pooled sessions always rename uploads that conflict with existing files. Files shifted to another
+	// remote can't use a session of this one.
+	var pool *sessionPool
+	if opts.sessionPool > 0 && opts.shift == nil && opts.cas == nil && opts.dedup == nil && !opts.resume && !opts.dryRun && (opts.conflict == "" || opts.conflict == azure.ConflictRename) && len(targets) > 1 {
+		pool = newSessionPool(client, httpClient, targets, max(opts.sessionPool, opts.transfers))
+		summary.pool = pool
+	}
+
+	// Each worker uploads one file at a time with its own chunk workers
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for range max(opts.transfers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				target := targets[i]
+
+				// While Graph throttles the client fewer files are uploaded at once, unless they can go to another remote
+				var result *uploadResult
+				remote, fileClient, fileOpts, remotePath := opts.shift.route(client, httpClient, opts, target.remotePath)
+				release, err := fileClient.AcquireFile(interrupted)
+				if err == nil {
+					if remote != "" {
+						fmt.Printf("\n[%d/%d] Uploading %s to remote '%s' while remote '%s' is throttled\n", i+1, len(targets), target.name, remote, opts.remoteConfig)
+					} else {
+						fmt.Printf("\n[%d/%d] Uploading %s\n", i+1, len(targets), target.name)
+					}
+					if pool != nil {
+						fileOpts.uploadURL = pool.take(i)
+					}
+					result, err = uploadEntry(fileClient, httpClient, fileOpts, target.localPath, remotePath)
+					release()
+				}
+
+				mu.Lock()
+				switch {
+				case errors.Is(err, errFileUnstable):
+					if pool != nil {
+						pool.discard(fileOpts.uploadURL)
+					}
+					fmt.Printf("%sSkipping '%s': %v%s\n", ColorYellow, target.name, err, ColorReset)
+					summary.skipped = append(summary.skipped, target.name)
+				case errors.Is(err, context.Canceled):
+					fmt.Printf("%sUpload of '%s' interrupted.%s\n", ColorYellow, target.name, ColorReset)
+					summary.failed = append(summary.failed, fmt.Sprintf("%s: %v", target.name, err))
+				case err != nil:
+					printError(fmt.Sprintf("Failed to upload '%s'", target.name), err)
+					summary.failed = append(summary.failed, fmt.Sprintf("%s: %v", target.name, err))
+					exitCode = exitCodeFor(err)
+				case result.unchanged:
+					if pool != nil {
+						pool.discard(fileOpts.uploadURL)
+					}
+					summary.unchanged++
+				default:
+					summary.uploaded++
+					summary.uploadedBytes += result.size
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range targets {
+		if interrupted.Err() != nil {
+			fmt.Printf("%sInterrupted; %d files not uploaded.%s\n", ColorYellow, len(targets)-i, ColorReset)
+			mu.Lock()
+			exitCode = exitInterrupted
+			mu.Unlock()
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-interrupted.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if pool != nil {
+		pool.close()
+	}
+
+	return summary, exitCode
+}
+
+// print prints the number of files and bytes uploaded and lists the skipped and failed files
+func (summary *uploadSummary) print() {
+	fmt.Println()
+	if summary.dryRun {
+		fmt.Printf("Dry run: would upload %d/%d files (%s)\n", summary.uploaded, summary.total, formatBytes(summary.uploadedBytes))
+	} else {
+		fmt.Printf("Uploaded %d/%d files (%s) in %s\n", summary.uploaded, summary.total, formatBytes(summary.uploadedBytes), time.Since(summary.startTime).Round(time.Second))
+	}
+	if notStarted := summary.total - summary.uploaded - len(summary.failed) - len(summary.skipped) - summary.unchanged; notStarted > 0 {
+		fmt.Printf("%s%d files not started before the interrupt%s\n", ColorYellow, notStarted, ColorReset)
+	}
+	if summary.unchanged > 0 {
+		fmt.Printf("%d files already up to date\n", summary.unchanged)
+	}
+	if summary.pool != nil {
+		fmt.Println(summary.pool.summary())
+	}
+	if shifted := summary.shift.summary(); shifted != "" {
+		fmt.Println(shifted)
+	}
+	if len(summary.skipped) > 0 {
+		fmt.Printf("%sSkipped files still being modified:%s\n", ColorYellow, ColorReset)
+		for _, s := range summary.skipped {
+			fmt.Printf("  %s\n", s)
+		}
+	}
+	if len(summary.failed) > 0 {
+		fmt.Printf("%sFailed uploads:%s\n", ColorRed, ColorReset)
+		for _, f := range summary.failed {
+			fmt.Printf("  %s\n", f)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// downloadURLData holds the placeholders available to a remote's url_template
+type downloadURLData struct {
+	BaseURL    string // The remote's base_url, if set
+	Path       string // Path of the file below the root folder, with forward slashes and not escaped
+	FileName   string
+	FileID     string // OneDrive item ID of the file
+	RootFolder string // The remote's root folder on the drive
+	Remote     string
+}
+
+// urlTemplateFuncs are the functions url_template can use besides the text/template builtins
+var urlTemplateFuncs = template.FuncMap{
+	// urlpath escapes each element of a slash-separated path, keeping the slashes
+	"urlpath": func(path string) string {
+		elements := strings.Split(path, "/")
+		for i, element := range elements {
+			elements[i] = url.PathEscape(element)
+		}
+		return strings.Join(elements, "/")
+	},
+}
+
+// executeURLTemplate builds a download URL from a remote's url_template
+func executeURLTemplate(remote, text string, data downloadURLData) (string, error) {
+	tmpl, err := template.New("url_template").Funcs(urlTemplateFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid url_template of remote-config '%s': %v", remote, err)
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("invalid url_template of remote-config '%s': %v", remote, err)
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// errHashMismatch is returned when a remote file's QuickXorHash differs from the local one
+var errHashMismatch = errors.New("QuickXorHash mismatch: file integrity verification failed")
+
+// hashCheck says how to verify a file against its remote copy
+type hashCheck struct {
+	localHash  string // QuickXorHash of the local file if it is already known, e.g. computed while uploading
+	retries    int    // Attempts at fetching the remote QuickXorHash, which OneDrive may not have computed yet right after an upload
+	retryDelay time.Duration
+}
+
+// verifyFileHash compares the QuickXorHash of the local file with that of the remote file with the
+// given ID, printing the result; it returns errHashMismatch if they differ
+func verifyFileHash(client *azure.AzureClient, httpClient *http.Client, localPath, fileID string, check hashCheck) error {
+	fmt.Println("Verifying file integrity...")
+
+	localHash := check.localHash
+	if localHash == "" {
+		var err error
+		if localHash, err = QuickXorHash(localPath); err != nil {
+			return fmt.Errorf("failed to calculate local QuickXorHash: %v", err)
+		}
+	}
+
+	// Retrieve the remote QuickXorHash with retries
+	remoteHash, err := getQuickXorHashWithRetry(client, httpClient, fileID, check.retries, check.retryDelay)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve remote QuickXorHash: %w", err)
+	}
+
+	// Compare the hashes
+	if localHash != remoteHash {
+		fmt.Printf("Local File Path: %s\n", localPath)
+		if info, err := os.Stat(localPath); err == nil {
+			fmt.Printf("Local File Size: %d bytes\n", info.Size())
+		}
+		fmt.Printf("Local QuickXorHash: %s\n", localHash)
+		fmt.Printf("Remote QuickXorHash: %s\n", remoteHash)
+		fmt.Printf("%sQuickXorHash mismatch: File integrity verification failed.%s\n", ColorRed, ColorReset)
+		return errHashMismatch
+	}
+	fmt.Printf("%sQuickXorHash match: File integrity verified.%s\n", ColorGreen, ColorReset)
+	return nil
+}
+
+// runVerify implements the verify command, which checks a local file against its remote copy by
+// QuickXorHash, so an earlier upload can be verified again at any time
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	localPath := fs.String("file", "", "Path of the local file to verify (required)")
+	remotePath := fs.String("remote", "", "Path of the remote file, or of the remote folder holding a file with the local file's name (required)")
+	hashRetries := fs.Int("hash-retries", 5, "Maximum number of retries for fetching QuickXorHash (default: 5)")
+	hashRetryDelay := fs.Duration("hash-retry-delay", 10*time.Second, "Delay between QuickXorHash retries (default: 10s)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	registerConfigFlag(fs)
+	fs.Parse(args)
+
+	if *localPath == "" || *remotePath == "" {
+		fmt.Println("Error: the -file and -remote flags are required")
+		fs.Usage()
+		return exitUsage
+	}
+	if *hashRetries < 1 {
+		fmt.Println("Error: -hash-retries must be at least 1")
+		return exitUsage
+	}
+
+	info, err := os.Stat(longPath(*localPath))
+	if err != nil || !info.Mode().IsRegular() {
+		fmt.Printf("Error: '%s' is not a local file\n", *localPath)
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, *remotePath)
+	if code != exitOK {
+		return code
+	}
+	fullRemotePath := paths[0]
+
+	httpClient := &http.Client{}
+
+	item, err := client.GetItem(httpClient, fullRemotePath)
+	if err == nil && item.IsFolder() {
+		fullRemotePath = remoteJoin(fullRemotePath, filepath.Base(*localPath))
+		item, err = client.GetItem(httpClient, fullRemotePath)
+	}
+	if err != nil {
+		printError("Failed to get remote file", err)
+		return exitCodeFor(err)
+	}
+	if item.IsFolder() {
+		fmt.Printf("Error: '%s' is a folder\n", fullRemotePath)
+		return exitUsage
+	}
+
+	fmt.Printf("Verifying %s against %s...\n", *localPath, fullRemotePath)
+
+	// A different size already means different content, no need to hash
+	if info.Size() != item.Size {
+		fmt.Printf("%sSize mismatch: local %s, remote %s.%s\n", ColorRed, formatBytes(info.Size()), formatBytes(item.Size), ColorReset)
+		return exitIntegrity
+	}
+
+	if err := verifyFileHash(client, httpClient, longPath(*localPath), item.ID, hashCheck{retries: *hashRetries, retryDelay: *hashRetryDelay}); err != nil {
+		if !errors.Is(err, errHashMismatch) {
+			printError("Failed to verify file", err)
+		}
+		return exitCodeFor(err)
+	}
+	return exitOK
+}
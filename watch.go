@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// watchedFile is what watch last saw of a local file
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	changed time.Time // When watch last saw the size or modification time change
+	pending bool      // New or changed since it was last uploaded
+}
+
+// localWatcher finds the files of a local directory that are new or changed and have since stopped
+// changing. It subscribes to file system events for every folder of the tree, and falls back to
+// scanning the whole directory when events aren't available, e.g. on network shares, whose changes
+// aren't always reported.
+type localWatcher struct {
+	dir         string
+	filter      *fileFilter
+	settle      time.Duration
+	files       map[string]*watchedFile
+	uploadFirst bool // Treat the files of the first scan as new
+	scanned     bool
+	notify      *fsnotify.Watcher // Events of the folders scanned so far (nil when polling)
+	ignores     *ignoreList       // Rules of the .ksauignore files read by the last scan
+	rescan      bool              // Events were missed or can't be handled alone, e.g. a new folder
+}
+
+// runWatch implements the watch command, which keeps running and uploads the files that appear or
+// change in a local directory once they have stopped changing
+func runWatch(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := fs.Duration("interval", 2*time.Second, "How often to check for files that have settled, and to scan the directory for changes when polling (default: 2s)")
+	poll := fs.Bool("poll", false, "Scan the directory every -interval instead of subscribing to file system events, e.g. for network shares whose changes aren't reported (default: false)")
+	settle := fs.Duration("settle", 5*time.Second, "Upload a new or changed file once its size and modification time have stayed the same for this long (default: 5s)")
+	initial := fs.Bool("initial", false, "Also upload the files already in the directory when watching starts, unless the remote copy is identical (default: false)")
+	removeSource := fs.Bool("remove-source", false, "Delete local files once they are uploaded, e.g. to empty a camera dump folder (default: false)")
+	chunkSize := fs.Int64("chunk-size", 0, "Chunk size for uploads (in bytes). If 0, it will be dynamically selected based on file size (default: 0)")
+	parallelChunks := fs.Int("parallel", 1, "Number of parallel chunks to upload (default: 1)")
+	bwLimit := fs.String("bwlimit", "", "Limit the transfer rate in bytes/s, e.g. 4M, or follow a schedule such as \"08:00,1M 23:00,off\" (default: no limit)")
+	conflict := fs.String("conflict", string(azure.ConflictReplace), "What to do when a file with the same name already exists remotely: rename, replace or fail (default: 'replace')")
+	skipHash := fs.Bool("skip-hash", false, "Skip QuickXorHash verification of uploaded files (default: false)")
+	remoteConfig := fs.String("remote-config", "oned", "Name of the remote configuration section in rclone.conf (default: 'oned')")
+	stateDir := fs.String("state-dir", ".ksau-state", "Directory for cached tokens (default: '.ksau-state')")
+	filterOptions := registerFilterFlags(fs)
+	registerConfigFlag(fs)
+	registerMetricsFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Println("Usage: ksau-go watch [flags] <local-dir> <remote:dir>")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	localDir := longPath(fs.Arg(0))
+
+	info, err := os.Stat(localDir)
+	if err != nil || !info.IsDir() {
+		fmt.Printf("Error: '%s' is not a local directory\n", fs.Arg(0))
+		return exitUsage
+	}
+	if *interval <= 0 {
+		fmt.Println("Error: -interval must be positive")
+		return exitUsage
+	}
+	conflictBehavior, err := azure.ParseConflictBehavior(*conflict)
+	if err != nil {
+		fmt.Printf("Error: invalid -conflict: %v\n", err)
+		return exitUsage
+	}
+
+	filter, err := filterOptions.build()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	bandwidth, err := parseBandwidth(*bwLimit)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	client, paths, code := setupRemote(*remoteConfig, *stateDir, fs.Arg(1))
+	if code != exitOK {
+		return code
+	}
+	if err := startMetricsServer(); err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+	client.UseBandwidthLimit(bandwidth)
+	remoteDir := paths[0]
+
+	configData, _ := loadConfig()
+	remote, _ := resolveRemote(configData, fs.Arg(1), *remoteConfig)
+	retryPolicy, err := remoteRetryPolicy(configData, remote, azure.DefaultRetryPolicy())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return exitUsage
+	}
+
+	httpClient := &http.Client{}
+	opts := uploadOptions{
+		remoteConfig:   remote,
+		chunkSize:      *chunkSize,
+		parallelChunks: *parallelChunks,
+		retryPolicy:    retryPolicy,
+		skipHash:       *skipHash,
+		hashRetries:    5,
+		hashRetryDelay: 10 * time.Second,
+		conflict:       conflictBehavior,
+		// Uploads that are repeated, e.g. after a restart with -initial, are skipped, and a file
+		// written to again while it uploads is retried instead of leaving a partial copy
+		skipExisting: conflictBehavior == azure.ConflictReplace,
+		stableFor:    *settle,
+	}
+
+	// Ctrl+C stops the upload in progress and cleans up its session instead of killing the process mid-transfer
+	gracefulShutdown.Store(true)
+
+	watcher := &localWatcher{dir: localDir, filter: filter, settle: *settle, files: make(map[string]*watchedFile), uploadFirst: *initial}
+	if !*poll {
+		if watcher.notify, err = fsnotify.NewWatcher(); err != nil {
+			fmt.Printf("%sWarning: file system events unavailable, scanning every %s instead: %v%s\n", ColorYellow, *interval, err, ColorReset)
+		} else {
+			defer watcher.close()
+		}
+	}
+	fmt.Printf("Watching %s for new and changed files to upload to %s (press Ctrl+C to stop)\n", fs.Arg(0), remoteDir)
+
+	folders := make(map[string]bool)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for now := time.Now(); ; now = time.Now() {
+		// With events, the tree is only scanned at first and when events can't tell what changed
+		var ready []string
+		if watcher.notify == nil || !watcher.scanned || watcher.rescan {
+			ready, err = watcher.scan(now)
+			if err != nil {
+				// The directory may be in the middle of being moved or remounted; the next scan tries again
+				fmt.Printf("%sWarning: failed to scan '%s': %v%s\n", ColorYellow, fs.Arg(0), err, ColorReset)
+			}
+		} else {
+			ready = watcher.ready(now)
+		}
+
+		for _, rel := range ready {
+			if interrupted.Err() != nil {
+				break
+			}
+			localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+			remotePath := remoteJoin(remoteDir, rel)
+			fmt.Printf("\n[%s] Uploading %s\n", time.Now().Format("15:04:05"), rel)
+
+			folder := azure.NewRemotePath(remotePath).Dir().String()
+			if !folders[folder] {
+				if _, err = client.EnsureFolder(httpClient, folder); err == nil {
+					folders[folder] = true
+				}
+			}
+			var result *uploadResult
+			if err == nil {
+				result, err = uploadEntry(client, httpClient, opts, localPath, remotePath)
+			}
+
+			switch {
+			case errors.Is(err, context.Canceled):
+				fmt.Printf("%sUpload of '%s' interrupted.%s\n", ColorYellow, rel, ColorReset)
+				return exitInterrupted
+			case errors.Is(err, errFileUnstable):
+				fmt.Printf("%s'%s' is still being written; waiting for it to settle.%s\n", ColorYellow, rel, ColorReset)
+				watcher.retry(rel, time.Now())
+			case err != nil:
+				printError(fmt.Sprintf("Failed to upload '%s'; retrying after the next settle time", rel), err)
+				watcher.retry(rel, time.Now())
+			case result.unchanged:
+				fmt.Printf("'%s' is already up to date.\n", rel)
+			case *removeSource:
+				// Only the version that was uploaded is deleted; a file that changed since is kept for the next upload
+				if info, statErr := os.Stat(localPath); statErr == nil && watcher.same(rel, info) {
+					if err := os.Remove(localPath); err != nil {
+						fmt.Printf("%sWarning: failed to delete '%s': %v%s\n", ColorYellow, rel, err, ColorReset)
+					}
+				}
+			}
+		}
+
+		var events chan fsnotify.Event
+		var errs chan error
+		if watcher.notify != nil {
+			events, errs = watcher.notify.Events, watcher.notify.Errors
+		}
+		select {
+		case <-interrupted.Done():
+			fmt.Println("Stopped.")
+			return exitOK
+		case <-ticker.C:
+		case event := <-events:
+			watcher.handle(event, time.Now())
+		case err := <-errs:
+			// Typically the event queue overflowed while an upload ran; a scan finds what was missed
+			fmt.Printf("%sWarning: file system events lost, rescanning: %v%s\n", ColorYellow, err, ColorReset)
+			watcher.rescan = true
+		}
+	}
+}
+
+// scan walks the directory and returns the files that are new or changed and haven't changed for
+// the settle time since, in name order. They are no longer pending afterwards; use retry to try one
+// again. Files of the first scan only count as new with uploadFirst.
+func (w *localWatcher) scan(now time.Time) ([]string, error) {
+	seen := make(map[string]bool)
+	ignores, err := walkLocal(w.dir, w.filter, func(rel string, d os.DirEntry) error {
+		if d.IsDir() {
+			w.subscribe(rel)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Deleted since the directory was read
+			return nil
+		}
+		seen[rel] = true
+		file, known := w.files[rel]
+		if !known || file.size != info.Size() || !file.modTime.Equal(info.ModTime()) {
+			w.files[rel] = &watchedFile{size: info.Size(), modTime: info.ModTime(), changed: now, pending: w.scanned || w.uploadFirst}
+		}
+		return nil
+	})
+	if err != nil {
+		// Files that weren't reached are kept as they were rather than taken for deleted
+		return nil, err
+	}
+	w.scanned = true
+	w.rescan = false
+	w.ignores = ignores
+
+	for rel := range w.files {
+		if !seen[rel] {
+			delete(w.files, rel)
+		}
+	}
+	return w.ready(now), nil
+}
+
+// ready returns the files that are new or changed and haven't changed for the settle time since, in
+// name order. They are no longer pending afterwards.
+func (w *localWatcher) ready(now time.Time) []string {
+	var ready []string
+	for rel, file := range w.files {
+		if file.pending && now.Sub(file.changed) >= w.settle && w.filter.includesSize(file.size) {
+			file.pending = false
+			ready = append(ready, rel)
+		}
+	}
+	sort.Strings(ready)
+	return ready
+}
+
+// subscribe adds the events of a folder found by a scan. If that fails, e.g. because the system's
+// limit of watched folders is reached, the watcher falls back to polling.
+func (w *localWatcher) subscribe(rel string) {
+	if w.notify == nil {
+		return
+	}
+	if err := w.notify.Add(filepath.Join(w.dir, filepath.FromSlash(rel))); err != nil {
+		fmt.Printf("%sWarning: failed to watch '%s' for events, scanning instead: %v%s\n", ColorYellow, rel, err, ColorReset)
+		w.close()
+	}
+}
+
+// close stops receiving events, leaving scans to find changes
+func (w *localWatcher) close() {
+	if w.notify != nil {
+		w.notify.Close()
+		w.notify = nil
+	}
+}
+
+// handle applies a file system event to the files watched. A file that was written or created is
+// pending again from now, one that was removed or renamed is forgotten. A new folder, which may
+// already have files before its events are subscribed to, and a changed .ksauignore file, which
+// changes what is included, are left to a scan of the whole tree.
+func (w *localWatcher) handle(event fsnotify.Event, now time.Time) {
+	rel, err := filepath.Rel(w.dir, event.Name)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	if filepath.Base(event.Name) == ignoreFileName {
+		w.rescan = true
+		return
+	}
+
+	info, err := os.Lstat(event.Name)
+	switch {
+	case err != nil:
+		// Removed or renamed away, with everything below it if it was a folder
+		for known := range w.files {
+			if known == rel || strings.HasPrefix(known, rel+"/") {
+				delete(w.files, known)
+			}
+		}
+	case info.IsDir():
+		if event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+			w.rescan = true
+		}
+	case info.Mode().IsRegular() && w.included(rel):
+		file, known := w.files[rel]
+		if !known || file.size != info.Size() || !file.modTime.Equal(info.ModTime()) {
+			w.files[rel] = &watchedFile{size: info.Size(), modTime: info.ModTime(), changed: now, pending: true}
+		}
+	}
+}
+
+// included reports whether a file at rel, found by an event rather than a scan, is one a scan would
+// find: the filter includes it and neither the filter nor the .ksauignore files exclude its folders
+func (w *localWatcher) included(rel string) bool {
+	elements := strings.Split(rel, "/")
+	for i := 1; i < len(elements); i++ {
+		if w.filter.excludesDir(strings.Join(elements[:i], "/")) {
+			return false
+		}
+	}
+	return w.filter.includes(rel) && !w.ignores.ignoredPath(rel)
+}
+
+// retry makes a file pending again, to be returned once the settle time has passed from now
+func (w *localWatcher) retry(rel string, now time.Time) {
+	if file, ok := w.files[rel]; ok {
+		file.pending = true
+		file.changed = now
+	}
+}
+
+// same reports whether a file still has the size and modification time watch last saw
+func (w *localWatcher) same(rel string, info os.FileInfo) bool {
+	file, ok := w.files[rel]
+	return ok && file.size == info.Size() && file.modTime.Equal(info.ModTime())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ksauraj/ksau-oned-api/azure"
+)
+
+// webhookAttempts bounds how often an upload webhook is sent before giving up
+const webhookAttempts = 5
+
+// uploadWebhookPayload is the JSON body posted to a remote's upload_webhook after each upload
+type uploadWebhookPayload struct {
+	Event        string    `json:"event"`
+	Remote       string    `json:"remote"`
+	Path         string    `json:"path"` // Full path on the drive
+	Name         string    `json:"name"`
+	FileID       string    `json:"file_id"`
+	Size         int64     `json:"size"`
+	QuickXorHash string    `json:"quick_xor_hash,omitempty"`
+	URL          string    `json:"url,omitempty"`
+	ShareURL     string    `json:"share_url,omitempty"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+}
+
+// notifyUploadWebhook posts an uploaded file's metadata to the remote's upload_webhook, if it has
+// one. With upload_webhook_secret, the body is signed with HMAC-SHA256 in the X-Ksau-Signature
+// header. Network errors, throttling and server errors are retried with backoff.
+func notifyUploadWebhook(client *azure.AzureClient, httpClient *http.Client, remoteConfig, remoteFilePath string, result *uploadResult) error {
+	configData, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	hookURL, ok := remoteSetting(configData, remoteConfig, "upload_webhook")
+	if !ok {
+		return nil
+	}
+	secret, _ := remoteSetting(configData, remoteConfig, "upload_webhook_secret")
+
+	// Hashes aren't computed with -skip-hash or for resumed uploads, but OneDrive may already have one
+	if result.quickXorHash == "" && result.fileID != "" {
+		result.quickXorHash, _ = client.GetQuickXorHash(httpClient, result.fileID)
+	}
+	body, err := json.Marshal(uploadWebhookPayload{
+		Event:        "upload",
+		Remote:       remoteConfig,
+		Path:         remoteFilePath,
+		Name:         azure.NewRemotePath(remoteFilePath).Base(),
+		FileID:       result.fileID,
+		Size:         result.size,
+		QuickXorHash: result.quickXorHash,
+		URL:          result.downloadURL,
+		ShareURL:     result.shareURL,
+		UploadedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	hookClient := &http.Client{Timeout: 30 * time.Second}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := postWebhook(hookClient, hookURL, secret, body)
+		if err == nil {
+			return nil
+		}
+		if retryAfter < 0 || attempt == webhookAttempts {
+			return fmt.Errorf("upload webhook failed: %v", err)
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		fmt.Printf("%sUpload webhook failed (%v); retrying in %s%s\n", ColorYellow, err, delay, ColorReset)
+		select {
+		case <-interrupted.Done():
+			return fmt.Errorf("upload webhook failed: %v", err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// postWebhook sends one webhook request. On failure, it returns how long the endpoint asked to wait
+// before retrying (0 if it didn't say), or -1 if the request shouldn't be retried.
+func postWebhook(hookClient *http.Client, hookURL, secret string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(interrupted, http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", azure.DefaultUserAgent)
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Ksau-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, fmt.Errorf("%s returned %s", hookURL, resp.Status)
+	default:
+		return -1, fmt.Errorf("%s returned %s", hookURL, resp.Status)
+	}
+}